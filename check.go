@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jpetrucciani/portunus/pkg/portunus"
+)
+
+// runCheck implements the check subcommand, verifying every provider the
+// config's mappings use is reachable with working credentials. With -users
+// it also checks that each GitHub and GitLab username the mappings reference
+// exists, to catch typos. It exits 1 if any check fails.
+func runCheck(args []string) int {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	timeout := fs.Duration("timeout", 10*time.Second, "how long to give each provider's check")
+	strict := fs.Bool("strict", false, "reject ambiguous configs, such as a login mapped twice or an unknown field")
+	users := fs.Bool("users", false, "also check that every referenced GitHub and GitLab username exists")
+	userInterval := fs.Duration("user-interval", 250*time.Millisecond, "pause between username checks, to stay under API rate limits")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s check [flags] [<config-path>]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return 2
+	}
+
+	var opts []portunus.Option
+	if *strict {
+		opts = append(opts, portunus.WithStrictConfig())
+	}
+	km, err := portunus.NewKeyManager(fs.Arg(0), opts...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error initializing key manager: %v\n", err)
+		return 1
+	}
+	defer km.WaitHooks()
+
+	failed := false
+	for _, r := range km.Check(*timeout) {
+		switch {
+		case errors.Is(r.Err, portunus.ErrNoCheck):
+			fmt.Printf("%s: skipped, %v\n", r.Provider, r.Err)
+		case r.Err != nil:
+			failed = true
+			fmt.Printf("%s: FAIL (%s): %v\n", r.Provider, r.Elapsed.Round(time.Millisecond), r.Err)
+		default:
+			fmt.Printf("%s: ok (%s)\n", r.Provider, r.Elapsed.Round(time.Millisecond))
+		}
+	}
+	if *users {
+		for _, r := range km.CheckUsers(*userInterval) {
+			logins := strings.Join(r.Logins, ", ")
+			switch {
+			case r.Err != nil:
+				failed = true
+				fmt.Printf("%s user %s (%s): FAIL: %v\n", r.Provider, r.Upstream, logins, r.Err)
+			case !r.Exists:
+				failed = true
+				fmt.Printf("%s user %s (%s): not found\n", r.Provider, r.Upstream, logins)
+			default:
+				fmt.Printf("%s user %s (%s): ok\n", r.Provider, r.Upstream, logins)
+			}
+		}
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
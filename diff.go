@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/jpetrucciani/portunus/pkg/portunus"
+)
+
+// runDiff implements the diff subcommand. Like diff(1) it exits 0 when the
+// keys match, 1 when they differ and 2 on error.
+func runDiff(args []string) int {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	strict := fs.Bool("strict", false, "reject ambiguous configs, such as a login mapped twice or an unknown field")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s diff [flags] <config-path> <username> <authorized-keys-file>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 3 {
+		fs.Usage()
+		return 2
+	}
+	configPath, username, existingPath := fs.Arg(0), fs.Arg(1), fs.Arg(2)
+
+	existing, err := os.ReadFile(existingPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading %s: %v\n", existingPath, err)
+		return 2
+	}
+
+	var opts []portunus.Option
+	if *strict {
+		opts = append(opts, portunus.WithStrictConfig())
+	}
+	km, err := portunus.NewKeyManager(configPath, opts...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error initializing key manager: %v\n", err)
+		return 2
+	}
+	defer km.WaitHooks()
+	d, err := diffLogin(km, username, existing)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error getting keys: %v\n", err)
+		return 2
+	}
+	if d.Empty() {
+		return 0
+	}
+	d.Write(os.Stdout)
+	return 1
+}
+
+// diffLogin compares existing, an authorized_keys file, with the keys served
+// for username. A login left with no keys wants none, so every existing key
+// is reported removed.
+func diffLogin(km *portunus.KeyManager, username string, existing []byte) (portunus.KeyDiff, error) {
+	resolved, err := km.GetKeys(username)
+	if err != nil && !errors.Is(err, portunus.ErrNoKeys) {
+		return portunus.KeyDiff{}, err
+	}
+	return portunus.DiffKeys(portunus.SplitKeyLines(string(existing)), resolved), nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/jpetrucciani/portunus/pkg/portunus"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestDiffLogin(t *testing.T) {
+	var keys []string
+	for range 2 {
+		pub, _, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sshPub, err := ssh.NewPublicKey(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPub))))
+	}
+	km, err := portunus.NewKeyManagerFromConfig(portunus.Config{Mappings: map[string]portunus.UserMapping{
+		"alice": {StaticKeys: []portunus.StaticKey{{Key: keys[0]}}},
+		"bob":   {},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		login       string
+		existing    []string
+		wantAdded   int
+		wantRemoved int
+		wantErr     error
+	}{
+		{name: "matching keys", login: "alice", existing: keys[:1]},
+		{name: "a key to add and one to remove", login: "alice", existing: keys[1:], wantAdded: 1, wantRemoved: 1},
+		{name: "a login with no keys removes every existing key", login: "bob", existing: keys, wantRemoved: 2},
+		{name: "a login with no keys and an empty file", login: "bob"},
+		{name: "an unmapped login fails", login: "carol", existing: keys, wantErr: portunus.ErrNoMapping},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := diffLogin(km, tt.login, []byte(strings.Join(tt.existing, "\n")))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if len(d.Added) != tt.wantAdded || len(d.Removed) != tt.wantRemoved {
+				t.Errorf("got %d added and %d removed, want %d and %d", len(d.Added), len(d.Removed), tt.wantAdded, tt.wantRemoved)
+			}
+		})
+	}
+}
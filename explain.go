@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/jpetrucciani/portunus/pkg/portunus"
+)
+
+// runExplain implements the explain subcommand, printing how each of a
+// login's keys was resolved. It exits 1 if the lookup failed.
+func runExplain(args []string) int {
+	fs := flag.NewFlagSet("explain", flag.ExitOnError)
+	strict := fs.Bool("strict", false, "reject ambiguous configs, such as a login mapped twice or an unknown field")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s explain [flags] <config-path> <username>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return 1
+	}
+
+	var opts []portunus.Option
+	if *strict {
+		opts = append(opts, portunus.WithStrictConfig())
+	}
+	km, err := portunus.NewKeyManager(fs.Arg(0), opts...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error initializing key manager: %v\n", err)
+		return 1
+	}
+	defer km.WaitHooks()
+
+	explanation := km.Explain(context.Background(), fs.Arg(1))
+	explanation.Write(os.Stdout)
+	if explanation.Err != nil {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/jpetrucciani/portunus/pkg/portunus"
+)
+
+// runGenerateFiles implements the generate-files subcommand, writing each
+// mapped login's keys to <output-dir>/<login> for sshd's AuthorizedKeysFile.
+// Logins without keys get no file, and a file left from an earlier run is
+// removed, so revoked and disabled logins lose access. With -prune, files
+// for logins no longer mapped are removed too. It exits 1 if any login
+// failed. With
+// -state, ETags and key digests are kept between runs so upstreams that
+// haven't changed answer 304 and are reported as unchanged. With -timeout
+// the whole run is given a deadline, after which the logins not yet resolved
+// are reported and lookups still in flight are abandoned, while the files
+// already written are kept.
+func runGenerateFiles(args []string) int {
+	fs := flag.NewFlagSet("generate-files", flag.ExitOnError)
+	strict := fs.Bool("strict", false, "reject ambiguous configs, such as a login mapped twice or an unknown field")
+	statePath := fs.String("state", "", "file to keep ETags and key digests in between runs, for conditional fetches and an unchanged count")
+	timeout := fs.Duration("timeout", 0, "overall deadline for the run, e.g. 2m; logins not resolved by then are reported as failed")
+	prune := fs.Bool("prune", false, "also remove files in <output-dir> for logins that are no longer mapped")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s generate-files [flags] <config-path> <output-dir>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return 1
+	}
+	configPath, outputDir := fs.Arg(0), fs.Arg(1)
+
+	var opts []portunus.Option
+	if *strict {
+		opts = append(opts, portunus.WithStrictConfig())
+	}
+	km, err := portunus.NewKeyManager(configPath, opts...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error initializing key manager: %v\n", err)
+		return 1
+	}
+	if *statePath != "" {
+		if err := km.LoadFetchState(*statePath); err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading -state: %v\n", err)
+			return 1
+		}
+	}
+	if err := os.MkdirAll(outputDir, 0o755); err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating %s: %v\n", outputDir, err)
+		return 1
+	}
+
+	ctx := context.Background()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+
+	logins := km.Logins()
+	stats := generateFiles(ctx, km, logins, outputDir)
+
+	if *prune {
+		keep := slices.Clone(logins)
+		if *statePath != "" {
+			// the state file may live in the output directory
+			if absPath(filepath.Dir(*statePath)) == absPath(outputDir) {
+				keep = append(keep, filepath.Base(*statePath))
+			}
+		}
+		n, err := pruneUnmapped(outputDir, keep)
+		stats.removed += n
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error pruning %s: %v\n", outputDir, err)
+			stats.failed++
+		}
+	}
+
+	km.WaitHooks()
+	if len(stats.incomplete) > 0 {
+		fmt.Fprintf(os.Stderr, "Timed out after %s, %d logins not resolved: %s\n", *timeout, len(stats.incomplete), strings.Join(stats.incomplete, ", "))
+		stats.failed += len(stats.incomplete)
+	}
+	fmt.Fprintf(os.Stderr, "Wrote %d key files to %s, skipped %d logins with no keys, removed %d stale files, %d failed\n", stats.written, outputDir, stats.skipped, stats.removed, stats.failed)
+	if *statePath != "" {
+		fmt.Fprintf(os.Stderr, "%d of %d upstream fetches unchanged since the last run\n", stats.unchanged, stats.fetched)
+		if err := km.SaveFetchState(*statePath); err != nil {
+			fmt.Fprintf(os.Stderr, "Error saving -state: %v\n", err)
+			return 1
+		}
+	}
+	if stats.failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// generateStats counts what a generate-files run did. incomplete lists the
+// logins not resolved before the run's deadline.
+type generateStats struct {
+	written, skipped, removed, failed int
+	fetched, unchanged                int
+	incomplete                        []string
+}
+
+// generateFiles writes the keys of each of logins to a file in outputDir,
+// removing the files of logins left without keys. Once ctx is done the
+// remaining logins are recorded as incomplete, and the files already written
+// are kept.
+func generateFiles(ctx context.Context, km *portunus.KeyManager, logins []string, outputDir string) generateStats {
+	var stats generateStats
+	for i, login := range logins {
+		if ctx.Err() != nil {
+			stats.incomplete = append(stats.incomplete, logins[i:]...)
+			break
+		}
+		if login != filepath.Base(login) || strings.HasPrefix(login, ".") {
+			fmt.Fprintf(os.Stderr, "Skipping %s: not usable as a file name\n", login)
+			stats.failed++
+			continue
+		}
+		result, err := km.Resolve(ctx, login)
+		if ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+			stats.incomplete = append(stats.incomplete, logins[i:]...)
+			break
+		}
+		if errors.Is(err, portunus.ErrNoKeys) {
+			stats.skipped++
+			switch ok, err := removeStale(filepath.Join(outputDir, login), "no keys"); {
+			case err != nil:
+				fmt.Fprintf(os.Stderr, "Error removing stale key file for %s: %v\n", login, err)
+				stats.failed++
+			case ok:
+				stats.removed++
+			}
+			continue
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error getting keys for %s: %v\n", login, err)
+			stats.failed++
+			continue
+		}
+
+		for _, b := range result.Blocks {
+			if b.Source == "static" || b.Source == "break-glass" {
+				continue
+			}
+			stats.fetched++
+			if b.Unchanged {
+				stats.unchanged++
+			}
+		}
+
+		if err := portunus.WriteFileAtomic(filepath.Join(outputDir, login), result.Text(), 0o600); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing keys for %s: %v\n", login, err)
+			stats.failed++
+			continue
+		}
+		stats.written++
+	}
+	return stats
+}
+
+// removeStale removes a key file left from an earlier run, logging why. It
+// reports whether there was a file to remove.
+func removeStale(path, reason string) (bool, error) {
+	err := os.Remove(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	fmt.Fprintf(os.Stderr, "Removed stale key file %s: %s\n", path, reason)
+	return true, nil
+}
+
+// pruneUnmapped removes the regular files in dir not named in keep,
+// returning how many it removed
+func pruneUnmapped(dir string, keep []string) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	var removed int
+	var errs []error
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || slices.Contains(keep, entry.Name()) {
+			continue
+		}
+		ok, err := removeStale(filepath.Join(dir, entry.Name()), "login no longer mapped")
+		if err != nil {
+			errs = append(errs, err)
+		} else if ok {
+			removed++
+		}
+	}
+	return removed, errors.Join(errs...)
+}
+
+// absPath returns path made absolute, or unchanged if that fails
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
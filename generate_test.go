@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jpetrucciani/portunus/pkg/portunus"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestPruneUnmapped(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"alice", "bob", "state.json"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("x\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "subdir"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := pruneUnmapped(dir, []string{"alice", "state.json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Errorf("removed %d files, want 1", removed)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if want := []string{"alice", "state.json", "subdir"}; !slices.Equal(names, want) {
+		t.Errorf("left %q, want %q", names, want)
+	}
+}
+
+func TestRemoveStale(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "alice")
+	if ok, err := removeStale(path, "no keys"); ok || err != nil {
+		t.Errorf("missing file: got %v, %v, want false, nil", ok, err)
+	}
+	if err := os.WriteFile(path, []byte("x\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := removeStale(path, "no keys"); !ok || err != nil {
+		t.Errorf("existing file: got %v, %v, want true, nil", ok, err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("file still exists: %v", err)
+	}
+}
+
+// hungProvider never answers for the upstreams in hang, until the test ends
+type hungProvider struct {
+	key  string
+	hang map[string]bool
+	stop chan struct{}
+}
+
+func (p *hungProvider) GetKeys(upstream string) ([]string, error) {
+	if p.hang[upstream] {
+		<-p.stop
+	}
+	return []string{p.key}, nil
+}
+
+func TestGenerateFilesDeadline(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPub)))
+
+	provider := &hungProvider{key: key, hang: map[string]bool{"bobcat": true}, stop: make(chan struct{})}
+	t.Cleanup(func() { close(provider.stop) })
+	km, err := portunus.NewKeyManagerFromConfig(portunus.Config{Mappings: map[string]portunus.UserMapping{
+		"alice": {GitHub: portunus.Usernames{"octocat"}},
+		"bob":   {GitHub: portunus.Usernames{"bobcat"}},
+		"carol": {GitHub: portunus.Usernames{"carolcat"}},
+	}}, portunus.WithProvider("github", provider))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	stats := generateFiles(ctx, km, km.Logins(), dir)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("run took %s, want it cut off at the deadline", elapsed)
+	}
+
+	if stats.written != 1 || stats.failed != 0 {
+		t.Errorf("wrote %d and failed %d, want only alice written", stats.written, stats.failed)
+	}
+	if want := []string{"bob", "carol"}; !slices.Equal(stats.incomplete, want) {
+		t.Errorf("incomplete = %q, want %q", stats.incomplete, want)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "alice" {
+		t.Errorf("got %v, want only alice's file kept", entries)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/jpetrucciani/portunus/pkg/portunus"
+)
+
+// runLint implements the lint subcommand, checking the keys served for a
+// login against the config's lint policy, as overridden by flags. Like diff
+// it exits 0 when every key passes, 1 when any violates the policy and 2 on
+// error.
+func runLint(args []string) int {
+	fs := flag.NewFlagSet("lint", flag.ExitOnError)
+	strict := fs.Bool("strict", false, "reject ambiguous configs, such as a login mapped twice or an unknown field")
+	minRSABits := fs.Int("min-rsa-bits", 0, "smallest RSA key allowed, overriding lint.min_rsa_bits (default 2048)")
+	allowedTypes := fs.String("allowed-types", "", "comma separated key types allowed, overriding lint.allowed_types")
+	disallowedOptions := fs.String("disallowed-options", "", "comma separated authorized_keys options keys may not carry, overriding lint.disallowed_options")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s lint [flags] <config-path> <username>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return 2
+	}
+	configPath, username := fs.Arg(0), fs.Arg(1)
+
+	var opts []portunus.Option
+	if *strict {
+		opts = append(opts, portunus.WithStrictConfig())
+	}
+	km, err := portunus.NewKeyManager(configPath, opts...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error initializing key manager: %v\n", err)
+		return 2
+	}
+	defer km.WaitHooks()
+	result, err := km.Resolve(context.Background(), username)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error getting keys: %v\n", err)
+		return 2
+	}
+
+	policy := km.EffectiveConfig().Lint
+	if *minRSABits > 0 {
+		policy.MinRSABits = *minRSABits
+	}
+	if *allowedTypes != "" {
+		policy.AllowedTypes = splitList(*allowedTypes)
+	}
+	if *disallowedOptions != "" {
+		policy.DisallowedOptions = splitList(*disallowedOptions)
+	}
+
+	findings := result.Lint(policy)
+	for _, f := range findings {
+		fmt.Println(f)
+	}
+	if len(findings) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// splitList splits a comma separated flag value, dropping empty entries
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
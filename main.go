@@ -1,376 +1,270 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
 	"os"
 	"strings"
 	"time"
 
-	"github.com/go-ldap/ldap/v3"
+	"github.com/jpetrucciani/portunus/pkg/portunus"
 )
 
-// KeyProvider defines the interface for different key sources
-type KeyProvider interface {
-	GetKeys(username string) ([]string, error)
-}
-
-// Config represents the application configuration
-type Config struct {
-	Mappings map[string]UserMapping `json:"mappings"`
-	Cache    CacheConfig            `json:"cache"`
-	GitHub   GitHubConfig           `json:"github,omitempty"`
-	GitLab   GitLabConfig           `json:"gitlab,omitempty"`
-	LDAP     LDAPConfig             `json:"ldap,omitempty"`
-}
-
-type UserMapping struct {
-	GitHub     string   `json:"github,omitempty"`
-	GitLab     string   `json:"gitlab,omitempty"`
-	LDAPUser   string   `json:"ldap,omitempty"`
-	StaticKeys []string `json:"static_keys,omitempty"`
-}
-
-type CacheConfig struct {
-	Enabled bool          `json:"enabled"`
-	TTL     time.Duration `json:"ttl"`
-	MaxSize int           `json:"max_size"`
-}
-
-type GitHubConfig struct {
-	URL   string `json:"url,omitempty"`
-	Token string `json:"token,omitempty"`
-}
-
-type GitLabConfig struct {
-	URL   string `json:"url,omitempty"`
-	Token string `json:"token,omitempty"`
-}
-
-type LDAPConfig struct {
-	URL          string `json:"url"`
-	BindDN       string `json:"bind_dn"`
-	BindPassword string `json:"bind_password"`
-	BaseDN       string `json:"base_dn"`
-	KeyAttribute string `json:"key_attribute"`
-}
-
-// type KeyCache struct {
-// 	mu    sync.RWMutex
-// 	items map[string]cacheItem
-// 	ttl   time.Duration
-// }
+// version is set at build time via -ldflags "-X main.version=..."
+var version = "dev"
 
-// type cacheItem struct {
-// 	keys      []string
-// 	timestamp time.Time
-// }
-
-// GitHubProvider implements key fetching from GitHub
-type GitHubProvider struct {
-	client  *http.Client
-	baseURL string
-	token   string
-}
-
-func NewGitHubProvider(baseURL string, token string) *GitHubProvider {
-	if baseURL == "" {
-		baseURL = "https://github.com/"
-	}
-	if !strings.HasSuffix(baseURL, "/") {
-		baseURL += "/"
-	}
-	return &GitHubProvider{
-		client:  &http.Client{Timeout: 10 * time.Second},
-		baseURL: baseURL,
-		token:   token,
-	}
+func main() {
+	os.Exit(run())
 }
 
-func (p *GitHubProvider) GetKeys(username string) ([]string, error) {
-	url := fmt.Sprintf("%s%s.keys", p.baseURL, username)
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, err
-	}
-
-	if p.token != "" {
-		req.Header.Set("Authorization", "token "+p.token)
+// run runs the command and returns its exit code, so that the deferred hook
+// and profile work is done before main exits
+func run() int {
+	portunus.Version = version
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "reverse":
+			return runReverse(os.Args[2:])
+		case "diff":
+			return runDiff(os.Args[2:])
+		case "check":
+			return runCheck(os.Args[2:])
+		case "generate-files":
+			return runGenerateFiles(os.Args[2:])
+		case "watch":
+			return runWatch(os.Args[2:])
+		case "lint":
+			return runLint(os.Args[2:])
+		case "explain":
+			return runExplain(os.Args[2:])
+		case "providers":
+			return runProviders(os.Args[2:])
+		}
 	}
 
-	resp, err := p.client.Do(req)
+	sortKeys := flag.Bool("sort", false, "sort keys within each source block for stable output")
+	format := flag.String("format", "text", "output format: text, json, or principals for AuthorizedPrincipalsCommand")
+	lookupBy := flag.String("by", "username", "how to interpret the requested name: username or email")
+	onlySources := flag.String("only-sources", "", "comma separated sources to resolve from, e.g. github,static")
+	unmapped := flag.String("unmapped", "", "what to do for logins with no mapping: deny (no keys, exit 0) or error (default from config, else error)")
+	cacheStats := flag.Bool("cache-stats", false, "print cache size, hit/miss counts and entries to stderr as JSON when done")
+	profile := flag.Bool("profile", false, "print a per-provider timing breakdown to stderr when done")
+	strict := flag.Bool("strict", false, "reject ambiguous configs, such as a login mapped twice or an unknown field")
+	output := flag.String("output", "", "write keys to this file atomically, with mode 0600, instead of stdout")
+	noNetwork := flag.Bool("no-network", false, "skip every network-backed provider, resolving only static keys and exec sources")
+	exitCodeSpec := flag.String("exit-codes", "", "override exit codes as name=code pairs, e.g. no-mapping=1,no-keys=1 (defaults: provider-error=1, config-error=2, no-mapping=3, no-keys=4)")
+	verbose := flag.Bool("verbose", false, "print a one-line summary of the keys resolved per source to stderr")
+	printConfig := flag.Bool("print-config", false, "print the effective config as JSON, with defaults filled in and secrets redacted, and exit")
+	breakGlass := flag.Bool("break-glass", false, "serve the config's break_glass_keys to every login, logging a warning each time")
+	stripComments := flag.Bool("strip-comments", false, "emit keys as bare \"keytype base64\" with no options, comments or headers")
+	defaultConfig := flag.Bool("default-config", false, "use the built-in demo config, mapping each login to the same-named GitHub and GitLab accounts; insecure, not for production")
+	var configFiles configList
+	flag.Var(&configFiles, "config", "config path, repeatable to merge overlays onto a base in order; replaces the <config-path> argument")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] <config-path> <username|email>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s [flags] -config <path> [-config <path>...] <username|email>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s reverse -provider <name> -user <upstream> [<config-path>]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s -default-config [flags] <username>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s -print-config [flags] [<config-path>]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s diff [flags] <config-path> <username> <authorized-keys-file>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s check [flags] [<config-path>]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s generate-files [flags] <config-path> <output-dir>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s watch [flags] <config-path> <username>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s lint [flags] <config-path> <username>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s explain [flags] <config-path> <username>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s providers\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  <config-path> may be an http(s) URL, - to read from stdin, or omitted when %s is set\n", portunus.ConfigEnv)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	var configPath, username string
+	switch {
+	case *defaultConfig && len(configFiles) == 0 && flag.NArg() == 1:
+		username = flag.Arg(0)
+	case *defaultConfig && len(configFiles) == 0 && flag.NArg() == 0 && *printConfig:
+	case *defaultConfig:
+		flag.Usage()
+		return 1
+	case len(configFiles) > 0 && flag.NArg() == 1:
+		username = flag.Arg(0)
+	case len(configFiles) > 0 && flag.NArg() == 0 && *printConfig:
+	case len(configFiles) > 0:
+		flag.Usage()
+		return 1
+	case *printConfig && flag.NArg() == 1:
+		configPath = flag.Arg(0)
+	case *printConfig && flag.NArg() == 0 && os.Getenv(portunus.ConfigEnv) != "":
+	case flag.NArg() == 2:
+		configPath, username = flag.Arg(0), flag.Arg(1)
+	case flag.NArg() == 1 && os.Getenv(portunus.ConfigEnv) != "":
+		username = flag.Arg(0)
+	default:
+		flag.Usage()
+		return 1
+	}
+
+	if *format != "text" && *format != "json" && *format != "principals" {
+		fmt.Fprintf(os.Stderr, "Unknown output format: %s\n", *format)
+		return 1
+	}
+	if *stripComments && *format != "text" {
+		fmt.Fprintln(os.Stderr, "-strip-comments only applies to text output")
+		return 1
+	}
+
+	exitCodes, err := portunus.ParseExitCodes(*exitCodeSpec, portunus.DefaultExitCodes)
 	if err != nil {
-		return nil, err
+		fmt.Fprintf(os.Stderr, "Invalid -exit-codes: %v\n", err)
+		return 1
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("GitHub API returned status: %d", resp.StatusCode)
+	opts := []portunus.Option{portunus.WithExitCodes(exitCodes)}
+	switch *lookupBy {
+	case "username":
+	case "email":
+		opts = append(opts, portunus.WithEmailLookup())
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown -by mode: %s\n", *lookupBy)
+		return 1
 	}
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+	if *onlySources != "" {
+		sources, err := portunus.ParseSources(*onlySources)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -only-sources: %v\n", err)
+			return 1
+		}
+		opts = append(opts, portunus.WithOnlySources(sources))
 	}
-	keys := strings.Split(strings.TrimSpace(string(body)), "\n")
-	// var keys []struct {
-	// 	Key string `json:"key"`
-	// }
-	// if err := json.NewDecoder(resp.Body).Decode(&keys); err != nil {
-	// 	return nil, err
-	// }
-
-	// result := make([]string, len(keys))
-	// for i, k := range keys {
-	// 	result[i] = k
-	// }
-	return keys, nil
-}
-
-// GitLabProvider implements key fetching from GitLab
-type GitLabProvider struct {
-	client  *http.Client
-	baseURL string
-	token   string
-}
 
-func NewGitLabProvider(baseURL string, token string) *GitLabProvider {
-	if baseURL == "" {
-		baseURL = "https://gitlab.com/"
+	if *profile {
+		opts = append(opts, portunus.WithProfile())
 	}
-	if !strings.HasSuffix(baseURL, "/") {
-		baseURL += "/"
+	if *strict {
+		opts = append(opts, portunus.WithStrictConfig())
 	}
-	return &GitLabProvider{
-		client:  &http.Client{Timeout: 10 * time.Second},
-		baseURL: baseURL,
-		token:   token,
+	if *sortKeys {
+		opts = append(opts, portunus.WithSortKeys())
 	}
-}
-
-func (p *GitLabProvider) GetKeys(username string) ([]string, error) {
-	url := fmt.Sprintf("%s%s.keys", p.baseURL, username)
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, err
-	}
-
-	if p.token != "" {
-		req.Header.Set("PRIVATE-TOKEN", p.token)
+	if *unmapped != "" {
+		opts = append(opts, portunus.WithUnmapped(*unmapped))
 	}
-
-	resp, err := p.client.Do(req)
-	if err != nil {
-		return nil, err
+	if *noNetwork {
+		opts = append(opts, portunus.WithOffline())
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("GitLab API returned status: %d", resp.StatusCode)
+	if *breakGlass {
+		opts = append(opts, portunus.WithBreakGlass())
 	}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+	if *defaultConfig {
+		log.Printf("WARNING: using the built-in demo config, which lets anyone with a GitHub or GitLab account named like the login in; not for production")
 	}
-	keys := strings.Split(strings.TrimSpace(string(body)), "\n")
-	// var keys []struct {
-	// 	Key string `json:"key"`
-	// }
-	// if err := json.NewDecoder(resp.Body).Decode(&keys); err != nil {
-	// 	return nil, err
-	// }
-
-	// result := make([]string, len(keys))
-	// for i, k := range keys {
-	// 	result[i] = k
-	// }
-	return keys, nil
-}
-
-// LDAPProvider implements key fetching from LDAP
-type LDAPProvider struct {
-	config LDAPConfig
-}
-
-func NewLDAPProvider(config LDAPConfig) *LDAPProvider {
-	return &LDAPProvider{config: config}
-}
-
-func (p *LDAPProvider) GetKeys(username string) ([]string, error) {
-	l, err := ldap.DialURL(p.config.URL)
+	km, err := loadKeyManager(configPath, configFiles, *defaultConfig, *strict, opts)
 	if err != nil {
-		return nil, err
+		log.Printf("Error initializing key manager: %v", err)
+		return exitCodes.ConfigError
 	}
-	defer l.Close()
-
-	if err := l.Bind(p.config.BindDN, p.config.BindPassword); err != nil {
-		return nil, err
-	}
-
-	searchRequest := ldap.NewSearchRequest(
-		p.config.BaseDN,
-		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
-		fmt.Sprintf("(uid=%s)", username),
-		[]string{p.config.KeyAttribute},
-		nil,
-	)
-
-	result, err := l.Search(searchRequest)
-	if err != nil {
-		return nil, err
-	}
-
-	if len(result.Entries) == 0 {
-		return nil, fmt.Errorf("user not found: %s", username)
-	}
-
-	entry := result.Entries[0]
-	keys := entry.GetAttributeValues(p.config.KeyAttribute)
-	return keys, nil
-}
-
-// KeyManager orchestrates the key providers and caching
-type KeyManager struct {
-	config Config
-	// cache  *KeyCache
-	github *GitHubProvider
-	gitlab *GitLabProvider
-	ldap   *LDAPProvider
-}
-
-func NewKeyManager(configPath string) (*KeyManager, error) {
-	config, err := loadConfig(configPath)
-	if err != nil {
-		return nil, err
-	}
-
-	km := &KeyManager{
-		config: config,
-	}
-
-	// if config.Cache.Enabled {
-	// 	km.cache = &KeyCache{
-	// 		items: make(map[string]cacheItem),
-	// 		ttl:   config.Cache.TTL,
-	// 	}
-	// }
-
-	// if config.GitHub.Token != "" {
-	km.github = NewGitHubProvider(config.GitHub.URL, config.GitHub.Token)
-	// }
-
-	// if config.GitLab.URL != "" {
-	km.gitlab = NewGitLabProvider(config.GitLab.URL, config.GitLab.Token)
-	// }
-
-	if config.LDAP.URL != "" {
-		km.ldap = NewLDAPProvider(config.LDAP)
-	}
-
-	return km, nil
-}
-
-func (km *KeyManager) GetKeys(username string) ([]string, error) {
-	mapping, ok := km.config.Mappings[username]
-	if !ok {
-		return nil, fmt.Errorf("no mapping found for user: %s", username)
-	}
-
-	// if km.cache != nil {
-	// 	if keys, ok := km.cache.Get(username); ok {
-	// 		return keys, nil
-	// 	}
-	// }
-
-	var allKeys []string
-
-	// Add static keys if present
-	if len(mapping.StaticKeys) > 0 {
-		allKeys = append(allKeys, fmt.Sprintf("# static: %s", username))
-		allKeys = append(allKeys, mapping.StaticKeys...)
-	}
-
-	// Fetch from GitHub if configured
-	if mapping.GitHub != "" && km.github != nil {
-		keys, err := km.github.GetKeys(mapping.GitHub)
+	if *printConfig {
+		data, err := json.MarshalIndent(km.EffectiveConfig(), "", "  ")
 		if err != nil {
-			log.Printf("Error fetching GitHub keys for %s: %v", username, err)
-		} else {
-			allKeys = append(allKeys, fmt.Sprintf("# github: %s (%s)", username, mapping.GitHub))
-			allKeys = append(allKeys, keys...)
+			log.Printf("Error encoding config: %v", err)
+			return 1
 		}
+		fmt.Println(string(data))
+		return 0
+	}
+	defer km.WriteProfile(os.Stderr)
+	defer km.WaitHooks()
+	if *cacheStats {
+		defer km.WriteCacheStats(os.Stderr)
 	}
 
-	// Fetch from GitLab if configured
-	if mapping.GitLab != "" && km.gitlab != nil {
-		keys, err := km.gitlab.GetKeys(mapping.GitLab)
+	start := time.Now()
+	var result portunus.Result
+	var out bytes.Buffer
+	switch {
+	case *format == "principals":
+		principals, err := km.Principals(username)
 		if err != nil {
-			log.Printf("Error fetching GitLab keys for %s: %v", username, err)
-		} else {
-			allKeys = append(allKeys, fmt.Sprintf("# gitlab: %s (%s)", username, mapping.GitLab))
-			allKeys = append(allKeys, keys...)
+			if code := km.LookupExitCode(username, err); code != 0 {
+				return code
+			}
+		}
+		out.Write(portunus.FormatLines(principals))
+	default:
+		// an unmapped login under the deny policy gives an empty result and
+		// exit code zero, so it still gets well-formed output below
+		var code int
+		result, code = km.LookupForSSHD(context.Background(), username)
+		if code != 0 {
+			return code
+		}
+		switch {
+		case *format == "json":
+			if err := result.WriteJSON(&out); err != nil {
+				log.Printf("Error writing keys: %v", err)
+				return 1
+			}
+		case *stripComments:
+			out.Write(portunus.FormatLines(result.StrippedKeys()))
+		default:
+			out.Write(result.Text())
 		}
 	}
+	if *verbose && *format != "principals" {
+		fmt.Fprintln(os.Stderr, result.Summary(username, time.Since(start)))
+	}
 
-	// Fetch from LDAP if configured
-	if mapping.LDAPUser != "" && km.ldap != nil {
-		keys, err := km.ldap.GetKeys(mapping.LDAPUser)
-		if err != nil {
-			log.Printf("Error fetching LDAP keys for %s: %v", username, err)
-		} else {
-			allKeys = append(allKeys, fmt.Sprintf("# ldap: %s", username))
-			allKeys = append(allKeys, keys...)
-		}
+	if err := writeOutput(*output, out.Bytes()); err != nil {
+		log.Printf("Error writing keys: %v", err)
+		return 1
 	}
+	return 0
+}
 
-	if len(allKeys) == 0 {
-		return nil, fmt.Errorf("no keys found for user: %s", username)
+// writeOutput writes data to stdout, or atomically to path when it is set
+func writeOutput(path string, data []byte) error {
+	if path == "" {
+		_, err := os.Stdout.Write(data)
+		return err
 	}
+	return portunus.WriteFileAtomic(path, data, 0o600)
+}
 
-	// if km.cache != nil {
-	// 	km.cache.Set(username, allKeys)
-	// }
+// configList collects repeated -config flags
+type configList []string
 
-	return allKeys, nil
+func (c *configList) String() string {
+	return strings.Join(*c, ",")
 }
 
-func loadConfig(path string) (Config, error) {
-	var config Config
-	file, err := os.Open(path)
-	if err != nil {
-		return config, err
-	}
-	defer file.Close()
-
-	decoder := json.NewDecoder(file)
-	err = decoder.Decode(&config)
-	return config, err
+func (c *configList) Set(path string) error {
+	*c = append(*c, path)
+	return nil
 }
 
-func main() {
-	if len(os.Args) != 3 {
-		fmt.Fprintf(os.Stderr, "Usage: %s <config-path> <username>\n", os.Args[0])
-		os.Exit(1)
+// loadKeyManager builds the key manager from the embedded config with
+// -default-config, from the -config files merged in order when any were
+// given, otherwise from configPath
+func loadKeyManager(configPath string, configFiles []string, embedded, strict bool, opts []portunus.Option) (*portunus.KeyManager, error) {
+	if embedded {
+		config, err := portunus.EmbeddedConfig()
+		if err != nil {
+			return nil, err
+		}
+		return portunus.NewKeyManagerFromConfig(config, opts...)
 	}
-
-	configPath := os.Args[1]
-	username := os.Args[2]
-
-	km, err := NewKeyManager(configPath)
-	if err != nil {
-		log.Fatalf("Error initializing key manager: %v", err)
+	if len(configFiles) == 0 {
+		return portunus.NewKeyManager(configPath, opts...)
 	}
-
-	keys, err := km.GetKeys(username)
+	config, err := portunus.LoadConfigs(configFiles, strict)
 	if err != nil {
-		log.Fatalf("Error getting keys: %v", err)
-	}
-
-	for _, key := range keys {
-		fmt.Println(key)
+		return nil, err
 	}
+	return portunus.NewKeyManagerFromConfig(config, opts...)
 }
@@ -0,0 +1,50 @@
+package portunus
+
+import (
+	"log"
+	"sort"
+)
+
+// adaptiveDecay is how much of a source's score carries over each time it is
+// tried, so a source that stops returning keys drops back down the order
+// within a few lookups. Scores stay below 1/(1-adaptiveDecay).
+const adaptiveDecay = 0.8
+
+// scoreSource records whether name returned keys for a lookup, see
+// Config.AdaptiveOrdering. There is one score per source, so the state is
+// bounded by the number of sources.
+func (km *KeyManager) scoreSource(name string, found bool) {
+	if !km.config.AdaptiveOrdering {
+		return
+	}
+	km.mu.Lock()
+	defer km.mu.Unlock()
+	score := km.scores[name] * adaptiveDecay
+	if found {
+		score++
+	}
+	km.scores[name] = score
+}
+
+// adaptiveOrder sorts sources by score, highest first. Sources with equal
+// scores, such as those never tried, keep their order.
+func (km *KeyManager) adaptiveOrder(sources []string) []string {
+	km.mu.Lock()
+	scores := make(map[string]float64, len(sources))
+	for _, name := range sources {
+		scores[name] = km.scores[name]
+	}
+	km.mu.Unlock()
+
+	sort.SliceStable(sources, func(i, j int) bool {
+		return scores[sources[i]] > scores[sources[j]]
+	})
+	return sources
+}
+
+// checkAdaptiveOrdering warns when adaptive_ordering can't take effect
+func checkAdaptiveOrdering(config Config) {
+	if config.AdaptiveOrdering && len(config.SourceOrder) > 0 {
+		log.Printf("Warning: adaptive_ordering is ignored because source_order is set")
+	}
+}
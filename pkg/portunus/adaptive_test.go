@@ -0,0 +1,79 @@
+package portunus
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestAdaptiveOrdering(t *testing.T) {
+	hubKey, labKey := testKey(t, 1, "hub"), testKey(t, 2, "lab")
+	repeat := func(login string, n int) []string {
+		return slices.Repeat([]string{login}, n)
+	}
+
+	tests := []struct {
+		name        string
+		adaptive    bool
+		sourceOrder []string
+		history     []string
+		want        []string
+	}{
+		{name: "default order before any lookups", adaptive: true, want: []string{"github", "gitlab"}},
+		{name: "preferred source first", adaptive: true, history: repeat("labonly", 3), want: []string{"gitlab", "github"}},
+		{name: "one lookup is enough to lead", adaptive: true, history: []string{"labonly"}, want: []string{"gitlab", "github"}},
+		{
+			name:     "source that stops returning keys falls back",
+			adaptive: true,
+			history:  append(repeat("labonly", 3), repeat("hubonly", 5)...),
+			want:     []string{"github", "gitlab"},
+		},
+		{name: "disabled", history: repeat("labonly", 3), want: []string{"github", "gitlab"}},
+		{
+			name:        "source_order wins",
+			adaptive:    true,
+			sourceOrder: []string{"github", "gitlab"},
+			history:     repeat("labonly", 3),
+			want:        []string{"github", "gitlab"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			github := &fakeProvider{keys: map[string][]string{"both": {hubKey}, "hubonly": {hubKey}}}
+			gitlab := &fakeProvider{keys: map[string][]string{"both": {labKey}, "labonly": {labKey}}}
+			mappings := make(map[string]UserMapping)
+			for _, login := range []string{"both", "hubonly", "labonly"} {
+				mappings[login] = UserMapping{GitHub: Usernames{login}, GitLab: Usernames{login}}
+			}
+			km := newTestKeyManager(t, Config{
+				Mappings:         mappings,
+				AdaptiveOrdering: tt.adaptive,
+				SourceOrder:      tt.sourceOrder,
+			}, WithProvider("github", github), WithProvider("gitlab", gitlab))
+			for _, login := range tt.history {
+				resolveLines(t, km, login)
+			}
+
+			result, err := km.Resolve(context.Background(), "both")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, b := range result.Blocks {
+				got = append(got, b.Source)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got sources %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAdaptiveOrderingWithSourceOrderWarns(t *testing.T) {
+	logs := captureLog(t)
+	newTestKeyManager(t, Config{AdaptiveOrdering: true, SourceOrder: []string{"github"}})
+	if !strings.Contains(logs.String(), "adaptive_ordering is ignored because source_order is set") {
+		t.Errorf("log = %q, want a warning that adaptive_ordering is ignored", logs)
+	}
+}
@@ -0,0 +1,106 @@
+package portunus
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+type AuditConfig struct {
+	// Path is a file that audit records are appended to as JSON lines
+	Path string `json:"path,omitempty"`
+	// Syslog also sends each record to the local syslog daemon
+	Syslog bool `json:"syslog,omitempty"`
+	// SyslogAddress also sends each record to a remote collector as an
+	// RFC 5424 message, e.g. udp://siem.example.com:514 or tcp://...:601.
+	// The username, sources and fingerprints are in its structured data.
+	SyslogAddress string `json:"syslog_address,omitempty"`
+}
+
+// auditRecord describes one lookup. Only fingerprints of served keys are
+// recorded, never the keys themselves.
+type auditRecord struct {
+	Time         time.Time `json:"time"`
+	Username     string    `json:"username"`
+	Sources      []string  `json:"sources"`
+	Fingerprints []string  `json:"fingerprints"`
+	Error        string    `json:"error,omitempty"`
+}
+
+// auditLogger appends audit records to its writers, safe for concurrent use
+type auditLogger struct {
+	mu      sync.Mutex
+	writers []io.Writer
+	remote  *remoteSyslog
+}
+
+func newAuditLogger(config AuditConfig) (*auditLogger, error) {
+	a := &auditLogger{}
+	if config.Path != "" {
+		f, err := os.OpenFile(config.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("error opening audit log: %w", err)
+		}
+		a.writers = append(a.writers, f)
+	}
+	if config.Syslog {
+		// an unavailable syslog shouldn't stop logins, so only warn
+		w, err := newSyslogWriter()
+		if err != nil {
+			log.Printf("Error connecting to syslog for audit records: %v", err)
+		} else {
+			a.writers = append(a.writers, w)
+		}
+	}
+	if config.SyslogAddress != "" {
+		remote, err := newRemoteSyslog(config.SyslogAddress)
+		if err != nil {
+			return nil, err
+		}
+		a.remote = remote
+	}
+	return a, nil
+}
+
+// Record writes an audit entry for a lookup of username that served blocks
+// or failed with err
+func (a *auditLogger) Record(username string, blocks []KeyBlock, err error) {
+	record := auditRecord{
+		Time:         time.Now().UTC(),
+		Username:     username,
+		Sources:      []string{},
+		Fingerprints: []string{},
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	for _, b := range blocks {
+		record.Sources = append(record.Sources, b.Source)
+		for _, line := range b.Keys {
+			if pub, _, err := parseKey(line); err == nil {
+				record.Fingerprints = append(record.Fingerprints, ssh.FingerprintSHA256(pub))
+			}
+		}
+	}
+
+	data, _ := json.Marshal(record)
+	data = append(data, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, w := range a.writers {
+		// auditing must never break key resolution, so write errors are only logged
+		if _, err := w.Write(data); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing audit record: %v\n", err)
+		}
+	}
+	if a.remote != nil && !a.remote.enqueue(record, data) {
+		fmt.Fprintf(os.Stderr, "Error sending audit record to %s: too many records waiting, dropped\n", a.remote.address)
+	}
+}
@@ -0,0 +1,138 @@
+package portunus
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// remoteSyslogTimeout bounds dialing and each write, so an unreachable
+	// collector delays a lookup by at most this much
+	remoteSyslogTimeout = 500 * time.Millisecond
+
+	// remoteSyslogQueueSize is how many records wait to be sent before new
+	// ones are dropped
+	remoteSyslogQueueSize = 256
+
+	// remoteSyslogPriority is facility auth (4) at severity info (6)
+	remoteSyslogPriority = 4*8 + 6
+
+	// remoteSyslogSDID is the structured data element carrying the record's
+	// fields. 32473 is the enterprise number reserved for examples; the
+	// element name is only meant to be matched on by SIEM rules.
+	remoteSyslogSDID = "portunus@32473"
+)
+
+// remoteSyslog sends audit records as RFC 5424 messages to a collector over
+// UDP, or TCP with octet-counted framing. Records are queued and sent in the
+// background, so a slow or unreachable collector never holds up a lookup.
+// The connection is dialed on first use and redialed after a failure.
+type remoteSyslog struct {
+	network  string
+	address  string
+	hostname string
+	conn     net.Conn
+	queue    chan queuedRecord
+}
+
+// queuedRecord is a record waiting to be sent, with its JSON encoding
+type queuedRecord struct {
+	record auditRecord
+	msg    []byte
+}
+
+// newRemoteSyslog parses a udp://host:port or tcp://host:port address
+func newRemoteSyslog(address string) (*remoteSyslog, error) {
+	u, err := url.Parse(address)
+	if err != nil || (u.Scheme != "udp" && u.Scheme != "tcp") || u.Port() == "" {
+		return nil, fmt.Errorf("invalid syslog_address %q: want udp://host:port or tcp://host:port", address)
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+	s := &remoteSyslog{
+		network:  u.Scheme,
+		address:  u.Host,
+		hostname: hostname,
+		queue:    make(chan queuedRecord, remoteSyslogQueueSize),
+	}
+	go s.run()
+	return s, nil
+}
+
+// enqueue queues a record to be sent, reporting false if the queue is full
+// and the record was dropped
+func (s *remoteSyslog) enqueue(record auditRecord, msg []byte) bool {
+	select {
+	case s.queue <- queuedRecord{record: record, msg: msg}:
+		return true
+	default:
+		return false
+	}
+}
+
+// run sends queued records as they arrive, logging the ones that fail
+func (s *remoteSyslog) run() {
+	for q := range s.queue {
+		if err := s.send(q.record, q.msg); err != nil {
+			fmt.Fprintf(os.Stderr, "Error sending audit record to %s: %v\n", s.address, err)
+		}
+	}
+}
+
+// send writes one record. Errors are returned for the caller to log, and
+// drop the connection so the next record redials.
+func (s *remoteSyslog) send(record auditRecord, msg []byte) error {
+	if s.conn == nil {
+		conn, err := net.DialTimeout(s.network, s.address, remoteSyslogTimeout)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+
+	line := s.format(record, msg)
+	if s.network == "tcp" {
+		line = strconv.Itoa(len(line)) + " " + line
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(remoteSyslogTimeout))
+	if _, err := s.conn.Write([]byte(line)); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+// format renders an RFC 5424 message whose structured data holds the
+// username, sources and fingerprints, and whose message is the JSON record
+func (s *remoteSyslog) format(record auditRecord, msg []byte) string {
+	sd := fmt.Sprintf(`[%s username="%s" sources="%s" fingerprints="%s"`, remoteSyslogSDID,
+		escapeSDParam(record.Username),
+		escapeSDParam(strings.Join(record.Sources, ",")),
+		escapeSDParam(strings.Join(record.Fingerprints, ",")))
+	if record.Error != "" {
+		sd += fmt.Sprintf(` error="%s"`, escapeSDParam(record.Error))
+	}
+	sd += "]"
+
+	return fmt.Sprintf("<%d>1 %s %s portunus %d lookup %s %s",
+		remoteSyslogPriority,
+		record.Time.Format("2006-01-02T15:04:05.000000Z07:00"),
+		s.hostname,
+		os.Getpid(),
+		sd,
+		strings.TrimSpace(string(msg)))
+}
+
+// escapeSDParam escapes the characters RFC 5424 reserves in structured data
+// parameter values
+func escapeSDParam(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(value)
+}
@@ -0,0 +1,211 @@
+package portunus
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// syslogCollector listens for messages on network, udp or tcp, and returns
+// the address to send them to with a channel of the messages received. TCP
+// messages are read with octet-counted framing.
+func syslogCollector(t *testing.T, network string) (string, <-chan string) {
+	t.Helper()
+	messages := make(chan string, 16)
+	if network == "udp" {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		go func() {
+			buf := make([]byte, 64*1024)
+			for {
+				n, _, err := conn.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				messages <- string(buf[:n])
+			}
+		}()
+		return "udp://" + conn.LocalAddr().String(), messages
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			length, err := r.ReadString(' ')
+			if err != nil {
+				return
+			}
+			n, err := strconv.Atoi(strings.TrimSpace(length))
+			if err != nil {
+				t.Errorf("bad frame length %q", length)
+				return
+			}
+			buf := make([]byte, n)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return
+			}
+			messages <- string(buf)
+		}
+	}()
+	return "tcp://" + ln.Addr().String(), messages
+}
+
+func TestRemoteSyslog(t *testing.T) {
+	key := testKey(t, 1, "alice")
+	pub, _, err := parseKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp := ssh.FingerprintSHA256(pub)
+
+	for _, network := range []string{"udp", "tcp"} {
+		t.Run(network, func(t *testing.T) {
+			address, messages := syslogCollector(t, network)
+			km := newTestKeyManager(t, Config{
+				Mappings: map[string]UserMapping{
+					"alice": {StaticKeys: []StaticKey{{Key: key}}},
+					"bob":   {},
+				},
+				Audit: AuditConfig{SyslogAddress: address},
+			})
+
+			tests := []struct {
+				login  string
+				wantSD string
+				want   auditRecord
+			}{
+				{
+					login:  "alice",
+					wantSD: `[portunus@32473 username="alice" sources="static" fingerprints="` + fp + `"]`,
+					want:   auditRecord{Username: "alice", Sources: []string{"static"}, Fingerprints: []string{fp}},
+				},
+				{
+					login:  "bob",
+					wantSD: `[portunus@32473 username="bob" sources="" fingerprints="" error="`,
+					want:   auditRecord{Username: "bob", Sources: []string{}, Fingerprints: []string{}},
+				},
+			}
+			for _, tt := range tests {
+				km.Resolve(context.Background(), tt.login)
+
+				var msg string
+				select {
+				case msg = <-messages:
+				case <-time.After(5 * time.Second):
+					t.Fatalf("no message for %s", tt.login)
+				}
+				if !strings.HasPrefix(msg, "<38>1 ") {
+					t.Errorf("got %q, want facility auth at severity info", msg)
+				}
+				fields := strings.SplitN(msg, " ", 7)
+				if len(fields) < 7 || fields[3] != "portunus" || fields[5] != "lookup" {
+					t.Fatalf("got %q, want an RFC 5424 header", msg)
+				}
+				if !strings.HasPrefix(fields[6], tt.wantSD) {
+					t.Errorf("got structured data %q, want %q", fields[6], tt.wantSD)
+				}
+
+				var record auditRecord
+				body := fields[6][strings.Index(fields[6], "] ")+2:]
+				if err := json.Unmarshal([]byte(body), &record); err != nil {
+					t.Fatalf("message is not the JSON record: %v: %s", err, body)
+				}
+				if record.Username != tt.want.Username ||
+					!slices.Equal(record.Sources, tt.want.Sources) ||
+					!slices.Equal(record.Fingerprints, tt.want.Fingerprints) {
+					t.Errorf("got record %+v, want %+v", record, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestRemoteSyslogUnreachable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := "tcp://" + ln.Addr().String()
+	ln.Close()
+
+	key := testKey(t, 1, "alice")
+	km := newTestKeyManager(t, Config{
+		Mappings: map[string]UserMapping{"alice": {StaticKeys: []StaticKey{{Key: key}}}},
+		Audit:    AuditConfig{SyslogAddress: address},
+	})
+	for range 2 {
+		start := time.Now()
+		if got := stripHeaders(resolveLines(t, km, "alice")); !slices.Equal(got, []string{key}) {
+			t.Errorf("got %q, want the keys served anyway", got)
+		}
+		if elapsed := time.Since(start); elapsed > 2*remoteSyslogTimeout {
+			t.Errorf("lookup took %v with the collector down", elapsed)
+		}
+	}
+}
+
+func TestRemoteSyslogDropsOnOverflow(t *testing.T) {
+	// nothing drains this queue, so it stays full after the first record
+	s := &remoteSyslog{queue: make(chan queuedRecord, 1)}
+	record := auditRecord{Username: "alice"}
+	if !s.enqueue(record, nil) {
+		t.Fatal("first record dropped, want it queued")
+	}
+	if s.enqueue(record, nil) {
+		t.Error("second record queued, want it dropped with the queue full")
+	}
+}
+
+func TestInvalidSyslogAddressFailsAtLoad(t *testing.T) {
+	for _, address := range []string{
+		"siem.example.com:514",
+		"http://siem.example.com:514",
+		"udp://siem.example.com",
+		"unix:///dev/log",
+	} {
+		t.Run(address, func(t *testing.T) {
+			_, err := NewKeyManagerFromConfig(Config{Audit: AuditConfig{SyslogAddress: address}})
+			if err == nil || !strings.Contains(err.Error(), "syslog_address") {
+				t.Errorf("got error %v, want syslog_address rejected", err)
+			}
+		})
+	}
+}
+
+func TestEscapeSDParam(t *testing.T) {
+	tests := []struct {
+		value, want string
+	}{
+		{`alice`, `alice`},
+		{`say "hi"`, `say \"hi\"`},
+		{`a\b`, `a\\b`},
+		{`[x]`, `[x\]`},
+	}
+	for _, tt := range tests {
+		if got := escapeSDParam(tt.value); got != tt.want {
+			t.Errorf("escapeSDParam(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
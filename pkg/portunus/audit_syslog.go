@@ -0,0 +1,12 @@
+//go:build !windows && !plan9
+
+package portunus
+
+import (
+	"io"
+	"log/syslog"
+)
+
+func newSyslogWriter() (io.Writer, error) {
+	return syslog.New(syslog.LOG_INFO|syslog.LOG_AUTH, "portunus")
+}
@@ -0,0 +1,12 @@
+//go:build windows || plan9
+
+package portunus
+
+import (
+	"errors"
+	"io"
+)
+
+func newSyslogWriter() (io.Writer, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
@@ -0,0 +1,76 @@
+package portunus
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestAuditLog(t *testing.T) {
+	key := testKey(t, 1, "alice")
+	pub, _, err := parseKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "audit.log")
+	km := newTestKeyManager(t, Config{
+		Mappings: map[string]UserMapping{
+			"alice": {StaticKeys: []StaticKey{{Key: key}}},
+			"bob":   {},
+		},
+		Audit: AuditConfig{Path: path},
+	})
+
+	tests := []struct {
+		login            string
+		wantSources      []string
+		wantFingerprints []string
+		wantErr          bool
+	}{
+		{login: "alice", wantSources: []string{"static"}, wantFingerprints: []string{ssh.FingerprintSHA256(pub)}},
+		{login: "bob", wantSources: []string{}, wantFingerprints: []string{}, wantErr: true},
+	}
+	start := time.Now().Add(-time.Second)
+	for _, tt := range tests {
+		km.Resolve(context.Background(), tt.login)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for _, tt := range tests {
+		if !scanner.Scan() {
+			t.Fatalf("no audit record for %s", tt.login)
+		}
+		var record auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("audit record is not JSON: %v: %s", err, scanner.Bytes())
+		}
+		if record.Username != tt.login || record.Time.Before(start) ||
+			!slices.Equal(record.Sources, tt.wantSources) ||
+			!slices.Equal(record.Fingerprints, tt.wantFingerprints) ||
+			(record.Error != "") != tt.wantErr {
+			t.Errorf("got record %+v for %s", record, tt.login)
+		}
+	}
+	if scanner.Scan() {
+		t.Errorf("unexpected record %s", scanner.Bytes())
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0o600 {
+		t.Errorf("audit log mode = %v, want 0600", mode)
+	}
+}
@@ -0,0 +1,97 @@
+package portunus
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// AzureDevOpsProvider implements key fetching from the Azure DevOps SSH public
+// key API, authenticating with a personal access token
+type AzureDevOpsProvider struct {
+	http         *httpFetcher
+	baseURL      string
+	organization string
+	pat          string
+	apiVersion   string
+}
+
+// defaults for the AzureDevOpsConfig fields left unset
+const (
+	defaultAzureDevOpsURL        = "https://vssps.dev.azure.com/"
+	defaultAzureDevOpsAPIVersion = "7.1-preview.1"
+)
+
+type AzureDevOpsConfig struct {
+	URL          string `json:"url,omitempty"`
+	Organization string `json:"organization"`
+	PAT          string `json:"pat,omitempty"`
+	APIVersion   string `json:"api_version,omitempty"`
+	HTTPConfig
+}
+
+// azureDevOpsKeys is the list envelope returned by the SSH public key API
+type azureDevOpsKeys struct {
+	Count int `json:"count"`
+	Value []struct {
+		PublicData string `json:"publicData"`
+	} `json:"value"`
+}
+
+func NewAzureDevOpsProvider(config AzureDevOpsConfig) *AzureDevOpsProvider {
+	baseURL := config.URL
+	if baseURL == "" {
+		baseURL = defaultAzureDevOpsURL
+	}
+	if !strings.HasSuffix(baseURL, "/") {
+		baseURL += "/"
+	}
+	apiVersion := config.APIVersion
+	if apiVersion == "" {
+		apiVersion = defaultAzureDevOpsAPIVersion
+	}
+	return &AzureDevOpsProvider{
+		http:         newHTTPFetcher("Azure DevOps", config.HTTPConfig),
+		baseURL:      baseURL,
+		organization: config.Organization,
+		pat:          config.PAT,
+		apiVersion:   apiVersion,
+	}
+}
+
+func (p *AzureDevOpsProvider) GetKeys(username string) ([]string, error) {
+	query := url.Values{}
+	query.Set("user", username)
+	query.Set("api-version", p.apiVersion)
+	keysURL := fmt.Sprintf("%s%s/_apis/ssh/publickeys?%s", p.baseURL, url.PathEscape(p.organization), query.Encode())
+
+	req, err := http.NewRequest("GET", keysURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if p.pat != "" {
+		// PATs are sent as basic auth with an empty username
+		req.SetBasicAuth("", p.pat)
+	}
+
+	body, err := p.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var result azureDevOpsKeys
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for _, v := range result.Value {
+		if key := strings.TrimSpace(v.PublicData); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,71 @@
+package portunus
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestAzureDevOpsProvider(t *testing.T) {
+	key := testKey(t, 1, "alice")
+
+	tests := []struct {
+		name     string
+		pat      string
+		status   int
+		body     string
+		want     []string
+		wantAuth bool
+		wantErr  bool
+	}{
+		{
+			name:     "keys with a pat",
+			pat:      "secret",
+			body:     `{"count": 2, "value": [{"publicData": "` + key + `\n"}, {"publicData": ""}]}`,
+			want:     []string{key},
+			wantAuth: true,
+		},
+		{
+			name: "no keys without a pat",
+			body: `{"count": 0, "value": []}`,
+		},
+		{
+			name:    "error status",
+			status:  http.StatusUnauthorized,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/acme/_apis/ssh/publickeys" || r.URL.Query().Get("user") != "alice" || r.URL.Query().Get("api-version") != defaultAzureDevOpsAPIVersion {
+					t.Errorf("unexpected request %s", r.URL)
+				}
+				user, pass, ok := r.BasicAuth()
+				if ok != tt.wantAuth || user != "" || pass != tt.pat {
+					t.Errorf("basic auth = %q, %q, %v, want the pat", user, pass, ok)
+				}
+				if tt.status != 0 {
+					w.WriteHeader(tt.status)
+				}
+				w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+
+			p := NewAzureDevOpsProvider(AzureDevOpsConfig{
+				URL:          srv.URL,
+				Organization: "acme",
+				PAT:          tt.pat,
+				HTTPConfig:   HTTPConfig{AllowPrivateNetworks: true},
+			})
+			got, err := p.GetKeys("alice")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package portunus
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned instead of calling a provider whose breaker has
+// tripped. Callers treat it like any other provider error and skip the source.
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// defaultBreakerCooldown is used when a threshold is set without a cooldown
+const defaultBreakerCooldown = 30 * time.Second
+
+type CircuitBreakerConfig struct {
+	// Threshold is the number of consecutive failures that opens the breaker.
+	// Zero disables circuit breaking.
+	Threshold int `json:"threshold,omitempty"`
+	// Window bounds how far apart the consecutive failures may be. Zero means
+	// failures count regardless of how long ago the previous one was.
+	Window time.Duration `json:"window,omitempty"`
+	// Cooldown is how long the breaker stays open before letting a trial
+	// request through.
+	Cooldown time.Duration `json:"cooldown,omitempty"`
+}
+
+// circuitBreaker short-circuits calls to a provider after repeated failures.
+// Once the cooldown passes it half-opens, letting one trial call through: a
+// success closes it again and a failure reopens it for another cooldown.
+type circuitBreaker struct {
+	mu           sync.Mutex
+	threshold    int
+	window       time.Duration
+	cooldown     time.Duration
+	failures     int
+	firstFailure time.Time
+	openUntil    time.Time
+	trial        bool
+	now          func() time.Time
+}
+
+func newCircuitBreaker(config CircuitBreakerConfig) *circuitBreaker {
+	cooldown := config.Cooldown
+	if cooldown <= 0 {
+		cooldown = defaultBreakerCooldown
+	}
+	return &circuitBreaker{
+		threshold: config.Threshold,
+		window:    config.Window,
+		cooldown:  cooldown,
+		now:       time.Now,
+	}
+}
+
+// Call runs fn unless the breaker is open, recording the outcome
+func (b *circuitBreaker) Call(fn func() ([]string, error)) ([]string, error) {
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+	keys, err := fn()
+	b.record(err)
+	return keys, err
+}
+
+func (b *circuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.openUntil.IsZero() {
+		return nil
+	}
+	if b.now().Before(b.openUntil) || b.trial {
+		return ErrCircuitOpen
+	}
+	// half-open: let a single trial call through
+	b.trial = true
+	return nil
+}
+
+func (b *circuitBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	if err == nil {
+		b.failures = 0
+		b.openUntil = time.Time{}
+		b.trial = false
+		return
+	}
+
+	if b.trial {
+		b.trial = false
+		b.openUntil = now.Add(b.cooldown)
+		return
+	}
+
+	if b.failures == 0 || (b.window > 0 && now.Sub(b.firstFailure) > b.window) {
+		b.failures = 0
+		b.firstFailure = now
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = now.Add(b.cooldown)
+	}
+}
@@ -0,0 +1,97 @@
+package portunus
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	errDown := errors.New("down")
+
+	// step is one call: advance the clock, then call a provider that fails
+	// when fail is set
+	type step struct {
+		advance    time.Duration
+		fail       bool
+		wantCalled bool
+		wantErr    error
+	}
+	tests := []struct {
+		name   string
+		config CircuitBreakerConfig
+		steps  []step
+	}{
+		{
+			name:   "opens after the threshold and fails fast",
+			config: CircuitBreakerConfig{Threshold: 2, Cooldown: time.Minute},
+			steps: []step{
+				{fail: true, wantCalled: true, wantErr: errDown},
+				{fail: true, wantCalled: true, wantErr: errDown},
+				{wantErr: ErrCircuitOpen},
+				{advance: 59 * time.Second, wantErr: ErrCircuitOpen},
+			},
+		},
+		{
+			name:   "half-opens after the cooldown and recovers",
+			config: CircuitBreakerConfig{Threshold: 1, Cooldown: time.Minute},
+			steps: []step{
+				{fail: true, wantCalled: true, wantErr: errDown},
+				{wantErr: ErrCircuitOpen},
+				{advance: time.Minute, wantCalled: true},
+				{wantCalled: true},
+			},
+		},
+		{
+			name:   "failed trial reopens for another cooldown",
+			config: CircuitBreakerConfig{Threshold: 1, Cooldown: time.Minute},
+			steps: []step{
+				{fail: true, wantCalled: true, wantErr: errDown},
+				{advance: time.Minute, fail: true, wantCalled: true, wantErr: errDown},
+				{advance: 30 * time.Second, wantErr: ErrCircuitOpen},
+				{advance: 30 * time.Second, wantCalled: true},
+			},
+		},
+		{
+			name:   "a success resets the count",
+			config: CircuitBreakerConfig{Threshold: 2},
+			steps: []step{
+				{fail: true, wantCalled: true, wantErr: errDown},
+				{wantCalled: true},
+				{fail: true, wantCalled: true, wantErr: errDown},
+				{wantCalled: true},
+			},
+		},
+		{
+			name:   "failures outside the window don't add up",
+			config: CircuitBreakerConfig{Threshold: 2, Window: time.Minute},
+			steps: []step{
+				{fail: true, wantCalled: true, wantErr: errDown},
+				{advance: 2 * time.Minute, fail: true, wantCalled: true, wantErr: errDown},
+				{wantCalled: true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+			b := newCircuitBreaker(tt.config)
+			b.now = func() time.Time { return now }
+
+			for i, s := range tt.steps {
+				now = now.Add(s.advance)
+				called := false
+				_, err := b.Call(func() ([]string, error) {
+					called = true
+					if s.fail {
+						return nil, errDown
+					}
+					return nil, nil
+				})
+				if called != s.wantCalled || !errors.Is(err, s.wantErr) || (s.wantErr == nil && err != nil) {
+					t.Errorf("step %d: called %v, error %v, want called %v, error %v", i, called, err, s.wantCalled, s.wantErr)
+				}
+			}
+		})
+	}
+}
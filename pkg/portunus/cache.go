@@ -0,0 +1,235 @@
+package portunus
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"math/rand/v2"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// KeyCache is an in-memory cache of the keys fetched from each provider
+type KeyCache struct {
+	mu            sync.RWMutex
+	items         map[string]cacheItem
+	maxSize       int
+	refreshWindow time.Duration
+	jitter        time.Duration
+
+	hits, misses, evictions atomic.Int64
+}
+
+type cacheItem struct {
+	keys      []string
+	timestamp time.Time
+	// expires is zero when entries don't expire
+	expires time.Time
+}
+
+func NewKeyCache(config CacheConfig) *KeyCache {
+	return &KeyCache{
+		items:         make(map[string]cacheItem),
+		maxSize:       config.MaxSize,
+		refreshWindow: config.RefreshWindow,
+		jitter:        config.Jitter,
+	}
+}
+
+// Get returns the cached keys for key if present and not expired. refresh
+// reports whether the entry is within the refresh window of expiring.
+func (c *KeyCache) Get(key string) (keys []string, refresh bool, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	item, ok := c.items[key]
+	if !ok {
+		c.misses.Add(1)
+		return nil, false, false
+	}
+	if item.expires.IsZero() {
+		c.hits.Add(1)
+		return slices.Clone(item.keys), false, true
+	}
+	remaining := time.Until(item.expires)
+	if remaining < 0 {
+		c.misses.Add(1)
+		return nil, false, false
+	}
+	c.hits.Add(1)
+	refresh = c.refreshWindow > 0 && remaining < c.refreshWindow
+	return slices.Clone(item.keys), refresh, true
+}
+
+// Set stores keys under key for ttl, evicting the oldest entry if the cache
+// is full. A zero ttl never expires.
+func (c *KeyCache) Set(key string, keys []string, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.items[key]; !ok && c.maxSize > 0 && len(c.items) >= c.maxSize {
+		c.evictOldest()
+	}
+	now := time.Now()
+	c.items[key] = cacheItem{
+		keys:      slices.Clone(keys),
+		timestamp: now,
+		expires:   c.expiry(now, ttl),
+	}
+}
+
+// expiry returns when an entry stored at now for ttl expires. A random jitter
+// is added to the TTL so entries stored together don't all expire together.
+func (c *KeyCache) expiry(now time.Time, ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	if c.jitter > 0 {
+		ttl += rand.N(c.jitter)
+	}
+	return now.Add(ttl)
+}
+
+// DeleteUser removes every entry for username, whatever source or lookup
+// mode it was stored under, and reports how many were removed
+func (c *KeyCache) DeleteUser(username string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	removed := 0
+	prefix := username + "/"
+	for key := range c.items {
+		if strings.HasPrefix(key, prefix) {
+			delete(c.items, key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// evictOldest removes the least recently stored entry. Callers must hold c.mu.
+func (c *KeyCache) evictOldest() {
+	var oldestKey string
+	var oldest time.Time
+	for k, item := range c.items {
+		if oldestKey == "" || item.timestamp.Before(oldest) {
+			oldestKey, oldest = k, item.timestamp
+		}
+	}
+	delete(c.items, oldestKey)
+	c.evictions.Add(1)
+}
+
+// CacheStats is a snapshot of the cache's size, counters and entries
+type CacheStats struct {
+	Size      int               `json:"size"`
+	MaxSize   int               `json:"max_size"`
+	Hits      int64             `json:"hits"`
+	Misses    int64             `json:"misses"`
+	Evictions int64             `json:"evictions"`
+	Entries   []CacheEntryStats `json:"entries"`
+}
+
+// CacheEntryStats describes one cache entry. TTL is the time left before it
+// expires, and zero for entries that never expire.
+type CacheEntryStats struct {
+	Key string        `json:"key"`
+	Age time.Duration `json:"age"`
+	TTL time.Duration `json:"ttl"`
+}
+
+// Stats returns the cache's current size, hit/miss/eviction counts and the
+// age and remaining TTL of every entry, sorted by key
+func (c *KeyCache) Stats() CacheStats {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	now := time.Now()
+	stats := CacheStats{
+		Size:      len(c.items),
+		MaxSize:   c.maxSize,
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+		Entries:   make([]CacheEntryStats, 0, len(c.items)),
+	}
+	for key, item := range c.items {
+		entry := CacheEntryStats{Key: key, Age: now.Sub(item.timestamp)}
+		if !item.expires.IsZero() {
+			entry.TTL = max(item.expires.Sub(now), 0)
+		}
+		stats.Entries = append(stats.Entries, entry)
+	}
+	sort.Slice(stats.Entries, func(i, j int) bool { return stats.Entries[i].Key < stats.Entries[j].Key })
+	return stats
+}
+
+// copyBlocks deep copies blocks so callers sharing a result can't mutate each other's
+func copyBlocks(blocks []KeyBlock) []KeyBlock {
+	result := make([]KeyBlock, len(blocks))
+	for i, b := range blocks {
+		b.Keys = append([]string(nil), b.Keys...)
+		result[i] = b
+	}
+	return result
+}
+
+// fetchKey identifies the cache entry for the keys one source returned for
+// one of a login's upstream identities. It starts with the login so
+// DeleteUser can find every entry for it.
+func fetchKey(username, source, upstream string, byEmail bool) string {
+	key := username + "/" + source + "/" + upstream
+	if byEmail {
+		key += "?by=email"
+	}
+	return key
+}
+
+// mappingDigest hashes a login's mapping with the config of source, so a
+// cache entry made before either was edited is missed rather than served
+// until it expires
+func (km *KeyManager) mappingDigest(source string, mapping UserMapping) string {
+	// UserMapping only holds strings, slices and maps, so Marshal can't fail
+	data, _ := json.Marshal(mapping)
+	sum := sha256.New()
+	sum.Write(data)
+	sum.Write([]byte{0})
+	sum.Write(km.providerConfigs[source])
+	return hex.EncodeToString(sum.Sum(nil)[:8])
+}
+
+// providerConfigSections returns the config section of each provider by
+// source name: the builtin providers' own sections, and the plugins' and
+// registered providers' entries
+func providerConfigSections(config Config) map[string]json.RawMessage {
+	data, _ := json.Marshal(config)
+	var all map[string]json.RawMessage
+	json.Unmarshal(data, &all)
+
+	sections := make(map[string]json.RawMessage, len(providerNames)+len(config.Plugins)+len(config.Providers))
+	for name := range providerNames {
+		sections[name] = all[name]
+	}
+	for name, plugin := range config.Plugins {
+		sections[name], _ = json.Marshal(plugin)
+	}
+	for name, raw := range config.Providers {
+		sections[name] = raw
+	}
+	return sections
+}
+
+// processedDigest hashes the settings that shape processed cache entries, so
+// entries made under other transforms or comment_template are not served
+func processedDigest(config Config) string {
+	data, _ := json.Marshal(struct {
+		Transforms      []TransformRule
+		CommentTemplate string
+	}{config.Transforms, config.CommentTemplate})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
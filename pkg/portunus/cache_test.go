@@ -0,0 +1,516 @@
+package portunus
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestCacheFollowsMappingChanges(t *testing.T) {
+	tests := []struct {
+		name      string
+		before    UserMapping
+		after     UserMapping
+		wantCalls int
+	}{
+		{
+			name:      "unchanged mapping hits",
+			before:    UserMapping{GitHub: Usernames{"octocat"}},
+			after:     UserMapping{GitHub: Usernames{"octocat"}},
+			wantCalls: 1,
+		},
+		{
+			name:      "changed upstream misses",
+			before:    UserMapping{GitHub: Usernames{"octocat"}},
+			after:     UserMapping{GitHub: Usernames{"hubot"}},
+			wantCalls: 2,
+		},
+		{
+			name:      "added upstream misses",
+			before:    UserMapping{GitHub: Usernames{"octocat"}},
+			after:     UserMapping{GitHub: Usernames{"octocat", "hubot"}},
+			wantCalls: 3,
+		},
+		{
+			name:      "edit to another source misses",
+			before:    UserMapping{GitHub: Usernames{"octocat"}},
+			after:     UserMapping{GitHub: Usernames{"octocat"}, GitLab: Usernames{"tanuki"}},
+			wantCalls: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := &fakeProvider{keys: map[string][]string{
+				"octocat": {testKey(t, 1, "octocat")},
+				"hubot":   {testKey(t, 2, "hubot")},
+			}}
+			km := newTestKeyManager(t, Config{
+				Mappings: map[string]UserMapping{"alice": tt.before},
+				Cache:    CacheConfig{Enabled: true, TTL: time.Hour},
+			}, WithProvider("github", provider))
+			resolveLines(t, km, "alice")
+
+			km.mappingsMu.Lock()
+			km.config.Mappings = map[string]UserMapping{"alice": tt.after}
+			km.mappingsMu.Unlock()
+			resolveLines(t, km, "alice")
+
+			if got := provider.Calls(); got != tt.wantCalls {
+				t.Errorf("provider called %d times, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestCacheServesNewKeysAfterMappingEdit(t *testing.T) {
+	old, rotated := testKey(t, 1, "old"), testKey(t, 2, "rotated")
+	provider := &fakeProvider{keys: map[string][]string{"octocat": {old}}}
+	km := newTestKeyManager(t, Config{
+		Mappings: map[string]UserMapping{"alice": {GitHub: Usernames{"octocat"}}},
+		Cache:    CacheConfig{Enabled: true, TTL: time.Hour},
+	}, WithProvider("github", provider))
+	resolveLines(t, km, "alice")
+
+	provider.mu.Lock()
+	provider.keys = map[string][]string{"octocat": {rotated}}
+	provider.mu.Unlock()
+	km.mappingsMu.Lock()
+	km.config.Mappings = map[string]UserMapping{"alice": {GitHub: Usernames{"octocat"}, Priority: []string{"github"}}}
+	km.mappingsMu.Unlock()
+
+	if got := stripHeaders(resolveLines(t, km, "alice")); !slices.Equal(got, []string{rotated}) {
+		t.Errorf("got %q, want the rotated key straight after the edit", got)
+	}
+}
+
+func TestMappingDigest(t *testing.T) {
+	mapping := UserMapping{GitHub: Usernames{"octocat"}}
+	base := Config{GitHub: GitHubConfig{URL: "https://github.example.com"}}
+	digest := func(config Config, source string, mapping UserMapping) string {
+		km := &KeyManager{providerConfigs: providerConfigSections(config)}
+		return km.mappingDigest(source, mapping)
+	}
+	want := digest(base, "github", mapping)
+
+	tests := []struct {
+		name    string
+		config  Config
+		mapping UserMapping
+		same    bool
+	}{
+		{name: "same mapping and config", config: base, mapping: mapping, same: true},
+		{name: "another source's config", config: Config{GitHub: base.GitHub, GitLab: GitLabConfig{URL: "https://gitlab.example.com"}}, mapping: mapping, same: true},
+		{name: "edited mapping", config: base, mapping: UserMapping{GitHub: Usernames{"octocat"}, Derive: []string{"gitlab"}}},
+		{name: "edited provider config", config: Config{GitHub: GitHubConfig{URL: "https://mirror.example.com"}}, mapping: mapping},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := digest(tt.config, "github", tt.mapping); (got == want) != tt.same {
+				t.Errorf("got digest %s against %s, want same %v", got, want, tt.same)
+			}
+		})
+	}
+}
+
+func TestCacheServesStaleWhileRefreshing(t *testing.T) {
+	key := testKey(t, 1, "octocat")
+	provider := &gatedProvider{keys: []string{key}, free: 1, release: make(chan struct{})}
+	// every hit is within the refresh window
+	km := newTestKeyManager(t, Config{
+		Mappings: map[string]UserMapping{"alice": {GitHub: Usernames{"octocat"}}},
+		Cache:    CacheConfig{Enabled: true, TTL: time.Hour, RefreshWindow: 2 * time.Hour},
+	}, WithProvider("github", provider))
+	resolveLines(t, km, "alice")
+
+	// the refreshes block, yet every lookup is served from the cache
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, err := km.Resolve(context.Background(), "alice")
+			if got := flattenBlocks(result.Blocks); err != nil || !slices.Contains(got, key) {
+				t.Errorf("got %q, %v, want the cached key", got, err)
+			}
+		}()
+	}
+	wg.Wait()
+	time.Sleep(50 * time.Millisecond)
+	if got := provider.calls.Load(); got != 2 {
+		t.Errorf("provider called %d times, want one fetch and one shared refresh", got)
+	}
+	close(provider.release)
+}
+
+func TestCacheJitter(t *testing.T) {
+	const ttl, jitter, entries = time.Hour, 10 * time.Minute, 1000
+
+	tests := []struct {
+		name       string
+		jitter     time.Duration
+		wantSpread bool
+	}{
+		{name: "no jitter", jitter: 0},
+		{name: "jitter", jitter: jitter, wantSpread: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewKeyCache(CacheConfig{Jitter: tt.jitter})
+			start := time.Now()
+			for i := range entries {
+				c.Set(fmt.Sprint(i), nil, ttl)
+			}
+			end := time.Now()
+
+			earliest, latest := end.Add(ttl+tt.jitter), start
+			for key, item := range c.items {
+				if item.expires.Before(start.Add(ttl)) || !item.expires.Before(end.Add(ttl+max(tt.jitter, time.Nanosecond))) {
+					t.Fatalf("%s expires at %v, outside the jitter window", key, item.expires)
+				}
+				earliest, latest = minTime(earliest, item.expires), maxTime(latest, item.expires)
+			}
+			// 1000 entries spread over the window leave no large gap at
+			// either end
+			if spread := latest.Sub(earliest); tt.wantSpread && spread < tt.jitter*9/10 {
+				t.Errorf("expiries spread over %v, want most of %v", spread, tt.jitter)
+			}
+		})
+	}
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+func TestInvalidate(t *testing.T) {
+	tests := []struct {
+		name            string
+		caseInsensitive bool
+		// asAlice is the case alice is looked up in, alice by default
+		asAlice    string
+		invalidate string
+		wantAlice  int
+		wantBob    int
+	}{
+		{name: "no invalidation hits", invalidate: "", wantAlice: 1, wantBob: 1},
+		{name: "invalidated login misses", invalidate: "alice", wantAlice: 2, wantBob: 1},
+		{name: "login prefix is not a match", invalidate: "ali", wantAlice: 1, wantBob: 1},
+		{name: "unmapped login changes nothing", invalidate: "carol", wantAlice: 1, wantBob: 1},
+		{name: "case-insensitive login in another case hits", caseInsensitive: true, asAlice: "Alice", wantAlice: 1, wantBob: 1},
+		{name: "case-insensitive login invalidated in another case misses", caseInsensitive: true, asAlice: "Alice", invalidate: "ALICE", wantAlice: 2, wantBob: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alice := &fakeProvider{keys: map[string][]string{"octocat": {testKey(t, 1, "octocat")}}}
+			bob := &fakeProvider{keys: map[string][]string{"hubot": {testKey(t, 2, "hubot")}}}
+			km := newTestKeyManager(t, Config{
+				Mappings: map[string]UserMapping{
+					"alice": {GitHub: Usernames{"octocat"}},
+					"bob":   {GitLab: Usernames{"hubot"}},
+				},
+				Cache:                CacheConfig{Enabled: true, TTL: time.Hour},
+				CaseInsensitiveUsers: tt.caseInsensitive,
+			}, WithProvider("github", alice), WithProvider("gitlab", bob))
+			resolveLines(t, km, cmp.Or(tt.asAlice, "alice"))
+			resolveLines(t, km, "bob")
+
+			if tt.invalidate != "" {
+				km.Invalidate(tt.invalidate)
+			}
+			resolveLines(t, km, "alice")
+			resolveLines(t, km, "bob")
+
+			if got := alice.Calls(); got != tt.wantAlice {
+				t.Errorf("alice's provider called %d times, want %d", got, tt.wantAlice)
+			}
+			if got := bob.Calls(); got != tt.wantBob {
+				t.Errorf("bob's provider called %d times, want %d", got, tt.wantBob)
+			}
+		})
+	}
+}
+
+func TestKeyCacheDeleteUser(t *testing.T) {
+	c := NewKeyCache(CacheConfig{})
+	for _, key := range []string{
+		fetchKey("alice", "github", "octocat", false),
+		fetchKey("alice", "github", "octocat@example.com", true),
+		fetchKey("alice", "gitlab", "octocat", false),
+		fetchKey("alicia", "github", "octocat", false),
+	} {
+		c.Set(key, []string{"key"}, time.Hour)
+	}
+
+	if n := c.DeleteUser("alice"); n != 3 {
+		t.Errorf("DeleteUser(alice) removed %d, want 3", n)
+	}
+	if n := c.DeleteUser("alice"); n != 0 {
+		t.Errorf("second DeleteUser(alice) removed %d, want 0", n)
+	}
+	if _, _, ok := c.Get(fetchKey("alicia", "github", "octocat", false)); !ok {
+		t.Error("alicia's entry was removed with alice's")
+	}
+}
+
+func TestCacheStats(t *testing.T) {
+	tests := []struct {
+		name string
+		// run drives the cache, which holds at most two entries
+		run  func(c *KeyCache)
+		want CacheStats
+		keys []string
+	}{
+		{
+			name: "empty",
+			run:  func(c *KeyCache) {},
+			want: CacheStats{MaxSize: 2},
+		},
+		{
+			name: "hits and misses",
+			run: func(c *KeyCache) {
+				c.Get("a")
+				c.Set("a", []string{"key"}, time.Hour)
+				c.Get("a")
+				c.Get("a")
+			},
+			want: CacheStats{Size: 1, MaxSize: 2, Hits: 2, Misses: 1},
+			keys: []string{"a"},
+		},
+		{
+			name: "expired entries miss",
+			run: func(c *KeyCache) {
+				c.Set("a", []string{"key"}, time.Nanosecond)
+				time.Sleep(time.Millisecond)
+				c.Get("a")
+			},
+			want: CacheStats{Size: 1, MaxSize: 2, Misses: 1},
+			keys: []string{"a"},
+		},
+		{
+			name: "evictions",
+			run: func(c *KeyCache) {
+				c.Set("a", nil, time.Hour)
+				c.Set("b", nil, time.Hour)
+				c.Set("b", nil, time.Hour)
+				c.Set("c", nil, time.Hour)
+			},
+			want: CacheStats{Size: 2, MaxSize: 2, Evictions: 1},
+			keys: []string{"b", "c"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewKeyCache(CacheConfig{MaxSize: 2})
+			tt.run(c)
+
+			got := c.Stats()
+			var keys []string
+			for _, entry := range got.Entries {
+				keys = append(keys, entry.Key)
+				if entry.Age < 0 || entry.TTL > time.Hour {
+					t.Errorf("entry %s has age %v and ttl %v", entry.Key, entry.Age, entry.TTL)
+				}
+			}
+			got.Entries = nil
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("stats = %+v, want %+v", got, tt.want)
+			}
+			if !slices.Equal(keys, tt.keys) {
+				t.Errorf("entries = %q, want %q", keys, tt.keys)
+			}
+		})
+	}
+}
+
+func TestPerProviderCache(t *testing.T) {
+	tests := []struct {
+		name       string
+		cache      CacheConfig
+		wantGitHub int
+		wantGitLab int
+	}{
+		{
+			name:       "shared ttl",
+			cache:      CacheConfig{Enabled: true, TTL: time.Hour},
+			wantGitHub: 1, wantGitLab: 1,
+		},
+		{
+			name: "github entries expire on their own",
+			cache: CacheConfig{Enabled: true, TTL: time.Hour, Providers: map[string]ProviderCacheConfig{
+				"github": {Enabled: true, TTL: 20 * time.Millisecond},
+			}},
+			wantGitHub: 2, wantGitLab: 1,
+		},
+		{
+			name: "github caching off",
+			cache: CacheConfig{Enabled: true, TTL: time.Hour, Providers: map[string]ProviderCacheConfig{
+				"github": {Enabled: false},
+			}},
+			wantGitHub: 2, wantGitLab: 1,
+		},
+		{
+			name: "only gitlab cached",
+			cache: CacheConfig{TTL: time.Hour, Providers: map[string]ProviderCacheConfig{
+				"gitlab": {Enabled: true},
+			}},
+			wantGitHub: 2, wantGitLab: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			github := &fakeProvider{keys: map[string][]string{"octocat": {testKey(t, 1, "hub")}}}
+			gitlab := &fakeProvider{keys: map[string][]string{"octocat": {testKey(t, 2, "lab")}}}
+			km := newTestKeyManager(t, Config{
+				Mappings: map[string]UserMapping{"alice": {GitHub: Usernames{"octocat"}, GitLab: Usernames{"octocat"}}},
+				Cache:    tt.cache,
+			}, WithProvider("github", github), WithProvider("gitlab", gitlab))
+
+			resolveLines(t, km, "alice")
+			time.Sleep(50 * time.Millisecond)
+			resolveLines(t, km, "alice")
+
+			if github.Calls() != tt.wantGitHub || gitlab.Calls() != tt.wantGitLab {
+				t.Errorf("github called %d times and gitlab %d, want %d and %d",
+					github.Calls(), gitlab.Calls(), tt.wantGitHub, tt.wantGitLab)
+			}
+		})
+	}
+}
+
+func TestProcessedCache(t *testing.T) {
+	work, personal := testKey(t, 1, "alice@corp"), testKey(t, 2, "alice@home")
+	lab := testKey(t, 3, "alice@lab")
+
+	tests := []struct {
+		name   string
+		config Config
+	}{
+		{name: "no processing"},
+		{
+			name: "transforms",
+			config: Config{Transforms: []TransformRule{
+				{ReplaceComment: &CommentReplacement{Pattern: `@corp$`, Replacement: "@example.com"}},
+				{DropIfComment: `@home$`},
+				{AddOption: "no-agent-forwarding"},
+			}},
+		},
+		{name: "comment template", config: Config{CommentTemplate: "{login} via {source}/{upstream}"}},
+		{name: "sorted and deduplicated", config: Config{SortKeys: true, Dedup: true}},
+		{
+			name: "everything",
+			config: Config{
+				Transforms:      []TransformRule{{Sources: []string{"gitlab"}, AddOption: "no-pty"}},
+				CommentTemplate: "{login}@{source}",
+				SortKeys:        true,
+				Dedup:           true,
+				HeaderTemplate:  "# {source} {upstream}",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			captureLog(t)
+			newKM := func(cache CacheConfig) (*KeyManager, *fakeProvider) {
+				github := &fakeProvider{keys: map[string][]string{"octocat": {work, personal, work}}}
+				gitlab := &fakeProvider{keys: map[string][]string{"tanuki": {lab, work}}}
+				config := tt.config
+				config.Mappings = map[string]UserMapping{"alice": {GitHub: Usernames{"octocat"}, GitLab: Usernames{"tanuki"}}}
+				config.Cache = cache
+				return newTestKeyManager(t, config, WithProvider("github", github), WithProvider("gitlab", gitlab)), github
+			}
+			fresh, _ := newKM(CacheConfig{})
+			want := resolveLines(t, fresh, "alice")
+
+			for _, processed := range []bool{false, true} {
+				km, github := newKM(CacheConfig{Enabled: true, TTL: time.Hour, Processed: processed})
+				for i := range 3 {
+					if got := resolveLines(t, km, "alice"); !slices.Equal(got, want) {
+						t.Errorf("processed %v, lookup %d: got %q, want %q", processed, i, got, want)
+					}
+				}
+				if calls := github.Calls(); calls != 1 {
+					t.Errorf("processed %v: got %d fetches, want the later lookups cached", processed, calls)
+				}
+			}
+		})
+	}
+}
+
+func TestProcessedCacheFollowsSettings(t *testing.T) {
+	key := testKey(t, 1, "alice@corp")
+	mr := miniredis.RunT(t)
+	github := &fakeProvider{keys: map[string][]string{"octocat": {key}}}
+	newKM := func(template string) *KeyManager {
+		return newTestKeyManager(t, Config{
+			Mappings:        map[string]UserMapping{"alice": {GitHub: Usernames{"octocat"}}},
+			CommentTemplate: template,
+			Cache: CacheConfig{
+				Enabled:   true,
+				TTL:       time.Hour,
+				Processed: true,
+				Redis:     &RedisConfig{Address: mr.Addr()},
+			},
+		}, WithProvider("github", github))
+	}
+
+	// replicas sharing the cache with other settings don't serve each
+	// other's processed keys
+	for i, template := range []string{"{login}", "{source}", "{login}"} {
+		got := stripHeaders(resolveLines(t, newKM(template), "alice"))
+		want := testKey(t, 1, strings.NewReplacer("{login}", "alice", "{source}", "github").Replace(template))
+		if !slices.Equal(got, []string{want}) {
+			t.Errorf("lookup %d with %q: got %q, want %q", i, template, got, want)
+		}
+	}
+	if calls := github.Calls(); calls != 2 {
+		t.Errorf("got %d fetches, want one for each set of settings", calls)
+	}
+}
+
+// BenchmarkCacheHit compares cache hits on entries cached as fetched, which
+// are parsed and processed again on every hit, with processed entries
+func BenchmarkCacheHit(b *testing.B) {
+	keys := make([]string, 50)
+	for i := range keys {
+		keys[i] = testKey(b, i+1, fmt.Sprintf("alice@host%d", i))
+	}
+	for _, processed := range []bool{false, true} {
+		b.Run(fmt.Sprintf("processed=%v", processed), func(b *testing.B) {
+			km := newTestKeyManager(b, Config{
+				Mappings: map[string]UserMapping{"alice": {GitHub: Usernames{"octocat"}}},
+				Transforms: []TransformRule{
+					{ReplaceComment: &CommentReplacement{Pattern: `@host(\d+)$`, Replacement: "@example.com"}},
+					{AddOption: "no-agent-forwarding"},
+				},
+				CommentTemplate: "{login} via {source}",
+				Cache:           CacheConfig{Enabled: true, TTL: time.Hour, Processed: processed},
+			}, WithProvider("github", &fakeProvider{keys: map[string][]string{"octocat": keys}}))
+			resolveLines(b, km, "alice")
+
+			b.ResetTimer()
+			for range b.N {
+				if _, err := km.Resolve(context.Background(), "alice"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package portunus
+
+import (
+	"encoding/json"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ProviderInfo describes a key source available in this build, for tools
+// that generate or validate configs
+type ProviderInfo struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+
+	// ConfigKey is where the provider's settings go in the config, empty
+	// for sources with none
+	ConfigKey string `json:"config_key,omitempty"`
+
+	// MappingFields are the mapping fields that look keys up with it
+	MappingFields []string `json:"mapping_fields"`
+
+	// Fields are the provider's settings. They are unknown for registered
+	// providers, whose config is passed to them as raw JSON.
+	Fields []FieldInfo `json:"fields,omitempty"`
+
+	Registered bool `json:"registered,omitempty"`
+}
+
+// FieldInfo describes one config setting
+type FieldInfo struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Required bool   `json:"required,omitempty"`
+}
+
+// requiredFields are the settings a built-in provider is not built without
+var requiredFields = map[string][]string{
+	"ldap":        {"url", "base_dn"},
+	"azuredevops": {"organization"},
+	"exec":        {"command"},
+	"dns":         {"name"},
+}
+
+// groupFields are the mapping fields that serve a provider's group members,
+// see UserMapping.Groups
+var groupFields = map[string]string{
+	"github": "github_teams",
+	"gitlab": "gitlab_groups",
+}
+
+// Providers describes static keys, every built-in provider and every
+// registered provider, in the default emission order
+func Providers() []ProviderInfo {
+	infos := []ProviderInfo{{Name: "static", DisplayName: "Static", MappingFields: []string{"static_keys"}}}
+
+	configType := reflect.TypeOf(Config{})
+	for _, name := range providerOrder {
+		info := ProviderInfo{Name: name, DisplayName: providerName(name), ConfigKey: name, MappingFields: []string{name}}
+		if group, ok := groupFields[name]; ok {
+			info.MappingFields = append(info.MappingFields, group)
+		}
+		for i := range configType.NumField() {
+			if f := configType.Field(i); jsonName(f) == name {
+				info.Fields = configFields(f.Type, requiredFields[name])
+			}
+		}
+		infos = append(infos, info)
+	}
+
+	registryMu.RLock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	registryMu.RUnlock()
+	sort.Strings(names)
+	for _, name := range names {
+		infos = append(infos, ProviderInfo{
+			Name:          name,
+			DisplayName:   name,
+			ConfigKey:     "providers." + name,
+			MappingFields: []string{"providers." + name},
+			Registered:    true,
+		})
+	}
+	return infos
+}
+
+// configFields lists the JSON settings of a config struct, including those of
+// embedded structs such as HTTPConfig
+func configFields(t reflect.Type, required []string) []FieldInfo {
+	var fields []FieldInfo
+	for i := range t.NumField() {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			fields = append(fields, configFields(f.Type, required)...)
+			continue
+		}
+		name := jsonName(f)
+		if name == "" {
+			continue
+		}
+		fields = append(fields, FieldInfo{Name: name, Type: jsonType(f.Type), Required: slices.Contains(required, name)})
+	}
+	return fields
+}
+
+// jsonName returns the JSON name of a struct field, or an empty string for
+// fields left out of JSON
+func jsonName(f reflect.StructField) string {
+	name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+	switch name {
+	case "-":
+		return ""
+	case "":
+		return f.Name
+	}
+	return name
+}
+
+var (
+	durationType   = reflect.TypeOf(time.Duration(0))
+	rawMessageType = reflect.TypeOf(json.RawMessage(nil))
+)
+
+// jsonType names the JSON type a setting takes
+func jsonType(t reflect.Type) string {
+	switch t {
+	case durationType:
+		return "integer (nanoseconds)"
+	case rawMessageType:
+		return "any"
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return jsonType(t.Elem())
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice, reflect.Array:
+		return "list of " + jsonType(t.Elem())
+	}
+	return "object"
+}
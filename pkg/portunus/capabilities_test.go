@@ -0,0 +1,126 @@
+package portunus
+
+import (
+	"encoding/json"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestProviders(t *testing.T) {
+	infos := make(map[string]ProviderInfo)
+	var names []string
+	for _, info := range Providers() {
+		infos[info.Name] = info
+		names = append(names, info.Name)
+	}
+	if want := append(append([]string{"static"}, providerOrder...), "testvault"); !slices.Equal(names, want) {
+		t.Errorf("got providers %q, want %q", names, want)
+	}
+
+	tests := []struct {
+		name          string
+		configKey     string
+		mappingFields []string
+		fields        []FieldInfo
+		registered    bool
+	}{
+		{name: "static", mappingFields: []string{"static_keys"}},
+		{
+			name:          "github",
+			configKey:     "github",
+			mappingFields: []string{"github", "github_teams"},
+			fields: []FieldInfo{
+				{Name: "token", Type: "string"},
+				{Name: "mirrors", Type: "list of string"},
+				{Name: "membership_ttl", Type: "integer (nanoseconds)"},
+				{Name: "allow_private_networks", Type: "boolean"},
+				{Name: "headers", Type: "object"},
+			},
+		},
+		{
+			name:          "gitlab",
+			configKey:     "gitlab",
+			mappingFields: []string{"gitlab", "gitlab_groups"},
+			fields:        []FieldInfo{{Name: "url", Type: "string"}, {Name: "use_api", Type: "boolean"}},
+		},
+		{
+			name:          "ldap",
+			configKey:     "ldap",
+			mappingFields: []string{"ldap"},
+			fields: []FieldInfo{
+				{Name: "url", Type: "string", Required: true},
+				{Name: "base_dn", Type: "string", Required: true},
+				{Name: "key_attributes", Type: "list of string"},
+				{Name: "split_values", Type: "boolean"},
+				{Name: "page_size", Type: "integer"},
+				{Name: "bind_password_keyring", Type: "object"},
+			},
+		},
+		{name: "azuredevops", configKey: "azuredevops", mappingFields: []string{"azuredevops"}, fields: []FieldInfo{{Name: "organization", Type: "string", Required: true}}},
+		{name: "exec", configKey: "exec", mappingFields: []string{"exec"}, fields: []FieldInfo{{Name: "command", Type: "string", Required: true}}},
+		{name: "dns", configKey: "dns", mappingFields: []string{"dns"}, fields: []FieldInfo{{Name: "name", Type: "string", Required: true}}},
+		{name: "testvault", configKey: "providers.testvault", mappingFields: []string{"providers.testvault"}, registered: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info := infos[tt.name]
+			if info.ConfigKey != tt.configKey || !slices.Equal(info.MappingFields, tt.mappingFields) || info.Registered != tt.registered {
+				t.Errorf("got %+v, want config key %q, mapping fields %q, registered %v", info, tt.configKey, tt.mappingFields, tt.registered)
+			}
+			for _, want := range tt.fields {
+				if !slices.Contains(info.Fields, want) {
+					t.Errorf("fields %+v don't include %+v", info.Fields, want)
+				}
+			}
+			if tt.registered && len(info.Fields) > 0 {
+				t.Errorf("registered provider lists fields %+v, want none", info.Fields)
+			}
+		})
+	}
+}
+
+func TestProvidersMatchTheConfig(t *testing.T) {
+	mappingFields := make(map[string]bool)
+	mappingType := reflect.TypeOf(UserMapping{})
+	for i := range mappingType.NumField() {
+		mappingFields[jsonName(mappingType.Field(i))] = true
+	}
+
+	for _, info := range Providers() {
+		for _, field := range info.MappingFields {
+			// registered providers are keyed by name under the providers field
+			field, _, _ = strings.Cut(field, ".")
+			if !mappingFields[field] {
+				t.Errorf("%s: mapping field %q isn't in UserMapping", info.Name, field)
+			}
+		}
+		var listed []string
+		for _, f := range info.Fields {
+			listed = append(listed, f.Name)
+		}
+		for _, field := range requiredFields[info.Name] {
+			if !slices.Contains(listed, field) {
+				t.Errorf("%s: required field %q isn't a setting", info.Name, field)
+			}
+		}
+	}
+}
+
+func TestProvidersJSON(t *testing.T) {
+	data, err := json.Marshal(Providers()[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded []map[string]any
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := decoded[0]["config_key"]; ok {
+		t.Errorf("static entry %v has a config_key, want it left out", decoded[0])
+	}
+	if decoded[1]["name"] != "github" || decoded[1]["display_name"] != "GitHub" || decoded[1]["fields"] == nil {
+		t.Errorf("github entry %v, want its name, display name and fields", decoded[1])
+	}
+}
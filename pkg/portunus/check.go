@@ -0,0 +1,123 @@
+package portunus
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Checker is implemented by providers that can verify they are reachable and
+// their credentials work without looking any user up
+type Checker interface {
+	Check() error
+}
+
+// ErrNoCheck is the CheckResult error for providers without a Checker
+var ErrNoCheck = errors.New("no check available")
+
+// CheckResult is the outcome of checking one configured provider
+type CheckResult struct {
+	Provider string
+	Err      error
+	Elapsed  time.Duration
+}
+
+// Check runs the Checker of every provider some mapping uses concurrently,
+// giving each up to timeout, and returns the results in emission order.
+// Providers without a Checker report ErrNoCheck.
+func (km *KeyManager) Check(timeout time.Duration) []CheckResult {
+	var custom []string
+	for name := range km.providers {
+		if !slices.Contains(providerOrder, name) {
+			custom = append(custom, name)
+		}
+	}
+	sort.Strings(custom)
+	var order []string
+	for _, name := range append(slices.Clone(providerOrder), custom...) {
+		if _, ok := km.providers[name]; ok && km.providerUsed(name) {
+			order = append(order, name)
+		}
+	}
+
+	results := make([]CheckResult, len(order))
+	var wg sync.WaitGroup
+	for i, name := range order {
+		results[i].Provider = name
+		c, ok := km.providers[name].(Checker)
+		if !ok {
+			results[i].Err = ErrNoCheck
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			results[i].Err = checkWithTimeout(c, timeout)
+			results[i].Elapsed = time.Since(start)
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// providerUsed reports whether any mapping looks keys up with the provider
+func (km *KeyManager) providerUsed(name string) bool {
+	for _, mapping := range km.currentMappings() {
+		if len(mapping.Upstreams(name))+len(mapping.Groups(name)) > 0 || slices.Contains(mapping.Derive, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrNothingResolvable is returned under WithStrictConfig when no mapping uses
+// static keys or a provider that is configured, so every lookup would come
+// back empty
+var ErrNothingResolvable = errors.New("no mapping can resolve keys from static keys or a configured provider")
+
+// resolvable reports whether any mapping could serve keys: it has static
+// keys, or an upstream, group or derived name on a provider that is built
+// and enabled, and is not disabled. Whether the upstream accounts have keys
+// is not checked.
+func (km *KeyManager) resolvable() bool {
+	if km.breakGlass && len(km.config.BreakGlassKeys) > 0 {
+		return true
+	}
+	for _, mapping := range km.currentMappings() {
+		if mapping.disabled() {
+			continue
+		}
+		if len(mapping.StaticKeys) > 0 && km.sourceEnabled("static") {
+			return true
+		}
+		for _, name := range km.sources(mapping) {
+			if _, ok := km.providers[name]; !ok || !km.sourceEnabled(name) || (km.offline && !localSources[name]) {
+				continue
+			}
+			if len(mapping.Upstreams(name))+len(mapping.Groups(name)) > 0 || slices.Contains(mapping.Derive, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkWithTimeout runs c.Check, giving up after timeout. A check that times
+// out is left to finish in the background.
+func checkWithTimeout(c Checker, timeout time.Duration) error {
+	done := make(chan error, 1)
+	go func() { done <- c.Check() }()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		return fmt.Errorf("check timed out after %s", timeout)
+	}
+}
@@ -0,0 +1,218 @@
+package portunus
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// checkedProvider is a fakeProvider with a Check that fails with err after
+// waiting delay
+type checkedProvider struct {
+	fakeProvider
+	err   error
+	delay time.Duration
+}
+
+func (p *checkedProvider) Check() error {
+	time.Sleep(p.delay)
+	return p.err
+}
+
+func TestCheck(t *testing.T) {
+	down := errors.New("connection refused")
+	km := newTestKeyManager(t, Config{
+		Mappings: map[string]UserMapping{
+			"alice": {GitHub: Usernames{"octocat"}, GitLab: Usernames{"tanuki"}, LDAPUser: "alice"},
+			"bob":   {Exec: "bob"},
+		},
+	},
+		WithProvider("github", &checkedProvider{}),
+		WithProvider("gitlab", &checkedProvider{err: down}),
+		WithProvider("ldap", &checkedProvider{delay: time.Second}),
+		WithProvider("exec", &fakeProvider{}),
+		// dns is configured but no mapping uses it, so it isn't checked
+		WithProvider("dns", &checkedProvider{err: down}),
+	)
+
+	results := km.Check(50 * time.Millisecond)
+	tests := []struct {
+		provider string
+		wantErr  string
+	}{
+		{provider: "github"},
+		{provider: "gitlab", wantErr: "connection refused"},
+		{provider: "ldap", wantErr: "check timed out after 50ms"},
+		{provider: "exec", wantErr: ErrNoCheck.Error()},
+	}
+	if len(results) != len(tests) {
+		t.Fatalf("got %d results, want %d: %+v", len(results), len(tests), results)
+	}
+	for i, tt := range tests {
+		t.Run(tt.provider, func(t *testing.T) {
+			got := results[i]
+			if got.Provider != tt.provider {
+				t.Fatalf("result %d is for %s, want %s", i, got.Provider, tt.provider)
+			}
+			if (got.Err == nil) != (tt.wantErr == "") || got.Err != nil && got.Err.Error() != tt.wantErr {
+				t.Errorf("error = %v, want %q", got.Err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestProviderChecks(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodHead && r.URL.Path == "/":
+		case r.URL.Path == "/api/v3/rate_limit" && r.Header.Get("Authorization") == "token good":
+		case r.URL.Path == "/api/v4/user" && r.Header.Get("PRIVATE-TOKEN") == "good":
+		default:
+			http.Error(w, "bad credentials", http.StatusUnauthorized)
+		}
+	}))
+	defer srv.Close()
+	httpConfig := HTTPConfig{AllowPrivateNetworks: true}
+	directory := newStubLDAP(t, "secret", func(stubSearch) stubPage { return stubPage{} })
+
+	tests := []struct {
+		name    string
+		build   func() (Checker, error)
+		wantErr bool
+	}{
+		{
+			name: "github without a token",
+			build: func() (Checker, error) {
+				return NewGitHubProvider(GitHubConfig{URL: srv.URL, HTTPConfig: httpConfig})
+			},
+		},
+		{
+			name: "github with a good token",
+			build: func() (Checker, error) {
+				return NewGitHubProvider(GitHubConfig{URL: srv.URL, Token: "good", HTTPConfig: httpConfig})
+			},
+		},
+		{
+			name: "github with a bad token",
+			build: func() (Checker, error) {
+				return NewGitHubProvider(GitHubConfig{URL: srv.URL, Token: "bad", HTTPConfig: httpConfig})
+			},
+			wantErr: true,
+		},
+		{
+			name: "gitlab with a good token",
+			build: func() (Checker, error) {
+				return NewGitLabProvider(GitLabConfig{URL: srv.URL, Token: "good", HTTPConfig: httpConfig})
+			},
+		},
+		{
+			name: "gitlab with a bad token",
+			build: func() (Checker, error) {
+				return NewGitLabProvider(GitLabConfig{URL: srv.URL, Token: "bad", HTTPConfig: httpConfig})
+			},
+			wantErr: true,
+		},
+		{
+			name: "ldap with a good password",
+			build: func() (Checker, error) {
+				return NewLDAPProvider(LDAPConfig{URL: directory.URL, BindPassword: "secret", BaseDN: "dc=example,dc=com"})
+			},
+		},
+		{
+			name: "ldap with a bad password",
+			build: func() (Checker, error) {
+				return NewLDAPProvider(LDAPConfig{URL: directory.URL, BindPassword: "wrong", BaseDN: "dc=example,dc=com"})
+			},
+			wantErr: true,
+		},
+		{
+			name: "ldap server down",
+			build: func() (Checker, error) {
+				return NewLDAPProvider(LDAPConfig{URL: closedLDAPURL(t), BindPassword: "secret", BaseDN: "dc=example,dc=com"})
+			},
+			wantErr: true,
+		},
+		{
+			name:  "exec command found",
+			build: func() (Checker, error) { return NewExecProvider(ExecConfig{Command: "sh -c true"}) },
+		},
+		{
+			name: "exec command missing",
+			build: func() (Checker, error) {
+				return NewExecProvider(ExecConfig{Command: "/nonexistent/getkeys {username}"})
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := tt.build()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := checkWithTimeout(c, 5*time.Second); (err != nil) != tt.wantErr {
+				t.Errorf("error = %v, want error %v", err, tt.wantErr)
+			} else if err != nil && strings.Contains(err.Error(), "timed out") {
+				t.Errorf("error = %v, want the check to fail rather than time out", err)
+			}
+		})
+	}
+}
+
+func TestResolvable(t *testing.T) {
+	key := testKey(t, 1, "alice")
+	off := false
+	github := WithProvider("github", &fakeProvider{})
+
+	tests := []struct {
+		name     string
+		mappings map[string]UserMapping
+		glass    []string
+		opts     []Option
+		want     bool
+	}{
+		{name: "no mappings"},
+		{name: "static keys", mappings: map[string]UserMapping{"alice": {StaticKeys: []StaticKey{{Key: key}}}}, want: true},
+		{name: "configured provider", mappings: map[string]UserMapping{"alice": {GitHub: Usernames{"octocat"}}}, opts: []Option{github}, want: true},
+		{name: "group on a configured provider", mappings: map[string]UserMapping{"alice": {GitHubTeams: []string{"acme/ops"}}}, opts: []Option{github}, want: true},
+		{name: "derived upstream", mappings: map[string]UserMapping{"alice": {Derive: []string{"github"}}}, opts: []Option{github}, want: true},
+		{name: "unconfigured provider", mappings: map[string]UserMapping{"alice": {LDAPUser: "alice"}}},
+		{name: "unconfigured providers only", mappings: map[string]UserMapping{"alice": {LDAPUser: "alice", Exec: "alice"}, "bob": {DNS: "bob"}}},
+		{name: "empty mapping", mappings: map[string]UserMapping{"alice": {}}, opts: []Option{github}},
+		{name: "disabled mapping", mappings: map[string]UserMapping{"alice": {StaticKeys: []StaticKey{{Key: key}}, Enabled: &off}}},
+		{
+			name:     "provider filtered out by only sources",
+			mappings: map[string]UserMapping{"alice": {GitHub: Usernames{"octocat"}}},
+			opts:     []Option{github, WithOnlySources([]string{"static"})},
+		},
+		{name: "network provider offline", mappings: map[string]UserMapping{"alice": {GitHub: Usernames{"octocat"}}}, opts: []Option{github, WithOffline()}},
+		{name: "static keys offline", mappings: map[string]UserMapping{"alice": {StaticKeys: []StaticKey{{Key: key}}}}, opts: []Option{WithOffline()}, want: true},
+		{name: "break-glass keys in use", glass: []string{key}, opts: []Option{WithBreakGlass()}, want: true},
+		{name: "break-glass keys not in use", glass: []string{key}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := Config{Mappings: tt.mappings, BreakGlassKeys: tt.glass}
+
+			logs := captureLog(t)
+			if _, err := NewKeyManagerFromConfig(config, tt.opts...); err != nil {
+				t.Fatal(err)
+			}
+			warned := strings.Contains(logs.String(), ErrNothingResolvable.Error())
+			if warned == tt.want {
+				t.Errorf("warning logged = %v, want %v", warned, !tt.want)
+			}
+
+			_, err := NewKeyManagerFromConfig(config, append(tt.opts, WithStrictConfig())...)
+			if tt.want && err != nil {
+				t.Errorf("strict: error = %v, want none", err)
+			}
+			if !tt.want && !errors.Is(err, ErrNothingResolvable) {
+				t.Errorf("strict: error = %v, want ErrNothingResolvable", err)
+			}
+		})
+	}
+}
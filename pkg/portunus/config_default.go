@@ -0,0 +1,17 @@
+package portunus
+
+import (
+	"bytes"
+	_ "embed"
+)
+
+//go:embed default_config.json
+var embeddedConfig []byte
+
+// EmbeddedConfig returns the built-in demo config, which serves every login
+// the keys of the GitHub and GitLab accounts with the same name. Anyone able
+// to register a matching account can log in, so it is for demos only and
+// must not be used in production.
+func EmbeddedConfig() (Config, error) {
+	return decodeConfig(bytes.NewReader(embeddedConfig), true)
+}
@@ -0,0 +1,59 @@
+package portunus
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestEmbeddedConfig(t *testing.T) {
+	hubKey, labKey := testKey(t, 1, "hub"), testKey(t, 2, "lab")
+
+	tests := []struct {
+		name    string
+		login   string
+		want    []string
+		wantErr error
+	}{
+		{
+			name:  "accounts on both",
+			login: "octocat",
+			want:  []string{"# github: octocat (octocat)", hubKey, "# gitlab: octocat (octocat)", labKey},
+		},
+		{name: "account on one", login: "hubonly", want: []string{"# github: hubonly (hubonly)", hubKey}},
+		{name: "no accounts", login: "nobody", wantErr: ErrNoKeys},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := EmbeddedConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			github := &fakeProvider{keys: map[string][]string{"octocat": {hubKey}, "hubonly": {hubKey}}}
+			gitlab := &fakeProvider{keys: map[string][]string{"octocat": {labKey}}}
+			km := newTestKeyManager(t, config, WithProvider("github", github), WithProvider("gitlab", gitlab))
+
+			result, err := km.Resolve(context.Background(), tt.login)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			if got := result.Lines(); !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEmbeddedConfigIsStrict(t *testing.T) {
+	config, err := EmbeddedConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewKeyManagerFromConfig(config, WithStrictConfig()); err != nil {
+		t.Errorf("embedded config rejected under -strict: %v", err)
+	}
+	if _, ok := config.Mappings[DefaultMapping]; !ok || len(config.Mappings) != 1 {
+		t.Errorf("got mappings %v, want only the default mapping", config.Mappings)
+	}
+}
@@ -0,0 +1,182 @@
+package portunus
+
+import (
+	"cmp"
+	"encoding/json"
+	"net/url"
+	"strings"
+)
+
+// redacted replaces secret values in EffectiveConfig
+const redacted = "***"
+
+// EffectiveConfig returns the config as the manager uses it, with option
+// overrides applied, unset fields shown with their defaults and secrets
+// replaced by "***", for printing while debugging a deployment
+func (km *KeyManager) EffectiveConfig() Config {
+	km.mappingsMu.RLock()
+	config := km.config
+	km.mappingsMu.RUnlock()
+	return config.withDefaults().Redacted()
+}
+
+// withDefaults fills in the values providers fall back to for unset fields
+func (c Config) withDefaults() Config {
+	c.GitHub.URL = cmp.Or(c.GitHub.URL, defaultGitHubURL)
+	c.GitLab.URL = cmp.Or(c.GitLab.URL, defaultGitLabURL)
+	c.Keybase.URL = cmp.Or(c.Keybase.URL, defaultKeybaseURL)
+	c.AzureDevOps.URL = cmp.Or(c.AzureDevOps.URL, defaultAzureDevOpsURL)
+	c.AzureDevOps.APIVersion = cmp.Or(c.AzureDevOps.APIVersion, defaultAzureDevOpsAPIVersion)
+	c.OSLogin.URL = cmp.Or(c.OSLogin.URL, defaultOSLoginURL)
+	if c.GitHub.App != nil {
+		app := *c.GitHub.App
+		app.APIURL = cmp.Or(app.APIURL, defaultGitHubAPIURL)
+		c.GitHub.App = &app
+	}
+	if c.LDAP.URL != "" {
+		c.LDAP.EmailAttribute = cmp.Or(c.LDAP.EmailAttribute, defaultLDAPEmailAttribute)
+	}
+	if c.Exec.Command != "" && c.Exec.Timeout <= 0 {
+		c.Exec.Timeout = defaultExecTimeout
+	}
+	if len(c.Plugins) > 0 {
+		plugins := make(map[string]PluginConfig, len(c.Plugins))
+		for name, plugin := range c.Plugins {
+			if plugin.Timeout <= 0 {
+				plugin.Timeout = defaultExecTimeout
+			}
+			plugins[name] = plugin
+		}
+		c.Plugins = plugins
+	}
+	if c.Hook.Enabled && c.Hook.Timeout <= 0 {
+		c.Hook.Timeout = defaultHookTimeout
+	}
+	if c.DNS.Name != "" && c.DNS.Timeout <= 0 {
+		c.DNS.Timeout = defaultDNSTimeout
+	}
+	if c.Cache.Redis != nil {
+		redis := *c.Cache.Redis
+		redis.Prefix = cmp.Or(redis.Prefix, defaultRedisPrefix)
+		if redis.Timeout <= 0 {
+			redis.Timeout = defaultRedisTimeout
+		}
+		c.Cache.Redis = &redis
+	}
+	if c.CircuitBreaker.Threshold > 0 && c.CircuitBreaker.Cooldown <= 0 {
+		c.CircuitBreaker.Cooldown = defaultBreakerCooldown
+	}
+
+	c.UserAgent = userAgentOrDefault(c.UserAgent)
+	for _, h := range c.httpConfigs() {
+		h.UserAgent = cmp.Or(h.UserAgent, c.UserAgent)
+		if h.MaxResponseBytes <= 0 {
+			h.MaxResponseBytes = defaultMaxResponseBytes
+		}
+	}
+	return c
+}
+
+// Redacted returns a copy of c with tokens, passwords, private keys and
+// header values replaced by "***", and proxy passwords by "xxxxx". Fields of registered
+// provider configs are redacted when their name suggests a secret.
+func (c Config) Redacted() Config {
+	c.GitHub.Token = redact(c.GitHub.Token)
+	c.GitLab.Token = redact(c.GitLab.Token)
+	c.AzureDevOps.PAT = redact(c.AzureDevOps.PAT)
+	c.LDAP.BindPassword = redact(c.LDAP.BindPassword)
+	c.Hook.URL = redact(c.Hook.URL)
+	if c.MappingsSQL != nil {
+		sqlConfig := *c.MappingsSQL
+		sqlConfig.DSN = redact(sqlConfig.DSN)
+		c.MappingsSQL = &sqlConfig
+	}
+	if c.Cache.Redis != nil {
+		redis := *c.Cache.Redis
+		redis.Password = redact(redis.Password)
+		c.Cache.Redis = &redis
+	}
+	if c.GitHub.App != nil {
+		app := *c.GitHub.App
+		app.PrivateKey = redact(app.PrivateKey)
+		c.GitHub.App = &app
+	}
+
+	for _, h := range c.httpConfigs() {
+		if len(h.Headers) > 0 {
+			headers := make(map[string]string, len(h.Headers))
+			for name := range h.Headers {
+				headers[name] = redacted
+			}
+			h.Headers = headers
+		}
+		if u, err := url.Parse(h.Proxy); err == nil {
+			h.Proxy = u.Redacted()
+		}
+	}
+
+	if len(c.Plugins) > 0 {
+		plugins := make(map[string]PluginConfig, len(c.Plugins))
+		for name, plugin := range c.Plugins {
+			if len(plugin.Config) > 0 {
+				plugin.Config = redactRaw(plugin.Config)
+			}
+			plugins[name] = plugin
+		}
+		c.Plugins = plugins
+	}
+	if len(c.Providers) > 0 {
+		providers := make(map[string]json.RawMessage, len(c.Providers))
+		for name, raw := range c.Providers {
+			providers[name] = redactRaw(raw)
+		}
+		c.Providers = providers
+	}
+	return c
+}
+
+// httpConfigs returns pointers to the HTTP settings of each HTTP provider
+func (c *Config) httpConfigs() []*HTTPConfig {
+	return []*HTTPConfig{&c.GitHub.HTTPConfig, &c.GitLab.HTTPConfig, &c.Keybase.HTTPConfig, &c.AzureDevOps.HTTPConfig, &c.OSLogin.HTTPConfig}
+}
+
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return redacted
+}
+
+// secretField reports whether a config field name looks like it holds a secret
+func secretField(name string) bool {
+	name = strings.ToLower(name)
+	if name == "pat" {
+		return true
+	}
+	for _, secret := range []string{"token", "password", "secret", "private_key"} {
+		if strings.Contains(name, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactRaw redacts the top-level fields of a registered provider's config
+// whose names look like secrets, leaving configs it can't parse as objects
+// alone
+func redactRaw(raw json.RawMessage) json.RawMessage {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return raw
+	}
+	for name := range fields {
+		if secretField(name) {
+			fields[name] = json.RawMessage(`"` + redacted + `"`)
+		}
+	}
+	out, err := json.Marshal(fields)
+	if err != nil {
+		return raw
+	}
+	return out
+}
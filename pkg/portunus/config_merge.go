@@ -0,0 +1,57 @@
+package portunus
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// LoadConfigs reads each of paths as LoadConfig does and merges them in
+// order. JSON objects are merged key by key, recursively, so a later file
+// can add logins to "mappings" or change one provider setting. Any other
+// value, including a list, replaces the earlier one wholesale. When strict
+// is set, each file is checked on its own as by LoadConfig.
+func LoadConfigs(paths []string, strict bool) (Config, error) {
+	if len(paths) == 1 {
+		return LoadConfig(paths[0], strict)
+	}
+
+	var merged any
+	for _, path := range paths {
+		data, err := readConfig(path, strict)
+		if err != nil {
+			return Config{}, err
+		}
+		if _, err := decodeConfig(bytes.NewReader(data), strict); err != nil {
+			return Config{}, fmt.Errorf("%s: %w", path, err)
+		}
+
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		var layer any
+		if err := dec.Decode(&layer); err != nil {
+			return Config{}, fmt.Errorf("%s: %w", path, err)
+		}
+		merged = mergeJSON(merged, layer)
+	}
+
+	data, err := json.Marshal(merged)
+	if err != nil {
+		return Config{}, err
+	}
+	return decodeConfig(bytes.NewReader(data), false)
+}
+
+// mergeJSON overlays src on dst, merging objects recursively and otherwise
+// taking src
+func mergeJSON(dst, src any) any {
+	dstObj, ok := dst.(map[string]any)
+	srcObj, ok2 := src.(map[string]any)
+	if !ok || !ok2 {
+		return src
+	}
+	for key, value := range srcObj {
+		dstObj[key] = mergeJSON(dstObj[key], value)
+	}
+	return dstObj
+}
@@ -0,0 +1,448 @@
+package portunus
+
+import (
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStrictConfigDuplicateMappings(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr string
+	}{
+		{name: "distinct logins", config: `{"mappings": {"alice": {}, "bob": {}}}`},
+		{name: "duplicate login", config: `{"mappings": {"alice": {}, "alice": {}}}`, wantErr: "duplicate mapping for user: alice"},
+		{name: "duplicate after other fields", config: `{"sort_keys": true, "mappings": {"bob": {"github": ["b"]}, "bob": {}}}`, wantErr: "duplicate mapping for user: bob"},
+		{name: "null mappings", config: `{"mappings": null, "sort_keys": true}`},
+		{name: "no mappings", config: `{"sort_keys": true}`},
+		{name: "nested login names are not logins", config: `{"mappings": {"alice": {"providers": {"x": "a"}}, "bob": {"providers": {"x": "a"}}}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decodeConfig(strings.NewReader(tt.config), true)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr):
+				t.Errorf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadConfigSources(t *testing.T) {
+	const config = `{"mappings": {"alice": {"github": ["octocat"]}}}`
+	file := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(file, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		stdin   string
+		env     string
+		wantErr string
+	}{
+		{name: "file", path: file},
+		{name: "stdin", path: "-", stdin: config},
+		{name: "inline env", env: config},
+		{name: "no path and no env", wantErr: ConfigEnv + " is not set"},
+		{name: "invalid inline env", env: `{"mappings": `, wantErr: "unexpected EOF"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(ConfigEnv, tt.env)
+			if tt.path == "-" {
+				stdin := filepath.Join(t.TempDir(), "stdin")
+				if err := os.WriteFile(stdin, []byte(tt.stdin), 0o600); err != nil {
+					t.Fatal(err)
+				}
+				f, err := os.Open(stdin)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer f.Close()
+				saved := os.Stdin
+				os.Stdin = f
+				defer func() { os.Stdin = saved }()
+			}
+
+			got, err := LoadConfig(tt.path, false)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if upstreams := got.Mappings["alice"].GitHub; len(upstreams) != 1 || upstreams[0] != "octocat" {
+				t.Errorf("alice maps to %q, want octocat", upstreams)
+			}
+		})
+	}
+}
+
+func TestUsernamesJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		github  string
+		want    Usernames
+		wantErr bool
+	}{
+		{name: "single string", github: `"octocat"`, want: Usernames{"octocat"}},
+		{name: "list", github: `["octocat", "octobot"]`, want: Usernames{"octocat", "octobot"}},
+		{name: "empty string", github: `""`, want: nil},
+		{name: "number", github: `42`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := decodeConfig(strings.NewReader(`{"mappings": {"alice": {"github": `+tt.github+`}}}`), false)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if got := config.Mappings["alice"].GitHub; !slices.Equal(got, tt.want) {
+				t.Errorf("github = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStaticKeyJSON(t *testing.T) {
+	endOfDay := time.Date(2030, 1, 2, 23, 59, 59, int(time.Second-time.Nanosecond), time.UTC)
+
+	tests := []struct {
+		name    string
+		json    string
+		want    StaticKey
+		wantErr bool
+	}{
+		{name: "plain line", json: `"ssh-ed25519 AAAA alice"`, want: StaticKey{Key: "ssh-ed25519 AAAA alice"}},
+		{
+			name: "rfc 3339 not_after",
+			json: `{"key": "ssh-ed25519 AAAA alice", "not_after": "2030-01-02T15:04:05Z"}`,
+			want: StaticKey{Key: "ssh-ed25519 AAAA alice", NotAfter: time.Date(2030, 1, 2, 15, 4, 5, 0, time.UTC)},
+		},
+		{
+			name: "date not_after lasts the whole day",
+			json: `{"key": "ssh-ed25519 AAAA alice", "not_after": "2030-01-02"}`,
+			want: StaticKey{Key: "ssh-ed25519 AAAA alice", NotAfter: endOfDay},
+		},
+		{name: "invalid not_after", json: `{"key": "ssh-ed25519 AAAA alice", "not_after": "soon"}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got StaticKey
+			err := json.Unmarshal([]byte(tt.json), &got)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (got.Key != tt.want.Key || !got.NotAfter.Equal(tt.want.NotAfter)) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigURL(t *testing.T) {
+	const served = `{"mappings":{"alice":{"github":"octocat"}}}`
+	const cached = `{"mappings":{"alice":{"github":"cached"}}}`
+
+	tests := []struct {
+		name       string
+		status     int
+		body       string
+		cached     string
+		cachedFrom string
+		want       string
+		wantErr    bool
+		wantCached string
+	}{
+		{name: "fetched config is saved", status: http.StatusOK, body: served, want: "octocat", wantCached: served},
+		{name: "failed fetch falls back to the last good copy", status: http.StatusBadGateway, cached: cached, want: "cached", wantCached: cached},
+		{name: "failed fetch without a copy", status: http.StatusBadGateway, wantErr: true},
+		{name: "invalid config is not saved", status: http.StatusOK, body: `{"mappings": `, cached: cached, wantErr: true, wantCached: cached},
+		{
+			name:       "copy recorded from another URL is refused",
+			status:     http.StatusBadGateway,
+			cached:     cached,
+			cachedFrom: "https://other.example.com/portunus.json",
+			wantErr:    true,
+			wantCached: cached,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Authorization") != "Bearer s3cret" {
+					http.Error(w, "unauthorized", http.StatusUnauthorized)
+					return
+				}
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+			configURL := srv.URL + "/portunus.json"
+
+			t.Setenv(configCacheEnv, filepath.Join(t.TempDir(), "portunus", "config.json"))
+			t.Setenv(configTokenEnv, "s3cret")
+			t.Setenv(configAllowedHostsEnv, "127.0.0.1")
+			cachePath := configCachePath(configURL)
+			if tt.cached != "" {
+				entry, _ := json.Marshal(configCacheEntry{URL: cmp.Or(tt.cachedFrom, configURL), Config: json.RawMessage(tt.cached)})
+				os.MkdirAll(filepath.Dir(cachePath), 0o700)
+				if err := os.WriteFile(cachePath, entry, 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := LoadConfig(configURL, false)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if upstreams := got.Mappings["alice"].GitHub; tt.want != "" && !slices.Equal(upstreams, Usernames{tt.want}) {
+				t.Errorf("alice maps to %q, want %s", upstreams, tt.want)
+			}
+
+			var entry configCacheEntry
+			if data, err := os.ReadFile(cachePath); err == nil {
+				json.Unmarshal(data, &entry)
+			}
+			if string(entry.Config) != tt.wantCached {
+				t.Errorf("cached config = %q, want %q", entry.Config, tt.wantCached)
+			}
+			if info, err := os.Stat(cachePath); err == nil && info.Mode().Perm() != 0o600 {
+				t.Errorf("cached config has mode %v, want 0600", info.Mode().Perm())
+			}
+		})
+	}
+}
+
+func TestConfigURLNetworkPolicy(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"mappings":{"alice":{"github":"octocat"}}}`))
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name         string
+		allowedHosts string
+		wantErr      string
+	}{
+		{name: "internal host refused by default", wantErr: "loopback, link-local or private"},
+		{name: "host not in the list", allowedHosts: "config.example.com", wantErr: "not in allowed_hosts"},
+		{name: "listed address", allowedHosts: "config.example.com, 127.0.0.1"},
+		{name: "listed range", allowedHosts: "127.0.0.0/8"},
+		{name: "invalid entry", allowedHosts: "http://config.example.com", wantErr: "invalid " + configAllowedHostsEnv},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(configCacheEnv, filepath.Join(t.TempDir(), "config.json"))
+			t.Setenv(configAllowedHostsEnv, tt.allowedHosts)
+			_, err := LoadConfig(srv.URL+"/portunus.json", false)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("got error %v, want the config fetched", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConfigCachePerURL(t *testing.T) {
+	t.Setenv(configCacheEnv, filepath.Join(t.TempDir(), "config.json"))
+	urls := []string{
+		"https://a.example.com/portunus.json",
+		"https://b.example.com/portunus.json",
+		"https://a.example.com/other.json",
+	}
+	seen := make(map[string]string)
+	for _, u := range urls {
+		path := configCachePath(u)
+		if filepath.Ext(path) != ".json" || !strings.HasPrefix(filepath.Base(path), "config-") {
+			t.Errorf("%s: got path %s, want config-<hash>.json", u, path)
+		}
+		if other, ok := seen[path]; ok {
+			t.Errorf("%s and %s share %s", other, u, path)
+		}
+		seen[path] = u
+	}
+	if configCachePath(urls[0]) != configCachePath(urls[0]) {
+		t.Error("the same URL maps to different paths")
+	}
+}
+
+func TestBase64StaticKeys(t *testing.T) {
+	plain := testKey(t, 1, "alice@laptop")
+	encoded := base64.StdEncoding.EncodeToString([]byte(plain))
+
+	tests := []struct {
+		name    string
+		json    string
+		want    string
+		wantErr bool
+	}{
+		{name: "plain line", json: `"` + plain + `"`, want: plain},
+		{name: "base64 line", json: `"base64:` + encoded + `"`, want: plain},
+		{name: "base64 object", json: `{"key": "base64:` + encoded + `", "not_after": "2030-01-02"}`, want: plain},
+		{name: "base64 with a trailing newline", json: `"base64:` + base64.StdEncoding.EncodeToString([]byte(plain+"\n")) + `"`, want: plain},
+		{name: "wrapped base64", json: `"base64:` + encoded[:20] + `\n` + encoded[20:] + `"`, want: plain},
+		{name: "invalid base64", json: `"base64:not base64!"`, wantErr: true},
+		{name: "several lines", json: `"base64:` + base64.StdEncoding.EncodeToString([]byte(plain+"\n"+plain)) + `"`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got StaticKey
+			err := json.Unmarshal([]byte(tt.json), &got)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if got.Key != tt.want {
+				t.Errorf("key = %q, want %q", got.Key, tt.want)
+			}
+		})
+	}
+}
+
+func TestBase64StaticKeysEmitLikePlainOnes(t *testing.T) {
+	other := testKey(t, 2, "alice@desktop")
+	encoded := base64.StdEncoding.EncodeToString([]byte(testKey(t, 1, "alice@laptop")))
+	resolve := func(keys string) []string {
+		var config Config
+		if err := json.Unmarshal([]byte(`{"mappings": {"alice": {"static_keys": [`+keys+`]}}}`), &config); err != nil {
+			t.Fatal(err)
+		}
+		return resolveLines(t, newTestKeyManager(t, config), "alice")
+	}
+
+	want := resolve(`"` + testKey(t, 1, "alice@laptop") + `", "` + other + `"`)
+	got := resolve(`"base64:` + encoded + `", "` + other + `"`)
+	if !slices.Equal(got, want) {
+		t.Errorf("mixed base64 and plain keys emit %q, want %q", got, want)
+	}
+}
+
+func TestLoadConfigs(t *testing.T) {
+	tests := []struct {
+		name    string
+		base    string
+		overlay string
+		// want is the single config the two files should merge into
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "later scalars override",
+			base:    `{"dedup": true, "fail_closed": false, "username_pattern": "^[a-z]+$"}`,
+			overlay: `{"fail_closed": true, "username_pattern": "^[a-z0-9]+$"}`,
+			want:    `{"dedup": true, "fail_closed": true, "username_pattern": "^[a-z0-9]+$"}`,
+		},
+		{
+			name:    "mappings merge by login",
+			base:    `{"mappings": {"alice": {"github": "octocat"}, "bob": {"github": "bobcat"}}}`,
+			overlay: `{"mappings": {"carol": {"gitlab": "tanuki"}}}`,
+			want:    `{"mappings": {"alice": {"github": "octocat"}, "bob": {"github": "bobcat"}, "carol": {"gitlab": "tanuki"}}}`,
+		},
+		{
+			name:    "a login in both files merges field by field",
+			base:    `{"mappings": {"alice": {"github": "octocat", "gitlab": "old"}}}`,
+			overlay: `{"mappings": {"alice": {"gitlab": "tanuki"}}}`,
+			want:    `{"mappings": {"alice": {"github": "octocat", "gitlab": "tanuki"}}}`,
+		},
+		{
+			name:    "provider settings merge",
+			base:    `{"github": {"url": "https://github.example.com/"}}`,
+			overlay: `{"github": {"token": "ghp_prod"}}`,
+			want:    `{"github": {"url": "https://github.example.com/", "token": "ghp_prod"}}`,
+		},
+		{
+			name:    "lists are replaced",
+			base:    `{"source_order": ["ldap", "github"], "mappings": {"alice": {"static_keys": ["ssh-ed25519 AAAA one"]}}}`,
+			overlay: `{"source_order": ["gitlab"], "mappings": {"alice": {"static_keys": ["ssh-ed25519 AAAA two"]}}}`,
+			want:    `{"source_order": ["gitlab"], "mappings": {"alice": {"static_keys": ["ssh-ed25519 AAAA two"]}}}`,
+		},
+		{
+			name:    "an invalid file fails",
+			base:    `{"mappings": {}}`,
+			overlay: `{"mappings": `,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			var paths []string
+			for i, body := range []string{tt.base, tt.overlay, tt.want} {
+				path := filepath.Join(dir, []string{"base", "overlay", "want"}[i]+".json")
+				if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+					t.Fatal(err)
+				}
+				paths = append(paths, path)
+			}
+
+			got, err := LoadConfigs(paths[:2], false)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			want, err := LoadConfig(paths[2], false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			gotJSON, _ := json.Marshal(got)
+			wantJSON, _ := json.Marshal(want)
+			if string(gotJSON) != string(wantJSON) {
+				t.Errorf("got %s\nwant %s", gotJSON, wantJSON)
+			}
+		})
+	}
+}
+
+func TestStrictConfigUnknownFields(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		// field is the unknown field strict decoding should name
+		field string
+	}{
+		{name: "known fields only", config: `{"github": {"token": "t"}, "mappings": {"alice": {"github": "octocat"}}}`},
+		{name: "top-level typo", config: `{"githb": {"token": "t"}}`, field: "githb"},
+		{name: "provider setting typo", config: `{"github": {"tokn": "t"}}`, field: "tokn"},
+		{name: "mapping typo", config: `{"mappings": {"alice": {"gihub": "octocat"}}}`, field: "gihub"},
+		{name: "static key typo", config: `{"mappings": {"alice": {"static_keys": [{"key": "ssh-ed25519 AAAA", "not_afer": "2030-01-01"}]}}}`, field: "not_afer"},
+		{name: "template static key typo", config: `{"templates": {"base": {"static_keys": [{"key": "ssh-ed25519 AAAA", "priorty": true}]}}}`, field: "priorty"},
+		{name: "static key object", config: `{"mappings": {"alice": {"static_keys": ["ssh-ed25519 AAAA", {"key": "ssh-ed25519 BBBB", "not_after": "2030-01-01", "priority": true}]}}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decodeConfig(strings.NewReader(tt.config), false); err != nil {
+				t.Errorf("lenient decoding failed: %v", err)
+			}
+			_, err := decodeConfig(strings.NewReader(tt.config), true)
+			switch {
+			case tt.field == "" && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tt.field != "" && (err == nil || !strings.Contains(err.Error(), `unknown field "`+tt.field+`"`)):
+				t.Errorf("error = %v, want it to name %q", err, tt.field)
+			}
+		})
+	}
+}
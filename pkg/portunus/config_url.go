@@ -0,0 +1,140 @@
+package portunus
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// configTokenEnv holds an optional bearer token sent when fetching the
+	// config from a URL
+	configTokenEnv = "PORTUNUS_CONFIG_TOKEN"
+
+	// configCacheEnv overrides where the last good config fetched from a URL
+	// is kept, defaulting to portunus/config.json in the user cache directory.
+	// A hash of the URL is added to the file name, so each URL keeps its own.
+	configCacheEnv = "PORTUNUS_CONFIG_CACHE"
+
+	// configAllowedHostsEnv lists, comma separated, the host names, IPs and
+	// CIDR ranges the config may be fetched from, like allowed_hosts. Without
+	// it the config URL can't reach loopback, link-local or private
+	// addresses, so set it to fetch from an internal host.
+	configAllowedHostsEnv = "PORTUNUS_CONFIG_ALLOWED_HOSTS"
+)
+
+// configCacheEntry is the last good config fetched from URL, as saved in
+// the config cache
+type configCacheEntry struct {
+	URL    string          `json:"url"`
+	Config json.RawMessage `json:"config"`
+}
+
+// isConfigURL reports whether a config path is an http(s) URL
+func isConfigURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// loadConfigURL fetches the config at rawURL. A config that decodes
+// successfully is saved locally, and used instead if a later fetch fails.
+func loadConfigURL(rawURL string, strict bool) ([]byte, error) {
+	body, fetchErr := fetchConfig(rawURL)
+	if fetchErr == nil {
+		if _, err := decodeConfig(bytes.NewReader(body), strict); err != nil {
+			return nil, fmt.Errorf("error decoding config from %s: %w", rawURL, err)
+		}
+		saveConfigCache(rawURL, body)
+		return body, nil
+	}
+
+	path := configCachePath(rawURL)
+	if path == "" {
+		return nil, fetchErr
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fetchErr
+	}
+	var cached configCacheEntry
+	if err := json.Unmarshal(data, &cached); err != nil || cached.URL != rawURL {
+		log.Printf("Error fetching config, not using %s, which is not a copy of this URL", path)
+		return nil, fetchErr
+	}
+	log.Printf("Error fetching config, using last good copy from %s: %v", path, fetchErr)
+	return cached.Config, nil
+}
+
+// fetchConfig fetches rawURL under the network policy of
+// configAllowedHostsEnv, as provider requests are under theirs
+func fetchConfig(rawURL string) ([]byte, error) {
+	httpConfig := HTTPConfig{AllowedHosts: strings.Split(os.Getenv(configAllowedHostsEnv), ",")}
+	if _, err := httpConfig.hostPolicy(); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", configAllowedHostsEnv, err)
+	}
+	req, err := http.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgentOrDefault(""))
+	if token := os.Getenv(configTokenEnv); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second, Transport: httpConfig.guardedTransport()}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching config: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("config URL returned status: %d", resp.StatusCode)
+	}
+	return readLimited(resp.Body, defaultMaxResponseBytes)
+}
+
+// configCachePath returns where the last good config from rawURL is kept,
+// or an empty string if there is nowhere to keep it
+func configCachePath(rawURL string) string {
+	path := os.Getenv(configCacheEnv)
+	if path == "" {
+		dir, err := os.UserCacheDir()
+		if err != nil {
+			return ""
+		}
+		path = filepath.Join(dir, "portunus", "config.json")
+	}
+	sum := sha256.Sum256([]byte(rawURL))
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "-" + hex.EncodeToString(sum[:8]) + ext
+}
+
+// saveConfigCache writes body, fetched from rawURL, to the config cache
+// atomically, so a concurrent reader never sees a partial config. The config
+// may hold tokens, so it is only readable by the owner. Failures are only
+// logged.
+func saveConfigCache(rawURL string, body []byte) {
+	path := configCachePath(rawURL)
+	if path == "" {
+		return
+	}
+	data, err := json.Marshal(configCacheEntry{URL: rawURL, Config: body})
+	if err != nil {
+		log.Printf("Error saving config cache: %v", err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		log.Printf("Error saving config cache: %v", err)
+		return
+	}
+	if err := WriteFileAtomic(path, data, 0o600); err != nil {
+		log.Printf("Error saving config cache: %v", err)
+	}
+}
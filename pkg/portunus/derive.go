@@ -0,0 +1,86 @@
+package portunus
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+)
+
+// UsernameRule derives a provider's upstream username from the local login,
+// for mappings that list the provider in Derive. Every match of Pattern in
+// the login is replaced with Replacement, which may refer to groups as $1.
+// An empty Pattern uses the login unchanged.
+type UsernameRule struct {
+	Pattern     string `json:"pattern,omitempty"`
+	Replacement string `json:"replacement"`
+}
+
+// compileUsernameRules compiles the username_rules patterns by provider
+func compileUsernameRules(rules map[string]UsernameRule) (map[string]*regexp.Regexp, error) {
+	compiled := make(map[string]*regexp.Regexp, len(rules))
+	for name, rule := range rules {
+		if name == "static" {
+			return nil, fmt.Errorf("username_rules: static keys have no upstream username")
+		}
+		if rule.Pattern == "" {
+			continue
+		}
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("username_rules %s: invalid pattern: %w", name, err)
+		}
+		compiled[name] = re
+	}
+	return compiled, nil
+}
+
+// deriveUsername applies provider's username rule to login
+func (km *KeyManager) deriveUsername(provider, login string) string {
+	re, ok := km.usernameRules[provider]
+	if !ok {
+		return login
+	}
+	return re.ReplaceAllString(login, km.config.UsernameRules[provider].Replacement)
+}
+
+// deriveUpstreams fills in the upstream username of each provider the mapping
+// lists in Derive from login. Upstreams the mapping sets itself are kept.
+func (km *KeyManager) deriveUpstreams(login string, m UserMapping) UserMapping {
+	for _, provider := range m.Derive {
+		if len(m.Upstreams(provider)) > 0 {
+			continue
+		}
+		if upstream := km.deriveUsername(provider, login); upstream != "" {
+			m = m.withUpstream(provider, upstream)
+		}
+	}
+	return m
+}
+
+// withUpstream returns m with upstream as its username on provider
+func (m UserMapping) withUpstream(provider, upstream string) UserMapping {
+	switch provider {
+	case "github":
+		m.GitHub = Usernames{upstream}
+	case "gitlab":
+		m.GitLab = Usernames{upstream}
+	case "ldap":
+		m.LDAPUser = upstream
+	case "keybase":
+		m.Keybase = upstream
+	case "azuredevops":
+		m.AzureDevOps = upstream
+	case "oslogin":
+		m.OSLogin = upstream
+	case "exec":
+		m.Exec = upstream
+	case "dns":
+		m.DNS = upstream
+	default:
+		providers := make(map[string]string, len(m.Providers)+1)
+		maps.Copy(providers, m.Providers)
+		providers[provider] = upstream
+		m.Providers = providers
+	}
+	return m
+}
@@ -0,0 +1,119 @@
+package portunus
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestDeriveUpstreams(t *testing.T) {
+	hubKey, labKey, ownKey := testKey(t, 1, "hub"), testKey(t, 2, "lab"), testKey(t, 3, "own")
+	stripDots := map[string]UsernameRule{"github": {Pattern: `\.`, Replacement: ""}}
+
+	tests := []struct {
+		name    string
+		login   string
+		mapping UserMapping
+		def     *UserMapping
+		rules   map[string]UsernameRule
+		want    []string
+	}{
+		{
+			name:    "dots stripped for github",
+			login:   "j.doe",
+			mapping: UserMapping{Derive: []string{"github"}},
+			rules:   stripDots,
+			want:    []string{"# github: j.doe (jdoe)", hubKey},
+		},
+		{
+			name:    "passthrough without a rule",
+			login:   "j.doe",
+			mapping: UserMapping{Derive: []string{"gitlab"}},
+			rules:   stripDots,
+			want:    []string{"# gitlab: j.doe (j.doe)", labKey},
+		},
+		{
+			name:    "rule with capture groups",
+			login:   "j.doe",
+			mapping: UserMapping{Derive: []string{"gitlab"}},
+			rules:   map[string]UsernameRule{"gitlab": {Pattern: `^(\w)\.(\w+)$`, Replacement: "${2}_$1"}},
+			want:    []string{"# gitlab: j.doe (doe_j)", labKey},
+		},
+		{
+			name:    "empty pattern passes the login through",
+			login:   "j.doe",
+			mapping: UserMapping{Derive: []string{"gitlab"}},
+			rules:   map[string]UsernameRule{"gitlab": {Replacement: "ignored"}},
+			want:    []string{"# gitlab: j.doe (j.doe)", labKey},
+		},
+		{
+			name:    "several providers",
+			login:   "j.doe",
+			mapping: UserMapping{Derive: []string{"github", "gitlab"}},
+			rules:   stripDots,
+			want:    []string{"# github: j.doe (jdoe)", hubKey, "# gitlab: j.doe (j.doe)", labKey},
+		},
+		{
+			name:    "explicit upstream is kept",
+			login:   "j.doe",
+			mapping: UserMapping{Derive: []string{"github"}, GitHub: Usernames{"octocat"}},
+			rules:   stripDots,
+			want:    []string{"# github: j.doe (octocat)", hubKey},
+		},
+		{
+			name:    "rules apply only to mappings that opt in",
+			login:   "j.doe",
+			mapping: UserMapping{StaticKeys: []StaticKey{{Key: ownKey}}},
+			rules:   stripDots,
+			want:    []string{"# static: j.doe", ownKey},
+		},
+		{
+			name:  "default mapping opts every login in",
+			login: "a.smith",
+			def:   &UserMapping{Derive: []string{"github"}},
+			rules: map[string]UsernameRule{"github": {Pattern: `^a\.smith$`, Replacement: "jdoe"}},
+			want:  []string{"# github: a.smith (jdoe)", hubKey},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			github := &fakeProvider{keys: map[string][]string{"jdoe": {hubKey}, "octocat": {hubKey}}}
+			gitlab := &fakeProvider{keys: map[string][]string{"j.doe": {labKey}, "doe_j": {labKey}}}
+			mappings := map[string]UserMapping{"j.doe": tt.mapping}
+			if tt.def != nil {
+				mappings[DefaultMapping] = *tt.def
+			}
+			km := newTestKeyManager(t, Config{
+				Mappings:      mappings,
+				UsernameRules: tt.rules,
+				SourceOrder:   []string{"static", "github", "gitlab"},
+			}, WithProvider("github", github), WithProvider("gitlab", gitlab))
+
+			if got := resolveLines(t, km, tt.login); !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInvalidUsernameRules(t *testing.T) {
+	tests := []struct {
+		name     string
+		rules    map[string]UsernameRule
+		mappings map[string]UserMapping
+		want     string
+	}{
+		{name: "unknown provider in rules", rules: map[string]UsernameRule{"githib": {Pattern: `\.`}}, want: "unknown provider in username_rules: githib"},
+		{name: "static rule", rules: map[string]UsernameRule{"static": {Pattern: `\.`}}, want: "static keys have no upstream username"},
+		{name: "invalid pattern", rules: map[string]UsernameRule{"github": {Pattern: `(`}}, want: "username_rules github: invalid pattern"},
+		{name: "unknown provider in derive", mappings: map[string]UserMapping{"alice": {Derive: []string{"githib"}}}, want: "mapping alice: unknown provider in derive: githib"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewKeyManagerFromConfig(Config{Mappings: tt.mappings, UsernameRules: tt.rules})
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package portunus
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// KeyDiff is the change between an existing authorized_keys file and the keys
+// portunus would serve, as fingerprint to the line the key is described by
+type KeyDiff struct {
+	Added   map[string]string
+	Removed map[string]string
+}
+
+// parseKeySet returns the keys in lines by SHA256 fingerprint, so options,
+// comments and whitespace don't count as differences. Comment, blank and
+// unparseable lines are skipped.
+func parseKeySet(lines []string) map[string]string {
+	keys := make(map[string]string)
+	for _, line := range lines {
+		if isComment(line) || strings.TrimSpace(line) == "" {
+			continue
+		}
+		pub, comment, err := parseKey(line)
+		if err != nil {
+			log.Printf("Skipping unparseable key line: %v", err)
+			continue
+		}
+		desc := pub.Type()
+		if comment != "" {
+			desc += " " + comment
+		}
+		keys[ssh.FingerprintSHA256(pub)] = desc
+	}
+	return keys
+}
+
+// DiffKeys compares the keys in an existing authorized_keys file against
+// resolved, the keys portunus would serve
+func DiffKeys(existing, resolved []string) KeyDiff {
+	before, after := parseKeySet(existing), parseKeySet(resolved)
+	d := KeyDiff{Added: make(map[string]string), Removed: make(map[string]string)}
+	for fp, desc := range after {
+		if _, ok := before[fp]; !ok {
+			d.Added[fp] = desc
+		}
+	}
+	for fp, desc := range before {
+		if _, ok := after[fp]; !ok {
+			d.Removed[fp] = desc
+		}
+	}
+	return d
+}
+
+// Empty reports whether the two key sets were the same
+func (d KeyDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0
+}
+
+// Write prints removed keys prefixed with - and added keys with +, each
+// sorted by fingerprint
+func (d KeyDiff) Write(w io.Writer) {
+	for _, change := range []struct {
+		prefix string
+		keys   map[string]string
+	}{{"-", d.Removed}, {"+", d.Added}} {
+		fps := make([]string, 0, len(change.keys))
+		for fp := range change.keys {
+			fps = append(fps, fp)
+		}
+		sort.Strings(fps)
+		for _, fp := range fps {
+			fmt.Fprintf(w, "%s %s %s\n", change.prefix, fp, change.keys[fp])
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package portunus
+
+import (
+	"bytes"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestDiffKeys(t *testing.T) {
+	k1, k2, k3 := testKey(t, 1, "alice@laptop"), testKey(t, 2, "alice@desktop"), testKey(t, 3, "alice@phone")
+	fp := func(line string) string {
+		pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ssh.FingerprintSHA256(pub)
+	}
+
+	tests := []struct {
+		name        string
+		existing    []string
+		resolved    []string
+		wantAdded   []string
+		wantRemoved []string
+	}{
+		{
+			name:     "no change",
+			existing: []string{k1, k2},
+			resolved: []string{k2, k1},
+		},
+		{
+			name:     "comments, options and whitespace don't count",
+			existing: []string{"# managed by hand", "", "  " + k1 + "  ", `no-pty ` + k2},
+			resolved: []string{"# github: alice (octocat)", strings.Fields(k1)[0] + " " + strings.Fields(k1)[1] + " other", k2},
+		},
+		{
+			name:      "addition",
+			existing:  []string{k1},
+			resolved:  []string{k1, k2},
+			wantAdded: []string{fp(k2)},
+		},
+		{
+			name:        "removal",
+			existing:    []string{k1, k2},
+			resolved:    []string{k1},
+			wantRemoved: []string{fp(k2)},
+		},
+		{
+			name:        "additions and removals",
+			existing:    []string{k1, k2, "ssh-ed25519 not-a-key"},
+			resolved:    []string{k2, k3},
+			wantAdded:   []string{fp(k3)},
+			wantRemoved: []string{fp(k1)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := DiffKeys(tt.existing, tt.resolved)
+			if got := slices.Sorted(maps.Keys(d.Added)); !slices.Equal(got, tt.wantAdded) {
+				t.Errorf("added = %q, want %q", got, tt.wantAdded)
+			}
+			if got := slices.Sorted(maps.Keys(d.Removed)); !slices.Equal(got, tt.wantRemoved) {
+				t.Errorf("removed = %q, want %q", got, tt.wantRemoved)
+			}
+			if d.Empty() != (len(tt.wantAdded)+len(tt.wantRemoved) == 0) {
+				t.Errorf("Empty() = %v", d.Empty())
+			}
+		})
+	}
+}
+
+func TestKeyDiffWrite(t *testing.T) {
+	d := KeyDiff{
+		Added:   map[string]string{"SHA256:b": "ssh-ed25519 alice@phone"},
+		Removed: map[string]string{"SHA256:a": "ssh-ed25519 alice@laptop"},
+	}
+	var out bytes.Buffer
+	d.Write(&out)
+	want := "- SHA256:a ssh-ed25519 alice@laptop\n+ SHA256:b ssh-ed25519 alice@phone\n"
+	if out.String() != want {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+}
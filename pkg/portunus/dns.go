@@ -0,0 +1,119 @@
+package portunus
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const defaultDNSTimeout = 5 * time.Second
+
+// txtResolver is the part of *net.Resolver the DNS provider needs
+type txtResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// DNSProvider fetches keys published in DNS TXT records, one key per record
+type DNSProvider struct {
+	resolver txtResolver
+	name     string
+	timeout  time.Duration
+}
+
+type DNSConfig struct {
+	// Name is the TXT record to look up, with {username} replaced by the
+	// upstream identity, e.g. {username}.keys.example.com
+	Name string `json:"name,omitempty"`
+
+	// Resolver is a host:port DNS server to query instead of the system
+	// resolver
+	Resolver string        `json:"resolver,omitempty"`
+	Timeout  time.Duration `json:"timeout,omitempty"`
+}
+
+func NewDNSProvider(config DNSConfig) (*DNSProvider, error) {
+	if !strings.Contains(config.Name, "{username}") {
+		return nil, errors.New("dns name must contain {username}")
+	}
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = defaultDNSTimeout
+	}
+
+	resolver := net.DefaultResolver
+	if config.Resolver != "" {
+		if _, _, err := net.SplitHostPort(config.Resolver); err != nil {
+			return nil, fmt.Errorf("invalid dns resolver %q: %w", config.Resolver, err)
+		}
+		server := config.Resolver
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+
+	return &DNSProvider{
+		resolver: resolver,
+		name:     config.Name,
+		timeout:  timeout,
+	}, nil
+}
+
+func (p *DNSProvider) GetKeys(username string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+
+	name := strings.ReplaceAll(p.name, "{username}", username)
+	records, err := p.resolver.LookupTXT(ctx, name)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, fmt.Errorf("no TXT record found at %s", name)
+		}
+		return nil, fmt.Errorf("DNS lookup of %s failed: %w", name, err)
+	}
+
+	var keys []string
+	for _, record := range records {
+		key, err := decodeTXTKey(record)
+		if err != nil {
+			log.Printf("Skipping TXT record at %s: %v", name, err)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// decodeTXTKey turns a TXT record into an OpenSSH key line. The resolver
+// has already joined the record's character strings, which may hold the key
+// line itself, the key line base64 encoded, or the base64 wire format key.
+func decodeTXTKey(record string) (string, error) {
+	record = strings.TrimSpace(record)
+	if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(record)); err == nil {
+		return record, nil
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(record), ""))
+	if err != nil {
+		return "", errors.New("not an OpenSSH key or base64")
+	}
+	if _, _, _, _, err := ssh.ParseAuthorizedKey(decoded); err == nil {
+		return strings.TrimSpace(string(decoded)), nil
+	}
+	pub, err := ssh.ParsePublicKey(decoded)
+	if err != nil {
+		return "", errors.New("base64 does not decode to an OpenSSH key")
+	}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub))), nil
+}
@@ -0,0 +1,126 @@
+package portunus
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// stubResolver serves the TXT records listed for each name
+type stubResolver struct {
+	records map[string][]string
+	err     error
+}
+
+func (r stubResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	records, ok := r.records[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return records, nil
+}
+
+func TestDNSProvider(t *testing.T) {
+	key := testKey(t, 1, "alice@laptop")
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bare := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub)))
+	encoded := base64.StdEncoding.EncodeToString([]byte(key))
+	// long records come back from the resolver already joined, but may
+	// still carry whitespace between the chunks
+	chunked := encoded[:20] + " " + encoded[20:]
+
+	tests := []struct {
+		name     string
+		resolver stubResolver
+		want     []string
+		wantErr  string
+	}{
+		{
+			name:     "key line",
+			resolver: stubResolver{records: map[string][]string{"alice.keys.example.com": {key}}},
+			want:     []string{key},
+		},
+		{
+			name:     "base64 key line",
+			resolver: stubResolver{records: map[string][]string{"alice.keys.example.com": {encoded}}},
+			want:     []string{key},
+		},
+		{
+			name:     "chunked base64 key line",
+			resolver: stubResolver{records: map[string][]string{"alice.keys.example.com": {chunked}}},
+			want:     []string{key},
+		},
+		{
+			name:     "base64 wire format key",
+			resolver: stubResolver{records: map[string][]string{"alice.keys.example.com": {base64.StdEncoding.EncodeToString(pub.Marshal())}}},
+			want:     []string{bare},
+		},
+		{
+			name:     "unparseable records are skipped",
+			resolver: stubResolver{records: map[string][]string{"alice.keys.example.com": {"v=spf1 -all", key}}},
+			want:     []string{key},
+		},
+		{
+			name:     "missing record",
+			resolver: stubResolver{records: map[string][]string{}},
+			wantErr:  "no TXT record found at alice.keys.example.com",
+		},
+		{
+			name:     "resolver failure",
+			resolver: stubResolver{err: errors.New("server misbehaving")},
+			wantErr:  "server misbehaving",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewDNSProvider(DNSConfig{Name: "{username}.keys.example.com"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.resolver = tt.resolver
+
+			got, err := p.GetKeys("alice")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewDNSProviderValidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		config DNSConfig
+	}{
+		{name: "name without placeholder", config: DNSConfig{Name: "keys.example.com"}},
+		{name: "resolver without port", config: DNSConfig{Name: "{username}.keys.example.com", Resolver: "10.0.0.53"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewDNSProvider(tt.config); err == nil {
+				t.Error("NewDNSProvider accepted an invalid config")
+			}
+		})
+	}
+}
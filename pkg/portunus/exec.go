@@ -0,0 +1,109 @@
+package portunus
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const defaultExecTimeout = 10 * time.Second
+
+// ExecProvider fetches keys by running an external command and reading one
+// key per line from its stdout
+type ExecProvider struct {
+	argv    []string
+	timeout time.Duration
+}
+
+type ExecConfig struct {
+	// Command is split on whitespace into an argv, and {username} in any
+	// argument is replaced with the upstream identity. It is never passed
+	// through a shell.
+	Command string        `json:"command,omitempty"`
+	Timeout time.Duration `json:"timeout,omitempty"`
+}
+
+func NewExecProvider(config ExecConfig) (*ExecProvider, error) {
+	argv := strings.Fields(config.Command)
+	if len(argv) == 0 {
+		return nil, errors.New("exec command is empty")
+	}
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = defaultExecTimeout
+	}
+	return &ExecProvider{argv: argv, timeout: timeout}, nil
+}
+
+// Check verifies the command can be found, without running it
+func (p *ExecProvider) Check() error {
+	_, err := exec.LookPath(p.argv[0])
+	return err
+}
+
+func (p *ExecProvider) GetKeys(username string) ([]string, error) {
+	args := make([]string, len(p.argv))
+	for i, arg := range p.argv {
+		args[i] = strings.ReplaceAll(arg, "{username}", username)
+	}
+
+	stdout, err := runCommand(args, nil, p.timeout, "exec command")
+	if err != nil {
+		return nil, err
+	}
+	return SplitKeyLines(string(stdout)), nil
+}
+
+// runCommand runs argv with stdin, killing it after timeout or once its
+// stdout passes defaultMaxResponseBytes, and returns its stdout. Errors are
+// prefixed with what and carry the command's stderr.
+func runCommand(argv []string, stdin []byte, timeout time.Duration, what string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	stdout := &cappedBuffer{limit: defaultMaxResponseBytes, exceeded: cancel}
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+	// don't wait on grandchildren still holding stdout once the command is killed
+	cmd.WaitDelay = time.Second
+	if err := cmd.Run(); err != nil {
+		if stdout.over {
+			return nil, fmt.Errorf("%s output exceeds %d bytes", what, stdout.limit)
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("%s timed out after %s", what, timeout)
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%s failed: %w: %s", what, err, msg)
+		}
+		return nil, fmt.Errorf("%s failed: %w", what, err)
+	}
+	return stdout.buf.Bytes(), nil
+}
+
+// cappedBuffer collects a command's output up to limit bytes. A write past
+// the limit fails and calls exceeded, which kills the command, so a runaway
+// command isn't read to the end. The buffer isn't embedded, so its ReadFrom
+// can't bypass the limit.
+type cappedBuffer struct {
+	buf      bytes.Buffer
+	limit    int
+	exceeded func()
+	over     bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if b.buf.Len()+len(p) > b.limit {
+		b.over = true
+		b.exceeded()
+		return 0, errors.New("output limit exceeded")
+	}
+	return b.buf.Write(p)
+}
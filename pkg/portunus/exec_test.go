@@ -0,0 +1,106 @@
+package portunus
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// execStub writes a shell script to a temp directory and returns its path
+func execStub(t *testing.T, script string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "getkeys")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestExecProvider(t *testing.T) {
+	stub := execStub(t, `case "$1" in
+alice) echo "ssh-ed25519 AAAA1 alice"; echo; echo "ssh-ed25519 AAAA2 alice" ;;
+fail) echo "no such user" >&2; exit 3 ;;
+slow) exec sleep 5 ;;
+endless) exec yes ssh-ed25519 AAAA1 alice ;;
+*) echo "arg:$1" ;;
+esac
+`)
+
+	tests := []struct {
+		name     string
+		command  string
+		username string
+		timeout  time.Duration
+		want     []string
+		wantErr  string
+	}{
+		{
+			name:     "one key per line",
+			command:  stub + " {username}",
+			username: "alice",
+			want:     []string{"ssh-ed25519 AAAA1 alice", "ssh-ed25519 AAAA2 alice"},
+		},
+		{
+			name:     "username is a single argument",
+			command:  stub + " {username}",
+			username: "bob; touch pwned",
+			want:     []string{"arg:bob; touch pwned"},
+		},
+		{
+			name:     "non-zero exit",
+			command:  stub + " {username}",
+			username: "fail",
+			wantErr:  "no such user",
+		},
+		{
+			name:     "timeout",
+			command:  stub + " {username}",
+			username: "slow",
+			timeout:  100 * time.Millisecond,
+			wantErr:  "timed out",
+		},
+		{
+			name:     "output past the cap",
+			command:  stub + " {username}",
+			username: "endless",
+			timeout:  5 * time.Second,
+			wantErr:  "output exceeds",
+		},
+		{
+			name:     "missing command",
+			command:  filepath.Join(t.TempDir(), "missing") + " {username}",
+			username: "alice",
+			wantErr:  "exec command failed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewExecProvider(ExecConfig{Command: tt.command, Timeout: tt.timeout})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := p.GetKeys(tt.username)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewExecProviderRejectsEmptyCommand(t *testing.T) {
+	if _, err := NewExecProvider(ExecConfig{Command: "  "}); err == nil {
+		t.Error("NewExecProvider accepted an empty command")
+	}
+}
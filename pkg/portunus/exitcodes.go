@@ -0,0 +1,81 @@
+package portunus
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ExitCodes are the process exit codes for each way a lookup can end
+// badly, so monitoring can tell them apart. Success is always zero.
+type ExitCodes struct {
+	// ProviderError covers failures not listed below, such as a source
+	// failing under FailClosed
+	ProviderError int
+	// ConfigError is for a config that can't be loaded or is invalid
+	ConfigError int
+	// NoMapping is for a login with no mapping, or a name that fails the
+	// username pattern. Under the deny unmapped policy the exit code is zero.
+	NoMapping int
+	// NoKeys is for a mapped login whose sources returned no keys
+	NoKeys int
+}
+
+// DefaultExitCodes are the exit codes used unless overridden with
+// WithExitCodes
+var DefaultExitCodes = ExitCodes{
+	ProviderError: 1,
+	ConfigError:   2,
+	NoMapping:     3,
+	NoKeys:        4,
+}
+
+// exitCodeNames are the names ParseExitCodes accepts for each code
+var exitCodeNames = map[string]func(*ExitCodes) *int{
+	"provider-error": func(c *ExitCodes) *int { return &c.ProviderError },
+	"config-error":   func(c *ExitCodes) *int { return &c.ConfigError },
+	"no-mapping":     func(c *ExitCodes) *int { return &c.NoMapping },
+	"no-keys":        func(c *ExitCodes) *int { return &c.NoKeys },
+}
+
+// ParseExitCodes applies comma separated name=code overrides to base, e.g.
+// "no-mapping=1,no-keys=1" to report those as plain failures
+func ParseExitCodes(spec string, base ExitCodes) (ExitCodes, error) {
+	codes := base
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, "=")
+		field, known := exitCodeNames[strings.TrimSpace(name)]
+		if !ok || !known {
+			return base, fmt.Errorf("want name=code with name one of provider-error, config-error, no-mapping, no-keys: %q", pair)
+		}
+		code, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || code < 0 || code > 255 {
+			return base, fmt.Errorf("invalid exit code %q for %s", value, name)
+		}
+		*field(&codes) = code
+	}
+	return codes, nil
+}
+
+// WithExitCodes sets the exit codes LookupExitCode returns
+func WithExitCodes(codes ExitCodes) Option {
+	return func(km *KeyManager) {
+		km.exitCodes = codes
+	}
+}
+
+// exitCode classifies a failed lookup
+func (c ExitCodes) exitCode(err error) int {
+	switch {
+	case errors.Is(err, ErrNoMapping), errors.Is(err, ErrInvalidUsername):
+		return c.NoMapping
+	case errors.Is(err, ErrNoKeys):
+		return c.NoKeys
+	}
+	return c.ProviderError
+}
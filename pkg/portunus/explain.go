@@ -0,0 +1,216 @@
+package portunus
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// explainTrace records what collect did for Explain. Its methods do nothing
+// on a nil trace, so the lookup path pays nothing when not explaining.
+type explainTrace struct {
+	mu      sync.Mutex
+	fetches []fetchTrace
+	hits    map[string]bool
+}
+
+// fetchTrace is one source and upstream collect fetched keys for
+type fetchTrace struct {
+	source, upstream string
+	// keys are the keys as returned, before any transform
+	keys []string
+	err  error
+}
+
+type explainKey struct{}
+
+func withExplainTrace(ctx context.Context, t *explainTrace) context.Context {
+	return context.WithValue(ctx, explainKey{}, t)
+}
+
+func explainTraceFrom(ctx context.Context) *explainTrace {
+	t, _ := ctx.Value(explainKey{}).(*explainTrace)
+	return t
+}
+
+func (t *explainTrace) fetched(source, upstream string, keys []string, err error) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.fetches = append(t.fetches, fetchTrace{source, upstream, keys, err})
+}
+
+func (t *explainTrace) cacheHit(source, upstream string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.hits == nil {
+		t.hits = make(map[string]bool)
+	}
+	t.hits[source+"/"+upstream] = true
+}
+
+// Explanation is a human readable trace of how a login's keys were resolved,
+// for support tickets
+type Explanation struct {
+	Login   string
+	Mapping string
+	Sources []SourceExplanation
+	// Err is set when the lookup failed as a whole
+	Err error
+}
+
+// SourceExplanation is what one source returned for one upstream identity
+type SourceExplanation struct {
+	Source   string
+	Upstream string
+	CacheHit bool
+	Err      error
+	Keys     []KeyExplanation
+}
+
+// KeyExplanation follows one returned key through the pipeline
+type KeyExplanation struct {
+	// Key is the key's fingerprint, type and comment, or the raw line when
+	// it doesn't parse
+	Key        string
+	Transforms []string
+	// Outcome is "served", or why the key was not served from this source
+	Outcome string
+}
+
+// Explain resolves username like Resolve, recording where each key came
+// from, whether it was cached, which transforms changed it and whether it
+// was deduplicated or truncated. Lookups are not shared with concurrent
+// ones, so the trace is always this lookup's own.
+func (km *KeyManager) Explain(ctx context.Context, username string) Explanation {
+	e := Explanation{Login: username}
+	mapping, err := km.mapping(username)
+	if err != nil {
+		e.Err = err
+		return e
+	}
+	e.Mapping = km.describeMapping(username)
+
+	trace := &explainTrace{}
+	blocks, err := km.collect(withExplainTrace(ctx, trace), username, mapping)
+	if err != nil {
+		e.Err = err
+	}
+
+	// where each served key ended up, by fingerprint
+	served := make(map[string]string)
+	for _, b := range blocks {
+		for _, line := range b.Keys {
+			if pub, _, err := parseKey(line); err == nil {
+				if _, ok := served[ssh.FingerprintSHA256(pub)]; !ok {
+					served[ssh.FingerprintSHA256(pub)] = b.Source
+				}
+			}
+		}
+	}
+
+	for _, f := range trace.fetches {
+		s := SourceExplanation{Source: f.source, Upstream: f.upstream, CacheHit: trace.hits[f.source+"/"+f.upstream], Err: f.err}
+		rules := km.transformsFor(f.source)
+		if f.source == "static" {
+			rules = nil
+		}
+		for _, line := range f.keys {
+			if isComment(line) || strings.TrimSpace(line) == "" {
+				continue
+			}
+			out, keep, applied, _ := transformKey(line, rules)
+			k := KeyExplanation{Key: describeKey(line), Transforms: applied}
+			pub, _, parseErr := parseKey(out)
+			switch {
+			case !keep:
+				k.Outcome = "dropped by transform"
+			case parseErr != nil:
+				k.Outcome = "served unparsed"
+			case served[ssh.FingerprintSHA256(pub)] == f.source:
+				k.Outcome = "served"
+			case served[ssh.FingerprintSHA256(pub)] != "":
+				k.Outcome = "deduplicated, served from " + served[ssh.FingerprintSHA256(pub)]
+			case km.config.MaxKeysPerUser > 0:
+				k.Outcome = fmt.Sprintf("dropped over max_keys_per_user (%d)", km.config.MaxKeysPerUser)
+			default:
+				k.Outcome = "not served"
+			}
+			s.Keys = append(s.Keys, k)
+		}
+		e.Sources = append(e.Sources, s)
+	}
+	return e
+}
+
+// describeMapping says which mapping a login resolves through
+func (km *KeyManager) describeMapping(username string) string {
+	login := km.canonicalLogin(username)
+	mappings := km.currentMappings()
+	_, exact := mappings[login]
+	_, hasDefault := mappings[DefaultMapping]
+	switch {
+	case !exact:
+		return fmt.Sprintf("default mapping %q", DefaultMapping)
+	case hasDefault && km.config.DefaultMerge:
+		return fmt.Sprintf("mapping %q merged with %q", login, DefaultMapping)
+	}
+	return fmt.Sprintf("mapping %q", login)
+}
+
+// describeKey renders a key as its fingerprint, type and comment
+func describeKey(line string) string {
+	pub, comment, err := parseKey(line)
+	if err != nil {
+		return line
+	}
+	desc := ssh.FingerprintSHA256(pub) + " " + pub.Type()
+	if comment != "" {
+		desc += " " + comment
+	}
+	return desc
+}
+
+// Write prints the explanation as indented text
+func (e Explanation) Write(w io.Writer) {
+	fmt.Fprintf(w, "login %s", e.Login)
+	if e.Mapping != "" {
+		fmt.Fprintf(w, " via %s", e.Mapping)
+	}
+	fmt.Fprintln(w)
+	for _, s := range e.Sources {
+		status := "fetched"
+		switch {
+		case s.Source == "static":
+			status = "from config"
+		case s.CacheHit:
+			status = "cache hit"
+		}
+		switch {
+		case s.Err != nil:
+			status += ", error: " + s.Err.Error()
+		case len(s.Keys) == 0:
+			status += ", no keys"
+		}
+		fmt.Fprintf(w, "%s (%s): %s\n", s.Source, s.Upstream, status)
+		for _, k := range s.Keys {
+			fmt.Fprintf(w, "  %s\n", k.Key)
+			for _, t := range k.Transforms {
+				fmt.Fprintf(w, "    transform: %s\n", t)
+			}
+			fmt.Fprintf(w, "    %s\n", k.Outcome)
+		}
+	}
+	if e.Err != nil {
+		fmt.Fprintf(w, "lookup failed: %v\n", e.Err)
+	}
+}
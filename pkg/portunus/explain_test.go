@@ -0,0 +1,153 @@
+package portunus
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExplain(t *testing.T) {
+	own, shared := testKey(t, 1, "own"), testKey(t, 2, "shared")
+	hub, home, lab := testKey(t, 3, "hub"), testKey(t, 4, "alice@home"), testKey(t, 5, "lab")
+	dropHome := `drop_if_comment "@home$"`
+
+	tests := []struct {
+		name    string
+		warm    bool
+		maxKeys int
+		want    []SourceExplanation
+	}{
+		{
+			name: "fresh lookup",
+			want: []SourceExplanation{
+				{Source: "static", Upstream: "alice", Keys: []KeyExplanation{{Key: describeKey(own), Outcome: "served"}}},
+				{Source: "github", Upstream: "octocat", Keys: []KeyExplanation{
+					{Key: describeKey(shared), Outcome: "served"},
+					{Key: describeKey(hub), Outcome: "served"},
+					{Key: describeKey(home), Transforms: []string{dropHome}, Outcome: "dropped by transform"},
+				}},
+				{Source: "gitlab", Upstream: "octocat", Keys: []KeyExplanation{
+					{Key: describeKey(shared), Outcome: "deduplicated, served from github"},
+					{Key: describeKey(lab), Outcome: "served"},
+				}},
+			},
+		},
+		{
+			name: "cached lookup",
+			warm: true,
+			want: []SourceExplanation{
+				{Source: "static", Upstream: "alice", Keys: []KeyExplanation{{Key: describeKey(own), Outcome: "served"}}},
+				{Source: "github", Upstream: "octocat", CacheHit: true, Keys: []KeyExplanation{
+					{Key: describeKey(shared), Outcome: "served"},
+					{Key: describeKey(hub), Outcome: "served"},
+					{Key: describeKey(home), Transforms: []string{dropHome}, Outcome: "dropped by transform"},
+				}},
+				{Source: "gitlab", Upstream: "octocat", CacheHit: true, Keys: []KeyExplanation{
+					{Key: describeKey(shared), Outcome: "deduplicated, served from github"},
+					{Key: describeKey(lab), Outcome: "served"},
+				}},
+			},
+		},
+		{
+			name:    "over max_keys_per_user",
+			maxKeys: 2,
+			want: []SourceExplanation{
+				{Source: "static", Upstream: "alice", Keys: []KeyExplanation{{Key: describeKey(own), Outcome: "served"}}},
+				{Source: "github", Upstream: "octocat", Keys: []KeyExplanation{
+					{Key: describeKey(shared), Outcome: "served"},
+					{Key: describeKey(hub), Outcome: "dropped over max_keys_per_user (2)"},
+					{Key: describeKey(home), Transforms: []string{dropHome}, Outcome: "dropped by transform"},
+				}},
+				{Source: "gitlab", Upstream: "octocat", Keys: []KeyExplanation{
+					{Key: describeKey(shared), Outcome: "deduplicated, served from github"},
+					{Key: describeKey(lab), Outcome: "dropped over max_keys_per_user (2)"},
+				}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			github := &fakeProvider{keys: map[string][]string{"octocat": {shared, hub, home}}}
+			gitlab := &fakeProvider{keys: map[string][]string{"octocat": {shared, lab}}}
+			km := newTestKeyManager(t, Config{
+				Mappings: map[string]UserMapping{"alice": {
+					StaticKeys: []StaticKey{{Key: own}},
+					GitHub:     Usernames{"octocat"},
+					GitLab:     Usernames{"octocat"},
+				}},
+				SourceOrder:    []string{"static", "github", "gitlab"},
+				Dedup:          true,
+				MaxKeysPerUser: tt.maxKeys,
+				Transforms:     []TransformRule{{Sources: []string{"github"}, DropIfComment: "@home$"}},
+				Cache:          CacheConfig{Enabled: true, TTL: time.Hour},
+			}, WithProvider("github", github), WithProvider("gitlab", gitlab))
+			if tt.warm {
+				resolveLines(t, km, "alice")
+			}
+
+			e := km.Explain(context.Background(), "alice")
+			if e.Err != nil {
+				t.Fatal(e.Err)
+			}
+			if e.Mapping != `mapping "alice"` {
+				t.Errorf("mapping = %q, want alice's own", e.Mapping)
+			}
+			if !reflect.DeepEqual(e.Sources, tt.want) {
+				t.Errorf("got %+v\nwant %+v", e.Sources, tt.want)
+			}
+		})
+	}
+}
+
+func TestExplainWrite(t *testing.T) {
+	own, hub := testKey(t, 1, "own"), testKey(t, 2, "hub@corp")
+	github := &fakeProvider{keys: map[string][]string{"octocat": {hub}}}
+	gitlab := &fakeProvider{err: errors.New("gitlab down")}
+	km := newTestKeyManager(t, Config{
+		Mappings: map[string]UserMapping{
+			"*":     {StaticKeys: []StaticKey{{Key: own}}, GitLab: Usernames{"octocat"}},
+			"alice": {GitHub: Usernames{"octocat"}},
+		},
+		DefaultMerge: true,
+		SourceOrder:  []string{"static", "github", "gitlab"},
+		Transforms:   []TransformRule{{ReplaceComment: &CommentReplacement{Pattern: "@corp$", Replacement: "@example.com"}}},
+		Cache:        CacheConfig{Enabled: true, TTL: time.Hour},
+	}, WithProvider("github", github), WithProvider("gitlab", gitlab))
+	resolveLines(t, km, "alice")
+
+	var buf bytes.Buffer
+	km.Explain(context.Background(), "alice").Write(&buf)
+	want := strings.Join([]string{
+		`login alice via mapping "alice" merged with "*"`,
+		"static (alice): from config",
+		"  " + describeKey(own),
+		"    served",
+		"github (octocat): cache hit",
+		"  " + describeKey(hub),
+		`    transform: replace_comment "@corp$" -> "@example.com"`,
+		"    served",
+		"gitlab (octocat): fetched, error: gitlab down",
+		"",
+	}, "\n")
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestExplainFailedLookup(t *testing.T) {
+	km := newTestKeyManager(t, Config{Mappings: map[string]UserMapping{"alice": {}}})
+
+	var buf bytes.Buffer
+	e := km.Explain(context.Background(), "../root")
+	e.Write(&buf)
+	if !errors.Is(e.Err, ErrInvalidUsername) {
+		t.Errorf("error = %v, want ErrInvalidUsername", e.Err)
+	}
+	if got := buf.String(); !strings.HasPrefix(got, "login ../root\n") || !strings.Contains(got, "lookup failed: invalid username") {
+		t.Errorf("got %q, want the login and the failure", got)
+	}
+}
@@ -0,0 +1,229 @@
+package portunus
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// fallbackProvider tries a primary endpoint and then its mirrors in order,
+// returning the keys from the first one that answers. Unlike merging sources,
+// every endpoint serves the same keys, so later ones are only asked when the
+// earlier ones fail.
+type fallbackProvider struct {
+	name      string
+	endpoints []string
+	providers []KeyProvider
+
+	// failover reports whether an error should move on to the next
+	// endpoint. When nil every error does.
+	failover func(error) bool
+
+	// sticky starts each lookup at the endpoint that last answered, rather
+	// than at the primary
+	sticky    bool
+	mu        sync.Mutex
+	preferred int
+}
+
+// emailFallbackProvider is a fallbackProvider whose endpoints all support
+// email lookups
+type emailFallbackProvider struct {
+	*fallbackProvider
+}
+
+// newFallbackProvider chains providers, which were built for endpoints in the
+// same order. The result only implements EmailKeyProvider if every provider does.
+func newFallbackProvider(name string, endpoints []string, providers []KeyProvider) KeyProvider {
+	return wrapFallback(&fallbackProvider{name: name, endpoints: endpoints, providers: providers})
+}
+
+// wrapFallback returns f as an EmailKeyProvider if every provider it chains is one
+func wrapFallback(f *fallbackProvider) KeyProvider {
+	for _, p := range f.providers {
+		if _, ok := p.(EmailKeyProvider); !ok {
+			return f
+		}
+	}
+	return emailFallbackProvider{f}
+}
+
+func (f *fallbackProvider) GetKeys(username string) ([]string, error) {
+	return f.try(func(p KeyProvider) ([]string, error) {
+		return p.GetKeys(username)
+	})
+}
+
+func (f emailFallbackProvider) GetKeysByEmail(email string) ([]string, error) {
+	return f.try(func(p KeyProvider) ([]string, error) {
+		return p.(EmailKeyProvider).GetKeysByEmail(email)
+	})
+}
+
+// Check checks every endpoint that supports it, failing if any of them
+// fails, since a broken mirror is only noticed once it is needed
+func (f *fallbackProvider) Check() error {
+	var errs []error
+	for i, p := range f.providers {
+		c, ok := p.(Checker)
+		if !ok {
+			continue
+		}
+		if err := c.Check(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", f.endpoints[i], err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Members lists group from the first endpoint that can, like GetKeys
+func (f *fallbackProvider) Members(group string) ([]string, error) {
+	var err error
+	for _, i := range f.order() {
+		lister, ok := f.providers[i].(MemberLister)
+		if !ok {
+			continue
+		}
+		var members []string
+		if members, err = lister.Members(group); err == nil {
+			f.answered(i)
+			return members, nil
+		}
+		if f.failover != nil && !f.failover(err) {
+			return nil, err
+		}
+		log.Printf("Error listing %s group %s from %s: %v", f.name, group, f.endpoints[i], err)
+	}
+	return nil, fmt.Errorf("no %s endpoint could list group %s, last error: %w", f.name, group, err)
+}
+
+// try calls get on each endpoint's provider until one succeeds, or fails
+// with an error that isn't worth failing over on
+func (f *fallbackProvider) try(get func(KeyProvider) ([]string, error)) ([]string, error) {
+	var err error
+	order := f.order()
+	for n, i := range order {
+		var keys []string
+		if keys, err = get(f.providers[i]); err == nil {
+			f.answered(i)
+			return keys, nil
+		}
+		if f.failover != nil && !f.failover(err) {
+			return nil, err
+		}
+		if n < len(order)-1 {
+			log.Printf("Error fetching %s keys from %s, trying %s: %v", f.name, f.endpoints[i], f.endpoints[order[n+1]], err)
+		}
+	}
+	return nil, fmt.Errorf("all %d %s endpoints failed, last error: %w", len(f.providers), f.name, err)
+}
+
+// order returns the endpoint indexes in the order they are tried: the
+// preferred endpoint first, then the rest in configured order
+func (f *fallbackProvider) order() []int {
+	f.mu.Lock()
+	preferred := f.preferred
+	f.mu.Unlock()
+
+	order := []int{preferred}
+	for i := range f.providers {
+		if i != preferred {
+			order = append(order, i)
+		}
+	}
+	return order
+}
+
+// answered records that endpoint i served a lookup, making it the preferred
+// one for sticky providers
+func (f *fallbackProvider) answered(i int) {
+	if !f.sticky {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.preferred != i {
+		log.Printf("Preferring %s endpoint %s until it fails", f.name, f.endpoints[i])
+		f.preferred = i
+	}
+}
+
+// newGitHubWithMirrors builds the GitHub provider, falling back to each of
+// config.Mirrors in turn when there are any
+func newGitHubWithMirrors(config GitHubConfig) (KeyProvider, error) {
+	primary, err := NewGitHubProvider(config)
+	if err != nil {
+		return nil, err
+	}
+	if len(config.Mirrors) == 0 {
+		return primary, nil
+	}
+	endpoints := append([]string{primary.baseURL}, config.Mirrors...)
+	providers := []KeyProvider{primary}
+	for _, mirror := range config.Mirrors {
+		config.URL = mirror
+		p, err := NewGitHubProvider(config)
+		if err != nil {
+			return nil, err
+		}
+		providers = append(providers, p)
+	}
+	return newFallbackProvider("GitHub", endpoints, providers), nil
+}
+
+// newGitLabWithMirrors builds the GitLab provider, falling back to each of
+// config.Mirrors in turn when there are any
+func newGitLabWithMirrors(config GitLabConfig) (KeyProvider, error) {
+	primary, err := NewGitLabProvider(config)
+	if err != nil {
+		return nil, err
+	}
+	if len(config.Mirrors) == 0 {
+		return primary, nil
+	}
+	endpoints := append([]string{primary.baseURL}, config.Mirrors...)
+	providers := []KeyProvider{primary}
+	for _, mirror := range config.Mirrors {
+		config.URL = mirror
+		p, err := NewGitLabProvider(config)
+		if err != nil {
+			return nil, err
+		}
+		providers = append(providers, p)
+	}
+	return newFallbackProvider("GitLab", endpoints, providers), nil
+}
+
+// newLDAPWithMirrors builds the LDAP provider, falling back to each of
+// config.Mirrors in turn when there are any. Mirrors are replicas, so only
+// errors reaching or binding to a server fail over, and the server that last
+// answered is tried first.
+func newLDAPWithMirrors(config LDAPConfig) (KeyProvider, error) {
+	primary, err := NewLDAPProvider(config)
+	if err != nil {
+		return nil, err
+	}
+	if len(config.Mirrors) == 0 {
+		return primary, nil
+	}
+	endpoints := append([]string{primary.config.URL}, config.Mirrors...)
+	providers := []KeyProvider{primary}
+	// mirrors reuse the bind password the primary read from the keyring
+	config = primary.config
+	for _, mirror := range config.Mirrors {
+		config.URL = mirror
+		p, err := NewLDAPProvider(config)
+		if err != nil {
+			return nil, err
+		}
+		providers = append(providers, p)
+	}
+	return wrapFallback(&fallbackProvider{
+		name:      "LDAP",
+		endpoints: endpoints,
+		providers: providers,
+		failover:  ldapFailover,
+		sticky:    true,
+	}), nil
+}
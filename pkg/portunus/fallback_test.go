@@ -0,0 +1,236 @@
+package portunus
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestFallbackProvider(t *testing.T) {
+	key := testKey(t, 1, "alice@laptop")
+	notFound := errors.New("user not found")
+
+	tests := []struct {
+		name        string
+		primary     *fakeProvider
+		mirror      *fakeProvider
+		failover    func(error) bool
+		want        []string
+		wantErr     bool
+		wantMirrors int
+	}{
+		{
+			name:    "healthy primary serves",
+			primary: &fakeProvider{keys: map[string][]string{"octocat": {key}}},
+			mirror:  &fakeProvider{keys: map[string][]string{"octocat": {"mirror"}}},
+			want:    []string{key},
+		},
+		{
+			name:        "failing primary falls back to the mirror",
+			primary:     &fakeProvider{err: errors.New("503")},
+			mirror:      &fakeProvider{keys: map[string][]string{"octocat": {key}}},
+			want:        []string{key},
+			wantMirrors: 1,
+		},
+		{
+			name:        "every endpoint failing",
+			primary:     &fakeProvider{err: errors.New("503")},
+			mirror:      &fakeProvider{err: errors.New("503")},
+			wantErr:     true,
+			wantMirrors: 1,
+		},
+		{
+			name:     "errors not worth failing over on",
+			primary:  &fakeProvider{err: notFound},
+			mirror:   &fakeProvider{keys: map[string][]string{"octocat": {key}}},
+			failover: func(err error) bool { return !errors.Is(err, notFound) },
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFallbackProvider("GitHub", []string{"primary", "mirror"}, []KeyProvider{tt.primary, tt.mirror})
+			f.(*fallbackProvider).failover = tt.failover
+
+			got, err := f.GetKeys("octocat")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if n := tt.mirror.Calls(); n != tt.wantMirrors {
+				t.Errorf("mirror called %d times, want %d", n, tt.wantMirrors)
+			}
+		})
+	}
+}
+
+func TestGitHubMirrors(t *testing.T) {
+	key := testKey(t, 1, "alice@laptop")
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer primary.Close()
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, key)
+	}))
+	defer mirror.Close()
+
+	p, err := newGitHubWithMirrors(GitHubConfig{
+		URL:        primary.URL,
+		Mirrors:    []string{mirror.URL},
+		HTTPConfig: HTTPConfig{AllowPrivateNetworks: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := p.GetKeys("octocat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{key}; !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// ldapMirrorStub is a stubLDAP server accepting password that serves key for
+// uid=alice
+func ldapMirrorStub(t *testing.T, password, key string) *stubLDAP {
+	t.Helper()
+	return newStubLDAP(t, password, func(req stubSearch) stubPage {
+		if req.Filter != "(uid=alice)" {
+			return stubPage{}
+		}
+		return stubPage{Entries: map[string]map[string][]string{"uid=alice,dc=example,dc=com": {"sshPublicKey": {key}}}}
+	})
+}
+
+// testLDAPMirrors builds the LDAP provider for urls, the first as the
+// primary and the rest as its mirrors
+func testLDAPMirrors(t *testing.T, urls ...string) KeyProvider {
+	t.Helper()
+	p, err := newLDAPWithMirrors(LDAPConfig{
+		URL:          urls[0],
+		Mirrors:      urls[1:],
+		BindPassword: "secret",
+		BaseDN:       "dc=example,dc=com",
+		KeyAttribute: "sshPublicKey",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestLDAPMirrors(t *testing.T) {
+	primaryKey, secondaryKey := testKey(t, 1, "primary"), testKey(t, 2, "secondary")
+
+	tests := []struct {
+		name          string
+		primary       func(t *testing.T) string
+		username      string
+		want          []string
+		wantErr       bool
+		wantSecondary int
+	}{
+		{
+			name:     "healthy primary serves",
+			primary:  func(t *testing.T) string { return ldapMirrorStub(t, "secret", primaryKey).URL },
+			username: "alice",
+			want:     []string{primaryKey},
+		},
+		{
+			name:          "down primary fails over",
+			primary:       closedLDAPURL,
+			username:      "alice",
+			want:          []string{secondaryKey},
+			wantSecondary: 1,
+		},
+		{
+			name:          "primary refusing the bind fails over",
+			primary:       func(t *testing.T) string { return ldapMirrorStub(t, "rotated", primaryKey).URL },
+			username:      "alice",
+			want:          []string{secondaryKey},
+			wantSecondary: 1,
+		},
+		{
+			name:     "a missing user doesn't fail over",
+			primary:  func(t *testing.T) string { return ldapMirrorStub(t, "secret", primaryKey).URL },
+			username: "nobody",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			captureLog(t)
+			secondary := ldapMirrorStub(t, "secret", secondaryKey)
+			p := testLDAPMirrors(t, tt.primary(t), secondary.URL)
+
+			got, err := p.GetKeys(tt.username)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if n := len(secondary.Searches()); n != tt.wantSecondary {
+				t.Errorf("secondary searched %d times, want %d", n, tt.wantSecondary)
+			}
+		})
+	}
+}
+
+func TestLDAPMirrorsAllDown(t *testing.T) {
+	captureLog(t)
+	p := testLDAPMirrors(t, closedLDAPURL(t), closedLDAPURL(t))
+	if _, err := p.GetKeys("alice"); err == nil || !strings.Contains(err.Error(), "all 2 LDAP endpoints failed") {
+		t.Errorf("got error %v, want every endpoint failed", err)
+	}
+}
+
+func TestLDAPMirrorsPreferLastGood(t *testing.T) {
+	logs := captureLog(t)
+	secondKey, thirdKey := testKey(t, 2, "second"), testKey(t, 3, "third")
+	// the primary refuses the bind, so each attempt on it is counted
+	primary := ldapMirrorStub(t, "rotated", testKey(t, 1, "primary"))
+	second := ldapMirrorStub(t, "secret", secondKey)
+	third := ldapMirrorStub(t, "secret", thirdKey)
+	p := testLDAPMirrors(t, primary.URL, second.URL, third.URL)
+
+	steps := []struct {
+		name        string
+		before      func()
+		want        string
+		wantPrimary int
+	}{
+		{name: "first lookup fails over", want: secondKey, wantPrimary: 1},
+		{name: "last-good server is tried first", want: secondKey, wantPrimary: 1},
+		{
+			name:        "when it goes down the rest are tried in order",
+			before:      func() { second.ln.Close() },
+			want:        thirdKey,
+			wantPrimary: 2,
+		},
+		{name: "the new last-good server is tried first", want: thirdKey, wantPrimary: 2},
+	}
+	for _, s := range steps {
+		if s.before != nil {
+			s.before()
+		}
+		got, err := p.GetKeys("alice")
+		if err != nil || !slices.Equal(got, []string{s.want}) {
+			t.Errorf("%s: got %q, %v, want %q", s.name, got, err, s.want)
+		}
+		if n := primary.Binds(); n != s.wantPrimary {
+			t.Errorf("%s: primary tried %d times, want %d", s.name, n, s.wantPrimary)
+		}
+	}
+	if !strings.Contains(logs.String(), "Preferring LDAP endpoint "+third.URL) {
+		t.Errorf("got logs %q, want the switch to the third server logged", logs)
+	}
+}
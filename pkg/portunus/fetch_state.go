@@ -0,0 +1,100 @@
+package portunus
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"time"
+)
+
+// fetchRecord is what is remembered about the last successful fetch of one
+// provider's keys for one upstream identity
+type fetchRecord struct {
+	Fetched time.Time `json:"fetched"`
+	// Digest is a SHA-256 of the keys, in the order they were returned
+	Digest string `json:"digest"`
+}
+
+// fetchState is the file written by SaveFetchState
+type fetchState struct {
+	ETags   map[string]etagEntry   `json:"etags"`
+	Fetches map[string]fetchRecord `json:"fetches"`
+}
+
+// recordFetch remembers the keys just fetched by source for upstream and
+// reports whether they are the same as the last time it was fetched.
+// Responses served from an ETag after a 304 always count as unchanged.
+func (km *KeyManager) recordFetch(source, upstream string, keys []string) bool {
+	sum := sha256.Sum256([]byte(strings.Join(keys, "\n")))
+	digest := hex.EncodeToString(sum[:])
+	key := source + "/" + upstream
+	if km.byEmail {
+		key += "?by=email"
+	}
+
+	km.mu.Lock()
+	defer km.mu.Unlock()
+	last, seen := km.fetches[key]
+	km.fetches[key] = fetchRecord{Fetched: time.Now(), Digest: digest}
+	return seen && last.Digest == digest
+}
+
+// LoadFetchState restores the ETags and fetch records saved by
+// SaveFetchState, so this run's requests are conditional and blocks whose
+// keys haven't changed are marked Unchanged. A missing file is not an error,
+// since the first run has nothing to load.
+func (km *KeyManager) LoadFetchState(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state fetchState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("invalid fetch state %s: %w", path, err)
+	}
+
+	etags.Lock()
+	for key, entry := range state.ETags {
+		etags.entries[key] = entry
+	}
+	etags.Unlock()
+
+	km.mu.Lock()
+	for key, record := range state.Fetches {
+		km.fetches[key] = record
+	}
+	km.mu.Unlock()
+	return nil
+}
+
+// SaveFetchState atomically writes the ETags and fetch records of every
+// fetch so far to path, with mode 0600
+func (km *KeyManager) SaveFetchState(path string) error {
+	etags.Lock()
+	state := fetchState{ETags: make(map[string]etagEntry, len(etags.entries))}
+	for key, entry := range etags.entries {
+		state.ETags[key] = entry
+	}
+	etags.Unlock()
+
+	km.mu.Lock()
+	state.Fetches = make(map[string]fetchRecord, len(km.fetches))
+	for key, record := range km.fetches {
+		state.Fetches[key] = record
+	}
+	km.mu.Unlock()
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(path, data, 0o600)
+}
@@ -0,0 +1,129 @@
+package portunus
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// forgetETags clears the ETags kept in memory, as a new process starts
+func forgetETags() {
+	etags.Lock()
+	defer etags.Unlock()
+	etags.entries = make(map[string]etagEntry)
+}
+
+func TestFetchState(t *testing.T) {
+	k1, k2 := testKey(t, 1, "one"), testKey(t, 2, "two")
+	var (
+		mu          sync.Mutex
+		body        string
+		notModified bool
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		sum := sha256.Sum256([]byte(body))
+		etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+		w.Header().Set("ETag", etag)
+		if notModified = r.Header.Get("If-None-Match") == etag; notModified {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+	t.Cleanup(forgetETags)
+	statePath := filepath.Join(t.TempDir(), "state.json")
+
+	// each run is a fresh process sharing only the state file
+	runs := []struct {
+		name string
+		keys string
+		// save is false for a run that doesn't write the state back
+		save            bool
+		wantUnchanged   bool
+		wantNotModified bool
+	}{
+		{name: "first run", keys: k1 + "\n", save: true},
+		{name: "nothing changed", keys: k1 + "\n", save: true, wantUnchanged: true, wantNotModified: true},
+		{name: "keys changed", keys: k1 + "\n" + k2 + "\n"},
+		{name: "state not saved by the last run", keys: k1 + "\n" + k2 + "\n", save: true},
+		{name: "unchanged again", keys: k1 + "\n" + k2 + "\n", save: true, wantUnchanged: true, wantNotModified: true},
+	}
+	for _, run := range runs {
+		t.Run(run.name, func(t *testing.T) {
+			mu.Lock()
+			body, notModified = run.keys, false
+			mu.Unlock()
+			forgetETags()
+
+			p, err := NewGitHubProvider(GitHubConfig{URL: srv.URL, HTTPConfig: HTTPConfig{AllowPrivateNetworks: true}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			km := newTestKeyManager(t, Config{
+				Mappings: map[string]UserMapping{"alice": {StaticKeys: []StaticKey{{Key: testKey(t, 3, "")}}, GitHub: Usernames{"octocat"}}},
+			}, WithProvider("github", p))
+			if err := km.LoadFetchState(statePath); err != nil {
+				t.Fatal(err)
+			}
+
+			result, err := km.Resolve(context.Background(), "alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, b := range result.Blocks {
+				if want := b.Source == "github" && run.wantUnchanged; b.Unchanged != want {
+					t.Errorf("%s block unchanged = %v, want %v", b.Source, b.Unchanged, want)
+				}
+			}
+			mu.Lock()
+			if notModified != run.wantNotModified {
+				t.Errorf("server answered 304 = %v, want %v", notModified, run.wantNotModified)
+			}
+			mu.Unlock()
+
+			if run.save {
+				if err := km.SaveFetchState(statePath); err != nil {
+					t.Fatal(err)
+				}
+				if info, err := os.Stat(statePath); err != nil || info.Mode().Perm() != 0o600 {
+					t.Errorf("state file mode = %v, %v, want 0600", info.Mode(), err)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadFetchState(t *testing.T) {
+	dir := t.TempDir()
+	invalid := filepath.Join(dir, "invalid.json")
+	if err := os.WriteFile(invalid, []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		wantErr bool
+	}{
+		{name: "missing file is a first run", path: filepath.Join(dir, "missing.json")},
+		{name: "invalid file", path: invalid, wantErr: true},
+		{name: "unreadable path", path: dir, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			km := newTestKeyManager(t, Config{})
+			if err := km.LoadFetchState(tt.path); (err != nil) != tt.wantErr {
+				t.Errorf("error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package portunus
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// defaultGitHubURL is used when GitHubConfig.URL is unset
+const defaultGitHubURL = "https://github.com/"
+
+type GitHubConfig struct {
+	URL   string `json:"url,omitempty"`
+	Token string `json:"token,omitempty"`
+
+	// App authenticates as a GitHub App installation, taking precedence
+	// over Token
+	App *GitHubAppConfig `json:"app,omitempty"`
+
+	// RequireToken refuses to start without a token or App credentials
+	// instead of silently making unauthenticated requests
+	RequireToken bool `json:"require_token,omitempty"`
+
+	// Mirrors are tried in order, with the same settings, when fetching from
+	// URL fails
+	Mirrors []string `json:"mirrors,omitempty"`
+
+	// MembershipTTL is how long the member lists of github_teams are kept,
+	// defaulting to defaultMembershipTTL
+	MembershipTTL time.Duration `json:"membership_ttl,omitempty"`
+	HTTPConfig
+}
+
+// GitHubProvider implements key fetching from GitHub
+type GitHubProvider struct {
+	http    *httpFetcher
+	baseURL string
+	token   string
+	app     *githubAppTokens
+	members *memberCache
+}
+
+func NewGitHubProvider(config GitHubConfig) (*GitHubProvider, error) {
+	if config.RequireToken && config.Token == "" && config.App == nil {
+		return nil, errors.New("github require_token is set but no token or app is configured")
+	}
+	baseURL := config.URL
+	if baseURL == "" {
+		baseURL = defaultGitHubURL
+	}
+	if !strings.HasSuffix(baseURL, "/") {
+		baseURL += "/"
+	}
+	p := &GitHubProvider{
+		http:    newHTTPFetcher("GitHub", config.HTTPConfig),
+		baseURL: baseURL,
+		token:   config.Token,
+		members: newMemberCache(config.MembershipTTL),
+	}
+	if config.App != nil {
+		app, err := newGitHubAppTokens(*config.App, p.http.client)
+		if err != nil {
+			return nil, err
+		}
+		p.app = app
+	}
+	return p, nil
+}
+
+func (p *GitHubProvider) GetKeys(username string) ([]string, error) {
+	keysURL := fmt.Sprintf("%s%s.keys", p.baseURL, url.PathEscape(username))
+	req, err := http.NewRequest("GET", keysURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.authorize(req); err != nil {
+		return nil, err
+	}
+
+	body, err := p.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	return SplitKeyLines(string(body)), nil
+}
+
+// authorize adds the configured token, or a fresh App installation token, to req
+func (p *GitHubProvider) authorize(req *http.Request) error {
+	token := p.token
+	if p.app != nil {
+		var err error
+		if token, err = p.app.Token(); err != nil {
+			return err
+		}
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "token "+token)
+	}
+	return nil
+}
+
+// Check verifies the configured credentials against the REST API's rate
+// limit endpoint, which rejects bad tokens but needs no particular scope.
+// Without credentials it only checks the base URL answers.
+func (p *GitHubProvider) Check() error {
+	req, err := http.NewRequest("HEAD", p.baseURL, nil)
+	if p.token != "" || p.app != nil {
+		req, err = http.NewRequest("GET", p.apiURL()+"rate_limit", nil)
+	}
+	if err != nil {
+		return err
+	}
+	if err := p.authorize(req); err != nil {
+		return err
+	}
+	_, err = p.http.Do(req)
+	return err
+}
+
+// Members lists the logins in an org, or a team written "org/team", through
+// the REST API
+func (p *GitHubProvider) Members(group string) ([]string, error) {
+	if p.token == "" && p.app == nil {
+		return nil, fmt.Errorf("listing GitHub team %s needs a token or app", group)
+	}
+	org, team, isTeam := strings.Cut(group, "/")
+	path := fmt.Sprintf("orgs/%s/members", url.PathEscape(org))
+	if isTeam {
+		path = fmt.Sprintf("orgs/%s/teams/%s/members", url.PathEscape(org), url.PathEscape(team))
+	}
+
+	return p.members.get(group, func() ([]string, error) {
+		return listPages(func(n int) ([]string, int, error) {
+			req, err := http.NewRequest("GET", fmt.Sprintf("%s%s?per_page=%d&page=%d", p.apiURL(), path, membersPerPage, n), nil)
+			if err != nil {
+				return nil, 0, err
+			}
+			req.Header.Set("Accept", "application/vnd.github+json")
+			if err := p.authorize(req); err != nil {
+				return nil, 0, err
+			}
+			body, err := p.http.Do(req)
+			if err != nil {
+				return nil, 0, err
+			}
+
+			var page []struct {
+				Login string `json:"login"`
+			}
+			if err := json.Unmarshal(body, &page); err != nil {
+				return nil, 0, err
+			}
+			logins := make([]string, 0, len(page))
+			for _, m := range page {
+				logins = append(logins, m.Login)
+			}
+			return logins, len(page), nil
+		})
+	})
+}
+
+// apiURL returns the REST API base for the configured host: api.github.com
+// for github.com and /api/v3/ under GitHub Enterprise Server
+func (p *GitHubProvider) apiURL() string {
+	if p.baseURL == defaultGitHubURL {
+		return defaultGitHubAPIURL
+	}
+	return p.baseURL + "api/v3/"
+}
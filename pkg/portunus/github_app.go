@@ -0,0 +1,187 @@
+package portunus
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// installationTokenSlack is how long before expiry an installation token is
+// replaced, so a token never expires mid-request
+const installationTokenSlack = 5 * time.Minute
+
+// defaultGitHubAPIURL is used when GitHubAppConfig.APIURL is unset
+const defaultGitHubAPIURL = "https://api.github.com/"
+
+// GitHubAppConfig authenticates as a GitHub App installation instead of with
+// a personal access token
+type GitHubAppConfig struct {
+	AppID          int64 `json:"app_id"`
+	InstallationID int64 `json:"installation_id"`
+
+	// PrivateKey is the App's PEM encoded private key. PrivateKeyFile reads
+	// it from a file instead.
+	PrivateKey     string `json:"private_key,omitempty"`
+	PrivateKeyFile string `json:"private_key_file,omitempty"`
+
+	// APIURL is the REST API base, defaulting to https://api.github.com/
+	APIURL string `json:"api_url,omitempty"`
+}
+
+// githubAppTokens mints installation tokens and caches each until shortly
+// before it expires
+type githubAppTokens struct {
+	client   *http.Client
+	tokenURL string
+	appID    int64
+	key      *rsa.PrivateKey
+	now      func() time.Time
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func newGitHubAppTokens(config GitHubAppConfig, client *http.Client) (*githubAppTokens, error) {
+	if config.AppID == 0 || config.InstallationID == 0 {
+		return nil, errors.New("github app requires app_id and installation_id")
+	}
+
+	pemData := []byte(config.PrivateKey)
+	if config.PrivateKeyFile != "" {
+		data, err := os.ReadFile(config.PrivateKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading github app private key: %w", err)
+		}
+		pemData = data
+	}
+	key, err := parseRSAPrivateKey(pemData)
+	if err != nil {
+		return nil, fmt.Errorf("invalid github app private key: %w", err)
+	}
+
+	apiURL := config.APIURL
+	if apiURL == "" {
+		apiURL = defaultGitHubAPIURL
+	}
+	if !strings.HasSuffix(apiURL, "/") {
+		apiURL += "/"
+	}
+
+	return &githubAppTokens{
+		client:   client,
+		tokenURL: fmt.Sprintf("%sapp/installations/%d/access_tokens", apiURL, config.InstallationID),
+		appID:    config.AppID,
+		key:      key,
+		now:      time.Now,
+	}, nil
+}
+
+// parseRSAPrivateKey accepts the PKCS #1 keys GitHub issues as well as PKCS #8
+func parseRSAPrivateKey(pemData []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an RSA key")
+	}
+	return key, nil
+}
+
+// Token returns a valid installation token, minting a new one when there is
+// none cached or the cached one is about to expire
+func (t *githubAppTokens) Token() (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.token != "" && t.now().Add(installationTokenSlack).Before(t.expires) {
+		return t.token, nil
+	}
+
+	jwt, err := t.appJWT()
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest("POST", t.tokenURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	req.Header.Set("Accept", "application/vnd.github+json")
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return "", newStatusError("GitHub App", req, resp)
+	}
+
+	var minted struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&minted); err != nil {
+		return "", fmt.Errorf("error decoding GitHub installation token: %w", err)
+	}
+	if minted.Token == "" {
+		return "", errors.New("GitHub installation token response had no token")
+	}
+
+	t.token, t.expires = minted.Token, minted.ExpiresAt
+	return t.token, nil
+}
+
+// appJWT signs the short-lived RS256 JWT that identifies the App when
+// requesting installation tokens. iat is backdated to allow for clock drift.
+func (t *githubAppTokens) appJWT() (string, error) {
+	now := t.now()
+	jwt, err := signJWT(t.key, map[string]any{
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": fmt.Sprint(t.appID),
+	})
+	if err != nil {
+		return "", fmt.Errorf("error signing GitHub App JWT: %w", err)
+	}
+	return jwt, nil
+}
+
+// signJWT encodes claims as a JWT signed with key using RS256
+func signJWT(key *rsa.PrivateKey, claims map[string]any) (string, error) {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	digest := sha256.Sum256([]byte(signingInput))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
@@ -0,0 +1,185 @@
+package portunus
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stubTokenEndpoint serves installation tokens for installation 42 of App
+// 7, valid for an hour from now(), after checking the App JWT against key
+type stubTokenEndpoint struct {
+	key   *rsa.PublicKey
+	now   func() time.Time
+	fail  atomic.Bool
+	mints atomic.Int32
+}
+
+func (s *stubTokenEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || r.URL.Path != "/app/installations/42/access_tokens" {
+		http.NotFound(w, r)
+		return
+	}
+	if s.fail.Load() {
+		http.Error(w, "boom", http.StatusInternalServerError)
+		return
+	}
+	jwt, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || verifyJWT(s.key, jwt) != "7" {
+		http.Error(w, "bad jwt", http.StatusUnauthorized)
+		return
+	}
+	n := s.mints.Add(1)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{
+		"token":      fmt.Sprintf("tok-%d", n),
+		"expires_at": s.now().Add(time.Hour),
+	})
+}
+
+// verifyJWT checks an RS256 JWT against key and returns its iss claim, or ""
+func verifyJWT(key *rsa.PublicKey, jwt string) string {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return ""
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) != nil {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ""
+	}
+	var claims struct {
+		Iss string `json:"iss"`
+	}
+	json.Unmarshal(payload, &claims)
+	return claims.Iss
+}
+
+// testAppKey returns a fresh RSA key and its PKCS #1 PEM encoding
+func testAppKey(t *testing.T) (*rsa.PrivateKey, string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+}
+
+func TestGitHubAppTokens(t *testing.T) {
+	key, keyPEM := testAppKey(t)
+
+	tests := []struct {
+		name      string
+		advance   time.Duration
+		wantToken string
+		wantMints int32
+	}{
+		{name: "fresh token is cached", advance: 10 * time.Minute, wantToken: "tok-1", wantMints: 1},
+		{name: "token near expiry is replaced", advance: 56 * time.Minute, wantToken: "tok-2", wantMints: 2},
+		{name: "expired token is replaced", advance: 2 * time.Hour, wantToken: "tok-2", wantMints: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Now()
+			clock := func() time.Time { return now }
+			endpoint := &stubTokenEndpoint{key: &key.PublicKey, now: clock}
+			srv := httptest.NewServer(endpoint)
+			defer srv.Close()
+
+			tokens, err := newGitHubAppTokens(GitHubAppConfig{AppID: 7, InstallationID: 42, PrivateKey: keyPEM, APIURL: srv.URL}, srv.Client())
+			if err != nil {
+				t.Fatal(err)
+			}
+			tokens.now = clock
+
+			if token, err := tokens.Token(); err != nil || token != "tok-1" {
+				t.Fatalf("first token = %q, %v, want tok-1", token, err)
+			}
+			now = now.Add(tt.advance)
+			token, err := tokens.Token()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if token != tt.wantToken || endpoint.mints.Load() != tt.wantMints {
+				t.Errorf("token = %q after %d mints, want %q after %d", token, endpoint.mints.Load(), tt.wantToken, tt.wantMints)
+			}
+		})
+	}
+}
+
+func TestGitHubAppTokenErrors(t *testing.T) {
+	key, keyPEM := testAppKey(t)
+	endpoint := &stubTokenEndpoint{key: &key.PublicKey, now: time.Now}
+	endpoint.fail.Store(true)
+	srv := httptest.NewServer(endpoint)
+	defer srv.Close()
+
+	tokens, err := newGitHubAppTokens(GitHubAppConfig{AppID: 7, InstallationID: 42, PrivateKey: keyPEM, APIURL: srv.URL}, srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tokens.Token(); err == nil {
+		t.Error("Token succeeded against a failing endpoint")
+	}
+
+	for _, config := range []GitHubAppConfig{
+		{InstallationID: 42, PrivateKey: keyPEM},
+		{AppID: 7, InstallationID: 42, PrivateKey: "not a key"},
+	} {
+		if _, err := newGitHubAppTokens(config, srv.Client()); err == nil {
+			t.Errorf("newGitHubAppTokens accepted %+v", config)
+		}
+	}
+}
+
+func TestGitHubProviderUsesInstallationToken(t *testing.T) {
+	key, keyPEM := testAppKey(t)
+	endpoint := &stubTokenEndpoint{key: &key.PublicKey, now: time.Now}
+	mux := http.NewServeMux()
+	mux.Handle("/app/", endpoint)
+	mux.HandleFunc("/octocat.keys", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "token tok-1" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintln(w, "ssh-ed25519 AAAA")
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	p, err := NewGitHubProvider(GitHubConfig{
+		URL:        srv.URL,
+		App:        &GitHubAppConfig{AppID: 7, InstallationID: 42, PrivateKey: keyPEM, APIURL: srv.URL},
+		HTTPConfig: HTTPConfig{AllowPrivateNetworks: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		if keys, err := p.GetKeys("octocat"); err != nil || len(keys) != 1 {
+			t.Fatalf("GetKeys = %q, %v", keys, err)
+		}
+	}
+	if n := endpoint.mints.Load(); n != 1 {
+		t.Errorf("minted %d tokens, want one reused", n)
+	}
+}
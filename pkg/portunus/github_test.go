@@ -0,0 +1,143 @@
+package portunus
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestRequireToken(t *testing.T) {
+	var auth http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Clone()
+	}))
+	defer srv.Close()
+	httpConfig := HTTPConfig{AllowPrivateNetworks: true}
+
+	tests := []struct {
+		name       string
+		build      func() (KeyProvider, error)
+		wantErr    bool
+		wantHeader string
+		wantValue  string
+	}{
+		{
+			name: "github without a token",
+			build: func() (KeyProvider, error) {
+				return NewGitHubProvider(GitHubConfig{URL: srv.URL, RequireToken: true, HTTPConfig: httpConfig})
+			},
+			wantErr: true,
+		},
+		{
+			name: "github with a token",
+			build: func() (KeyProvider, error) {
+				return NewGitHubProvider(GitHubConfig{URL: srv.URL, Token: "hub", RequireToken: true, HTTPConfig: httpConfig})
+			},
+			wantHeader: "Authorization",
+			wantValue:  "token hub",
+		},
+		{
+			name: "gitlab without a token",
+			build: func() (KeyProvider, error) {
+				return NewGitLabProvider(GitLabConfig{URL: srv.URL, RequireToken: true, HTTPConfig: httpConfig})
+			},
+			wantErr: true,
+		},
+		{
+			name: "gitlab with a token",
+			build: func() (KeyProvider, error) {
+				return NewGitLabProvider(GitLabConfig{URL: srv.URL, Token: "lab", RequireToken: true, HTTPConfig: httpConfig})
+			},
+			wantHeader: "PRIVATE-TOKEN",
+			wantValue:  "lab",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := tt.build()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			auth = nil
+			if _, err := p.GetKeys("alice"); err != nil {
+				t.Fatal(err)
+			}
+			if got := auth.Get(tt.wantHeader); got != tt.wantValue {
+				t.Errorf("%s = %q, want %q", tt.wantHeader, got, tt.wantValue)
+			}
+		})
+	}
+}
+
+func TestRequireTokenFailsAtLoad(t *testing.T) {
+	config := Config{
+		Mappings: map[string]UserMapping{"alice": {GitHub: Usernames{"octocat"}}},
+		GitHub:   GitHubConfig{RequireToken: true},
+	}
+	if _, err := NewKeyManagerFromConfig(config); err == nil {
+		t.Error("NewKeyManagerFromConfig accepted require_token without a token")
+	}
+}
+
+func TestZeroKeys(t *testing.T) {
+	staticKey := testKey(t, 1, "static")
+
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		wantErr bool
+	}{
+		{name: "empty body", status: http.StatusOK},
+		{name: "blank lines", status: http.StatusOK, body: "\n\r\n\n"},
+		{name: "server error", status: http.StatusInternalServerError, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+
+			p, err := NewGitHubProvider(GitHubConfig{URL: srv.URL, HTTPConfig: HTTPConfig{AllowPrivateNetworks: true}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys, err := p.GetKeys("octocat")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if len(keys) != 0 {
+				t.Errorf("got keys %q, want none", keys)
+			}
+
+			// failing closed tells an account with no keys from a failed fetch
+			km := newTestKeyManager(t, Config{
+				Mappings: map[string]UserMapping{"alice": {
+					StaticKeys: []StaticKey{{Key: staticKey}},
+					GitHub:     Usernames{"octocat"},
+				}},
+				FailClosed: true,
+			}, WithProvider("github", p))
+			result, err := km.Resolve(context.Background(), "alice")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolve error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if want := []string{staticKey}; !slices.Equal(stripHeaders(result.Lines()), want) {
+				t.Errorf("got %q, want %q", result.Lines(), want)
+			}
+			if len(result.Blocks) != 1 {
+				t.Errorf("got %d blocks, want only the static one", len(result.Blocks))
+			}
+		})
+	}
+}
@@ -0,0 +1,246 @@
+package portunus
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// defaultGitLabURL is used when GitLabConfig.URL is unset
+const defaultGitLabURL = "https://gitlab.com/"
+
+type GitLabConfig struct {
+	URL   string `json:"url,omitempty"`
+	Token string `json:"token,omitempty"`
+	HTTPConfig
+
+	// RequireToken refuses to start without a token instead of silently
+	// making unauthenticated requests
+	RequireToken bool `json:"require_token,omitempty"`
+
+	// UseAPI fetches keys from the REST API (/api/v4/users/:id/keys) rather
+	// than the public username.keys endpoint
+	UseAPI bool `json:"use_api,omitempty"`
+
+	// KeyMetadata precedes each key fetched through the API with a comment
+	// giving its title and creation and expiry dates, for spotting stale keys
+	KeyMetadata bool `json:"key_metadata,omitempty"`
+
+	// IncludeExpired serves API keys whose expires_at has passed. By default
+	// they are dropped, since GitLab keeps listing them after expiry.
+	IncludeExpired bool `json:"include_expired,omitempty"`
+
+	// ExpiryComments precedes each API key that has an expires_at with a
+	// "# expires:" line, see Config.ExpiryComments
+	ExpiryComments bool `json:"expiry_comments,omitempty"`
+
+	// MembershipTTL is how long the member lists of gitlab_groups are kept,
+	// defaulting to defaultMembershipTTL
+	MembershipTTL time.Duration `json:"membership_ttl,omitempty"`
+
+	// Mirrors are tried in order, with the same settings, when fetching from
+	// URL fails
+	Mirrors []string `json:"mirrors,omitempty"`
+}
+
+// GitLabProvider implements key fetching from GitLab
+type GitLabProvider struct {
+	http    *httpFetcher
+	baseURL string
+	token   string
+	useAPI  bool
+
+	keyMetadata    bool
+	includeExpired bool
+	expiryComments bool
+	members        *memberCache
+}
+
+// gitlabUser is the subset of a /api/v4/users entry we need
+type gitlabUser struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+}
+
+// gitlabKey is an SSH key as returned by /api/v4/users/:id/keys
+type gitlabKey struct {
+	Key       string     `json:"key"`
+	Title     string     `json:"title"`
+	CreatedAt *time.Time `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// gitlabMetadataPrefix starts the comment written by metadataComment
+const gitlabMetadataPrefix = "# gitlab key"
+
+// metadataComment describes the key's title and dates as a comment line
+func (k gitlabKey) metadataComment() string {
+	parts := []string{gitlabMetadataPrefix}
+	if title := strings.Join(strings.Fields(k.Title), " "); title != "" {
+		parts[0] += fmt.Sprintf(" %q", title)
+	}
+	if k.CreatedAt != nil {
+		parts = append(parts, "created "+k.CreatedAt.UTC().Format(time.DateOnly))
+	}
+	if k.ExpiresAt != nil {
+		parts = append(parts, "expires "+k.ExpiresAt.UTC().Format(time.DateOnly))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func NewGitLabProvider(config GitLabConfig) (*GitLabProvider, error) {
+	if config.RequireToken && config.Token == "" {
+		return nil, errors.New("gitlab require_token is set but no token is configured")
+	}
+	baseURL := config.URL
+	if baseURL == "" {
+		baseURL = defaultGitLabURL
+	}
+	// Self-hosted installs may live under a subpath, e.g.
+	// https://git.example.com/gitlab, so everything is appended after the base
+	if !strings.HasSuffix(baseURL, "/") {
+		baseURL += "/"
+	}
+	return &GitLabProvider{
+		http:           newHTTPFetcher("GitLab", config.HTTPConfig),
+		baseURL:        baseURL,
+		token:          config.Token,
+		useAPI:         config.UseAPI,
+		keyMetadata:    config.KeyMetadata,
+		includeExpired: config.IncludeExpired,
+		expiryComments: config.ExpiryComments,
+		members:        newMemberCache(config.MembershipTTL),
+	}, nil
+}
+
+func (p *GitLabProvider) GetKeys(username string) ([]string, error) {
+	if p.useAPI {
+		return p.getAPIKeys(username)
+	}
+
+	body, err := p.get(fmt.Sprintf("%s%s.keys", p.baseURL, url.PathEscape(username)))
+	if err != nil {
+		return nil, err
+	}
+	return SplitKeyLines(string(body)), nil
+}
+
+// getAPIKeys resolves username to a user ID, then lists that user's keys
+func (p *GitLabProvider) getAPIKeys(username string) ([]string, error) {
+	id, err := p.userID(username)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := p.get(fmt.Sprintf("%sapi/v4/users/%d/keys", p.baseURL, id))
+	if err != nil {
+		return nil, err
+	}
+
+	var apiKeys []gitlabKey
+	if err := json.Unmarshal(body, &apiKeys); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	keys := make([]string, 0, len(apiKeys))
+	for _, k := range apiKeys {
+		if !p.includeExpired && k.ExpiresAt != nil && !now.Before(*k.ExpiresAt) {
+			log.Printf("Skipping expired GitLab key %q for %s", k.Title, username)
+			continue
+		}
+		if p.keyMetadata {
+			keys = append(keys, k.metadataComment())
+		}
+		if p.expiryComments && k.ExpiresAt != nil {
+			keys = append(keys, expiryComment(*k.ExpiresAt))
+		}
+		keys = append(keys, SplitKeyLines(k.Key)...)
+	}
+	return keys, nil
+}
+
+// userID looks up the numeric ID for username via /api/v4/users?username=
+func (p *GitLabProvider) userID(username string) (int, error) {
+	body, err := p.get(fmt.Sprintf("%sapi/v4/users?username=%s", p.baseURL, url.QueryEscape(username)))
+	if err != nil {
+		return 0, err
+	}
+
+	var users []gitlabUser
+	if err := json.Unmarshal(body, &users); err != nil {
+		return 0, err
+	}
+	for _, u := range users {
+		if strings.EqualFold(u.Username, username) {
+			return u.ID, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: %s", errUserNotFound, username)
+}
+
+// Check fetches the token's own user when a token is configured, which fails
+// on a bad token, and otherwise checks the base URL answers
+func (p *GitLabProvider) Check() error {
+	if p.token == "" {
+		req, err := http.NewRequest("HEAD", p.baseURL, nil)
+		if err != nil {
+			return err
+		}
+		_, err = p.http.Do(req)
+		return err
+	}
+	_, err := p.get(p.baseURL + "api/v4/user")
+	return err
+}
+
+// Members lists the active members of a group, including those inherited
+// from parent groups, through the REST API
+func (p *GitLabProvider) Members(group string) ([]string, error) {
+	if p.token == "" {
+		return nil, fmt.Errorf("listing GitLab group %s needs a token", group)
+	}
+
+	return p.members.get(group, func() ([]string, error) {
+		return listPages(func(n int) ([]string, int, error) {
+			body, err := p.get(fmt.Sprintf("%sapi/v4/groups/%s/members/all?per_page=%d&page=%d", p.baseURL, url.PathEscape(group), membersPerPage, n))
+			if err != nil {
+				return nil, 0, err
+			}
+
+			var page []struct {
+				Username string `json:"username"`
+				State    string `json:"state"`
+			}
+			if err := json.Unmarshal(body, &page); err != nil {
+				return nil, 0, err
+			}
+			usernames := make([]string, 0, len(page))
+			for _, m := range page {
+				if m.State == "" || m.State == "active" {
+					usernames = append(usernames, m.Username)
+				}
+			}
+			return usernames, len(page), nil
+		})
+	})
+}
+
+// get performs an authenticated GET and returns the response body
+func (p *GitLabProvider) get(rawURL string) ([]byte, error) {
+	req, err := http.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.token != "" {
+		req.Header.Set("PRIVATE-TOKEN", p.token)
+	}
+
+	return p.http.Do(req)
+}
@@ -0,0 +1,280 @@
+package portunus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+// gitlabStub serves the user lookup and key listing of the GitLab API for
+// user "alice" with id 42
+func gitlabStub(t *testing.T, keys []gitlabKey) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v4/users", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("username") != "alice" {
+			json.NewEncoder(w).Encode([]gitlabUser{})
+			return
+		}
+		json.NewEncoder(w).Encode([]gitlabUser{{ID: 42, Username: "alice"}})
+	})
+	mux.HandleFunc("/api/v4/users/42/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(keys)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestGitLabKeyMetadataFollowsItsKey(t *testing.T) {
+	k1, k2 := testKey(t, 1, "one"), testKey(t, 2, "two")
+	if sortKeyLines([]string{k1, k2})[0] == k1 {
+		k1, k2 = k2, k1
+	}
+	created := time.Date(2024, 5, 6, 0, 0, 0, 0, time.UTC)
+	expires := time.Now().Add(24 * time.Hour).UTC().Truncate(time.Second)
+	srv := gitlabStub(t, []gitlabKey{
+		{Key: k1, Title: "laptop", CreatedAt: &created, ExpiresAt: &expires},
+		{Key: k2, Title: "desktop", CreatedAt: &created},
+	})
+	laptop := gitlabKey{Title: "laptop", CreatedAt: &created, ExpiresAt: &expires}.metadataComment()
+	desktop := gitlabKey{Title: "desktop", CreatedAt: &created}.metadataComment()
+	header := "# gitlab: alice (alice)"
+
+	tests := []struct {
+		name   string
+		config func(*Config)
+		want   []string
+	}{
+		{
+			name:   "as listed",
+			config: func(*Config) {},
+			want:   []string{header, laptop, expiryComment(expires), k1, desktop, k2},
+		},
+		{
+			name:   "sort_keys",
+			config: func(c *Config) { c.SortKeys = true },
+			want:   []string{header, desktop, k2, laptop, expiryComment(expires), k1},
+		},
+		{
+			name:   "max_keys_per_user",
+			config: func(c *Config) { c.MaxKeysPerUser = 1 },
+			want:   []string{header, laptop, expiryComment(expires), k1},
+		},
+		{
+			name: "dedup against static",
+			config: func(c *Config) {
+				c.Dedup = true
+				c.Mappings["alice"] = UserMapping{GitLab: Usernames{"alice"}, StaticKeys: []StaticKey{{Key: k1}}}
+			},
+			want: []string{"# static: alice", k1, header, desktop, k2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := Config{
+				Mappings:       map[string]UserMapping{"alice": {GitLab: Usernames{"alice"}}},
+				GitLab:         GitLabConfig{URL: srv.URL, UseAPI: true, KeyMetadata: true, ExpiryComments: true},
+				ExpiryComments: true,
+			}
+			config.GitLab.AllowPrivateNetworks = true
+			tt.config(&config)
+			km, err := NewKeyManagerFromConfig(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			result, err := km.Resolve(context.Background(), "alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := flattenBlocks(result.Blocks); !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGitLabSubpathAndAPILookup(t *testing.T) {
+	key := testKey(t, 1, "alice")
+	var requests []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/gitlab/alice.keys", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(key + "\n"))
+	})
+	mux.HandleFunc("/gitlab/api/v4/users", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("PRIVATE-TOKEN") != "secret" {
+			t.Errorf("PRIVATE-TOKEN = %q", r.Header.Get("PRIVATE-TOKEN"))
+		}
+		users := []gitlabUser{}
+		if r.URL.Query().Get("username") == "alice" {
+			users = append(users, gitlabUser{ID: 7, Username: "Alice"})
+		}
+		json.NewEncoder(w).Encode(users)
+	})
+	mux.HandleFunc("/gitlab/api/v4/users/7/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode([]gitlabKey{{Key: key}})
+	})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path)
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	tests := []struct {
+		name         string
+		url          string
+		useAPI       bool
+		username     string
+		want         []string
+		wantRequests []string
+		wantErr      error
+	}{
+		{
+			name:         "public keys under a subpath",
+			url:          srv.URL + "/gitlab",
+			username:     "alice",
+			want:         []string{key},
+			wantRequests: []string{"/gitlab/alice.keys"},
+		},
+		{
+			name:         "trailing slash",
+			url:          srv.URL + "/gitlab/",
+			username:     "alice",
+			want:         []string{key},
+			wantRequests: []string{"/gitlab/alice.keys"},
+		},
+		{
+			name:         "api looks up the id then the keys",
+			url:          srv.URL + "/gitlab",
+			useAPI:       true,
+			username:     "alice",
+			want:         []string{key},
+			wantRequests: []string{"/gitlab/api/v4/users", "/gitlab/api/v4/users/7/keys"},
+		},
+		{
+			name:         "api user not found",
+			url:          srv.URL + "/gitlab",
+			useAPI:       true,
+			username:     "bob",
+			wantRequests: []string{"/gitlab/api/v4/users"},
+			wantErr:      errUserNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests = nil
+			config := GitLabConfig{URL: tt.url, Token: "secret", UseAPI: tt.useAPI}
+			config.AllowPrivateNetworks = true
+			p, err := NewGitLabProvider(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := p.GetKeys(tt.username)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if !slices.Equal(requests, tt.wantRequests) {
+				t.Errorf("requests = %q, want %q", requests, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestGitLabKeyMetadata(t *testing.T) {
+	key := testKey(t, 1, "alice@laptop")
+	created := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		metadata bool
+		key      gitlabKey
+		want     []string
+	}{
+		{
+			name: "metadata off",
+			key:  gitlabKey{Key: key, Title: "laptop", CreatedAt: &created},
+			want: []string{key},
+		},
+		{
+			name:     "title and creation date",
+			metadata: true,
+			key:      gitlabKey{Key: key, Title: "laptop", CreatedAt: &created},
+			want:     []string{`# gitlab key "laptop", created 2024-05-06`, key},
+		},
+		{
+			name:     "title whitespace is collapsed",
+			metadata: true,
+			key:      gitlabKey{Key: key, Title: "work\nlaptop  ", CreatedAt: &created},
+			want:     []string{`# gitlab key "work laptop", created 2024-05-06`, key},
+		},
+		{
+			name:     "no timestamps available",
+			metadata: true,
+			key:      gitlabKey{Key: key},
+			want:     []string{"# gitlab key", key},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := gitlabStub(t, []gitlabKey{tt.key})
+			config := GitLabConfig{URL: srv.URL, UseAPI: true, KeyMetadata: tt.metadata}
+			config.AllowPrivateNetworks = true
+			p, err := NewGitLabProvider(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := p.GetKeys("alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGitLabExpiredKeys(t *testing.T) {
+	current, expired, undated := testKey(t, 1, "current"), testKey(t, 2, "expired"), testKey(t, 3, "undated")
+	past, future := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	keys := []gitlabKey{
+		{Key: current, Title: "current", ExpiresAt: &future},
+		{Key: expired, Title: "expired", ExpiresAt: &past},
+		{Key: undated, Title: "undated"},
+	}
+
+	tests := []struct {
+		name           string
+		includeExpired bool
+		want           []string
+	}{
+		{name: "expired keys dropped by default", want: []string{current, undated}},
+		{name: "include_expired", includeExpired: true, want: []string{current, expired, undated}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := gitlabStub(t, keys)
+			config := GitLabConfig{URL: srv.URL, UseAPI: true, IncludeExpired: tt.includeExpired}
+			config.AllowPrivateNetworks = true
+			p, err := NewGitLabProvider(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := p.GetKeys("alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
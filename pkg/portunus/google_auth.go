@@ -0,0 +1,190 @@
+package portunus
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// googleCredentialsEnv names the application default credentials file
+	googleCredentialsEnv = "GOOGLE_APPLICATION_CREDENTIALS"
+
+	// googleScope is the OAuth scope requested for API access
+	googleScope = "https://www.googleapis.com/auth/cloud-platform"
+
+	// googleTokenURL is used when a credentials file has no token_uri
+	googleTokenURL = "https://oauth2.googleapis.com/token"
+
+	// googleMetadataTokenURL serves tokens for the instance's service
+	// account on Compute Engine
+	googleMetadataTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+	// googleTokenSlack is how long before expiry an access token is replaced
+	googleTokenSlack = time.Minute
+)
+
+// metadataClient fetches tokens from the metadata server
+var metadataClient = &http.Client{Timeout: 10 * time.Second}
+
+// googleTokenSource returns OAuth2 access tokens for Google APIs. It is an
+// interface so providers can be given a fixed token in place of real
+// credentials.
+type googleTokenSource interface {
+	Token() (string, error)
+}
+
+// googleCredentials is the subset of a service account key or gcloud
+// authorized user file that is needed to mint tokens
+type googleCredentials struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// newGoogleTokenSource loads credentialsFile, or when it is empty the
+// application default credentials: the file named by
+// GOOGLE_APPLICATION_CREDENTIALS, else the metadata server's service account.
+// The metadata server is link-local, so it is reached with a plain client
+// rather than through the provider's allowed_hosts policy.
+func newGoogleTokenSource(credentialsFile string, client *http.Client) (googleTokenSource, error) {
+	if credentialsFile == "" {
+		credentialsFile = os.Getenv(googleCredentialsEnv)
+	}
+	if credentialsFile == "" {
+		return &cachedGoogleToken{mint: func() (string, time.Duration, error) {
+			req, err := http.NewRequest("GET", googleMetadataTokenURL, nil)
+			if err != nil {
+				return "", 0, err
+			}
+			req.Header.Set("Metadata-Flavor", "Google")
+			return doGoogleTokenRequest(metadataClient, req)
+		}}, nil
+	}
+
+	data, err := os.ReadFile(credentialsFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading Google credentials: %w", err)
+	}
+	var creds googleCredentials
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return nil, fmt.Errorf("invalid Google credentials %s: %w", credentialsFile, err)
+	}
+	tokenURL := creds.TokenURI
+	if tokenURL == "" {
+		tokenURL = googleTokenURL
+	}
+
+	switch creds.Type {
+	case "service_account":
+		key, err := parseRSAPrivateKey([]byte(creds.PrivateKey))
+		if err != nil {
+			return nil, fmt.Errorf("invalid Google service account key: %w", err)
+		}
+		return &cachedGoogleToken{mint: func() (string, time.Duration, error) {
+			return serviceAccountToken(client, tokenURL, creds.ClientEmail, key)
+		}}, nil
+	case "authorized_user":
+		return &cachedGoogleToken{mint: func() (string, time.Duration, error) {
+			form := url.Values{
+				"grant_type":    {"refresh_token"},
+				"client_id":     {creds.ClientID},
+				"client_secret": {creds.ClientSecret},
+				"refresh_token": {creds.RefreshToken},
+			}
+			return postGoogleTokenForm(client, tokenURL, form)
+		}}, nil
+	}
+	return nil, fmt.Errorf("unsupported Google credentials type %q in %s", creds.Type, credentialsFile)
+}
+
+// serviceAccountToken exchanges a JWT signed with the service account's key
+// for an access token
+func serviceAccountToken(client *http.Client, tokenURL, email string, key *rsa.PrivateKey) (string, time.Duration, error) {
+	now := time.Now()
+	assertion, err := signJWT(key, map[string]any{
+		"iss":   email,
+		"scope": googleScope,
+		"aud":   tokenURL,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", 0, fmt.Errorf("error signing Google service account JWT: %w", err)
+	}
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}
+	return postGoogleTokenForm(client, tokenURL, form)
+}
+
+func postGoogleTokenForm(client *http.Client, tokenURL string, form url.Values) (string, time.Duration, error) {
+	req, err := http.NewRequest("POST", tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return doGoogleTokenRequest(client, req)
+}
+
+// doGoogleTokenRequest sends a token request and returns the access token
+// and how long it lasts
+func doGoogleTokenRequest(client *http.Client, req *http.Request) (string, time.Duration, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, newStatusError("Google token", req, resp)
+	}
+
+	var minted struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&minted); err != nil {
+		return "", 0, fmt.Errorf("error decoding Google token: %w", err)
+	}
+	if minted.AccessToken == "" {
+		return "", 0, errors.New("Google token response had no access_token")
+	}
+	return minted.AccessToken, time.Duration(minted.ExpiresIn) * time.Second, nil
+}
+
+// cachedGoogleToken keeps the last token mint returned until shortly before
+// it expires
+type cachedGoogleToken struct {
+	mint func() (string, time.Duration, error)
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func (c *cachedGoogleToken) Token() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token != "" && time.Now().Add(googleTokenSlack).Before(c.expires) {
+		return c.token, nil
+	}
+	token, lifetime, err := c.mint()
+	if err != nil {
+		return "", err
+	}
+	c.token, c.expires = token, time.Now().Add(lifetime)
+	return token, nil
+}
@@ -0,0 +1,124 @@
+package portunus
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// testKey returns a distinct ed25519 authorized_keys line for each n, with
+// comment appended when it isn't empty
+func testKey(t testing.TB, n int, comment string) string {
+	t.Helper()
+	seed := bytes.Repeat([]byte{byte(n)}, ed25519.SeedSize)
+	pub, err := ssh.NewPublicKey(ed25519.NewKeyFromSeed(seed).Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub)))
+	if comment != "" {
+		line += " " + comment
+	}
+	return line
+}
+
+// fakeProvider serves the keys listed for each upstream, or err, counting
+// the lookups it gets
+type fakeProvider struct {
+	keys map[string][]string
+	err  error
+
+	mu    sync.Mutex
+	calls int
+}
+
+func (p *fakeProvider) GetKeys(upstream string) ([]string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.calls++
+	if p.err != nil {
+		return nil, p.err
+	}
+	return p.keys[upstream], nil
+}
+
+// Calls returns how many lookups p has served
+func (p *fakeProvider) Calls() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.calls
+}
+
+// gatedProvider serves keys, blocking every lookup after the first free
+// ones until release is closed
+type gatedProvider struct {
+	keys    []string
+	free    int32
+	release chan struct{}
+	calls   atomic.Int32
+}
+
+func (p *gatedProvider) GetKeys(upstream string) ([]string, error) {
+	if p.calls.Add(1) > p.free {
+		<-p.release
+	}
+	return p.keys, nil
+}
+
+// newTestKeyManager builds a KeyManager from config, failing the test if
+// that fails
+func newTestKeyManager(t testing.TB, config Config, opts ...Option) *KeyManager {
+	t.Helper()
+	km, err := NewKeyManagerFromConfig(config, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return km
+}
+
+// resolveLines resolves login and returns its output lines, failing the
+// test on an error
+func resolveLines(t testing.TB, km *KeyManager, login string) []string {
+	t.Helper()
+	result, err := km.Resolve(context.Background(), login)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return flattenBlocks(result.Blocks)
+}
+
+// logBuffer collects log output, safe for the goroutines providers log from
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureLog sends the standard logger's output to a buffer until the test
+// ends
+func captureLog(t testing.TB) *logBuffer {
+	t.Helper()
+	buf := &logBuffer{}
+	out := log.Writer()
+	log.SetOutput(buf)
+	t.Cleanup(func() { log.SetOutput(out) })
+	return buf
+}
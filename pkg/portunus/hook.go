@@ -0,0 +1,145 @@
+package portunus
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const defaultHookTimeout = 5 * time.Second
+
+// HookConfig runs a side effect after each lookup, such as telling a webhook
+// which host fetched a login's keys. It runs in the background and failures
+// are only logged. It gets a summary of the lookup, never the keys.
+type HookConfig struct {
+	Enabled bool `json:"enabled,omitempty"`
+
+	// Command is split on whitespace into an argv, with {username} in any
+	// argument replaced with the login, and gets the summary as JSON on
+	// stdin. It is never passed through a shell.
+	Command string `json:"command,omitempty"`
+
+	// URL receives the summary as a JSON POST
+	URL string `json:"url,omitempty"`
+
+	// Timeout bounds the command and the request alike, 5s by default
+	Timeout time.Duration `json:"timeout,omitempty"`
+}
+
+// hookPayload is the lookup summary sent to the hook
+type hookPayload struct {
+	Time     time.Time `json:"time"`
+	Username string    `json:"username"`
+	Host     string    `json:"host"`
+	Sources  []string  `json:"sources"`
+	Keys     int       `json:"keys"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// hook runs the configured HookConfig
+type hook struct {
+	argv    []string
+	url     string
+	timeout time.Duration
+	client  *http.Client
+}
+
+func newHook(config HookConfig) (*hook, error) {
+	if config.Command == "" && config.URL == "" {
+		return nil, errors.New("hook: command or url is required")
+	}
+	if config.URL != "" {
+		u, err := url.Parse(config.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("hook: invalid url %q", config.URL)
+		}
+	}
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = defaultHookTimeout
+	}
+	return &hook{
+		argv:    strings.Fields(config.Command),
+		url:     config.URL,
+		timeout: timeout,
+		client:  &http.Client{Timeout: timeout},
+	}, nil
+}
+
+// run sends payload to the command and the URL, logging failures
+func (h *hook) run(payload hookPayload) {
+	data, _ := json.Marshal(payload)
+	if len(h.argv) > 0 {
+		args := make([]string, len(h.argv))
+		for i, arg := range h.argv {
+			args[i] = strings.ReplaceAll(arg, "{username}", payload.Username)
+		}
+		if _, err := runCommand(args, data, h.timeout, "hook command"); err != nil {
+			log.Printf("Error running hook for %s: %v", payload.Username, err)
+		}
+	}
+	if h.url != "" {
+		if err := h.post(data); err != nil {
+			log.Printf("Error calling hook for %s: %v", payload.Username, err)
+		}
+	}
+}
+
+func (h *hook) post(data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgentOrDefault(""))
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("hook url returned %s", resp.Status)
+	}
+	return nil
+}
+
+// runHook starts the hook for a finished lookup in the background
+func (km *KeyManager) runHook(username string, blocks []KeyBlock, err error) {
+	host, _ := os.Hostname()
+	payload := hookPayload{
+		Time:     time.Now().UTC(),
+		Username: username,
+		Host:     host,
+		Sources:  []string{},
+		Keys:     countKeys(blocks),
+	}
+	for _, b := range blocks {
+		payload.Sources = append(payload.Sources, b.Source)
+	}
+	if err != nil {
+		payload.Error = err.Error()
+	}
+
+	km.hooks.Add(1)
+	go func() {
+		defer km.hooks.Done()
+		km.hook.run(payload)
+	}()
+}
+
+// WaitHooks waits for hooks still running in the background, each of which
+// gives up after its timeout. Short-lived programs call it before exiting so
+// the hooks are not cut off.
+func (km *KeyManager) WaitHooks() {
+	km.hooks.Wait()
+}
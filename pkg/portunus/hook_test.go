@@ -0,0 +1,223 @@
+package portunus
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// hookReceiver is a stub webhook collecting the payloads posted to it
+type hookReceiver struct {
+	mu       sync.Mutex
+	payloads []hookPayload
+	bodies   []string
+}
+
+func newHookReceiver(t *testing.T, status int) (*hookReceiver, *httptest.Server) {
+	t.Helper()
+	r := &hookReceiver{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		if req.Method != http.MethodPost || req.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("got %s with content type %q, want a JSON POST", req.Method, req.Header.Get("Content-Type"))
+		}
+		var payload hookPayload
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Errorf("payload is not JSON: %v: %s", err, body)
+		}
+		r.mu.Lock()
+		r.payloads = append(r.payloads, payload)
+		r.bodies = append(r.bodies, string(body))
+		r.mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return r, srv
+}
+
+// Payloads returns the payloads received, in order
+func (r *hookReceiver) Payloads() []hookPayload {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]hookPayload(nil), r.payloads...)
+}
+
+func TestHook(t *testing.T) {
+	key1, key2 := testKey(t, 1, "alice@laptop"), testKey(t, 2, "alice@desktop")
+	host, _ := os.Hostname()
+
+	tests := []struct {
+		name  string
+		login string
+		want  hookPayload
+	}{
+		{
+			name:  "successful lookup",
+			login: "alice",
+			want:  hookPayload{Username: "alice", Host: host, Sources: []string{"static", "github"}, Keys: 2},
+		},
+		{
+			name:  "failed lookup",
+			login: "bob",
+			want:  hookPayload{Username: "bob", Host: host, Sources: []string{}, Error: "no keys found for user: bob"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receiver, srv := newHookReceiver(t, http.StatusNoContent)
+			dir := t.TempDir()
+			command := execStub(t, `cat > "`+dir+`/$1.json"`)
+			km := newTestKeyManager(t, Config{
+				Mappings: map[string]UserMapping{
+					"alice": {StaticKeys: []StaticKey{{Key: key1}}, GitHub: Usernames{"octocat"}},
+					"bob":   {GitHub: Usernames{"nobody"}},
+				},
+				Hook: HookConfig{Enabled: true, Command: command + " {username}", URL: srv.URL},
+			}, WithProvider("github", &fakeProvider{keys: map[string][]string{"octocat": {key2}}}))
+
+			start := time.Now().Add(-time.Second)
+			km.Resolve(context.Background(), tt.login)
+			km.WaitHooks()
+
+			posted := receiver.Payloads()
+			if len(posted) != 1 {
+				t.Fatalf("got %d payloads posted, want 1", len(posted))
+			}
+			data, err := os.ReadFile(filepath.Join(dir, tt.login+".json"))
+			if err != nil {
+				t.Fatalf("command didn't get the payload: %v", err)
+			}
+			var piped hookPayload
+			if err := json.Unmarshal(data, &piped); err != nil {
+				t.Fatalf("command got %q, want the JSON payload: %v", data, err)
+			}
+
+			for name, got := range map[string]hookPayload{"posted": posted[0], "piped": piped} {
+				if got.Time.Before(start) {
+					t.Errorf("%s: got time %v, want the lookup's", name, got.Time)
+				}
+				got.Time = time.Time{}
+				if !strings.HasPrefix(got.Error, tt.want.Error) {
+					t.Errorf("%s: got error %q, want %q", name, got.Error, tt.want.Error)
+				}
+				got.Error = tt.want.Error
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("%s: got payload %+v, want %+v", name, got, tt.want)
+				}
+			}
+
+			// the hook gets a summary, never the keys
+			for _, key := range []string{key1, key2} {
+				blob := strings.Fields(key)[1]
+				if strings.Contains(receiver.bodies[0], blob) || strings.Contains(string(data), blob) {
+					t.Errorf("payload contains key %s", key)
+				}
+			}
+		})
+	}
+}
+
+func TestHookFailuresDontBlockLookups(t *testing.T) {
+	key := testKey(t, 1, "alice")
+	hung := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-hung:
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(func() { close(hung); slow.Close() })
+	_, failing := newHookReceiver(t, http.StatusInternalServerError)
+
+	tests := []struct {
+		name    string
+		hook    HookConfig
+		wantLog string
+	}{
+		{
+			name:    "url returning an error",
+			hook:    HookConfig{URL: failing.URL},
+			wantLog: "Error calling hook for alice: hook url returned 500",
+		},
+		{
+			name:    "url that never answers",
+			hook:    HookConfig{URL: slow.URL, Timeout: 50 * time.Millisecond},
+			wantLog: "Error calling hook for alice",
+		},
+		{
+			name:    "failing command",
+			hook:    HookConfig{Command: execStub(t, "exit 3")},
+			wantLog: "Error running hook for alice",
+		},
+		{
+			name:    "command that never exits",
+			hook:    HookConfig{Command: execStub(t, "exec sleep 5"), Timeout: 50 * time.Millisecond},
+			wantLog: "Error running hook for alice",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLog(t)
+			hook := tt.hook
+			hook.Enabled = true
+			km := newTestKeyManager(t, Config{
+				Mappings: map[string]UserMapping{"alice": {StaticKeys: []StaticKey{{Key: key}}}},
+				Hook:     hook,
+			})
+
+			start := time.Now()
+			if got := stripHeaders(resolveLines(t, km, "alice")); len(got) != 1 || got[0] != key {
+				t.Errorf("got %q, want the key served", got)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("lookup took %v, want it not to wait for the hook", elapsed)
+			}
+			km.WaitHooks()
+			if !strings.Contains(logs.String(), tt.wantLog) {
+				t.Errorf("got logs %q, want %q", logs, tt.wantLog)
+			}
+		})
+	}
+}
+
+func TestHookDisabled(t *testing.T) {
+	receiver, srv := newHookReceiver(t, http.StatusNoContent)
+	km := newTestKeyManager(t, Config{
+		Mappings: map[string]UserMapping{"alice": {StaticKeys: []StaticKey{{Key: testKey(t, 1, "alice")}}}},
+		Hook:     HookConfig{URL: srv.URL},
+	})
+	resolveLines(t, km, "alice")
+	km.WaitHooks()
+	if got := receiver.Payloads(); len(got) != 0 {
+		t.Errorf("got payloads %+v, want none without enabled", got)
+	}
+}
+
+func TestInvalidHookFailsAtLoad(t *testing.T) {
+	tests := []struct {
+		name    string
+		hook    HookConfig
+		wantErr string
+	}{
+		{name: "nothing to run", hook: HookConfig{Enabled: true}, wantErr: "command or url is required"},
+		{name: "not http", hook: HookConfig{Enabled: true, URL: "ftp://hooks.example.com"}, wantErr: "invalid url"},
+		{name: "not a url", hook: HookConfig{Enabled: true, URL: "://"}, wantErr: "invalid url"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewKeyManagerFromConfig(Config{Hook: tt.hook})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,367 @@
+package portunus
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultMaxResponseBytes bounds provider response bodies when no explicit
+// limit is configured
+const defaultMaxResponseBytes = 1 << 20
+
+// HTTPConfig holds the options shared by every HTTP-based provider. It is
+// embedded in each provider's config, so its fields sit alongside the
+// provider's own in JSON.
+type HTTPConfig struct {
+	UserAgent string `json:"user_agent,omitempty"`
+
+	// MaxResponseBytes caps the size of a response body, defaulting to
+	// defaultMaxResponseBytes when unset.
+	MaxResponseBytes int64 `json:"max_response_bytes,omitempty"`
+
+	// Proxy is the URL of the proxy requests go through. When unset the
+	// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables apply.
+	Proxy string `json:"proxy,omitempty"`
+
+	// Headers are added to every request. Headers the provider sets itself,
+	// such as Authorization, are only replaced when named here explicitly.
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// MaxIdleConnsPerHost is how many idle keep-alive connections are kept
+	// per host, defaulting to Go's 2. Raise it when many lookups hit the same
+	// provider at once.
+	MaxIdleConnsPerHost int `json:"max_idle_conns_per_host,omitempty"`
+
+	// IdleConnTimeout closes keep-alive connections idle for this long,
+	// defaulting to 90s
+	IdleConnTimeout time.Duration `json:"idle_conn_timeout,omitempty"`
+
+	// CACertFile and CACertDir add PEM CA certificates, from one file or
+	// every file in a directory, to the system roots for servers with a
+	// private CA
+	CACertFile string `json:"ca_cert_file,omitempty"`
+	CACertDir  string `json:"ca_cert_dir,omitempty"`
+
+	// InsecureSkipVerify disables TLS certificate verification entirely. It
+	// is logged as a warning, and only meant for testing.
+	InsecureSkipVerify bool `json:"insecure_skip_verify,omitempty"`
+
+	// AllowedHosts, when set, limits requests to these host names, IPs and
+	// CIDR ranges, redirects included. Listed entries may be internal.
+	AllowedHosts []string `json:"allowed_hosts,omitempty"`
+
+	// AllowPrivateNetworks lets requests reach loopback, link-local and
+	// private addresses, which are refused by default so a config cannot
+	// point a provider at a metadata endpoint or internal service.
+	AllowPrivateNetworks bool `json:"allow_private_networks,omitempty"`
+}
+
+// transportKey identifies the transport settings of an HTTPConfig, so
+// providers with the same settings can share connections
+type transportKey struct {
+	proxy               string
+	maxIdleConnsPerHost int
+	idleConnTimeout     time.Duration
+	caCertFile          string
+	caCertDir           string
+	insecureSkipVerify  bool
+	allowedHosts        string
+	allowPrivate        bool
+}
+
+// transports holds one transport per distinct transportKey, shared by every
+// fetcher built with those settings, e.g. a provider and its mirrors, so
+// keep-alive connections to a host are reused between them
+var (
+	transportsMu sync.Mutex
+	transports   = make(map[transportKey]*http.Transport)
+)
+
+// sharedTransport returns the transport for the config's settings, creating
+// it on first use
+func (c HTTPConfig) sharedTransport() *http.Transport {
+	key := transportKey{c.Proxy, c.MaxIdleConnsPerHost, c.IdleConnTimeout, c.CACertFile, c.CACertDir, c.InsecureSkipVerify, strings.Join(c.AllowedHosts, ","), c.AllowPrivateNetworks}
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+	if t, ok := transports[key]; ok {
+		return t
+	}
+
+	proxy, err := c.proxyFunc()
+	if err != nil {
+		proxy = http.ProxyFromEnvironment
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = proxy
+	// the policy must already have been validated, an invalid one leaves
+	// only the default blocking
+	policy, _ := c.hostPolicy()
+	t.DialContext = policy.dialContext()
+	if c.MaxIdleConnsPerHost > 0 {
+		t.MaxIdleConnsPerHost = c.MaxIdleConnsPerHost
+		if t.MaxIdleConns < c.MaxIdleConnsPerHost {
+			t.MaxIdleConns = c.MaxIdleConnsPerHost
+		}
+	}
+	if c.IdleConnTimeout > 0 {
+		t.IdleConnTimeout = c.IdleConnTimeout
+	}
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		log.Printf("Error loading CA certificates, using the system roots: %v", err)
+	} else if tlsConfig != nil {
+		t.TLSClientConfig = tlsConfig
+	}
+	transports[key] = t
+	return t
+}
+
+// tlsConfig returns the TLS settings for the config's CA certificates and
+// InsecureSkipVerify, or nil when neither is set
+func (c HTTPConfig) tlsConfig() (*tls.Config, error) {
+	if c.CACertFile == "" && c.CACertDir == "" && !c.InsecureSkipVerify {
+		return nil, nil
+	}
+	config := &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify}
+	if c.CACertFile == "" && c.CACertDir == "" {
+		return config, nil
+	}
+
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	var files []string
+	if c.CACertFile != "" {
+		files = append(files, c.CACertFile)
+	}
+	if c.CACertDir != "" {
+		entries, err := os.ReadDir(c.CACertDir)
+		if err != nil {
+			return nil, fmt.Errorf("error reading ca_cert_dir: %w", err)
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				files = append(files, filepath.Join(c.CACertDir, entry.Name()))
+			}
+		}
+	}
+	for _, file := range files {
+		pem, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA certificates: %w", err)
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificates found in %s", file)
+		}
+	}
+	config.RootCAs = roots
+	return config, nil
+}
+
+// proxyFunc returns the transport proxy function for the config
+func (c HTTPConfig) proxyFunc() (func(*http.Request) (*url.URL, error), error) {
+	if c.Proxy == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+	proxyURL, err := url.Parse(c.Proxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy %q: %w", c.Proxy, err)
+	}
+	if proxyURL.Scheme == "" || proxyURL.Host == "" {
+		return nil, fmt.Errorf("invalid proxy %q: want scheme://host[:port]", c.Proxy)
+	}
+	return http.ProxyURL(proxyURL), nil
+}
+
+// httpFetcher performs GET requests on behalf of a provider, applying the
+// shared HTTP options and conditional requests via ETag
+type httpFetcher struct {
+	name      string
+	client    *http.Client
+	maxBytes  int64
+	userAgent string
+	headers   map[string]string
+}
+
+// etagEntry is the last successful response body for a URL and its ETag
+type etagEntry struct {
+	ETag string `json:"etag"`
+	Body []byte `json:"body"`
+}
+
+// etags holds every fetcher's ETagged responses, keyed by provider name and
+// URL, so they can be saved with SaveFetchState and reused by a later run
+var etags = struct {
+	sync.Mutex
+	entries map[string]etagEntry
+}{entries: make(map[string]etagEntry)}
+
+// newHTTPFetcher builds a fetcher for the named provider, which is used in
+// error messages. The proxy must already have been validated, an invalid one
+// falls back to the environment. Fetchers with the same transport settings
+// share a connection pool.
+func newHTTPFetcher(name string, config HTTPConfig) *httpFetcher {
+	maxBytes := config.MaxResponseBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultMaxResponseBytes
+	}
+	return &httpFetcher{
+		name:      name,
+		client:    &http.Client{Timeout: 10 * time.Second, Transport: config.guardedTransport()},
+		maxBytes:  maxBytes,
+		userAgent: userAgentOrDefault(config.UserAgent),
+		headers:   config.Headers,
+	}
+}
+
+// Do sends req and returns the response body. If an earlier response for the
+// same URL carried an ETag it is sent as If-None-Match, and a 304 Not Modified
+// returns the earlier body.
+func (f *httpFetcher) Do(req *http.Request) ([]byte, error) {
+	etagKey := f.name + " " + req.URL.String()
+	req.Header.Set("User-Agent", f.userAgent)
+	for name, value := range f.headers {
+		req.Header.Set(name, value)
+	}
+
+	etags.Lock()
+	cached, haveCached := etags.entries[etagKey]
+	etags.Unlock()
+	if haveCached {
+		req.Header.Set("If-None-Match", cached.ETag)
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		// drain what's left so the connection can be reused
+		io.Copy(io.Discard, io.LimitReader(resp.Body, f.maxBytes))
+		resp.Body.Close()
+	}()
+
+	if resp.StatusCode == http.StatusNotModified && haveCached {
+		return cached.Body, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, newStatusError(f.name, req, resp)
+	}
+
+	body, err := readLimited(resp.Body, f.maxBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		etags.Lock()
+		etags.entries[etagKey] = etagEntry{ETag: etag, Body: body}
+		etags.Unlock()
+	}
+	return body, nil
+}
+
+// statusSnippetBytes is how much of an error response body StatusError keeps
+const statusSnippetBytes = 200
+
+// StatusError is returned when a provider responds with a status other than
+// 200. URL and Body never contain the credentials the request was sent with.
+type StatusError struct {
+	Provider   string
+	StatusCode int
+	// URL is the request URL with any userinfo password and token-like query
+	// parameters redacted
+	URL string
+	// Body is the start of the response body, on one line
+	Body string
+	// RateLimited is set for 429 responses and for 403s reporting no
+	// remaining rate limit, as GitHub sends
+	RateLimited bool
+}
+
+func (e *StatusError) Error() string {
+	msg := fmt.Sprintf("%s API returned status: %d", e.Provider, e.StatusCode)
+	if e.RateLimited {
+		msg += " (rate limited)"
+	}
+	msg += " for " + e.URL
+	if e.Body != "" {
+		msg += ": " + e.Body
+	}
+	return msg
+}
+
+// newStatusError describes resp, a non-200 response to req
+func newStatusError(provider string, req *http.Request, resp *http.Response) *StatusError {
+	e := &StatusError{
+		Provider:   provider,
+		StatusCode: resp.StatusCode,
+		URL:        redactURL(req.URL),
+		RateLimited: resp.StatusCode == http.StatusTooManyRequests ||
+			resp.StatusCode == http.StatusForbidden && resp.Header.Get("X-RateLimit-Remaining") == "0",
+	}
+
+	snippet, _ := io.ReadAll(io.LimitReader(resp.Body, statusSnippetBytes))
+	body := strings.Join(strings.Fields(string(snippet)), " ")
+	for _, name := range []string{"Authorization", "Private-Token"} {
+		value := req.Header.Get(name)
+		if value == "" {
+			continue
+		}
+		// "Bearer <token>" and "token <token>" both end in the credential
+		fields := strings.Fields(value)
+		body = strings.ReplaceAll(body, fields[len(fields)-1], redacted)
+	}
+	e.Body = body
+	return e
+}
+
+// redactURL formats u with its userinfo password and any query parameter
+// that looks like a secret redacted
+func redactURL(u *url.URL) string {
+	redactedURL := *u
+	query := redactedURL.Query()
+	changed := false
+	for name := range query {
+		if secretField(name) {
+			query.Set(name, redacted)
+			changed = true
+		}
+	}
+	if changed {
+		redactedURL.RawQuery = query.Encode()
+	}
+	return redactedURL.Redacted()
+}
+
+// userAgentOrDefault returns ua, or portunus/<version> when ua is empty
+func userAgentOrDefault(ua string) string {
+	if ua == "" {
+		return "portunus/" + Version
+	}
+	return ua
+}
+
+// readLimited reads r fully, returning an error rather than silently
+// truncating if it holds more than limit bytes
+func readLimited(r io.Reader, limit int64) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > limit {
+		return nil, fmt.Errorf("response body exceeds %d bytes", limit)
+	}
+	return body, nil
+}
@@ -0,0 +1,85 @@
+package portunus
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// KeybaseProvider implements key fetching from the Keybase user lookup API
+type KeybaseProvider struct {
+	http    *httpFetcher
+	baseURL string
+}
+
+// defaultKeybaseURL is used when KeybaseConfig.URL is unset
+const defaultKeybaseURL = "https://keybase.io/"
+
+type KeybaseConfig struct {
+	URL string `json:"url,omitempty"`
+	HTTPConfig
+}
+
+// keybaseLookup is the subset of the user/lookup.json response we care about
+type keybaseLookup struct {
+	Status struct {
+		Code int    `json:"code"`
+		Name string `json:"name"`
+	} `json:"status"`
+	Them []struct {
+		PublicKeys struct {
+			SSH []string `json:"ssh"`
+		} `json:"public_keys"`
+	} `json:"them"`
+}
+
+func NewKeybaseProvider(config KeybaseConfig) *KeybaseProvider {
+	baseURL := config.URL
+	if baseURL == "" {
+		baseURL = defaultKeybaseURL
+	}
+	if !strings.HasSuffix(baseURL, "/") {
+		baseURL += "/"
+	}
+	return &KeybaseProvider{
+		http:    newHTTPFetcher("Keybase", config.HTTPConfig),
+		baseURL: baseURL,
+	}
+}
+
+func (p *KeybaseProvider) GetKeys(username string) ([]string, error) {
+	lookupURL := fmt.Sprintf("%s_/api/1.0/user/lookup.json?usernames=%s&fields=public_keys", p.baseURL, url.QueryEscape(username))
+	req, err := http.NewRequest("GET", lookupURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := p.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var lookup keybaseLookup
+	if err := json.Unmarshal(body, &lookup); err != nil {
+		return nil, err
+	}
+	if lookup.Status.Code != 0 {
+		return nil, fmt.Errorf("Keybase API returned error: %s (%d)", lookup.Status.Name, lookup.Status.Code)
+	}
+	if len(lookup.Them) == 0 {
+		return nil, fmt.Errorf("user not found: %s", username)
+	}
+
+	// A user without SSH keys is not an error, they simply have none
+	var keys []string
+	for _, them := range lookup.Them {
+		for _, key := range them.PublicKeys.SSH {
+			if key = strings.TrimSpace(key); key != "" {
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,59 @@
+package portunus
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestKeybaseProvider(t *testing.T) {
+	key := testKey(t, 1, "alice")
+
+	tests := []struct {
+		name    string
+		body    string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "keys",
+			body: `{"status": {"code": 0}, "them": [{"public_keys": {"ssh": ["` + key + `", "  "]}}]}`,
+			want: []string{key},
+		},
+		{
+			name: "user with no keys",
+			body: `{"status": {"code": 0}, "them": [{"public_keys": {}}]}`,
+		},
+		{
+			name:    "user not found",
+			body:    `{"status": {"code": 0}, "them": []}`,
+			wantErr: true,
+		},
+		{
+			name:    "api error",
+			body:    `{"status": {"code": 100, "name": "INPUT_ERROR"}}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/_/api/1.0/user/lookup.json" || r.URL.Query().Get("usernames") != "alice" {
+					t.Errorf("unexpected request %s", r.URL)
+				}
+				w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+
+			p := NewKeybaseProvider(KeybaseConfig{URL: srv.URL, HTTPConfig: HTTPConfig{AllowPrivateNetworks: true}})
+			got, err := p.GetKeys("alice")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
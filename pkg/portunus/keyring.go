@@ -0,0 +1,47 @@
+package portunus
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// keyringTimeout bounds a keyring lookup, which may wait on an unlock prompt
+const keyringTimeout = 30 * time.Second
+
+// KeyringSecret names a secret in the OS keyring: the macOS login keychain,
+// or the Secret Service (GNOME Keyring, KWallet) elsewhere
+type KeyringSecret struct {
+	Service string `json:"service"`
+	Account string `json:"account"`
+}
+
+// keyringLookup reads a secret from the OS keyring. It is a variable so the
+// backend can be replaced where no keyring is available.
+var keyringLookup = func(service, account string) (string, error) {
+	var argv []string
+	switch runtime.GOOS {
+	case "darwin":
+		argv = []string{"security", "find-generic-password", "-s", service, "-a", account, "-w"}
+	case "windows":
+		return "", errors.New("keyring lookups are not supported on Windows")
+	default:
+		// secret-tool ships with libsecret and speaks the Secret Service API
+		argv = []string{"secret-tool", "lookup", "service", service, "account", account}
+	}
+	if _, err := exec.LookPath(argv[0]); err != nil {
+		return "", err
+	}
+	out, err := runCommand(argv, nil, keyringTimeout, "keyring lookup")
+	if err != nil {
+		return "", err
+	}
+	secret := strings.TrimRight(string(out), "\r\n")
+	if secret == "" {
+		return "", fmt.Errorf("no keyring secret for service %s account %s", service, account)
+	}
+	return secret, nil
+}
@@ -0,0 +1,109 @@
+package portunus
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// stubKeyring replaces the keyring backend until the test ends, answering
+// every lookup with secret or err and counting the lookups
+func stubKeyring(t *testing.T, secret string, err error) *atomic.Int32 {
+	t.Helper()
+	var lookups atomic.Int32
+	lookup := keyringLookup
+	keyringLookup = func(service, account string) (string, error) {
+		lookups.Add(1)
+		if service != "portunus" || account != "ldap-bind" {
+			return "", errors.New("no such secret")
+		}
+		return secret, err
+	}
+	t.Cleanup(func() { keyringLookup = lookup })
+	return &lookups
+}
+
+func TestLDAPBindPasswordKeyring(t *testing.T) {
+	key := testKey(t, 1, "alice")
+	secret := &KeyringSecret{Service: "portunus", Account: "ldap-bind"}
+
+	tests := []struct {
+		name        string
+		keyring     *KeyringSecret
+		secret      string
+		err         error
+		inline      string
+		wantLookups int32
+		wantWarn    bool
+		wantErr     bool
+	}{
+		{name: "inline password", inline: "secret"},
+		{name: "keyring password", keyring: secret, secret: "secret", wantLookups: 1},
+		{name: "keyring beats inline", keyring: secret, secret: "secret", inline: "stale", wantLookups: 1},
+		{name: "failed lookup falls back to inline", keyring: secret, err: errors.New("keyring locked"), inline: "secret", wantLookups: 1, wantWarn: true},
+		{name: "failed lookup without inline", keyring: secret, err: errors.New("keyring locked"), wantLookups: 1, wantWarn: true, wantErr: true},
+		{name: "unknown secret", keyring: &KeyringSecret{Service: "portunus", Account: "other"}, inline: "secret", wantLookups: 1, wantWarn: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLog(t)
+			lookups := stubKeyring(t, tt.secret, tt.err)
+			server := newStubLDAP(t, "secret", func(stubSearch) stubPage {
+				return stubPage{Entries: map[string]map[string][]string{"uid=alice,dc=example,dc=com": {"sshPublicKey": {key}}}}
+			})
+			p := testLDAPProvider(t, LDAPConfig{
+				URL:                 server.URL,
+				BindPassword:        tt.inline,
+				BindPasswordKeyring: tt.keyring,
+				BaseDN:              "dc=example,dc=com",
+				KeyAttribute:        "sshPublicKey",
+			})
+
+			got, err := p.GetKeys("alice")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !slices.Equal(got, []string{key}) {
+				t.Errorf("got %q, want %q", got, []string{key})
+			}
+			if n := lookups.Load(); n != tt.wantLookups {
+				t.Errorf("keyring looked up %d times, want %d", n, tt.wantLookups)
+			}
+			warned := strings.Contains(logs.String(), "Warning: error reading the LDAP bind password from the keyring")
+			if warned != tt.wantWarn {
+				t.Errorf("warning logged = %v, want %v; log:\n%s", warned, tt.wantWarn, logs)
+			}
+		})
+	}
+}
+
+func TestLDAPMirrorsReuseKeyringPassword(t *testing.T) {
+	key := testKey(t, 1, "alice")
+	lookups := stubKeyring(t, "secret", nil)
+	mirror := newStubLDAP(t, "secret", func(stubSearch) stubPage {
+		return stubPage{Entries: map[string]map[string][]string{"uid=alice,dc=example,dc=com": {"sshPublicKey": {key}}}}
+	})
+	p, err := newLDAPWithMirrors(LDAPConfig{
+		URL:                 closedLDAPURL(t),
+		Mirrors:             []string{mirror.URL},
+		BindPasswordKeyring: &KeyringSecret{Service: "portunus", Account: "ldap-bind"},
+		BaseDN:              "dc=example,dc=com",
+		KeyAttribute:        "sshPublicKey",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := p.GetKeys("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got, []string{key}) {
+		t.Errorf("got %q, want the mirror's keys", got)
+	}
+	if n := lookups.Load(); n != 1 {
+		t.Errorf("keyring looked up %d times, want once for the primary and its mirrors", n)
+	}
+}
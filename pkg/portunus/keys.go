@@ -0,0 +1,360 @@
+package portunus
+
+import (
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SplitKeyLines splits a key listing into trimmed lines, accepting LF, CRLF
+// or mixed line endings and dropping blank lines
+func SplitKeyLines(body string) []string {
+	var keys []string
+	for _, line := range strings.Split(strings.ReplaceAll(body, "\r", "\n"), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			keys = append(keys, line)
+		}
+	}
+	return keys
+}
+
+// optionPlaceholder matches a {NAME} placeholder in a key's options
+var optionPlaceholder = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandKeyOptions replaces {NAME} placeholders in the options prefix of an
+// authorized_keys line, e.g. from="{HOST_IP}", using lookup. The key and its
+// comment are left untouched. A placeholder lookup doesn't know is an error,
+// rather than emitting a broken option.
+func expandKeyOptions(line string, lookup func(string) (string, bool)) (string, error) {
+	end := optionsEnd(line)
+	if end == 0 {
+		return line, nil
+	}
+
+	var missing []string
+	options := optionPlaceholder.ReplaceAllStringFunc(line[:end], func(m string) string {
+		name := m[1 : len(m)-1]
+		value, ok := lookup(name)
+		if !ok {
+			missing = append(missing, name)
+			return m
+		}
+		return value
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("unknown key option placeholder: %s", strings.Join(missing, ", "))
+	}
+	return options + line[end:], nil
+}
+
+// optionsEnd returns the length of the options prefix of an authorized_keys
+// line, or zero when the line starts with the key type. Options run up to the
+// first space outside double quotes.
+func optionsEnd(line string) int {
+	fields := strings.Fields(line)
+	if len(fields) == 0 || isKeyType(fields[0]) {
+		return 0
+	}
+	quoted := false
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			i++
+		case '"':
+			quoted = !quoted
+		case ' ', '\t':
+			if !quoted {
+				return i
+			}
+		}
+	}
+	return len(line)
+}
+
+// isKeyType reports whether field names an OpenSSH public key algorithm
+func isKeyType(field string) bool {
+	return strings.HasPrefix(field, "ssh-") || strings.HasPrefix(field, "ecdsa-sha2-") ||
+		strings.HasPrefix(field, "sk-")
+}
+
+// isComment reports whether an output line is a comment, such as a source header
+func isComment(line string) bool {
+	return strings.HasPrefix(strings.TrimSpace(line), "#")
+}
+
+// hasKeyLine reports whether lines has any line other than comments and
+// blank lines
+func hasKeyLine(lines []string) bool {
+	for _, line := range lines {
+		if !isComment(line) && strings.TrimSpace(line) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// dropEmptyBlocks removes blocks with no key lines left, so their headers
+// and any comments a source returned aren't emitted as an empty section
+func dropEmptyBlocks(blocks []KeyBlock) []KeyBlock {
+	return slices.DeleteFunc(blocks, func(b KeyBlock) bool {
+		return !hasKeyLine(b.Keys)
+	})
+}
+
+// isKeyMetadata reports whether line is a comment describing the key after
+// it, as written by expiry_comments and the GitLab key_metadata option.
+// Sorting, dedup, the key limit and transforms keep these with their key.
+func isKeyMetadata(line string) bool {
+	return strings.HasPrefix(line, expiryCommentPrefix) || strings.HasPrefix(line, gitlabMetadataPrefix)
+}
+
+// keyUnits splits lines into the units that are kept, dropped or moved
+// together: each key line with the metadata comments directly before it, and
+// every other line on its own. Metadata with no key after it is left as
+// units of its own.
+func keyUnits(lines []string) [][]string {
+	var units [][]string
+	var meta []string
+	for _, line := range lines {
+		switch {
+		case isKeyMetadata(line):
+			meta = append(meta, line)
+		case isComment(line):
+			for _, m := range meta {
+				units = append(units, []string{m})
+			}
+			units = append(units, []string{line})
+			meta = nil
+		default:
+			units = append(units, append(meta, line))
+			meta = nil
+		}
+	}
+	for _, m := range meta {
+		units = append(units, []string{m})
+	}
+	return units
+}
+
+// unitKey returns the key line of a unit from keyUnits, or false for a
+// comment
+func unitKey(unit []string) (string, bool) {
+	line := unit[len(unit)-1]
+	return line, !isComment(line)
+}
+
+// sortKeyLines sorts the key lines of each source block by key type and then
+// base64 body, moving each key's metadata comments with it. Headers and
+// other comment lines stay at the top of the block they belong to, so
+// blocks themselves keep their original order.
+func sortKeyLines(lines []string) []string {
+	result := make([]string, 0, len(lines))
+	var comments []string
+	var keys [][]string
+
+	flush := func() {
+		sort.SliceStable(keys, func(i, j int) bool {
+			ti, bi := keySortFields(keys[i][len(keys[i])-1])
+			tj, bj := keySortFields(keys[j][len(keys[j])-1])
+			if ti != tj {
+				return ti < tj
+			}
+			return bi < bj
+		})
+		result = append(result, comments...)
+		for _, unit := range keys {
+			result = append(result, unit...)
+		}
+		comments, keys = nil, nil
+	}
+
+	for _, unit := range keyUnits(lines) {
+		if _, ok := unitKey(unit); !ok {
+			// a comment after keys starts the next block
+			if len(keys) > 0 {
+				flush()
+			}
+			comments = append(comments, unit...)
+			continue
+		}
+		keys = append(keys, unit)
+	}
+	flush()
+
+	return result
+}
+
+// parseKey parses an authorized_keys line like ssh.ParseAuthorizedKey,
+// returning the key and its comment, also accepting a base64 key body with
+// missing or extra padding, as some sources emit. It is used wherever keys
+// are compared or described, so the same key written two ways is recognised
+// by its wire form.
+func parseKey(line string) (ssh.PublicKey, string, error) {
+	pub, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err == nil {
+		return pub, comment, nil
+	}
+	if fixed, ok := repadKeyBody(line); ok {
+		if pub, comment, _, _, fixedErr := ssh.ParseAuthorizedKey([]byte(fixed)); fixedErr == nil {
+			return pub, comment, nil
+		}
+	}
+	return nil, "", err
+}
+
+// repadKeyBody rewrites the first field of line that decodes, padding
+// ignored, to a public key of the type named by the field before it, with
+// its padding made standard. The rest of the line is left untouched.
+func repadKeyBody(line string) (string, bool) {
+	fields := strings.Fields(line)
+	offset := 0
+	for i, field := range fields {
+		start := offset + strings.Index(line[offset:], field)
+		offset = start + len(field)
+		if i == 0 {
+			continue
+		}
+		raw, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(field, "="))
+		if err != nil {
+			continue
+		}
+		pub, err := ssh.ParsePublicKey(raw)
+		if err != nil || pub.Type() != fields[i-1] {
+			continue
+		}
+		return line[:start] + base64.StdEncoding.EncodeToString(raw) + line[offset:], true
+	}
+	return "", false
+}
+
+// expiryCommentPrefix starts the line written by expiryComment
+const expiryCommentPrefix = "# expires: "
+
+// expiryComment is the machine-readable line that precedes a key expiring at
+// t, see Config.ExpiryComments
+func expiryComment(t time.Time) string {
+	return expiryCommentPrefix + t.UTC().Format(time.RFC3339)
+}
+
+// keySortFields returns the key type and base64 body used as the sort order
+// for a key line. Lines that fail to parse sort by their raw text.
+func keySortFields(line string) (string, string) {
+	pub, _, err := parseKey(line)
+	if err != nil {
+		return "", line
+	}
+	return pub.Type(), base64.StdEncoding.EncodeToString(pub.Marshal())
+}
+
+// dedupBlocks drops keys that appear in more than one block. The copy kept is
+// the one from the block whose source comes first in priority, and sources not
+// listed in priority rank after those that are, in emission order. Blocks keep
+// their original order, and blocks left with no keys are dropped along with
+// their header. With provenance the kept copy of each duplicate gets a
+// trailing "# also-in:" comment naming the other sources it was found in. It
+// returns how many keys were dropped.
+func dedupBlocks(blocks []KeyBlock, priority []string, provenance bool) ([]KeyBlock, int) {
+	rank := make(map[string]int, len(priority))
+	for i, source := range priority {
+		if _, ok := rank[source]; !ok {
+			rank[source] = i
+		}
+	}
+	order := make([]int, len(blocks))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		ri, iok := rank[blocks[order[i]].Source]
+		rj, jok := rank[blocks[order[j]].Source]
+		if iok != jok {
+			return iok
+		}
+		return iok && ri < rj
+	})
+
+	// kept locates the copy of each key that is served, and alsoIn lists the
+	// other sources of the copies dropped in its favour
+	type keyPos struct{ block, line int }
+	kept := make(map[string]keyPos)
+	alsoIn := make(map[string][]string)
+	deduped := make([][]string, len(blocks))
+	hasKey := make([]bool, len(blocks))
+	dropped := 0
+	for _, i := range order {
+		for _, unit := range keyUnits(blocks[i].Keys) {
+			line, ok := unitKey(unit)
+			if !ok {
+				deduped[i] = append(deduped[i], unit...)
+				continue
+			}
+			keyType, body := keySortFields(line)
+			id := keyType + " " + body
+			if pos, ok := kept[id]; ok {
+				// the copy's metadata goes with it
+				dropped++
+				if source := blocks[i].Source; source != blocks[pos.block].Source && !slices.Contains(alsoIn[id], source) {
+					alsoIn[id] = append(alsoIn[id], source)
+				}
+				continue
+			}
+			deduped[i] = append(deduped[i], unit...)
+			kept[id] = keyPos{i, len(deduped[i]) - 1}
+			hasKey[i] = true
+		}
+	}
+	if provenance {
+		for id, sources := range alsoIn {
+			pos := kept[id]
+			line := strings.TrimRight(deduped[pos.block][pos.line], " \t")
+			deduped[pos.block][pos.line] = line + " # also-in: " + strings.Join(sources, ", ")
+		}
+	}
+
+	var result []KeyBlock
+	for i, b := range blocks {
+		if hasKey[i] {
+			b.Keys = deduped[i]
+			result = append(result, b)
+		}
+	}
+	return result, dropped
+}
+
+// limitKeys keeps at most max keys across all blocks, in emission order, and
+// returns how many were dropped. Comment lines don't count toward the limit,
+// though a dropped key's metadata comments are dropped with it, and blocks
+// left with no keys are dropped along with their header. Keys in the
+// Priority block are always kept, though they count toward the limit.
+func limitKeys(blocks []KeyBlock, max int) ([]KeyBlock, int) {
+	var result []KeyBlock
+	kept, dropped := 0, 0
+	for _, b := range blocks {
+		var keys []string
+		hasKey := false
+		for _, unit := range keyUnits(b.Keys) {
+			_, isKey := unitKey(unit)
+			switch {
+			case !isKey:
+				keys = append(keys, unit...)
+			case b.Priority || kept < max:
+				keys = append(keys, unit...)
+				kept++
+				hasKey = true
+			default:
+				dropped++
+			}
+		}
+		if hasKey {
+			b.Keys = keys
+			result = append(result, b)
+		}
+	}
+	return result, dropped
+}
@@ -0,0 +1,594 @@
+package portunus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestKeyMetadataStaysWithItsKey(t *testing.T) {
+	expiry := expiryComment(time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC))
+	// k2 is the key that sorts first
+	k1, k2 := testKey(t, 1, "one"), testKey(t, 2, "two")
+	if sortKeyLines([]string{k1, k2})[0] == k1 {
+		k1, k2 = k2, k1
+	}
+
+	tests := []struct {
+		name string
+		run  func([]string) []string
+		in   []string
+		want []string
+	}{
+		{
+			name: "sort moves metadata with its key",
+			run:  sortKeyLines,
+			in:   []string{expiry, k1, k2},
+			want: []string{k2, expiry, k1},
+		},
+		{
+			name: "dedup drops the duplicate's metadata",
+			run: func(lines []string) []string {
+				blocks, _ := dedupBlocks([]KeyBlock{
+					{Source: "github", Keys: []string{k2}},
+					{Source: "gitlab", Keys: lines},
+				}, []string{"github", "gitlab"}, false)
+				return flattenBlocks(blocks)
+			},
+			in:   []string{expiry, k2, k1},
+			want: []string{k2, k1},
+		},
+		{
+			name: "dedup keeps the kept copy's metadata",
+			run: func(lines []string) []string {
+				blocks, _ := dedupBlocks([]KeyBlock{
+					{Source: "gitlab", Keys: lines},
+					{Source: "github", Keys: []string{k2}},
+				}, []string{"gitlab", "github"}, false)
+				return flattenBlocks(blocks)
+			},
+			in:   []string{expiry, k2},
+			want: []string{expiry, k2},
+		},
+		{
+			name: "limit drops metadata with its key",
+			run: func(lines []string) []string {
+				blocks, _ := limitKeys([]KeyBlock{{Source: "gitlab", Keys: lines}}, 1)
+				return flattenBlocks(blocks)
+			},
+			in:   []string{k1, expiry, k2},
+			want: []string{k1},
+		},
+		{
+			name: "gitlab metadata behaves the same",
+			run:  sortKeyLines,
+			in:   []string{`# gitlab key "laptop"`, expiry, k1, k2},
+			want: []string{k2, `# gitlab key "laptop"`, expiry, k1},
+		},
+		{
+			name: "other comments stay at the top",
+			run:  sortKeyLines,
+			in:   []string{"# from the provider", expiry, k1, k2},
+			want: []string{"# from the provider", k2, expiry, k1},
+		},
+		{
+			name: "metadata with no key is kept in place",
+			run:  sortKeyLines,
+			in:   []string{k1, expiry},
+			want: []string{k1, expiry},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.run(slices.Clone(tt.in)); !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNonstandardPaddingIsParsed(t *testing.T) {
+	key := testKey(t, 1, "alice@laptop")
+	fields := strings.Fields(key)
+	padded := fields[0] + " " + fields[1] + "== " + fields[2]
+	pub, _, err := parseKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fingerprint := ssh.FingerprintSHA256(pub)
+
+	tests := []struct {
+		name string
+		run  func(line string) string
+		want string
+	}{
+		{
+			name: "json fingerprint",
+			run: func(line string) string {
+				keys := blocksToJSON([]KeyBlock{{Source: "static", Keys: []string{line}}})
+				return keys[0].Fingerprint + " " + keys[0].Comment + keys[0].Error
+			},
+			want: fingerprint + " alice@laptop",
+		},
+		{
+			name: "explain description",
+			run:  describeKey,
+			want: fingerprint + " ssh-ed25519 alice@laptop",
+		},
+		{
+			name: "diff against the padded line",
+			run: func(line string) string {
+				d := DiffKeys([]string{key}, []string{line})
+				return fmt.Sprintf("%d added, %d removed", len(d.Added), len(d.Removed))
+			},
+			want: "0 added, 0 removed",
+		},
+		{
+			name: "audit fingerprint",
+			run: func(line string) string {
+				var out strings.Builder
+				a := &auditLogger{writers: []io.Writer{&out}}
+				a.Record("alice", []KeyBlock{{Source: "static", Keys: []string{line}}}, nil)
+				var record auditRecord
+				if err := json.Unmarshal([]byte(out.String()), &record); err != nil {
+					return err.Error()
+				}
+				return strings.Join(record.Fingerprints, ",")
+			},
+			want: fingerprint,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, line := range []string{key, padded} {
+				if got := tt.run(line); got != tt.want {
+					t.Errorf("%q: got %q, want %q", line, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSortKeysIsStable(t *testing.T) {
+	keys := []string{testKey(t, 1, "a"), testKey(t, 2, "b"), testKey(t, 3, "c"), testKey(t, 4, "d")}
+	bodyOrder := func(a, b string) int {
+		_, x := keySortFields(a)
+		_, y := keySortFields(b)
+		return strings.Compare(x, y)
+	}
+	want := slices.SortedFunc(slices.Values(keys), bodyOrder)
+
+	tests := []struct {
+		name  string
+		order []int
+	}{
+		{name: "as given", order: []int{0, 1, 2, 3}},
+		{name: "reversed", order: []int{3, 2, 1, 0}},
+		{name: "shuffled", order: []int{2, 0, 3, 1}},
+		{name: "shuffled again", order: []int{1, 3, 0, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var shuffled []string
+			for _, i := range tt.order {
+				shuffled = append(shuffled, keys[i])
+			}
+			provider := &fakeProvider{keys: map[string][]string{"octocat": shuffled}}
+			km := newTestKeyManager(t, Config{
+				Mappings: map[string]UserMapping{"alice": {GitHub: Usernames{"octocat"}}},
+				SortKeys: true,
+			}, WithProvider("github", provider))
+
+			if got := resolveLines(t, km, "alice"); !slices.Equal(got[1:], want) {
+				t.Errorf("got %q, want %q", got[1:], want)
+			}
+		})
+	}
+}
+
+func TestLimitKeys(t *testing.T) {
+	k1, k2, k3 := testKey(t, 1, "one"), testKey(t, 2, "two"), testKey(t, 3, "three")
+
+	tests := []struct {
+		name        string
+		blocks      []KeyBlock
+		max         int
+		want        []string
+		wantDropped int
+	}{
+		{
+			name:   "under the limit",
+			blocks: []KeyBlock{{Source: "github", Keys: []string{"# github: alice", k1, k2}}},
+			max:    2,
+			want:   []string{"# github: alice", k1, k2},
+		},
+		{
+			name:        "truncated in emission order",
+			blocks:      []KeyBlock{{Source: "github", Keys: []string{k1, k2, k3}}},
+			max:         2,
+			want:        []string{k1, k2},
+			wantDropped: 1,
+		},
+		{
+			name:   "comments don't count",
+			blocks: []KeyBlock{{Source: "github", Keys: []string{"# one", "# two", k1, "# three", k2}}},
+			max:    2,
+			want:   []string{"# one", "# two", k1, "# three", k2},
+		},
+		{
+			name: "a block left without keys is dropped with its header",
+			blocks: []KeyBlock{
+				{Source: "github", Keys: []string{"# github: alice", k1, k2}},
+				{Source: "gitlab", Keys: []string{"# gitlab: alice", k3}},
+			},
+			max:         2,
+			want:        []string{"# github: alice", k1, k2},
+			wantDropped: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			blocks, dropped := limitKeys(tt.blocks, tt.max)
+			if got := flattenBlocks(blocks); !slices.Equal(got, tt.want) || dropped != tt.wantDropped {
+				t.Errorf("got %q, %d dropped, want %q, %d dropped", got, dropped, tt.want, tt.wantDropped)
+			}
+		})
+	}
+}
+
+func TestSplitKeyLines(t *testing.T) {
+	k1, k2 := testKey(t, 1, "alice@laptop"), testKey(t, 2, "alice@desktop")
+
+	tests := []struct {
+		name string
+		body string
+		want []string
+	}{
+		{name: "lf", body: k1 + "\n" + k2 + "\n", want: []string{k1, k2}},
+		{name: "crlf", body: k1 + "\r\n" + k2 + "\r\n", want: []string{k1, k2}},
+		{name: "bare cr", body: k1 + "\r" + k2, want: []string{k1, k2}},
+		{name: "mixed endings", body: k1 + "\r\n" + k2 + "\n\r\n", want: []string{k1, k2}},
+		{name: "surrounding whitespace", body: "  " + k1 + " \t\n\t" + k2 + "  ", want: []string{k1, k2}},
+		{name: "blank lines dropped", body: "\n \r\n" + k1 + "\n\n\n", want: []string{k1}},
+		{name: "empty body", body: "", want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := SplitKeyLines(tt.body)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			for _, line := range got {
+				if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line)); err != nil {
+					t.Errorf("%q doesn't parse: %v", line, err)
+				}
+			}
+		})
+	}
+}
+
+func TestCRLFBodiesFromProviders(t *testing.T) {
+	k1, k2 := testKey(t, 1, "alice@laptop"), testKey(t, 2, "alice@desktop")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(k1 + "\r\n" + k2 + "\r\n\r\n"))
+	}))
+	defer srv.Close()
+
+	p, err := NewGitHubProvider(GitHubConfig{URL: srv.URL, HTTPConfig: HTTPConfig{AllowPrivateNetworks: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := p.GetKeys("octocat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{k1, k2}; !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestDedupAttribution(t *testing.T) {
+	shared, hubKey, labKey := testKey(t, 1, "shared"), testKey(t, 2, "hub"), testKey(t, 3, "lab")
+
+	tests := []struct {
+		name        string
+		sourceOrder []string
+		priority    []string
+		want        map[string][]string
+	}{
+		{
+			name: "configured order wins",
+			want: map[string][]string{"github": {shared, hubKey}, "gitlab": {labKey}},
+		},
+		{
+			name:        "source_order wins",
+			sourceOrder: []string{"gitlab", "github"},
+			want:        map[string][]string{"github": {hubKey}, "gitlab": {shared, labKey}},
+		},
+		{
+			name:     "mapping priority beats emission order",
+			priority: []string{"gitlab"},
+			want:     map[string][]string{"github": {hubKey}, "gitlab": {shared, labKey}},
+		},
+		{
+			name:        "mapping priority beats source_order",
+			sourceOrder: []string{"gitlab", "github"},
+			priority:    []string{"github"},
+			want:        map[string][]string{"github": {shared, hubKey}, "gitlab": {labKey}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			github := &fakeProvider{keys: map[string][]string{"octocat": {shared, hubKey}}}
+			gitlab := &fakeProvider{keys: map[string][]string{"octocat": {shared, labKey}}}
+			km := newTestKeyManager(t, Config{
+				Mappings: map[string]UserMapping{"alice": {
+					GitHub:   Usernames{"octocat"},
+					GitLab:   Usernames{"octocat"},
+					Priority: tt.priority,
+				}},
+				Dedup:       true,
+				SourceOrder: tt.sourceOrder,
+			}, WithProvider("github", github), WithProvider("gitlab", gitlab))
+
+			result, err := km.Resolve(context.Background(), "alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[string][]string)
+			for _, b := range result.Blocks {
+				got[b.Source] = b.Keys
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDedupProvenance(t *testing.T) {
+	shared, hubKey, labKey := testKey(t, 1, "shared"), testKey(t, 2, "hub"), testKey(t, 3, "lab")
+
+	tests := []struct {
+		name       string
+		provenance bool
+		priority   []string
+		github     []string
+		want       map[string][]string
+	}{
+		{
+			name:       "key in three sources",
+			provenance: true,
+			github:     []string{shared, hubKey},
+			want: map[string][]string{
+				"github": {shared + " # also-in: gitlab, ldap", hubKey},
+				"gitlab": {labKey},
+			},
+		},
+		{
+			name:       "the kept copy follows priority",
+			provenance: true,
+			priority:   []string{"ldap"},
+			github:     []string{shared, hubKey},
+			want: map[string][]string{
+				"github": {hubKey},
+				"gitlab": {labKey},
+				"ldap":   {shared + " # also-in: github, gitlab"},
+			},
+		},
+		{
+			name:       "copies within one source aren't listed",
+			provenance: true,
+			github:     []string{shared, hubKey, shared},
+			want: map[string][]string{
+				"github": {shared + " # also-in: gitlab, ldap", hubKey},
+				"gitlab": {labKey},
+			},
+		},
+		{
+			name:       "trailing whitespace is trimmed",
+			provenance: true,
+			github:     []string{shared + "  ", hubKey},
+			want: map[string][]string{
+				"github": {shared + " # also-in: gitlab, ldap", hubKey},
+				"gitlab": {labKey},
+			},
+		},
+		{
+			name:   "off by default",
+			github: []string{shared, hubKey},
+			want: map[string][]string{
+				"github": {shared, hubKey},
+				"gitlab": {labKey},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			captureLog(t)
+			github := &fakeProvider{keys: map[string][]string{"octocat": tt.github}}
+			gitlab := &fakeProvider{keys: map[string][]string{"octocat": {shared, labKey}}}
+			ldap := &fakeProvider{keys: map[string][]string{"alice": {shared}}}
+			km := newTestKeyManager(t, Config{
+				Mappings: map[string]UserMapping{"alice": {
+					GitHub:   Usernames{"octocat"},
+					GitLab:   Usernames{"octocat"},
+					LDAPUser: "alice",
+					Priority: tt.priority,
+				}},
+				SourceOrder:     []string{"github", "gitlab", "ldap"},
+				Dedup:           true,
+				DedupProvenance: tt.provenance,
+			}, WithProvider("github", github), WithProvider("gitlab", gitlab), WithProvider("ldap", ldap))
+
+			result, err := km.Resolve(context.Background(), "alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[string][]string)
+			for _, b := range result.Blocks {
+				got[b.Source] = b.Keys
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			// the note is part of the comment, so the keys still parse
+			if findings := result.Lint(LintPolicy{}); len(findings) > 0 {
+				t.Errorf("got findings %v, want none", findings)
+			}
+		})
+	}
+}
+
+func TestDedupProvenanceWithoutDedupWarns(t *testing.T) {
+	logs := captureLog(t)
+	newTestKeyManager(t, Config{DedupProvenance: true})
+	if !strings.Contains(logs.String(), "dedup_provenance has no effect without dedup") {
+		t.Errorf("got logs %q, want a warning", logs)
+	}
+}
+
+func TestDedupBlocksDropsEmptiedBlocks(t *testing.T) {
+	shared := testKey(t, 1, "shared")
+	blocks := []KeyBlock{
+		{Source: "github", Header: "# github: alice", Keys: []string{shared}},
+		{Source: "exec", Header: "# exec: alice", Keys: []string{shared}},
+	}
+	got, dropped := dedupBlocks(blocks, []string{"exec"}, false)
+	if dropped != 1 || len(got) != 1 || got[0].Source != "exec" {
+		t.Errorf("got %+v with %d dropped, want only the exec block", got, dropped)
+	}
+}
+
+func TestEmptySourceSections(t *testing.T) {
+	own, hubKey := testKey(t, 1, "own"), testKey(t, 2, "hub")
+
+	tests := []struct {
+		name      string
+		github    []string
+		dedup     bool
+		noHeaders bool
+		want      []string
+	}{
+		{name: "source with keys", github: []string{hubKey}, want: []string{"# static: alice", own, "# github: alice (octocat)", hubKey}},
+		{name: "only comments", github: []string{"# no keys here"}, want: []string{"# static: alice", own}},
+		{name: "only blank lines", github: []string{"", "  "}, want: []string{"# static: alice", own}},
+		{name: "only duplicates", github: []string{own}, dedup: true, want: []string{"# static: alice", own}},
+		{name: "duplicates kept without dedup", github: []string{own}, want: []string{"# static: alice", own, "# github: alice (octocat)", own}},
+		{name: "only comments without headers", github: []string{"# no keys here"}, noHeaders: true, want: []string{own}},
+		{name: "only duplicates without headers", github: []string{own}, dedup: true, noHeaders: true, want: []string{own}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			github := &fakeProvider{keys: map[string][]string{"octocat": tt.github}}
+			km := newTestKeyManager(t, Config{
+				Mappings:    map[string]UserMapping{"alice": {StaticKeys: []StaticKey{{Key: own}}, GitHub: Usernames{"octocat"}}},
+				SourceOrder: []string{"static", "github"},
+				Dedup:       tt.dedup,
+				NoHeaders:   tt.noHeaders,
+			}, WithProvider("github", github))
+
+			if got := resolveLines(t, km, "alice"); !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCommentOnlySourceIsNoKeys(t *testing.T) {
+	github := &fakeProvider{keys: map[string][]string{"octocat": {"# no keys here"}}}
+	km := newTestKeyManager(t, Config{
+		Mappings: map[string]UserMapping{"alice": {GitHub: Usernames{"octocat"}}},
+	}, WithProvider("github", github))
+
+	if _, err := km.Resolve(context.Background(), "alice"); !errors.Is(err, ErrNoKeys) {
+		t.Errorf("error = %v, want ErrNoKeys for a login whose only source has no key lines", err)
+	}
+}
+
+func TestExpandKeyOptions(t *testing.T) {
+	key := testKey(t, 1, "deploy {HOST_IP}")
+	env := map[string]string{"HOST_IP": "10.0.0.7", "BASTION": "10.0.0.1"}
+	lookup := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+
+	tests := []struct {
+		name    string
+		line    string
+		want    string
+		wantErr string
+	}{
+		{name: "placeholders outside options are left alone", line: key, want: key},
+		{name: "options without placeholders", line: "no-pty " + key, want: "no-pty " + key},
+		{name: "placeholder in options", line: `from="{HOST_IP}" ` + key, want: `from="10.0.0.7" ` + key},
+		{
+			name: "several placeholders",
+			line: `from="{HOST_IP},{BASTION}",no-pty ` + key,
+			want: `from="10.0.0.7,10.0.0.1",no-pty ` + key,
+		},
+		{name: "unknown placeholder", line: `from="{HOST_IP},{NOPE}" ` + key, wantErr: "NOPE"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := expandKeyOptions(tt.line, lookup)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want one naming %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStaticKeyPlaceholdersFromEnvironment(t *testing.T) {
+	key := testKey(t, 1, "deploy")
+	t.Setenv("PORTUNUS_TEST_HOST_IP", "10.0.0.7")
+
+	tests := []struct {
+		name       string
+		failClosed bool
+		want       []string
+		wantErr    bool
+	}{
+		{name: "known placeholders expand, unknown keys are omitted", want: []string{`from="10.0.0.7" ` + key}},
+		{name: "unknown placeholders fail closed", failClosed: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			km := newTestKeyManager(t, Config{
+				Mappings: map[string]UserMapping{"alice": {StaticKeys: []StaticKey{
+					{Key: `from="{PORTUNUS_TEST_HOST_IP}" ` + key},
+					{Key: `from="{PORTUNUS_TEST_MISSING}" ` + key},
+				}}},
+				FailClosed: tt.failClosed,
+			})
+			result, err := km.Resolve(context.Background(), "alice")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if got := stripHeaders(flattenBlocks(result.Blocks)); !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,525 @@
+package portunus
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// defaultLDAPEmailAttribute is searched by email when EmailAttribute is unset
+const defaultLDAPEmailAttribute = "mail"
+
+type LDAPConfig struct {
+	URL          string `json:"url"`
+	BindDN       string `json:"bind_dn"`
+	BindPassword string `json:"bind_password"`
+	BaseDN       string `json:"base_dn"`
+	KeyAttribute string `json:"key_attribute"`
+
+	// BindPasswordKeyring reads the bind password from the OS keyring,
+	// keeping it off disk. If the lookup fails BindPassword is used, with a
+	// warning.
+	BindPasswordKeyring *KeyringSecret `json:"bind_password_keyring,omitempty"`
+
+	// KeyAttributes are read for keys as well as KeyAttribute, for
+	// directories that keep keys under more than one schema. An entry
+	// missing some of them still serves the keys in the others.
+	KeyAttributes []string `json:"key_attributes,omitempty"`
+
+	// EmailAttribute is searched when looking users up by email, defaulting
+	// to "mail"
+	EmailAttribute string `json:"email_attribute,omitempty"`
+
+	// KeyValueRegex extracts the OpenSSH key from attribute values that carry
+	// extra metadata. The first capture group is used if there is one,
+	// otherwise the whole match. Values that don't match are skipped.
+	KeyValueRegex string `json:"key_value_regex,omitempty"`
+
+	// SplitValues splits each attribute value on newlines, for directories
+	// that store several keys in one value, before KeyValueRegex is applied
+	// to each line. It defaults to true without KeyValueRegex and false
+	// with it, so a pattern written against whole values keeps working.
+	SplitValues *bool `json:"split_values,omitempty"`
+
+	// SearchScope is how far below BaseDN users are searched for: "base",
+	// "one" or "sub", the default, for the whole subtree
+	SearchScope string `json:"search_scope,omitempty"`
+
+	// DerefAliases controls alias dereferencing during the search: "never",
+	// the default, "search", "find" or "always"
+	DerefAliases string `json:"deref_aliases,omitempty"`
+
+	// FollowReferrals repeats a search that only returns referrals against
+	// the referred servers, binding to them with the same credentials. It is
+	// off by default, since chasing referrals can hang on unreachable servers
+	// and sends the bind password to them.
+	FollowReferrals bool `json:"follow_referrals,omitempty"`
+
+	// Mirrors are replicas of URL, tried in order with the same settings
+	// when a server can't be reached or refuses the bind. Lookups start at
+	// whichever server answered last.
+	Mirrors []string `json:"mirrors,omitempty"`
+
+	// PageSize requests results this many entries at a time with the paged
+	// results control. Zero sends a single unpaged search.
+	PageSize uint32 `json:"page_size,omitempty"`
+
+	// Timeout bounds a whole lookup, including every page and referral.
+	// Zero means no limit beyond the server's own.
+	Timeout time.Duration `json:"timeout,omitempty"`
+
+	// UnreachableCooldown remembers that a server couldn't be dialed for this
+	// long, failing lookups against it straight away instead of waiting on
+	// another dial per login. Zero dials every time.
+	UnreachableCooldown time.Duration `json:"unreachable_cooldown,omitempty"`
+}
+
+// ldapScopes and ldapDerefAliases map the search_scope and deref_aliases
+// settings to their protocol values
+var (
+	ldapScopes = map[string]int{
+		"base": ldap.ScopeBaseObject,
+		"one":  ldap.ScopeSingleLevel,
+		"sub":  ldap.ScopeWholeSubtree,
+	}
+	ldapDerefAliases = map[string]int{
+		"never":  ldap.NeverDerefAliases,
+		"search": ldap.DerefInSearching,
+		"find":   ldap.DerefFindingBaseObj,
+		"always": ldap.DerefAlways,
+	}
+)
+
+// ErrLDAPUnreachable is returned without dialing while a server that recently
+// failed to connect is within its UnreachableCooldown
+var ErrLDAPUnreachable = errors.New("LDAP server unreachable")
+
+// errLDAPBind wraps the error when a server refuses the bind credentials
+var errLDAPBind = errors.New("LDAP bind failed")
+
+// ldapFailover reports whether err means the server couldn't be reached or
+// bound to, so a mirror should be tried. Other errors, such as a user that
+// isn't found, would be the same on every replica.
+func ldapFailover(err error) bool {
+	return errors.Is(err, ErrLDAPUnreachable) || errors.Is(err, errLDAPBind) || ldap.IsErrorWithCode(err, ldap.ErrorNetwork)
+}
+
+// LDAPProvider implements key fetching from LDAP
+type LDAPProvider struct {
+	config       LDAPConfig
+	keyPattern   *regexp.Regexp
+	scope        int
+	derefAliases int
+
+	// tlsSessions lets ldaps:// connections resume an earlier TLS session,
+	// since every lookup dials a new connection
+	tlsSessions tls.ClientSessionCache
+
+	// unreachable maps server URLs that failed to dial to when they may be
+	// tried again
+	mu          sync.Mutex
+	unreachable map[string]time.Time
+}
+
+func NewLDAPProvider(config LDAPConfig) (*LDAPProvider, error) {
+	normalized, err := normalizeLDAPURL(config.URL)
+	if err != nil {
+		return nil, err
+	}
+	config.URL = normalized
+
+	if k := config.BindPasswordKeyring; k != nil {
+		password, err := keyringLookup(k.Service, k.Account)
+		if err != nil {
+			log.Printf("Warning: error reading the LDAP bind password from the keyring, using bind_password: %v", err)
+		} else {
+			config.BindPassword = password
+		}
+		config.BindPasswordKeyring = nil
+	}
+
+	p := &LDAPProvider{
+		config:       config,
+		scope:        ldap.ScopeWholeSubtree,
+		derefAliases: ldap.NeverDerefAliases,
+		tlsSessions:  tls.NewLRUClientSessionCache(0),
+	}
+	if config.SearchScope != "" {
+		scope, ok := ldapScopes[config.SearchScope]
+		if !ok {
+			return nil, fmt.Errorf("invalid LDAP search_scope %q: want base, one or sub", config.SearchScope)
+		}
+		p.scope = scope
+	}
+	if config.DerefAliases != "" {
+		deref, ok := ldapDerefAliases[config.DerefAliases]
+		if !ok {
+			return nil, fmt.Errorf("invalid LDAP deref_aliases %q: want never, search, find or always", config.DerefAliases)
+		}
+		p.derefAliases = deref
+	}
+	if config.KeyValueRegex != "" {
+		pattern, err := regexp.Compile(config.KeyValueRegex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid LDAP key_value_regex: %w", err)
+		}
+		p.keyPattern = pattern
+	}
+	return p, nil
+}
+
+// normalizeLDAPURL validates an LDAP URL before it is ever dialed, filling in
+// the scheme's default port so IPv6 literals and custom ports reach DialURL
+// in a form it handles, e.g. ldap://[::1] becomes ldap://[::1]:389
+func normalizeLDAPURL(raw string) (string, error) {
+	if strings.HasPrefix(raw, "ldapi://") {
+		// a Unix socket path, there is no host or port to check
+		return raw, nil
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("invalid LDAP url %q: %w", raw, err)
+	}
+
+	var defaultPort string
+	switch u.Scheme {
+	case "ldap":
+		defaultPort = "389"
+	case "ldaps":
+		defaultPort = "636"
+	default:
+		return "", fmt.Errorf("invalid LDAP url %q: scheme must be ldap, ldaps or ldapi", raw)
+	}
+
+	host, port := u.Hostname(), u.Port()
+	if host == "" {
+		return "", fmt.Errorf("invalid LDAP url %q: missing host", raw)
+	}
+	if strings.Contains(host, ":") && !strings.HasPrefix(u.Host, "[") {
+		return "", fmt.Errorf("invalid LDAP url %q: IPv6 addresses must be in brackets", raw)
+	}
+	if port == "" {
+		port = defaultPort
+	} else if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return "", fmt.Errorf("invalid LDAP url %q: bad port %s", raw, port)
+	}
+	u.Host = net.JoinHostPort(host, port)
+	return u.String(), nil
+}
+
+func (p *LDAPProvider) GetKeys(username string) ([]string, error) {
+	return p.search("uid", username)
+}
+
+// GetKeysByEmail finds the user whose email attribute matches email
+func (p *LDAPProvider) GetKeysByEmail(email string) ([]string, error) {
+	attribute := p.config.EmailAttribute
+	if attribute == "" {
+		attribute = defaultLDAPEmailAttribute
+	}
+	return p.search(attribute, email)
+}
+
+// maxReferrals bounds how many search continuation references are chased
+// for one lookup when FollowReferrals is set
+const maxReferrals = 5
+
+// search returns the keys of the first entry whose attribute equals value
+func (p *LDAPProvider) search(attribute, value string) ([]string, error) {
+	ctx := context.Background()
+	if p.config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.config.Timeout)
+		defer cancel()
+	}
+
+	filter := fmt.Sprintf("(%s=%s)", attribute, ldap.EscapeFilter(value))
+	result, err := p.searchAt(ctx, p.config.URL, p.config.BaseDN, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := result.Entries
+	if len(entries) == 0 && len(result.Referrals) > 0 {
+		if !p.config.FollowReferrals {
+			log.Printf("Ignoring %d LDAP referrals for %s, follow_referrals is off", len(result.Referrals), value)
+		} else {
+			entries = p.followReferrals(ctx, result.Referrals, filter)
+		}
+	}
+
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("user not found: %s", value)
+	}
+
+	// a missing attribute has no values, it isn't an error
+	entry := entries[0]
+	var keys []string
+	for _, attribute := range p.keyAttributes() {
+		keys = append(keys, p.extractKeys(attribute, entry.GetAttributeValues(attribute))...)
+	}
+	return keys, nil
+}
+
+// keyAttributes returns KeyAttribute followed by KeyAttributes, without
+// duplicates
+func (p *LDAPProvider) keyAttributes() []string {
+	var attributes []string
+	for _, attribute := range append([]string{p.config.KeyAttribute}, p.config.KeyAttributes...) {
+		if attribute != "" && !slices.Contains(attributes, attribute) {
+			attributes = append(attributes, attribute)
+		}
+	}
+	return attributes
+}
+
+// searchAt binds to the server at ldapURL and runs filter under baseDN,
+// giving up once ctx is done
+func (p *LDAPProvider) searchAt(ctx context.Context, ldapURL, baseDN, filter string) (*ldap.SearchResult, error) {
+	l, err := p.dial(ctx, ldapURL)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		l.SetTimeout(time.Until(deadline))
+	}
+
+	if err := l.Bind(p.config.BindDN, p.config.BindPassword); err != nil {
+		return nil, fmt.Errorf("%w: %w", errLDAPBind, err)
+	}
+
+	var result *ldap.SearchResult
+	if p.config.PageSize > 0 {
+		result, err = p.pagedSearch(ctx, l, p.searchRequest(baseDN, filter))
+	} else {
+		result, err = l.Search(p.searchRequest(baseDN, filter))
+	}
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultReferral) {
+		return nil, fmt.Errorf("LDAP server returned a referral for %s, check base_dn: %w", baseDN, err)
+	}
+	return result, err
+}
+
+// tlsConfig returns the TLS settings for dialing ldapURL, sharing the
+// provider's session cache, or nil for a connection without TLS
+func (p *LDAPProvider) tlsConfig(ldapURL string) *tls.Config {
+	if !strings.HasPrefix(ldapURL, "ldaps://") {
+		return nil
+	}
+	return &tls.Config{ClientSessionCache: p.tlsSessions}
+}
+
+// dial connects to ldapURL, skipping servers still in their unreachable
+// cooldown and starting one for servers that fail to connect
+func (p *LDAPProvider) dial(ctx context.Context, ldapURL string) (*ldap.Conn, error) {
+	cooldown := p.config.UnreachableCooldown
+	if cooldown > 0 {
+		p.mu.Lock()
+		until, down := p.unreachable[ldapURL]
+		p.mu.Unlock()
+		if down && time.Now().Before(until) {
+			return nil, fmt.Errorf("%w: %s, retrying after %s", ErrLDAPUnreachable, ldapURL, until.Format(time.TimeOnly))
+		}
+	}
+
+	var opts []ldap.DialOpt
+	if deadline, ok := ctx.Deadline(); ok {
+		opts = append(opts, ldap.DialWithDialer(&net.Dialer{Deadline: deadline}))
+	}
+	if tlsConfig := p.tlsConfig(ldapURL); tlsConfig != nil {
+		opts = append(opts, ldap.DialWithTLSConfig(tlsConfig))
+	}
+	l, err := ldap.DialURL(ldapURL, opts...)
+
+	if cooldown > 0 {
+		p.mu.Lock()
+		if err != nil {
+			if p.unreachable == nil {
+				p.unreachable = make(map[string]time.Time)
+			}
+			p.unreachable[ldapURL] = time.Now().Add(cooldown)
+		} else {
+			delete(p.unreachable, ldapURL)
+		}
+		p.mu.Unlock()
+	}
+	return l, err
+}
+
+// pagedSearch runs req a page of PageSize entries at a time, so broad base
+// DNs don't hit the server's size limit. Only the first matching entry is
+// used, so it stops at the first page with entries, and it checks ctx
+// between pages.
+func (p *LDAPProvider) pagedSearch(ctx context.Context, l *ldap.Conn, req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	paging := ldap.NewControlPaging(p.config.PageSize)
+	req.Controls = append(req.Controls, paging)
+
+	result := &ldap.SearchResult{}
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("LDAP search abandoned between pages: %w", err)
+		}
+		page, err := l.Search(req)
+		if err != nil {
+			return nil, err
+		}
+		result.Entries = append(result.Entries, page.Entries...)
+		result.Referrals = append(result.Referrals, page.Referrals...)
+
+		var cookie []byte
+		if ctrl, ok := ldap.FindControl(page.Controls, ldap.ControlTypePaging).(*ldap.ControlPaging); ok {
+			cookie = ctrl.Cookie
+		}
+		if len(cookie) == 0 {
+			return result, nil
+		}
+		paging.SetCookie(cookie)
+
+		if len(result.Entries) > 0 {
+			// a zero size request with the cookie releases the server's cursor
+			paging.PagingSize = 0
+			if _, err := l.Search(req); err != nil {
+				log.Printf("Error abandoning LDAP paged search: %v", err)
+			}
+			return result, nil
+		}
+	}
+}
+
+func (p *LDAPProvider) searchRequest(baseDN, filter string) *ldap.SearchRequest {
+	return ldap.NewSearchRequest(
+		baseDN,
+		p.scope, p.derefAliases, 0, 0, false,
+		filter,
+		p.keyAttributes(),
+		nil,
+	)
+}
+
+// Check binds with the configured credentials and reads the base DN entry
+// itself, without searching for any user
+func (p *LDAPProvider) Check() error {
+	ctx := context.Background()
+	if p.config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.config.Timeout)
+		defer cancel()
+	}
+
+	l, err := p.dial(ctx, p.config.URL)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		l.SetTimeout(time.Until(deadline))
+	}
+	if err := l.Bind(p.config.BindDN, p.config.BindPassword); err != nil {
+		return err
+	}
+
+	req := ldap.NewSearchRequest(
+		p.config.BaseDN,
+		ldap.ScopeBaseObject, ldap.NeverDerefAliases, 1, 0, false,
+		"(objectClass=*)",
+		[]string{"1.1"},
+		nil,
+	)
+	if _, err := l.Search(req); err != nil {
+		return fmt.Errorf("error reading base_dn %s: %w", p.config.BaseDN, err)
+	}
+	return nil
+}
+
+// followReferrals repeats the search against each referral in turn, binding
+// with the configured credentials, and returns the first entries found. It
+// only follows one hop, so referrals returned by a referred server are not
+// chased further.
+func (p *LDAPProvider) followReferrals(ctx context.Context, referrals []string, filter string) []*ldap.Entry {
+	if len(referrals) > maxReferrals {
+		referrals = referrals[:maxReferrals]
+	}
+	for _, referral := range referrals {
+		referralURL, baseDN, err := parseReferral(referral, p.config.BaseDN)
+		if err != nil {
+			log.Printf("Skipping LDAP referral %s: %v", referral, err)
+			continue
+		}
+		result, err := p.searchAt(ctx, referralURL, baseDN, filter)
+		if err != nil {
+			log.Printf("Error following LDAP referral %s: %v", referral, err)
+			continue
+		}
+		if len(result.Entries) > 0 {
+			return result.Entries
+		}
+	}
+	return nil
+}
+
+// parseReferral splits an LDAP referral URL into the server URL to dial and
+// the base DN to search, which defaults to baseDN when the referral has none
+func parseReferral(referral, baseDN string) (string, string, error) {
+	u, err := url.Parse(referral)
+	if err != nil {
+		return "", "", err
+	}
+	if dn := strings.TrimPrefix(u.Path, "/"); dn != "" {
+		baseDN = dn
+	}
+	server, err := normalizeLDAPURL(u.Scheme + "://" + u.Host)
+	if err != nil {
+		return "", "", err
+	}
+	return server, baseDN, nil
+}
+
+// extractKeys turns attribute values into key lines, splitting multi-line
+// values per SplitValues and applying KeyValueRegex when it is set. Both one
+// key per value and several keys per value yield one key per line.
+func (p *LDAPProvider) extractKeys(attribute string, values []string) []string {
+	split := p.keyPattern == nil
+	if p.config.SplitValues != nil {
+		split = *p.config.SplitValues
+	}
+
+	var lines []string
+	for _, value := range values {
+		if split {
+			lines = append(lines, SplitKeyLines(value)...)
+		} else if value = strings.TrimSpace(value); value != "" {
+			lines = append(lines, value)
+		}
+	}
+	if p.keyPattern == nil {
+		return lines
+	}
+
+	var keys []string
+	for _, value := range lines {
+		match := p.keyPattern.FindStringSubmatch(value)
+		switch {
+		case match == nil:
+			log.Printf("Skipping LDAP %s value not matching key_value_regex", attribute)
+		case len(match) > 1:
+			keys = append(keys, strings.TrimSpace(match[1]))
+		default:
+			keys = append(keys, strings.TrimSpace(match[0]))
+		}
+	}
+	return keys
+}
@@ -0,0 +1,190 @@
+package portunus
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// stubSearch is a search request received by a stubLDAP server
+type stubSearch struct {
+	BaseDN     string
+	Filter     string
+	Attributes []string
+	// Scope and DerefAliases are the go-ldap constants the search sent
+	Scope        int64
+	DerefAliases int64
+	// PageSize and Cookie come from the paged results control, if sent
+	PageSize uint32
+	Cookie   string
+}
+
+// stubPage is a stubLDAP server's answer to one search. A non-empty Cookie
+// is returned in a paged results control, asking for another page.
+type stubPage struct {
+	Entries   map[string]map[string][]string
+	Referrals []string
+	Cookie    string
+}
+
+// stubLDAP is a minimal LDAP server speaking just enough of the protocol
+// for LDAPProvider: simple binds, searches answered by search, and unbinds
+type stubLDAP struct {
+	URL string
+
+	// password is the bind password accepted, any other is refused
+	password string
+	search   func(stubSearch) stubPage
+	ln       net.Listener
+
+	mu       sync.Mutex
+	binds    int
+	searches []stubSearch
+}
+
+// newStubLDAP starts a stubLDAP server on localhost, closed with the test
+func newStubLDAP(t *testing.T, password string, search func(stubSearch) stubPage) *stubLDAP {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &stubLDAP{URL: "ldap://" + ln.Addr().String(), password: password, search: search, ln: ln}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+// Binds returns how many bind requests the server has received
+func (s *stubLDAP) Binds() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.binds
+}
+
+// Searches returns the searches the server has received, in order
+func (s *stubLDAP) Searches() []stubSearch {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]stubSearch(nil), s.searches...)
+}
+
+func (s *stubLDAP) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		id, _ := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			s.mu.Lock()
+			s.binds++
+			s.mu.Unlock()
+			code := uint16(ldap.LDAPResultSuccess)
+			if len(op.Children) < 3 || op.Children[2].Data.String() != s.password {
+				code = ldap.LDAPResultInvalidCredentials
+			}
+			conn.Write(ldapResponse(id, ldap.ApplicationBindResponse, code, nil).Bytes())
+		case ldap.ApplicationSearchRequest:
+			s.answer(conn, id, packet)
+		case ldap.ApplicationUnbindRequest:
+			return
+		}
+	}
+}
+
+// answer replies to the search request in packet with the entries,
+// references and paging cookie s.search returns
+func (s *stubLDAP) answer(conn net.Conn, id int64, packet *ber.Packet) {
+	op := packet.Children[1]
+	req := stubSearch{BaseDN: op.Children[0].Value.(string)}
+	req.Scope, _ = op.Children[1].Value.(int64)
+	req.DerefAliases, _ = op.Children[2].Value.(int64)
+	req.Filter, _ = ldap.DecompileFilter(op.Children[6])
+	for _, attribute := range op.Children[7].Children {
+		req.Attributes = append(req.Attributes, attribute.Data.String())
+	}
+	if len(packet.Children) > 2 {
+		for _, child := range packet.Children[2].Children {
+			if control, err := ldap.DecodeControl(child); err == nil {
+				if paging, ok := control.(*ldap.ControlPaging); ok {
+					req.PageSize, req.Cookie = paging.PagingSize, string(paging.Cookie)
+				}
+			}
+		}
+	}
+	s.mu.Lock()
+	s.searches = append(s.searches, req)
+	s.mu.Unlock()
+
+	page := s.search(req)
+	for dn, attributes := range page.Entries {
+		entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+		entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, "DN"))
+		list := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+		for name, values := range attributes {
+			attribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+			attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Type"))
+			set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+			for _, value := range values {
+				set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "Value"))
+			}
+			attribute.AppendChild(set)
+			list.AppendChild(attribute)
+		}
+		entry.AppendChild(list)
+		conn.Write(ldapEnvelope(id, entry).Bytes())
+	}
+	for _, referral := range page.Referrals {
+		ref := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultReference, nil, "Search Result Reference")
+		ref.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, referral, "URI"))
+		conn.Write(ldapEnvelope(id, ref).Bytes())
+	}
+
+	var controls []ldap.Control
+	if req.PageSize > 0 {
+		paging := ldap.NewControlPaging(0)
+		paging.SetCookie([]byte(page.Cookie))
+		controls = append(controls, paging)
+	}
+	conn.Write(ldapResponse(id, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess, controls).Bytes())
+}
+
+// ldapEnvelope wraps op in an LDAP message with id
+func ldapEnvelope(id int64, op *ber.Packet) *ber.Packet {
+	envelope := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "MessageID"))
+	envelope.AppendChild(op)
+	return envelope
+}
+
+// ldapResponse builds an LDAPResult of type tag with code and controls
+func ldapResponse(id int64, tag ber.Tag, code uint16, controls []ldap.Control) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Response")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, uint64(code), "Result Code"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+	envelope := ldapEnvelope(id, op)
+	if len(controls) > 0 {
+		packet := ber.Encode(ber.ClassContext, ber.TypeConstructed, 0, nil, "Controls")
+		for _, control := range controls {
+			packet.AppendChild(control.Encode())
+		}
+		envelope.AppendChild(packet)
+	}
+	return envelope
+}
@@ -0,0 +1,607 @@
+package portunus
+
+import (
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// testLDAPProvider builds an LDAPProvider from config, pointing it at a
+// placeholder server unless config names one
+func testLDAPProvider(t *testing.T, config LDAPConfig) *LDAPProvider {
+	t.Helper()
+	if config.URL == "" {
+		config.URL = "ldap://ldap.example.com"
+	}
+	p, err := NewLDAPProvider(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestLDAPKeyValueRegex(t *testing.T) {
+	key := testKey(t, 1, "alice@laptop")
+
+	tests := []struct {
+		name    string
+		pattern string
+		values  []string
+		want    []string
+	}{
+		{
+			name:   "clean value without a pattern",
+			values: []string{key},
+			want:   []string{key},
+		},
+		{
+			name:    "clean value matching the whole pattern",
+			pattern: `ssh-\S+ \S+.*`,
+			values:  []string{key},
+			want:    []string{key},
+		},
+		{
+			name:    "prefixed value with a capture group",
+			pattern: `^sshkey:\s*(.+)$`,
+			values:  []string{"sshkey: " + key},
+			want:    []string{key},
+		},
+		{
+			name:    "values not matching are skipped",
+			pattern: `^sshkey:\s*(.+)$`,
+			values:  []string{"legacy " + key, "sshkey:" + key},
+			want:    []string{key},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := testLDAPProvider(t, LDAPConfig{KeyValueRegex: tt.pattern})
+			if got := p.extractKeys("sshPublicKey", tt.values); !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := NewLDAPProvider(LDAPConfig{URL: "ldap://ldap.example.com", KeyValueRegex: "("}); err == nil {
+		t.Error("an invalid key_value_regex was accepted")
+	}
+}
+
+func TestLDAPSplitValues(t *testing.T) {
+	k1, k2, k3 := testKey(t, 1, "one"), testKey(t, 2, "two"), testKey(t, 3, "three")
+	yes, no := true, false
+
+	tests := []struct {
+		name    string
+		split   *bool
+		pattern string
+		values  []string
+		want    []string
+	}{
+		{name: "multiple values", values: []string{k1, k2, k3}, want: []string{k1, k2, k3}},
+		{name: "one multi-line value", values: []string{k1 + "\n" + k2 + "\r\n\n" + k3 + "\n"}, want: []string{k1, k2, k3}},
+		{name: "both layouts", values: []string{k1 + "\n" + k2, k3}, want: []string{k1, k2, k3}},
+		{name: "splitting disabled", split: &no, values: []string{" " + k1 + " ", k2}, want: []string{k1, k2}},
+		{
+			name:    "pattern applies to whole values by default",
+			pattern: `(?s)^keys:\s*(.+)$`,
+			values:  []string{"keys: " + k1},
+			want:    []string{k1},
+		},
+		{
+			name:    "pattern applies to each line when splitting",
+			split:   &yes,
+			pattern: `^sshkey:\s*(.+)$`,
+			values:  []string{"sshkey: " + k1 + "\nsshkey: " + k2 + "\nother: " + k3},
+			want:    []string{k1, k2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := testLDAPProvider(t, LDAPConfig{SplitValues: tt.split, KeyValueRegex: tt.pattern})
+			if got := p.extractKeys("sshPublicKey", tt.values); !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLDAPMultiLineValuesFromServer(t *testing.T) {
+	k1, k2, k3 := testKey(t, 1, "one"), testKey(t, 2, "two"), testKey(t, 3, "three")
+	server := newStubLDAP(t, "secret", func(stubSearch) stubPage {
+		return stubPage{Entries: map[string]map[string][]string{
+			"uid=alice,dc=example,dc=com": {"sshPublicKey": {k1 + "\n" + k2, k3}},
+		}}
+	})
+	p := testLDAPProvider(t, LDAPConfig{URL: server.URL, BindPassword: "secret", BaseDN: "dc=example,dc=com", KeyAttribute: "sshPublicKey"})
+	got, err := p.GetKeys("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{k1, k2, k3}; !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestLDAPKeyAttributes(t *testing.T) {
+	k1, k2, k3 := testKey(t, 1, "one"), testKey(t, 2, "two"), testKey(t, 3, "three")
+
+	tests := []struct {
+		name       string
+		attributes []string
+		entry      map[string][]string
+		want       []string
+		wantErr    bool
+	}{
+		{name: "one attribute", entry: map[string][]string{"sshPublicKey": {k1}}, want: []string{k1}},
+		{
+			name:       "every attribute present",
+			attributes: []string{"altSecurityKey"},
+			entry:      map[string][]string{"sshPublicKey": {k1}, "altSecurityKey": {k2, k3}},
+			want:       []string{k1, k2, k3},
+		},
+		{
+			name:       "key_attribute missing",
+			attributes: []string{"altSecurityKey"},
+			entry:      map[string][]string{"altSecurityKey": {k2}},
+			want:       []string{k2},
+		},
+		{
+			name:       "key_attributes missing",
+			attributes: []string{"altSecurityKey"},
+			entry:      map[string][]string{"sshPublicKey": {k1}, "cn": {"alice"}},
+			want:       []string{k1},
+		},
+		{
+			name:       "every attribute missing",
+			attributes: []string{"altSecurityKey"},
+			entry:      map[string][]string{"cn": {"alice"}},
+		},
+		{
+			name:       "duplicate attribute is read once",
+			attributes: []string{"sshPublicKey"},
+			entry:      map[string][]string{"sshPublicKey": {k1}},
+			want:       []string{k1},
+		},
+		{name: "no entry", attributes: []string{"altSecurityKey"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newStubLDAP(t, "secret", func(stubSearch) stubPage {
+				if tt.entry == nil {
+					return stubPage{}
+				}
+				return stubPage{Entries: map[string]map[string][]string{"uid=alice,dc=example,dc=com": tt.entry}}
+			})
+			p := testLDAPProvider(t, LDAPConfig{
+				URL:           server.URL,
+				BindPassword:  "secret",
+				BaseDN:        "dc=example,dc=com",
+				KeyAttribute:  "sshPublicKey",
+				KeyAttributes: tt.attributes,
+			})
+			got, err := p.GetKeys("alice")
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "user not found") {
+					t.Errorf("error = %v, want user not found", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			// every attribute is requested in the one search, key_attribute first
+			want := []string{"sshPublicKey"}
+			for _, attribute := range tt.attributes {
+				if !slices.Contains(want, attribute) {
+					want = append(want, attribute)
+				}
+			}
+			if searches := server.Searches(); len(searches) != 1 || !slices.Equal(searches[0].Attributes, want) {
+				t.Errorf("searches = %+v, want one requesting %q", searches, want)
+			}
+		})
+	}
+}
+
+func TestLDAPSearchScopeAndDeref(t *testing.T) {
+	key := testKey(t, 1, "alice")
+	tests := []struct {
+		name      string
+		scope     string
+		deref     string
+		wantScope int64
+		wantDeref int64
+	}{
+		{name: "defaults", wantScope: ldap.ScopeWholeSubtree, wantDeref: ldap.NeverDerefAliases},
+		{name: "base", scope: "base", wantScope: ldap.ScopeBaseObject, wantDeref: ldap.NeverDerefAliases},
+		{name: "one level", scope: "one", deref: "search", wantScope: ldap.ScopeSingleLevel, wantDeref: ldap.DerefInSearching},
+		{name: "subtree", scope: "sub", deref: "find", wantScope: ldap.ScopeWholeSubtree, wantDeref: ldap.DerefFindingBaseObj},
+		{name: "always deref", deref: "always", wantScope: ldap.ScopeWholeSubtree, wantDeref: ldap.DerefAlways},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newStubLDAP(t, "secret", func(stubSearch) stubPage {
+				return stubPage{Entries: map[string]map[string][]string{"uid=alice,dc=example,dc=com": {"sshPublicKey": {key}}}}
+			})
+			p := testLDAPProvider(t, LDAPConfig{
+				URL:          server.URL,
+				BindPassword: "secret",
+				BaseDN:       "dc=example,dc=com",
+				KeyAttribute: "sshPublicKey",
+				SearchScope:  tt.scope,
+				DerefAliases: tt.deref,
+			})
+			if _, err := p.GetKeys("alice"); err != nil {
+				t.Fatal(err)
+			}
+			searches := server.Searches()
+			if len(searches) != 1 || searches[0].Scope != tt.wantScope || searches[0].DerefAliases != tt.wantDeref {
+				t.Errorf("searches = %+v, want one with scope %d and deref %d", searches, tt.wantScope, tt.wantDeref)
+			}
+		})
+	}
+}
+
+func TestInvalidLDAPSearchScopeAndDeref(t *testing.T) {
+	tests := []struct {
+		name   string
+		config LDAPConfig
+		want   string
+	}{
+		{name: "scope", config: LDAPConfig{SearchScope: "subtree"}, want: `invalid LDAP search_scope "subtree"`},
+		{name: "deref", config: LDAPConfig{DerefAliases: "sometimes"}, want: `invalid LDAP deref_aliases "sometimes"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := tt.config
+			config.URL, config.BaseDN, config.KeyAttribute = "ldap://ldap.example.com", "dc=example,dc=com", "sshPublicKey"
+			if _, err := NewLDAPProvider(config); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %v, want %q", err, tt.want)
+			}
+			if _, err := NewKeyManagerFromConfig(Config{LDAP: config}); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("loading the config: error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLDAPTLSSessionCache(t *testing.T) {
+	p := testLDAPProvider(t, LDAPConfig{BaseDN: "dc=example,dc=com", KeyAttribute: "sshPublicKey"})
+	tests := []struct {
+		url     string
+		wantTLS bool
+	}{
+		{url: "ldaps://ldap.example.com:636", wantTLS: true},
+		{url: "ldaps://replica.example.com:636", wantTLS: true},
+		{url: "ldap://ldap.example.com:389"},
+		{url: "ldapi://%2Fvar%2Frun%2Fslapd%2Fldapi"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			config := p.tlsConfig(tt.url)
+			if (config != nil) != tt.wantTLS {
+				t.Fatalf("got %v, want TLS settings %v", config, tt.wantTLS)
+			}
+			if tt.wantTLS && (config.ClientSessionCache == nil || config.ClientSessionCache != p.tlsSessions) {
+				t.Errorf("connection doesn't use the provider's session cache")
+			}
+		})
+	}
+	if other := testLDAPProvider(t, LDAPConfig{BaseDN: "dc=example,dc=com", KeyAttribute: "sshPublicKey"}); other.tlsSessions == p.tlsSessions {
+		t.Error("providers share a session cache, want one each")
+	}
+}
+
+func TestLDAPTLSSessionResumption(t *testing.T) {
+	var resumed []bool
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resumed = append(resumed, r.TLS.DidResume)
+	}))
+	defer srv.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+
+	p := testLDAPProvider(t, LDAPConfig{BaseDN: "dc=example,dc=com", KeyAttribute: "sshPublicKey"})
+	// successive connections with the settings ldaps:// dials get
+	for range 3 {
+		config := p.tlsConfig("ldaps://" + srv.Listener.Addr().String())
+		config.RootCAs = roots
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: config, DisableKeepAlives: true}}
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if want := []bool{false, true, true}; !slices.Equal(resumed, want) {
+		t.Errorf("resumed = %v, want the first handshake in full and later ones resumed", resumed)
+	}
+}
+
+func TestNormalizeLDAPURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		url     string
+		want    string
+		wantErr bool
+	}{
+		{name: "default ldap port", url: "ldap://ldap.example.com", want: "ldap://ldap.example.com:389"},
+		{name: "default ldaps port", url: "ldaps://ldap.example.com", want: "ldaps://ldap.example.com:636"},
+		{name: "custom port", url: "ldap://ldap.example.com:3890", want: "ldap://ldap.example.com:3890"},
+		{name: "ipv6 literal", url: "ldap://[::1]", want: "ldap://[::1]:389"},
+		{name: "ipv6 literal with port", url: "ldap://[::1]:3890", want: "ldap://[::1]:3890"},
+		{name: "ldapi socket", url: "ldapi://%2Fvar%2Frun%2Fslapd%2Fldapi", want: "ldapi://%2Fvar%2Frun%2Fslapd%2Fldapi"},
+		{name: "invalid scheme", url: "http://ldap.example.com", wantErr: true},
+		{name: "missing scheme", url: "ldap.example.com:389", wantErr: true},
+		{name: "missing host", url: "ldap://:389", wantErr: true},
+		{name: "unbracketed ipv6", url: "ldap://::1", wantErr: true},
+		{name: "port out of range", url: "ldap://ldap.example.com:70000", wantErr: true},
+		{name: "malformed", url: "ldap://[::1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := normalizeLDAPURL(tt.url)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewLDAPProviderRejectsBadURL(t *testing.T) {
+	if _, err := NewLDAPProvider(LDAPConfig{URL: "ldap://[::1"}); err == nil {
+		t.Error("NewLDAPProvider accepted a malformed url")
+	}
+}
+
+func TestLDAPFollowReferrals(t *testing.T) {
+	key := testKey(t, 1, "alice@laptop")
+	referred := newStubLDAP(t, "secret", func(req stubSearch) stubPage {
+		return stubPage{Entries: map[string]map[string][]string{
+			"uid=alice,ou=people,dc=other": {"sshPublicKey": {key}},
+		}}
+	})
+
+	tests := []struct {
+		name      string
+		follow    bool
+		want      []string
+		wantBase  string
+		wantError bool
+	}{
+		{name: "referrals ignored by default", wantError: true},
+		{name: "referral followed", follow: true, want: []string{key}, wantBase: "ou=people,dc=other"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := len(referred.Searches())
+			primary := newStubLDAP(t, "secret", func(req stubSearch) stubPage {
+				return stubPage{Referrals: []string{referred.URL + "/ou=people,dc=other"}}
+			})
+			p := testLDAPProvider(t, LDAPConfig{
+				URL:             primary.URL,
+				BindPassword:    "secret",
+				BaseDN:          "dc=example,dc=com",
+				KeyAttribute:    "sshPublicKey",
+				FollowReferrals: tt.follow,
+			})
+
+			got, err := p.GetKeys("alice")
+			if (err != nil) != tt.wantError {
+				t.Fatalf("error = %v, want error %v", err, tt.wantError)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			searches := referred.Searches()[before:]
+			if !tt.follow && len(searches) > 0 {
+				t.Errorf("referred server searched %d times, want none", len(searches))
+			}
+			if tt.follow && (len(searches) != 1 || searches[0].BaseDN != tt.wantBase || searches[0].Filter != "(uid=alice)") {
+				t.Errorf("referred server searches = %+v, want one for (uid=alice) under %s", searches, tt.wantBase)
+			}
+		})
+	}
+}
+
+func TestParseReferral(t *testing.T) {
+	tests := []struct {
+		name       string
+		referral   string
+		wantServer string
+		wantBase   string
+		wantErr    bool
+	}{
+		{name: "with base dn", referral: "ldap://dc2.example.com/ou=people,dc=example,dc=com", wantServer: "ldap://dc2.example.com:389", wantBase: "ou=people,dc=example,dc=com"},
+		{name: "without base dn", referral: "ldaps://dc2.example.com:3269", wantServer: "ldaps://dc2.example.com:3269", wantBase: "dc=example,dc=com"},
+		{name: "not an LDAP url", referral: "http://dc2.example.com/", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, base, err := parseReferral(tt.referral, "dc=example,dc=com")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if server != tt.wantServer || base != tt.wantBase {
+				t.Errorf("got %q, %q, want %q, %q", server, base, tt.wantServer, tt.wantBase)
+			}
+		})
+	}
+}
+
+func TestLDAPPagedSearch(t *testing.T) {
+	key := testKey(t, 1, "alice@laptop")
+	entry := map[string]map[string][]string{"uid=alice,dc=example,dc=com": {"sshPublicKey": {key}}}
+
+	tests := []struct {
+		name string
+		// pages are served in order, each but the last asking for more
+		pages     []stubPage
+		pageSize  uint32
+		want      []string
+		wantSizes []uint32
+	}{
+		{
+			name:      "unpaged",
+			pages:     []stubPage{{Entries: entry}},
+			want:      []string{key},
+			wantSizes: []uint32{0},
+		},
+		{
+			name:      "entry on the first page releases the cursor",
+			pages:     []stubPage{{Entries: entry, Cookie: "next"}, {}},
+			pageSize:  10,
+			want:      []string{key},
+			wantSizes: []uint32{10, 0},
+		},
+		{
+			name:      "entry on a later page",
+			pages:     []stubPage{{Cookie: "2"}, {Cookie: "3"}, {Entries: entry}},
+			pageSize:  10,
+			want:      []string{key},
+			wantSizes: []uint32{10, 10, 10},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var served int
+			server := newStubLDAP(t, "secret", func(req stubSearch) stubPage {
+				page := tt.pages[min(served, len(tt.pages)-1)]
+				served++
+				return page
+			})
+			p := testLDAPProvider(t, LDAPConfig{
+				URL:          server.URL,
+				BindPassword: "secret",
+				BaseDN:       "dc=example,dc=com",
+				KeyAttribute: "sshPublicKey",
+				PageSize:     tt.pageSize,
+			})
+
+			got, err := p.GetKeys("alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			var sizes []uint32
+			for i, search := range server.Searches() {
+				sizes = append(sizes, search.PageSize)
+				// every page after the first carries the previous page's cookie
+				if i > 0 && search.Cookie != tt.pages[i-1].Cookie {
+					t.Errorf("search %d sent cookie %q, want %q", i, search.Cookie, tt.pages[i-1].Cookie)
+				}
+			}
+			if !slices.Equal(sizes, tt.wantSizes) {
+				t.Errorf("page sizes requested = %v, want %v", sizes, tt.wantSizes)
+			}
+		})
+	}
+}
+
+func TestLDAPTimeoutBetweenPages(t *testing.T) {
+	server := newStubLDAP(t, "secret", func(req stubSearch) stubPage {
+		time.Sleep(30 * time.Millisecond)
+		return stubPage{Cookie: "more"}
+	})
+	p := testLDAPProvider(t, LDAPConfig{
+		URL:          server.URL,
+		BindPassword: "secret",
+		BaseDN:       "dc=example,dc=com",
+		KeyAttribute: "sshPublicKey",
+		PageSize:     10,
+		Timeout:      100 * time.Millisecond,
+	})
+
+	start := time.Now()
+	if _, err := p.GetKeys("alice"); err == nil {
+		t.Fatal("endless paged search succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("lookup took %v, want it cut off near the 100ms timeout", elapsed)
+	}
+}
+
+// closedLDAPURL returns the URL of a local port nothing listens on
+func closedLDAPURL(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return "ldap://" + addr
+}
+
+func TestLDAPUnreachableCooldown(t *testing.T) {
+	tests := []struct {
+		name     string
+		cooldown time.Duration
+		wait     time.Duration
+		wantSkip bool
+	}{
+		{name: "no cooldown dials every time"},
+		{name: "within the cooldown", cooldown: time.Hour, wantSkip: true},
+		{name: "after the cooldown", cooldown: 20 * time.Millisecond, wait: 50 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := testLDAPProvider(t, LDAPConfig{
+				URL:                 closedLDAPURL(t),
+				BaseDN:              "dc=example,dc=com",
+				KeyAttribute:        "sshPublicKey",
+				UnreachableCooldown: tt.cooldown,
+			})
+
+			if _, err := p.GetKeys("alice"); err == nil || errors.Is(err, ErrLDAPUnreachable) {
+				t.Fatalf("first lookup error = %v, want a dial error", err)
+			}
+			time.Sleep(tt.wait)
+			_, err := p.GetKeys("bob")
+			if skipped := errors.Is(err, ErrLDAPUnreachable); skipped != tt.wantSkip {
+				t.Errorf("second lookup error = %v, want skipped %v", err, tt.wantSkip)
+			}
+		})
+	}
+}
+
+func TestLDAPMissIsNotUnreachable(t *testing.T) {
+	key := testKey(t, 1, "alice@laptop")
+	server := newStubLDAP(t, "secret", func(req stubSearch) stubPage {
+		if req.Filter != "(uid=alice)" {
+			return stubPage{}
+		}
+		return stubPage{Entries: map[string]map[string][]string{"uid=alice,dc=example,dc=com": {"sshPublicKey": {key}}}}
+	})
+	p := testLDAPProvider(t, LDAPConfig{
+		URL:                 server.URL,
+		BindPassword:        "secret",
+		BaseDN:              "dc=example,dc=com",
+		KeyAttribute:        "sshPublicKey",
+		UnreachableCooldown: time.Hour,
+	})
+
+	if _, err := p.GetKeys("nobody"); err == nil || errors.Is(err, ErrLDAPUnreachable) {
+		t.Fatalf("lookup of a missing user = %v, want not found", err)
+	}
+	if got, err := p.GetKeys("alice"); err != nil || !slices.Equal(got, []string{key}) {
+		t.Errorf("got %q, %v, want alice's key", got, err)
+	}
+}
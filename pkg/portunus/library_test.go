@@ -0,0 +1,71 @@
+package portunus_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/jpetrucciani/portunus/pkg/portunus"
+	"golang.org/x/crypto/ssh"
+)
+
+// staticProvider is a KeyProvider an embedding program might write
+type staticProvider map[string][]string
+
+func (p staticProvider) GetKeys(upstream string) ([]string, error) {
+	return p[upstream], nil
+}
+
+// TestLibraryAPI resolves keys using only the exported API, as a program
+// embedding portunus would
+func TestLibraryAPI(t *testing.T) {
+	pub, err := ssh.NewPublicKey(ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)).Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub))) + " alice@laptop"
+
+	t.Setenv(portunus.ConfigEnv, `{"mappings": {"alice": {"github": "octocat"}}}`)
+	config, err := portunus.LoadConfig("", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	km, err := portunus.NewKeyManagerFromConfig(config, portunus.WithProvider("github", staticProvider{"octocat": {key}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		username  string
+		wantLines []string
+		wantErr   error
+	}{
+		{name: "mapped login", username: "alice", wantLines: []string{"# github: alice (octocat)", key}},
+		{name: "unmapped login", username: "bob", wantErr: portunus.ErrNoMapping},
+		{name: "invalid login", username: "alice\nroot", wantErr: portunus.ErrInvalidUsername},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := km.Resolve(context.Background(), tt.username)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			if !slices.Equal(result.Lines(), tt.wantLines) {
+				t.Errorf("lines = %q, want %q", result.Lines(), tt.wantLines)
+			}
+			if err != nil {
+				return
+			}
+			if want := strings.Join(tt.wantLines, "\n") + "\n"; string(result.Text()) != want {
+				t.Errorf("text = %q, want %q", result.Text(), want)
+			}
+			if got := result.Summary(tt.username, 0); got != "resolved 1 key for alice from github(1) in 0s" {
+				t.Errorf("summary = %q", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package portunus
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// defaultMinRSABits is LintPolicy.MinRSABits when unset, what current
+// OpenSSH releases require
+const defaultMinRSABits = 2048
+
+// LintPolicy is what the lint subcommand checks each served key against
+type LintPolicy struct {
+	// MinRSABits is the smallest RSA modulus allowed, 2048 by default
+	MinRSABits int `json:"min_rsa_bits,omitempty"`
+
+	// AllowedTypes limits keys to these types, e.g. ["ssh-ed25519",
+	// "sk-ssh-ed25519@openssh.com"]. Empty allows every type except
+	// ssh-dss, which OpenSSH no longer accepts by default.
+	AllowedTypes []string `json:"allowed_types,omitempty"`
+
+	// DisallowedOptions are authorized_keys options keys may not carry,
+	// by name, e.g. ["command", "permitopen"]
+	DisallowedOptions []string `json:"disallowed_options,omitempty"`
+}
+
+// LintFinding is one policy violation by a served key
+type LintFinding struct {
+	Source   string
+	Upstream string
+	// Key is the key's SHA256 fingerprint, or the line itself when it
+	// doesn't parse
+	Key     string
+	Problem string
+}
+
+func (f LintFinding) String() string {
+	return fmt.Sprintf("%s (%s) %s: %s", f.Source, f.Upstream, f.Key, f.Problem)
+}
+
+// Lint checks every key in the result against policy, reporting each
+// violation. It never changes which keys are served.
+func (r Result) Lint(policy LintPolicy) []LintFinding {
+	minBits := policy.MinRSABits
+	if minBits <= 0 {
+		minBits = defaultMinRSABits
+	}
+
+	var findings []LintFinding
+	for _, b := range r.Blocks {
+		for _, line := range b.Keys {
+			if isComment(line) || strings.TrimSpace(line) == "" {
+				continue
+			}
+			report := func(key, format string, args ...any) {
+				findings = append(findings, LintFinding{b.Source, b.Upstream, key, fmt.Sprintf(format, args...)})
+			}
+
+			pub, _, options, _, err := ssh.ParseAuthorizedKey([]byte(line))
+			if err != nil {
+				report(line, "does not parse: %v", err)
+				continue
+			}
+			fp := ssh.FingerprintSHA256(pub)
+
+			switch {
+			case len(policy.AllowedTypes) > 0 && !slices.Contains(policy.AllowedTypes, pub.Type()):
+				report(fp, "type %s is not allowed", pub.Type())
+			case len(policy.AllowedTypes) == 0 && pub.Type() == ssh.KeyAlgoDSA:
+				report(fp, "type %s is disabled by default since OpenSSH 7.0", pub.Type())
+			}
+
+			if crypto, ok := pub.(ssh.CryptoPublicKey); ok {
+				if rsaKey, ok := crypto.CryptoPublicKey().(*rsa.PublicKey); ok && rsaKey.N.BitLen() < minBits {
+					report(fp, "RSA key is %d bits, under the minimum of %d", rsaKey.N.BitLen(), minBits)
+				}
+			}
+
+			for _, option := range options {
+				name, _, _ := strings.Cut(option, "=")
+				if slices.ContainsFunc(policy.DisallowedOptions, func(d string) bool { return strings.EqualFold(d, name) }) {
+					report(fp, "option %s is not allowed", name)
+				}
+			}
+		}
+	}
+	return findings
+}
@@ -0,0 +1,143 @@
+package portunus
+
+import (
+	"context"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"math/big"
+	"slices"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// authorizedKey returns pub as an authorized_keys line and its fingerprint
+func authorizedKey(t *testing.T, pub any) (string, string) {
+	t.Helper()
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))), ssh.FingerprintSHA256(key)
+}
+
+// rsaKey returns an RSA authorized_keys line of bits and its fingerprint
+func rsaKey(t *testing.T, bits int) (string, string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return authorizedKey(t, &key.PublicKey)
+}
+
+func TestLint(t *testing.T) {
+	rsa1024, rsa1024FP := rsaKey(t, 1024)
+	rsa2048, rsa2048FP := rsaKey(t, 2048)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaKey, ecdsaFP := authorizedKey(t, &ecKey.PublicKey)
+	// the parameters only need a 1024 bit P to parse, lint never verifies
+	p := new(big.Int).Add(new(big.Int).Lsh(big.NewInt(1), 1023), big.NewInt(1))
+	dsaKey, dsaFP := authorizedKey(t, &dsa.PublicKey{
+		Parameters: dsa.Parameters{P: p, Q: big.NewInt(7), G: big.NewInt(2)},
+		Y:          big.NewInt(3),
+	})
+	ed25519Key := testKey(t, 1, "")
+	ed25519Pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(ed25519Key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed25519FP := ssh.FingerprintSHA256(ed25519Pub)
+
+	tests := []struct {
+		name   string
+		policy LintPolicy
+		keys   []string
+		want   []string
+	}{
+		{name: "strong keys pass", keys: []string{rsa2048, ecdsaKey, ed25519Key}},
+		{name: "short RSA key", keys: []string{rsa1024, rsa2048}, want: []string{rsa1024FP + ": RSA key is 1024 bits, under the minimum of 2048"}},
+		{name: "lower minimum", policy: LintPolicy{MinRSABits: 1024}, keys: []string{rsa1024}},
+		{
+			name:   "higher minimum",
+			policy: LintPolicy{MinRSABits: 3072},
+			keys:   []string{rsa1024, rsa2048},
+			want: []string{
+				rsa1024FP + ": RSA key is 1024 bits, under the minimum of 3072",
+				rsa2048FP + ": RSA key is 2048 bits, under the minimum of 3072",
+			},
+		},
+		{name: "dsa is disabled by default", keys: []string{dsaKey}, want: []string{dsaFP + ": type ssh-dss is disabled by default since OpenSSH 7.0"}},
+		{name: "allowed dsa", policy: LintPolicy{AllowedTypes: []string{"ssh-dss"}}, keys: []string{dsaKey}},
+		{
+			name:   "allowed types",
+			policy: LintPolicy{AllowedTypes: []string{"ssh-ed25519"}},
+			keys:   []string{ed25519Key, ecdsaKey, rsa1024},
+			want: []string{
+				ecdsaFP + ": type ecdsa-sha2-nistp256 is not allowed",
+				rsa1024FP + ": type ssh-rsa is not allowed",
+				rsa1024FP + ": RSA key is 1024 bits, under the minimum of 2048",
+			},
+		},
+		{
+			name:   "disallowed options",
+			policy: LintPolicy{DisallowedOptions: []string{"command", "PermitOpen"}},
+			keys:   []string{`command="uptime",no-pty ` + ed25519Key, `permitopen="db:5432" ` + ecdsaKey, "no-pty " + rsa2048},
+			want: []string{
+				ed25519FP + ": option command is not allowed",
+				ecdsaFP + ": option permitopen is not allowed",
+			},
+		},
+		{name: "comments and blank lines are skipped", keys: []string{"# a comment", "", ed25519Key}},
+		{name: "unparseable key", keys: []string{"ssh-ed25519 not-base64"}, want: []string{"ssh-ed25519 not-base64: does not parse"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := Result{Username: "alice", Blocks: []KeyBlock{{Source: "github", Upstream: "octocat", Keys: tt.keys}}}
+			var got []string
+			for _, f := range result.Lint(tt.policy) {
+				if f.Source != "github" || f.Upstream != "octocat" {
+					t.Errorf("finding %+v, want it attributed to github (octocat)", f)
+				}
+				// parse errors carry the parser's message, which isn't ours
+				problem, _, _ := strings.Cut(f.Problem, ": ")
+				got = append(got, f.Key+": "+problem)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLintKeepsKeys(t *testing.T) {
+	short, _ := rsaKey(t, 1024)
+	km := newTestKeyManager(t, Config{
+		Mappings: map[string]UserMapping{"alice": {StaticKeys: []StaticKey{{Key: short}}}},
+		Lint:     LintPolicy{AllowedTypes: []string{"ssh-ed25519"}},
+	})
+	result, err := km.Resolve(context.Background(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if findings := result.Lint(km.EffectiveConfig().Lint); len(findings) != 2 {
+		t.Errorf("got %v, want the type and size of the key reported", findings)
+	}
+	if got := stripHeaders(result.Lines()); !slices.Equal(got, []string{short}) {
+		t.Errorf("got %q, want the key still served", got)
+	}
+}
+
+func TestLintFindingString(t *testing.T) {
+	f := LintFinding{Source: "github", Upstream: "octocat", Key: "SHA256:abc", Problem: "option command is not allowed"}
+	if got, want := f.String(), "github (octocat) SHA256:abc: option command is not allowed"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
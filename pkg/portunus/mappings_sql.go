@@ -0,0 +1,158 @@
+package portunus
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"maps"
+	"strings"
+	"time"
+)
+
+// defaultSQLMappingsTimeout bounds the mappings query when Timeout is unset
+const defaultSQLMappingsTimeout = 10 * time.Second
+
+// SQLMappingsConfig loads mappings from a database through database/sql. No
+// drivers are bundled: the program embedding portunus registers one, usually
+// by importing the driver package for its side effects.
+type SQLMappingsConfig struct {
+	Driver string `json:"driver"`
+	DSN    string `json:"dsn"`
+
+	// Query returns three columns, the login, a provider name and the
+	// upstream identity, one row per upstream. Provider "static" takes a
+	// key line as its upstream. A login may have several github or gitlab
+	// rows, but only one for each other provider.
+	Query string `json:"query"`
+
+	// RefreshInterval reloads the mappings on the first lookup after it
+	// has passed, keeping the previous ones if the query fails. Zero loads
+	// them once at startup.
+	RefreshInterval time.Duration `json:"refresh_interval,omitempty"`
+
+	// Timeout bounds each query, 10s by default
+	Timeout time.Duration `json:"timeout,omitempty"`
+}
+
+// loadSQLMappings runs the mappings query and adds the logins it returns to
+// file. Logins mapped in file keep that mapping, so the file can override
+// the database.
+func loadSQLMappings(config SQLMappingsConfig, file map[string]UserMapping) (map[string]UserMapping, error) {
+	if config.Driver == "" || config.Query == "" {
+		return nil, fmt.Errorf("mappings_sql: driver and query are required")
+	}
+	db, err := sql.Open(config.Driver, config.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("mappings_sql: %w", err)
+	}
+	defer db.Close()
+
+	timeout := defaultSQLMappingsTimeout
+	if config.Timeout > 0 {
+		timeout = config.Timeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, config.Query)
+	if err != nil {
+		return nil, fmt.Errorf("mappings_sql: %w", err)
+	}
+	defer rows.Close()
+
+	loaded := make(map[string]UserMapping)
+	for rows.Next() {
+		var login, provider, upstream string
+		if err := rows.Scan(&login, &provider, &upstream); err != nil {
+			return nil, fmt.Errorf("mappings_sql: %w", err)
+		}
+		login, provider, upstream = strings.TrimSpace(login), strings.TrimSpace(provider), strings.TrimSpace(upstream)
+		if login == "" || upstream == "" {
+			return nil, fmt.Errorf("mappings_sql: row for %q with provider %q has an empty login or upstream", login, provider)
+		}
+		if _, ok := file[login]; ok {
+			continue
+		}
+		m, err := loaded[login].addUpstream(provider, upstream)
+		if err != nil {
+			return nil, fmt.Errorf("mappings_sql: %s: %w", login, err)
+		}
+		loaded[login] = m
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("mappings_sql: %w", err)
+	}
+
+	mappings := make(map[string]UserMapping, len(file)+len(loaded))
+	maps.Copy(mappings, file)
+	maps.Copy(mappings, loaded)
+	return mappings, nil
+}
+
+// addUpstream returns m with upstream added on provider
+func (m UserMapping) addUpstream(provider, upstream string) (UserMapping, error) {
+	switch provider {
+	case "static":
+		m.StaticKeys = append(m.StaticKeys, StaticKey{Key: upstream})
+		return m, nil
+	case "github":
+		m.GitHub = append(m.GitHub, upstream)
+		return m, nil
+	case "gitlab":
+		m.GitLab = append(m.GitLab, upstream)
+		return m, nil
+	}
+	if _, builtin := providerNames[provider]; !builtin {
+		if _, ok := registeredProvider(provider); !ok {
+			return m, fmt.Errorf("unknown provider %q", provider)
+		}
+	}
+	if len(m.Upstreams(provider)) > 0 {
+		return m, fmt.Errorf("more than one %s upstream", provider)
+	}
+	return m.withUpstream(provider, upstream), nil
+}
+
+// currentMappings returns the mappings in use, which change when
+// mappings_sql is refreshed
+func (km *KeyManager) currentMappings() map[string]UserMapping {
+	km.mappingsMu.RLock()
+	defer km.mappingsMu.RUnlock()
+	return km.config.Mappings
+}
+
+// refreshSQLMappings reloads mappings_sql once RefreshInterval has passed
+// since the last attempt. Concurrent lookups share one reload, and a failed
+// one is logged and retried after another interval.
+func (km *KeyManager) refreshSQLMappings() {
+	config := km.config.MappingsSQL
+	if config == nil || config.RefreshInterval <= 0 {
+		return
+	}
+	km.mappingsMu.RLock()
+	due := time.Since(km.sqlLoaded) >= config.RefreshInterval
+	km.mappingsMu.RUnlock()
+	if !due {
+		return
+	}
+
+	km.refreshes.Do("mappings_sql", func() (any, error) {
+		mappings, err := loadSQLMappings(*config, km.fileMappings)
+		var folded map[string]string
+		if err == nil && km.config.CaseInsensitiveUsers {
+			folded, err = foldLogins(mappings)
+		}
+
+		km.mappingsMu.Lock()
+		defer km.mappingsMu.Unlock()
+		km.sqlLoaded = time.Now()
+		if err != nil {
+			log.Printf("Error refreshing mappings, keeping the previous ones: %v", err)
+			return nil, nil
+		}
+		km.config.Mappings = mappings
+		km.foldedLogins = folded
+		return nil, nil
+	})
+}
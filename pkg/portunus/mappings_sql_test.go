@@ -0,0 +1,241 @@
+package portunus
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"errors"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// testMappingsDB creates an in-memory SQLite database holding rows in a
+// mappings table, and returns the DSN to reach it and the database, which
+// keeps it alive until the test ends
+func testMappingsDB(t *testing.T, rows [][3]string) (string, *sql.DB) {
+	t.Helper()
+	dsn := "file:" + strings.NewReplacer("/", "_", " ", "_").Replace(t.Name()) + "?mode=memory&cache=shared"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Exec("CREATE TABLE mappings (login TEXT, provider TEXT, upstream TEXT)"); err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range rows {
+		if _, err := db.Exec("INSERT INTO mappings VALUES (?, ?, ?)", row[0], row[1], row[2]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dsn, db
+}
+
+// mappingsQuery selects every row of a testMappingsDB
+const mappingsQuery = "SELECT login, provider, upstream FROM mappings ORDER BY rowid"
+
+func TestSQLMappings(t *testing.T) {
+	key := testKey(t, 1, "alice")
+
+	tests := []struct {
+		name  string
+		rows  [][3]string
+		file  map[string]UserMapping
+		query string
+		want  map[string]UserMapping
+	}{
+		{
+			name: "one row per upstream",
+			rows: [][3]string{
+				{"alice", "github", "octocat"},
+				{"alice", "github", "hubot"},
+				{"alice", "gitlab", "tanuki"},
+				{"alice", "ldap", "alice"},
+				{"alice", "static", key},
+				{"bob", "dns", "bob.keys.example.com"},
+			},
+			want: map[string]UserMapping{
+				"alice": {
+					GitHub:     Usernames{"octocat", "hubot"},
+					GitLab:     Usernames{"tanuki"},
+					LDAPUser:   "alice",
+					StaticKeys: []StaticKey{{Key: key}},
+				},
+				"bob": {DNS: "bob.keys.example.com"},
+			},
+		},
+		{
+			name: "registered providers",
+			rows: [][3]string{{"alice", "testvault", "alice"}},
+			want: map[string]UserMapping{"alice": {Providers: map[string]string{"testvault": "alice"}}},
+		},
+		{
+			name: "the file overrides the database",
+			rows: [][3]string{{"alice", "github", "octocat"}, {"bob", "github", "hubot"}},
+			file: map[string]UserMapping{"alice": {GitLab: Usernames{"tanuki"}}},
+			want: map[string]UserMapping{
+				"alice": {GitLab: Usernames{"tanuki"}},
+				"bob":   {GitHub: Usernames{"hubot"}},
+			},
+		},
+		{
+			name: "whitespace is trimmed",
+			rows: [][3]string{{" alice ", " github", "octocat "}},
+			want: map[string]UserMapping{"alice": {GitHub: Usernames{"octocat"}}},
+		},
+		{
+			name:  "no rows",
+			query: "SELECT login, provider, upstream FROM mappings WHERE 0",
+			file:  map[string]UserMapping{"alice": {GitHub: Usernames{"octocat"}}},
+			want:  map[string]UserMapping{"alice": {GitHub: Usernames{"octocat"}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dsn, _ := testMappingsDB(t, tt.rows)
+			config := SQLMappingsConfig{Driver: "sqlite", DSN: dsn, Query: cmp.Or(tt.query, mappingsQuery)}
+			km := newTestKeyManager(t, Config{Mappings: tt.file, MappingsSQL: &config})
+
+			if got := km.currentMappings(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInvalidSQLMappings(t *testing.T) {
+	tests := []struct {
+		name    string
+		rows    [][3]string
+		config  SQLMappingsConfig
+		wantErr string
+	}{
+		{
+			name:    "no driver",
+			config:  SQLMappingsConfig{Query: mappingsQuery},
+			wantErr: "driver and query are required",
+		},
+		{
+			name:    "no query",
+			config:  SQLMappingsConfig{Driver: "sqlite"},
+			wantErr: "driver and query are required",
+		},
+		{
+			name:    "unknown driver",
+			config:  SQLMappingsConfig{Driver: "nosuchdb", Query: mappingsQuery},
+			wantErr: "unknown driver",
+		},
+		{
+			name:    "bad query",
+			config:  SQLMappingsConfig{Driver: "sqlite", Query: "SELECT * FROM nosuchtable"},
+			wantErr: "no such table",
+		},
+		{
+			name:    "wrong number of columns",
+			rows:    [][3]string{{"alice", "github", "octocat"}},
+			config:  SQLMappingsConfig{Driver: "sqlite", Query: "SELECT login, provider FROM mappings"},
+			wantErr: "expected 2 destination arguments",
+		},
+		{
+			name:    "empty upstream",
+			rows:    [][3]string{{"alice", "github", " "}},
+			config:  SQLMappingsConfig{Driver: "sqlite", Query: mappingsQuery},
+			wantErr: "empty login or upstream",
+		},
+		{
+			name:    "unknown provider",
+			rows:    [][3]string{{"alice", "gitea", "alice"}},
+			config:  SQLMappingsConfig{Driver: "sqlite", Query: mappingsQuery},
+			wantErr: `alice: unknown provider "gitea"`,
+		},
+		{
+			name:    "two upstreams on a single-valued provider",
+			rows:    [][3]string{{"alice", "ldap", "alice"}, {"alice", "ldap", "asmith"}},
+			config:  SQLMappingsConfig{Driver: "sqlite", Query: mappingsQuery},
+			wantErr: "more than one ldap upstream",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dsn, _ := testMappingsDB(t, tt.rows)
+			config := tt.config
+			config.DSN = dsn
+			_, err := NewKeyManagerFromConfig(Config{MappingsSQL: &config})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSQLMappingsRefresh(t *testing.T) {
+	key := testKey(t, 1, "bob")
+	dsn, db := testMappingsDB(t, [][3]string{{"alice", "github", "octocat"}})
+	interval := 50 * time.Millisecond
+	km := newTestKeyManager(t, Config{MappingsSQL: &SQLMappingsConfig{
+		Driver:          "sqlite",
+		DSN:             dsn,
+		Query:           mappingsQuery,
+		RefreshInterval: interval,
+	}})
+	if got := km.Logins(); !slices.Equal(got, []string{"alice"}) {
+		t.Fatalf("got logins %q, want alice", got)
+	}
+
+	// rows added to the database are picked up once the interval passes
+	if _, err := db.Exec("INSERT INTO mappings VALUES ('bob', 'static', ?)", key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := km.Resolve(context.Background(), "bob"); !errors.Is(err, ErrNoMapping) {
+		t.Errorf("got error %v, want bob unknown before the interval", err)
+	}
+	time.Sleep(interval)
+	if got := stripHeaders(resolveLines(t, km, "bob")); !slices.Equal(got, []string{key}) {
+		t.Errorf("got %q, want bob's key from the database", got)
+	}
+
+	// a failing refresh keeps the previous mappings
+	logs := captureLog(t)
+	if _, err := db.Exec("DROP TABLE mappings"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(interval)
+	if got := stripHeaders(resolveLines(t, km, "bob")); !slices.Equal(got, []string{key}) {
+		t.Errorf("got %q, want bob's key kept", got)
+	}
+	if !strings.Contains(logs.String(), "keeping the previous ones") {
+		t.Errorf("got logs %q, want the failed refresh logged", logs)
+	}
+}
+
+func TestSQLMappingsCaseInsensitive(t *testing.T) {
+	key := testKey(t, 1, "alice")
+
+	t.Run("logins from the database fold", func(t *testing.T) {
+		dsn, _ := testMappingsDB(t, [][3]string{{"Alice", "static", key}})
+		km := newTestKeyManager(t, Config{
+			CaseInsensitiveUsers: true,
+			MappingsSQL:          &SQLMappingsConfig{Driver: "sqlite", DSN: dsn, Query: mappingsQuery},
+		})
+		if got := stripHeaders(resolveLines(t, km, "alice")); !slices.Equal(got, []string{key}) {
+			t.Errorf("got %q, want Alice's key", got)
+		}
+	})
+
+	t.Run("clashing with the file", func(t *testing.T) {
+		dsn, _ := testMappingsDB(t, [][3]string{{"alice", "static", key}})
+		_, err := NewKeyManagerFromConfig(Config{
+			CaseInsensitiveUsers: true,
+			Mappings:             map[string]UserMapping{"Alice": {StaticKeys: []StaticKey{{Key: key}}}},
+			MappingsSQL:          &SQLMappingsConfig{Driver: "sqlite", DSN: dsn, Query: mappingsQuery},
+		})
+		if err == nil || !strings.Contains(err.Error(), "differ only in case") {
+			t.Errorf("got error %v, want the clash between the file and the database", err)
+		}
+	})
+}
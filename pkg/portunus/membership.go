@@ -0,0 +1,82 @@
+package portunus
+
+import (
+	"sync"
+	"time"
+)
+
+// MemberLister is implemented by providers that can list the accounts in a
+// group, such as a GitHub team, see UserMapping.GitHubTeams
+type MemberLister interface {
+	Members(group string) ([]string, error)
+}
+
+// defaultMembershipTTL is how long a group's member list is kept when the
+// provider's membership_ttl is unset
+const defaultMembershipTTL = 5 * time.Minute
+
+// membersPerPage is the page size requested when listing members, and
+// maxMemberPages bounds how many pages one group may take
+const (
+	membersPerPage = 100
+	maxMemberPages = 100
+)
+
+// memberCache keeps each group's member list for its TTL, separately from
+// the per-login key cache, since membership changes far less often than a
+// user's keys are looked up
+type memberCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]memberEntry
+}
+
+type memberEntry struct {
+	members []string
+	expires time.Time
+}
+
+func newMemberCache(ttl time.Duration) *memberCache {
+	if ttl <= 0 {
+		ttl = defaultMembershipTTL
+	}
+	return &memberCache{ttl: ttl, entries: make(map[string]memberEntry)}
+}
+
+// get returns the cached members of group, calling list on a miss. Failures
+// are not cached.
+func (c *memberCache) get(group string, list func() ([]string, error)) ([]string, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[group]
+	c.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.members, nil
+	}
+
+	members, err := list()
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.entries[group] = memberEntry{members: members, expires: time.Now().Add(c.ttl)}
+	c.mu.Unlock()
+	return members, nil
+}
+
+// listPages calls page with 1, 2, ... and collects the results, stopping at
+// the first page shorter than membersPerPage
+func listPages(page func(n int) ([]string, int, error)) ([]string, error) {
+	var all []string
+	for n := 1; n <= maxMemberPages; n++ {
+		members, size, err := page(n)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, members...)
+		if size < membersPerPage {
+			return all, nil
+		}
+	}
+	return all, nil
+}
@@ -0,0 +1,239 @@
+package portunus
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// membersStub serves members at path a page at a time, as the GitHub and
+// GitLab member listings do, and the keys of each account at
+// /<account>.keys, counting the member pages requested
+type membersStub struct {
+	*httptest.Server
+	pages atomic.Int32
+}
+
+func newMembersStub(t *testing.T, path, token string, members []map[string]string) *membersStub {
+	t.Helper()
+	stub := &membersStub{}
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "token "+token && r.Header.Get("PRIVATE-TOKEN") != token {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		stub.pages.Add(1)
+		size, _ := strconv.Atoi(r.URL.Query().Get("per_page"))
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		start := min(len(members), (page-1)*size)
+		json.NewEncoder(w).Encode(members[start:min(len(members), start+size)])
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		login, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/"), ".keys")
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintln(w, memberKey(t, login))
+	})
+	stub.Server = httptest.NewServer(mux)
+	t.Cleanup(stub.Close)
+	return stub
+}
+
+// memberKey is the key membersStub serves for login
+func memberKey(t *testing.T, login string) string {
+	return testKey(t, int(login[len(login)-1]), login)
+}
+
+// logins returns n member entries named <prefix>0, <prefix>1, ... under field
+func logins(field, prefix string, n int) ([]map[string]string, []string) {
+	var entries []map[string]string
+	var names []string
+	for i := range n {
+		name := prefix + strconv.Itoa(i)
+		entries = append(entries, map[string]string{field: name})
+		names = append(names, name)
+	}
+	return entries, names
+}
+
+func TestMembers(t *testing.T) {
+	many, manyNames := logins("login", "user", membersPerPage+3)
+	few, fewNames := logins("username", "dev", 3)
+	withBlocked := append(slices.Clone(few), map[string]string{"username": "gone", "state": "blocked"})
+	httpConfig := HTTPConfig{AllowPrivateNetworks: true}
+
+	tests := []struct {
+		name    string
+		path    string
+		members []map[string]string
+		build   func(url, token string) (MemberLister, error)
+		group   string
+		token   string
+		want    []string
+		// wantPages is how many member pages two listings should take
+		wantPages int32
+		wantErr   bool
+	}{
+		{
+			name:    "github team across pages",
+			path:    "/api/v3/orgs/acme/teams/ops/members",
+			members: many,
+			build: func(url, token string) (MemberLister, error) {
+				return NewGitHubProvider(GitHubConfig{URL: url, Token: token, HTTPConfig: httpConfig})
+			},
+			group:     "acme/ops",
+			token:     "hub",
+			want:      manyNames,
+			wantPages: 2,
+		},
+		{
+			name:    "github org",
+			path:    "/api/v3/orgs/acme/members",
+			members: many[:2],
+			build: func(url, token string) (MemberLister, error) {
+				return NewGitHubProvider(GitHubConfig{URL: url, Token: token, HTTPConfig: httpConfig})
+			},
+			group:     "acme",
+			token:     "hub",
+			want:      manyNames[:2],
+			wantPages: 1,
+		},
+		{
+			name:    "membership ttl expired",
+			path:    "/api/v3/orgs/acme/members",
+			members: many[:2],
+			build: func(url, token string) (MemberLister, error) {
+				return NewGitHubProvider(GitHubConfig{URL: url, Token: token, MembershipTTL: time.Nanosecond, HTTPConfig: httpConfig})
+			},
+			group:     "acme",
+			token:     "hub",
+			want:      manyNames[:2],
+			wantPages: 2,
+		},
+		{
+			name:    "github without a token",
+			path:    "/api/v3/orgs/acme/members",
+			members: many[:2],
+			build: func(url, token string) (MemberLister, error) {
+				return NewGitHubProvider(GitHubConfig{URL: url, HTTPConfig: httpConfig})
+			},
+			group:   "acme",
+			wantErr: true,
+		},
+		{
+			name:    "gitlab group skips inactive members",
+			path:    "/api/v4/groups/infra%2Foncall/members/all",
+			members: withBlocked,
+			build: func(url, token string) (MemberLister, error) {
+				return NewGitLabProvider(GitLabConfig{URL: url, Token: token, HTTPConfig: httpConfig})
+			},
+			group:     "infra/oncall",
+			token:     "lab",
+			want:      fewNames,
+			wantPages: 1,
+		},
+		{
+			name:    "gitlab without a token",
+			path:    "/api/v4/groups/infra/members/all",
+			members: few,
+			build: func(url, token string) (MemberLister, error) {
+				return NewGitLabProvider(GitLabConfig{URL: url, HTTPConfig: httpConfig})
+			},
+			group:   "infra",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newMembersStub(t, tt.path, tt.token, tt.members)
+			lister, err := tt.build(stub.URL, tt.token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for range 2 {
+				got, err := lister.Members(tt.group)
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+				}
+				if !slices.Equal(got, tt.want) {
+					t.Errorf("got %d members %q, want %d", len(got), got, len(tt.want))
+				}
+			}
+			if n := stub.pages.Load(); n != tt.wantPages {
+				t.Errorf("requested %d member pages, want %d", n, tt.wantPages)
+			}
+		})
+	}
+}
+
+func TestGroupKeys(t *testing.T) {
+	members, _ := logins("login", "dev", 2)
+	stub := newMembersStub(t, "/api/v3/orgs/acme/teams/ops/members", "hub", members)
+	github, err := NewGitHubProvider(GitHubConfig{URL: stub.URL, Token: "hub", HTTPConfig: HTTPConfig{AllowPrivateNetworks: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		mapping    UserMapping
+		failClosed bool
+		want       []string
+		wantErr    bool
+	}{
+		{
+			name:    "members are served",
+			mapping: UserMapping{GitHubTeams: []string{"acme/ops"}},
+			want: []string{
+				"# github: oncall (dev0)", memberKey(t, "dev0"),
+				"# github: oncall (dev1)", memberKey(t, "dev1"),
+			},
+		},
+		{
+			name:    "a member also listed directly is served once",
+			mapping: UserMapping{GitHub: Usernames{"dev1"}, GitHubTeams: []string{"acme/ops"}},
+			want: []string{
+				"# github: oncall (dev1)", memberKey(t, "dev1"),
+				"# github: oncall (dev0)", memberKey(t, "dev0"),
+			},
+		},
+		{
+			name:    "unlisted group is skipped",
+			mapping: UserMapping{GitHub: Usernames{"dev0"}, GitHubTeams: []string{"acme/missing"}},
+			want:    []string{"# github: oncall (dev0)", memberKey(t, "dev0")},
+		},
+		{
+			name:       "unlisted group fails closed",
+			mapping:    UserMapping{GitHub: Usernames{"dev0"}, GitHubTeams: []string{"acme/missing"}},
+			failClosed: true,
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			km := newTestKeyManager(t, Config{
+				Mappings:   map[string]UserMapping{"oncall": tt.mapping},
+				FailClosed: tt.failClosed,
+			}, WithProvider("github", github))
+
+			result, err := km.Resolve(context.Background(), "oncall")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if got := result.Lines(); !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package portunus
+
+import (
+	"errors"
+	"log"
+)
+
+// lastGoodPrefix namespaces the last-good key sets kept in the cache, see
+// Config.MinKeysExpected
+const lastGoodPrefix = "last-good/"
+
+// countKeys counts the key lines in blocks, leaving out comments
+func countKeys(blocks []KeyBlock) int {
+	var n int
+	for _, b := range blocks {
+		for _, line := range b.Keys {
+			if !isComment(line) {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// guardMinKeys applies Config.MinKeysExpected to the outcome of a lookup. A
+// lookup with at least that many keys becomes the login's last-good set. One
+// with fewer, when the last-good set had enough, is logged loudly, and with
+// FailClosed the last-good set is served in its place. Lookups that failed
+// before reaching any provider, and lookups narrowed by -only-sources or
+// offline mode, are left alone.
+func (km *KeyManager) guardMinKeys(username string, blocks []KeyBlock, err error) ([]KeyBlock, error) {
+	min := km.config.MinKeysExpected
+	if min <= 0 || km.lastGood == nil || km.onlySources != nil || km.offline ||
+		errors.Is(err, ErrInvalidUsername) || errors.Is(err, ErrNoMapping) || errors.Is(err, ErrMappingDisabled) {
+		return blocks, err
+	}
+
+	key := lastGoodPrefix + km.canonicalLogin(username)
+	count := countKeys(blocks)
+	if err == nil && count >= min {
+		km.lastGood.Set(key, flattenBlocks(blocks), 0)
+		return blocks, err
+	}
+	lastGood, _, ok := km.lastGood.Get(key)
+	if !ok {
+		return blocks, err
+	}
+	lastCount := countKeys([]KeyBlock{{Keys: lastGood}})
+	if lastCount < min {
+		return blocks, err
+	}
+
+	log.Printf("WARNING: %s resolved %d keys, fewer than min_keys_expected %d, after %d last time", username, count, min, lastCount)
+	if !km.config.FailClosed {
+		return blocks, err
+	}
+	if err != nil {
+		log.Printf("Error looking up keys for %s, serving the last-good set: %v", username, err)
+	} else {
+		log.Printf("Serving the last-good set of %d keys for %s instead", lastCount, username)
+	}
+	return []KeyBlock{{Source: "last-good", Upstream: username, Keys: lastGood}}, nil
+}
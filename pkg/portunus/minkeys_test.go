@@ -0,0 +1,182 @@
+package portunus
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestMinKeysExpected(t *testing.T) {
+	k1, k2, k3 := testKey(t, 1, "one"), testKey(t, 2, "two"), testKey(t, 3, "three")
+	outage := errors.New("503 service unavailable")
+
+	// each lookup serves the step's keys, or fails with its error
+	type step struct {
+		keys []string
+		err  error
+	}
+	tests := []struct {
+		name        string
+		min         int
+		failClosed  bool
+		steps       []step
+		want        []string
+		wantErr     bool
+		wantWarning bool
+	}{
+		{
+			name:        "drop to zero warns",
+			min:         1,
+			steps:       []step{{keys: []string{k1, k2}}, {}},
+			wantErr:     true,
+			wantWarning: true,
+		},
+		{
+			name:        "drop to zero with fail_closed serves the last-good set",
+			min:         1,
+			failClosed:  true,
+			steps:       []step{{keys: []string{k1, k2}}, {}},
+			want:        []string{k1, k2},
+			wantWarning: true,
+		},
+		{
+			name:        "failed fetch with fail_closed serves the last-good set",
+			min:         1,
+			failClosed:  true,
+			steps:       []step{{keys: []string{k1, k2}}, {err: outage}},
+			want:        []string{k1, k2},
+			wantWarning: true,
+		},
+		{
+			name:        "drop below the threshold",
+			min:         2,
+			steps:       []step{{keys: []string{k1, k2}}, {keys: []string{k1}}},
+			want:        []string{k1},
+			wantWarning: true,
+		},
+		{
+			name:        "drop below the threshold with fail_closed",
+			min:         2,
+			failClosed:  true,
+			steps:       []step{{keys: []string{k1, k2}}, {keys: []string{k1}}},
+			want:        []string{k1, k2},
+			wantWarning: true,
+		},
+		{
+			name:       "a login that never had enough keys",
+			min:        2,
+			failClosed: true,
+			steps:      []step{{keys: []string{k1}}, {}},
+			wantErr:    true,
+		},
+		{
+			name:  "a new set that still has enough keys replaces the last-good one",
+			min:   2,
+			steps: []step{{keys: []string{k1, k2}}, {keys: []string{k2, k3}}},
+			want:  []string{k2, k3},
+		},
+		{
+			name:       "fail_closed serves the latest last-good set",
+			min:        2,
+			failClosed: true,
+			steps:      []step{{keys: []string{k1, k2}}, {keys: []string{k2, k3}}, {}},
+			want:       []string{k2, k3},
+			// the last lookup is the only one that falls short
+			wantWarning: true,
+		},
+		{
+			name:    "guard off",
+			steps:   []step{{keys: []string{k1, k2}}, {}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLog(t)
+			github := &fakeProvider{}
+			km := newTestKeyManager(t, Config{
+				Mappings:        map[string]UserMapping{"alice": {GitHub: Usernames{"octocat"}}},
+				MinKeysExpected: tt.min,
+				FailClosed:      tt.failClosed,
+			}, WithProvider("github", github))
+
+			var result Result
+			var err error
+			for _, s := range tt.steps {
+				github.mu.Lock()
+				github.keys, github.err = map[string][]string{"octocat": s.keys}, s.err
+				github.mu.Unlock()
+				result, err = km.Resolve(context.Background(), "alice")
+			}
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if got := stripHeaders(result.Lines()); !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if warned := strings.Contains(logs.String(), "fewer than min_keys_expected"); warned != tt.wantWarning {
+				t.Errorf("warning logged = %v, want %v:\n%s", warned, tt.wantWarning, logs)
+			}
+		})
+	}
+}
+
+func TestMinKeysExpectedUsesTheCache(t *testing.T) {
+	key := testKey(t, 1, "one")
+	github := &fakeProvider{keys: map[string][]string{"octocat": {key}}}
+	mr := miniredis.RunT(t)
+	config := Config{
+		Mappings:        map[string]UserMapping{"alice": {GitHub: Usernames{"octocat"}}},
+		MinKeysExpected: 1,
+		FailClosed:      true,
+		Cache: CacheConfig{
+			Enabled: true,
+			TTL:     time.Minute,
+			Redis:   &RedisConfig{Address: mr.Addr()},
+		},
+	}
+	first := newTestKeyManager(t, config, WithProvider("github", github))
+	resolveLines(t, first, "alice")
+
+	// a new process sharing the cache still has the last-good set once the
+	// cached keys have expired
+	mr.FastForward(time.Hour)
+	github.mu.Lock()
+	github.keys = nil
+	github.mu.Unlock()
+	captureLog(t)
+	second := newTestKeyManager(t, config, WithProvider("github", github))
+	result, err := second.Resolve(context.Background(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Blocks) != 1 || result.Blocks[0].Source != "last-good" ||
+		!slices.Equal(result.Blocks[0].Keys, []string{"# github: alice (octocat)", key}) {
+		t.Errorf("got %+v, want the last-good set from the cache", result.Blocks)
+	}
+	if calls := github.Calls(); calls != 2 {
+		t.Errorf("got %d fetches, want the expired keys fetched again", calls)
+	}
+}
+
+func TestMinKeysExpectedLeavesDisabledMappingsAlone(t *testing.T) {
+	key := testKey(t, 1, "one")
+	disabled := false
+	km := newTestKeyManager(t, Config{
+		Mappings:        map[string]UserMapping{"alice": {StaticKeys: []StaticKey{{Key: key}}}},
+		MinKeysExpected: 1,
+		FailClosed:      true,
+	})
+	resolveLines(t, km, "alice")
+
+	km.config.Mappings["alice"] = UserMapping{StaticKeys: []StaticKey{{Key: key}}, Enabled: &disabled}
+	if _, err := km.Resolve(context.Background(), "alice"); !errors.Is(err, ErrMappingDisabled) {
+		t.Errorf("got error %v, want the mapping still disabled", err)
+	}
+}
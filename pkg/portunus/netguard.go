@@ -0,0 +1,203 @@
+package portunus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ErrBlockedAddress is returned when a provider request would reach a host
+// outside allowed_hosts, or a loopback, link-local or private address while
+// allow_private_networks is off
+var ErrBlockedAddress = errors.New("request blocked by network policy")
+
+// blockedPrefixes are refused by default on top of what netip classifies as
+// loopback, link-local or private: IPv4 "this network", carrier-grade NAT,
+// and NAT64, which could reach the others. IPv4-mapped IPv6 addresses are
+// unmapped before checking.
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+}
+
+// hostPolicy is the outbound network policy of an HTTPConfig
+type hostPolicy struct {
+	hosts        map[string]bool
+	prefixes     []netip.Prefix
+	allowPrivate bool
+}
+
+// hostPolicy parses allowed_hosts into host names and CIDR ranges. A bare IP
+// is treated as a single-address range.
+func (c HTTPConfig) hostPolicy() (hostPolicy, error) {
+	policy := hostPolicy{hosts: make(map[string]bool), allowPrivate: c.AllowPrivateNetworks}
+	for _, entry := range c.AllowedHosts {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if prefix, err := netip.ParsePrefix(entry); err == nil {
+			policy.prefixes = append(policy.prefixes, prefix.Masked())
+			continue
+		}
+		if addr, err := netip.ParseAddr(entry); err == nil {
+			policy.prefixes = append(policy.prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		if strings.ContainsAny(entry, "/:") {
+			return hostPolicy{}, fmt.Errorf("invalid allowed_hosts entry %q: want a host name, IP or CIDR", entry)
+		}
+		policy.hosts[strings.ToLower(entry)] = true
+	}
+	return policy, nil
+}
+
+// restricted reports whether allowed_hosts limits which hosts may be reached
+func (p hostPolicy) restricted() bool {
+	return len(p.hosts) > 0 || len(p.prefixes) > 0
+}
+
+// inPrefixes reports whether addr falls in one of the allowed CIDR ranges
+func (p hostPolicy) inPrefixes(addr netip.Addr) bool {
+	for _, prefix := range p.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkHost is applied to every request, redirects included, before it is
+// sent. With allowed_hosts set, a host name that is not listed can only pass
+// when there are ranges its address may turn out to be in, which the dialer
+// checks. A proxied request is never dialed directly, so there it must match
+// up front.
+func (p hostPolicy) checkHost(host string, proxied bool) error {
+	if !p.restricted() || p.hosts[host] {
+		return nil
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return p.checkAddr(addr)
+	}
+	if len(p.prefixes) > 0 && !proxied {
+		return nil
+	}
+	return fmt.Errorf("%w: %s is not in allowed_hosts", ErrBlockedAddress, host)
+}
+
+// checkAddr is applied to every address dialed, after DNS resolution, so a
+// name that resolves to an internal address is refused as well. With
+// allowed_hosts set the address must be in a listed range, otherwise it must
+// not be internal unless allow_private_networks is on.
+func (p hostPolicy) checkAddr(addr netip.Addr) error {
+	addr = addr.Unmap()
+	if p.restricted() {
+		if p.inPrefixes(addr) {
+			return nil
+		}
+		return fmt.Errorf("%w: %s is not in allowed_hosts", ErrBlockedAddress, addr)
+	}
+	if p.allowPrivate || !internalAddr(addr) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s is a loopback, link-local or private address", ErrBlockedAddress, addr)
+}
+
+// internalAddr reports whether addr is one the default policy refuses, which
+// covers cloud metadata endpoints such as 169.254.169.254
+func internalAddr(addr netip.Addr) bool {
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsUnspecified() ||
+		addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast() {
+		return true
+	}
+	for _, prefix := range blockedPrefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// trustedHostKey marks a request context whose host is listed by name in
+// allowed_hosts, or which goes through a proxy, for the dialer to see. Listed
+// names are trusted to resolve wherever they do.
+type trustedHostKey struct{}
+
+// dialContext returns a dial function that refuses addresses the policy
+// blocks. The check runs on the resolved address of each connection attempt.
+// Proxies are exempt, as the operator configured them, and allowed_hosts
+// still applies to every request's host.
+func (p hostPolicy) dialContext() func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		trusted, _ := ctx.Value(trustedHostKey{}).(bool)
+		dialer := &net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+			Control: func(_, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				addr, err := netip.ParseAddr(host)
+				if err != nil {
+					return err
+				}
+				if trusted {
+					return nil
+				}
+				return p.checkAddr(addr)
+			},
+		}
+		return dialer.DialContext(ctx, network, address)
+	}
+}
+
+// guardedTransport returns the shared transport wrapped with the config's
+// host policy
+func (c HTTPConfig) guardedTransport() http.RoundTripper {
+	policy, _ := c.hostPolicy()
+	proxy, err := c.proxyFunc()
+	if err != nil {
+		proxy = http.ProxyFromEnvironment
+	}
+	return guardedTransport{policy: policy, proxy: proxy, next: c.sharedTransport()}
+}
+
+// guardedTransport applies a hostPolicy to each request before handing it to
+// the shared transport
+type guardedTransport struct {
+	policy hostPolicy
+	proxy  func(*http.Request) (*url.URL, error)
+	next   http.RoundTripper
+}
+
+func (g guardedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := strings.ToLower(strings.TrimSuffix(req.URL.Hostname(), "."))
+	// the proxy is the operator's choice and is what gets dialed, so only
+	// the request's host can be checked
+	proxyURL, err := g.proxy(req)
+	proxied := err == nil && proxyURL != nil
+	if err := g.policy.checkHost(host, proxied); err != nil {
+		return nil, err
+	}
+	if proxied {
+		if addr, err := netip.ParseAddr(host); err == nil {
+			if err := g.policy.checkAddr(addr); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if proxied || g.policy.hosts[host] {
+		req = req.WithContext(context.WithValue(req.Context(), trustedHostKey{}, true))
+	}
+	return g.next.RoundTrip(req)
+}
@@ -0,0 +1,131 @@
+package portunus
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestCheckAddr(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  HTTPConfig
+		addr    string
+		blocked bool
+	}{
+		{name: "public IPv4", addr: "140.82.112.3"},
+		{name: "public IPv6", addr: "2606:50c0:8000::153"},
+		{name: "metadata endpoint", addr: "169.254.169.254", blocked: true},
+		{name: "mapped metadata endpoint", addr: "::ffff:169.254.169.254", blocked: true},
+		{name: "loopback", addr: "127.0.0.1", blocked: true},
+		{name: "IPv6 loopback", addr: "::1", blocked: true},
+		{name: "private", addr: "10.1.2.3", blocked: true},
+		{name: "IPv6 unique local", addr: "fd00::1", blocked: true},
+		{name: "IPv6 link-local", addr: "fe80::1", blocked: true},
+		{name: "unspecified", addr: "0.0.0.0", blocked: true},
+		{name: "carrier-grade NAT", addr: "100.64.0.1", blocked: true},
+		{name: "NAT64", addr: "64:ff9b::a9fe:a9fe", blocked: true},
+		{name: "allow_private_networks", config: HTTPConfig{AllowPrivateNetworks: true}, addr: "169.254.169.254"},
+		{name: "allowed range", config: HTTPConfig{AllowedHosts: []string{"10.0.0.0/8"}}, addr: "10.1.2.3"},
+		{name: "allowed IP", config: HTTPConfig{AllowedHosts: []string{"10.1.2.3"}}, addr: "10.1.2.3"},
+		{name: "outside the allowed range", config: HTTPConfig{AllowedHosts: []string{"10.0.0.0/8"}}, addr: "140.82.112.3", blocked: true},
+		{name: "metadata endpoint outside the allowed range", config: HTTPConfig{AllowedHosts: []string{"10.0.0.0/8"}}, addr: "169.254.169.254", blocked: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, err := tt.config.hostPolicy()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = policy.checkAddr(netip.MustParseAddr(tt.addr))
+			if blocked := errors.Is(err, ErrBlockedAddress); blocked != tt.blocked {
+				t.Errorf("error = %v, want blocked %v", err, tt.blocked)
+			}
+		})
+	}
+}
+
+func TestCheckHost(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		host    string
+		proxied bool
+		blocked bool
+	}{
+		{name: "anything without allowed_hosts", host: "github.com"},
+		{name: "listed name", allowed: []string{"GitHub.example.com"}, host: "github.example.com"},
+		{name: "unlisted name", allowed: []string{"github.example.com"}, host: "gitlab.example.com", blocked: true},
+		{name: "unlisted name left to the dialer to check against ranges", allowed: []string{"10.0.0.0/8"}, host: "gitlab.example.com"},
+		{name: "unlisted name through a proxy", allowed: []string{"10.0.0.0/8"}, host: "gitlab.example.com", proxied: true, blocked: true},
+		{name: "IP in range", allowed: []string{"10.0.0.0/8"}, host: "10.0.0.5"},
+		{name: "IP outside range", allowed: []string{"10.0.0.0/8"}, host: "169.254.169.254", blocked: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, err := HTTPConfig{AllowedHosts: tt.allowed}.hostPolicy()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = policy.checkHost(tt.host, tt.proxied)
+			if blocked := errors.Is(err, ErrBlockedAddress); blocked != tt.blocked {
+				t.Errorf("error = %v, want blocked %v", err, tt.blocked)
+			}
+		})
+	}
+}
+
+func TestNetworkPolicyRequests(t *testing.T) {
+	metadata := "http://169.254.169.254/latest/meta-data/iam/security-credentials/"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, metadata, http.StatusFound)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+	localhost := strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)
+
+	tests := []struct {
+		name    string
+		config  HTTPConfig
+		url     string
+		blocked bool
+	}{
+		{name: "metadata endpoint", url: metadata, blocked: true},
+		{name: "loopback by default", url: srv.URL, blocked: true},
+		{name: "name resolving to loopback", url: localhost, blocked: true},
+		{name: "allow_private_networks", config: HTTPConfig{AllowPrivateNetworks: true}, url: srv.URL},
+		{name: "allowlisted IP", config: HTTPConfig{AllowedHosts: []string{"127.0.0.1"}}, url: srv.URL},
+		{name: "allowlisted range", config: HTTPConfig{AllowedHosts: []string{"127.0.0.0/8"}}, url: srv.URL},
+		{name: "allowlisted name", config: HTTPConfig{AllowedHosts: []string{"localhost"}}, url: localhost},
+		{name: "host outside allowed_hosts", config: HTTPConfig{AllowedHosts: []string{"github.example.com"}}, url: srv.URL, blocked: true},
+		{name: "metadata endpoint outside allowed_hosts", config: HTTPConfig{AllowedHosts: []string{"127.0.0.1"}}, url: metadata, blocked: true},
+		{name: "redirect to the metadata endpoint", config: HTTPConfig{AllowedHosts: []string{"127.0.0.1"}}, url: srv.URL + "/redirect", blocked: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := get(t, newHTTPFetcher("Test", tt.config), tt.url)
+			if tt.blocked {
+				if !errors.Is(err, ErrBlockedAddress) {
+					t.Errorf("got %q, %v, want the request blocked", body, err)
+				}
+				return
+			}
+			if err != nil || string(body) != "ok" {
+				t.Errorf("got %q, %v, want the request allowed", body, err)
+			}
+		})
+	}
+}
+
+func TestInvalidAllowedHostsFailsAtLoad(t *testing.T) {
+	config := Config{GitLab: GitLabConfig{HTTPConfig: HTTPConfig{AllowedHosts: []string{"https://gitlab.example.com"}}}}
+	if _, err := NewKeyManagerFromConfig(config); err == nil || !strings.Contains(err.Error(), "gitlab") || !strings.Contains(err.Error(), "allowed_hosts") {
+		t.Errorf("error = %v, want an invalid gitlab allowed_hosts error", err)
+	}
+}
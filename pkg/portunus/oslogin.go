@@ -0,0 +1,130 @@
+package portunus
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultOSLoginURL is used when OSLoginConfig.URL is unset
+const defaultOSLoginURL = "https://oslogin.googleapis.com/"
+
+type OSLoginConfig struct {
+	URL string `json:"url,omitempty"`
+
+	// Project is sent as the projectId of each login profile request
+	Project string `json:"project,omitempty"`
+
+	// CredentialsFile is a service account key or authorized user JSON file.
+	// When unset the application default credentials are used:
+	// GOOGLE_APPLICATION_CREDENTIALS, then the metadata server.
+	CredentialsFile string `json:"credentials_file,omitempty"`
+	HTTPConfig
+}
+
+// OSLoginProvider fetches the SSH keys stored in a user's Google Cloud OS
+// Login profile. Users are identified by email.
+type OSLoginProvider struct {
+	http    *httpFetcher
+	baseURL string
+	project string
+
+	// credentialsFile is loaded on first use, so hosts that never look
+	// anyone up through OS Login don't need credentials
+	credentialsFile string
+	tokensOnce      sync.Once
+	tokens          googleTokenSource
+	tokensErr       error
+}
+
+func NewOSLoginProvider(config OSLoginConfig) *OSLoginProvider {
+	baseURL := config.URL
+	if baseURL == "" {
+		baseURL = defaultOSLoginURL
+	}
+	if !strings.HasSuffix(baseURL, "/") {
+		baseURL += "/"
+	}
+	return &OSLoginProvider{
+		http:            newHTTPFetcher("OS Login", config.HTTPConfig),
+		baseURL:         baseURL,
+		project:         config.Project,
+		credentialsFile: config.CredentialsFile,
+	}
+}
+
+// osLoginProfile is the subset of a LoginProfile we need. sshPublicKeys is
+// keyed by fingerprint.
+type osLoginProfile struct {
+	SSHPublicKeys map[string]struct {
+		Key                string `json:"key"`
+		ExpirationTimeUsec string `json:"expirationTimeUsec"`
+	} `json:"sshPublicKeys"`
+}
+
+func (p *OSLoginProvider) GetKeys(email string) ([]string, error) {
+	token, err := p.token()
+	if err != nil {
+		return nil, err
+	}
+
+	profileURL := fmt.Sprintf("%sv1/users/%s/loginProfile", p.baseURL, url.PathEscape(email))
+	if p.project != "" {
+		profileURL += "?projectId=" + url.QueryEscape(p.project)
+	}
+	req, err := http.NewRequest("GET", profileURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	body, err := p.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	var profile osLoginProfile
+	if err := json.Unmarshal(body, &profile); err != nil {
+		return nil, err
+	}
+
+	fingerprints := make([]string, 0, len(profile.SSHPublicKeys))
+	for fp := range profile.SSHPublicKeys {
+		fingerprints = append(fingerprints, fp)
+	}
+	sort.Strings(fingerprints)
+
+	now := time.Now()
+	var keys []string
+	for _, fp := range fingerprints {
+		k := profile.SSHPublicKeys[fp]
+		if usec, err := strconv.ParseInt(k.ExpirationTimeUsec, 10, 64); err == nil && now.After(time.UnixMicro(usec)) {
+			continue
+		}
+		keys = append(keys, SplitKeyLines(k.Key)...)
+	}
+	return keys, nil
+}
+
+// GetKeysByEmail is GetKeys, since OS Login users are always emails
+func (p *OSLoginProvider) GetKeysByEmail(email string) ([]string, error) {
+	return p.GetKeys(email)
+}
+
+// token returns an access token, loading the credentials on first use
+func (p *OSLoginProvider) token() (string, error) {
+	p.tokensOnce.Do(func() {
+		if p.tokens == nil {
+			p.tokens, p.tokensErr = newGoogleTokenSource(p.credentialsFile, p.http.client)
+		}
+	})
+	if p.tokensErr != nil {
+		return "", p.tokensErr
+	}
+	return p.tokens.Token()
+}
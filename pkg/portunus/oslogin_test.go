@@ -0,0 +1,195 @@
+package portunus
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// staticGoogleToken is a googleTokenSource handing out a fixed token, or err
+type staticGoogleToken struct {
+	token string
+	err   error
+}
+
+func (s staticGoogleToken) Token() (string, error) {
+	return s.token, s.err
+}
+
+// testOSLoginProvider returns an OSLoginProvider for url authenticating with
+// tokens in place of real credentials
+func testOSLoginProvider(url, project string, tokens googleTokenSource) *OSLoginProvider {
+	p := NewOSLoginProvider(OSLoginConfig{URL: url, Project: project, HTTPConfig: HTTPConfig{AllowPrivateNetworks: true}})
+	p.tokens = tokens
+	return p
+}
+
+func TestOSLoginProvider(t *testing.T) {
+	k1, k2, k3 := testKey(t, 1, "one"), testKey(t, 2, "two"), testKey(t, 3, "three")
+	future := strconv.FormatInt(time.Now().Add(time.Hour).UnixMicro(), 10)
+	past := strconv.FormatInt(time.Now().Add(-time.Hour).UnixMicro(), 10)
+
+	tests := []struct {
+		name    string
+		project string
+		tokens  googleTokenSource
+		profile string
+		want    []string
+		// wantQuery is the query string the profile request should carry
+		wantQuery string
+		wantErr   bool
+	}{
+		{
+			name:    "keys in fingerprint order",
+			tokens:  staticGoogleToken{token: "ya29.good"},
+			profile: `{"sshPublicKeys": {"bb": {"key": "` + k2 + `"}, "aa": {"key": "` + k1 + `\n"}}}`,
+			want:    []string{k1, k2},
+		},
+		{
+			name:    "expired keys dropped",
+			tokens:  staticGoogleToken{token: "ya29.good"},
+			profile: `{"sshPublicKeys": {"aa": {"key": "` + k1 + `", "expirationTimeUsec": "` + past + `"}, "bb": {"key": "` + k2 + `", "expirationTimeUsec": "` + future + `"}, "cc": {"key": "` + k3 + `"}}}`,
+			want:    []string{k2, k3},
+		},
+		{
+			name:      "project sent",
+			project:   "my-project",
+			tokens:    staticGoogleToken{token: "ya29.good"},
+			profile:   `{"sshPublicKeys": {"aa": {"key": "` + k1 + `"}}}`,
+			want:      []string{k1},
+			wantQuery: "projectId=my-project",
+		},
+		{name: "no keys", tokens: staticGoogleToken{token: "ya29.good"}, profile: `{}`},
+		{name: "rejected token", tokens: staticGoogleToken{token: "ya29.bad"}, wantErr: true},
+		{name: "no credentials", tokens: staticGoogleToken{err: errors.New("no credentials")}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotQuery string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Authorization") != "Bearer ya29.good" {
+					http.Error(w, "unauthenticated", http.StatusUnauthorized)
+					return
+				}
+				if r.URL.Path != "/v1/users/alice@example.com/loginProfile" {
+					http.NotFound(w, r)
+					return
+				}
+				gotQuery = r.URL.RawQuery
+				w.Write([]byte(tt.profile))
+			}))
+			defer srv.Close()
+
+			got, err := testOSLoginProvider(srv.URL, tt.project, tt.tokens).GetKeysByEmail("alice@example.com")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if gotQuery != tt.wantQuery {
+				t.Errorf("query = %q, want %q", gotQuery, tt.wantQuery)
+			}
+		})
+	}
+}
+
+func TestOSLoginMapping(t *testing.T) {
+	key := testKey(t, 1, "alice@laptop")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"sshPublicKeys": {"aa": {"key": "` + key + `"}}}`))
+	}))
+	defer srv.Close()
+
+	km := newTestKeyManager(t, Config{
+		Mappings: map[string]UserMapping{"alice": {OSLogin: "alice@example.com"}},
+	}, WithProvider("oslogin", testOSLoginProvider(srv.URL, "", staticGoogleToken{token: "ya29.good"})))
+	want := []string{"# oslogin: alice (alice@example.com)", key}
+	if got := resolveLines(t, km, "alice"); !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestGoogleTokenSource(t *testing.T) {
+	key, keyPEM := testAppKey(t)
+
+	tests := []struct {
+		name        string
+		credentials map[string]string
+		wantErr     bool
+	}{
+		{
+			name:        "service account",
+			credentials: map[string]string{"type": "service_account", "client_email": "portunus@proj.iam.gserviceaccount.com", "private_key": keyPEM},
+		},
+		{
+			name:        "authorized user",
+			credentials: map[string]string{"type": "authorized_user", "client_id": "id", "client_secret": "secret", "refresh_token": "refresh"},
+		},
+		{name: "unsupported type", credentials: map[string]string{"type": "external_account"}, wantErr: true},
+		{name: "bad private key", credentials: map[string]string{"type": "service_account", "private_key": "nope"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mints atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				r.ParseForm()
+				valid := false
+				switch r.PostForm.Get("grant_type") {
+				case "urn:ietf:params:oauth:grant-type:jwt-bearer":
+					valid = verifyJWT(&key.PublicKey, r.PostForm.Get("assertion")) == "portunus@proj.iam.gserviceaccount.com"
+				case "refresh_token":
+					valid = r.PostForm.Get("refresh_token") == "refresh" && r.PostForm.Get("client_secret") == "secret"
+				}
+				if !valid {
+					http.Error(w, "invalid_grant", http.StatusBadRequest)
+					return
+				}
+				mints.Add(1)
+				json.NewEncoder(w).Encode(map[string]any{"access_token": "ya29.minted", "expires_in": 3600})
+			}))
+			defer srv.Close()
+
+			tt.credentials["token_uri"] = srv.URL
+			data, _ := json.Marshal(tt.credentials)
+			path := filepath.Join(t.TempDir(), "credentials.json")
+			if err := os.WriteFile(path, data, 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			tokens, err := newGoogleTokenSource(path, srv.Client())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			for range 2 {
+				token, err := tokens.Token()
+				if err != nil || token != "ya29.minted" {
+					t.Fatalf("got %q, %v, want the minted token", token, err)
+				}
+			}
+			if n := mints.Load(); n != 1 {
+				t.Errorf("minted %d tokens, want 1 reused", n)
+			}
+		})
+	}
+}
+
+func TestGoogleCredentialsEnv(t *testing.T) {
+	t.Setenv(googleCredentialsEnv, filepath.Join(t.TempDir(), "missing.json"))
+	_, err := newGoogleTokenSource("", http.DefaultClient)
+	if err == nil || !strings.Contains(err.Error(), "error reading Google credentials") {
+		t.Errorf("error = %v, want %s to be read", err, googleCredentialsEnv)
+	}
+}
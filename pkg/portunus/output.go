@@ -0,0 +1,130 @@
+package portunus
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// jsonKey is one resolved key as emitted by -format json
+type jsonKey struct {
+	Source       string `json:"source"`
+	UpstreamUser string `json:"upstream_user"`
+	KeyType      string `json:"keytype,omitempty"`
+	Key          string `json:"key"`
+	Comment      string `json:"comment,omitempty"`
+	Fingerprint  string `json:"fingerprint,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+// blocksToJSON parses every key in blocks into its structured form. Keys that
+// fail to parse are kept with the raw line and an error rather than dropped.
+func blocksToJSON(blocks []KeyBlock) []jsonKey {
+	result := []jsonKey{}
+	for _, b := range blocks {
+		for _, line := range b.Keys {
+			if isComment(line) || strings.TrimSpace(line) == "" {
+				continue
+			}
+
+			entry := jsonKey{Source: b.Source, UpstreamUser: b.Upstream}
+			pub, comment, err := parseKey(line)
+			if err != nil {
+				entry.Key = line
+				entry.Error = err.Error()
+			} else {
+				entry.KeyType = pub.Type()
+				entry.Key = base64.StdEncoding.EncodeToString(pub.Marshal())
+				entry.Comment = comment
+				entry.Fingerprint = ssh.FingerprintSHA256(pub)
+			}
+			result = append(result, entry)
+		}
+	}
+	return result
+}
+
+// FormatLines renders lines as authorized_keys content, the one place text
+// output is formatted. Each line is trimmed and blank lines are dropped, so
+// keys and headers are never separated by blank lines and output ends with
+// exactly one newline. No lines render as empty output rather than a lone
+// newline.
+func FormatLines(lines []string) []byte {
+	var b strings.Builder
+	for _, line := range lines {
+		if line = strings.TrimSpace(line); line != "" {
+			b.WriteString(line)
+			b.WriteByte('\n')
+		}
+	}
+	return []byte(b.String())
+}
+
+// writeJSON writes blocks to w as an indented JSON array of keys
+func writeJSON(w io.Writer, blocks []KeyBlock) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(blocksToJSON(blocks))
+}
+
+// strippedKeys renders every key in blocks as just "keytype base64", with no
+// options, comments or source headers, dropping duplicates and unparseable keys
+func strippedKeys(blocks []KeyBlock) []string {
+	var result []string
+	seen := make(map[string]bool)
+	for _, b := range blocks {
+		for _, line := range b.Keys {
+			if isComment(line) || strings.TrimSpace(line) == "" {
+				continue
+			}
+
+			pub, _, err := parseKey(line)
+			if err != nil {
+				log.Printf("Skipping unparseable %s key for %s: %v", b.Source, b.Upstream, err)
+				continue
+			}
+
+			key := pub.Type() + " " + base64.StdEncoding.EncodeToString(pub.Marshal())
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			result = append(result, key)
+		}
+	}
+	return result
+}
+
+// WriteFileAtomic writes data to a temporary file next to path and renames it
+// into place, so readers see either the old contents or the new, never a
+// partial write
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
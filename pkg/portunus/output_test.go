@@ -0,0 +1,359 @@
+package portunus
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// update rewrites the golden files under testdata instead of comparing
+var update = flag.Bool("update", false, "rewrite golden files")
+
+func TestWriteJSON(t *testing.T) {
+	hubKey, staticKey := testKey(t, 1, "octocat@laptop"), testKey(t, 2, "")
+	fingerprint := func(line string) string {
+		pub, _, err := parseKey(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ssh.FingerprintSHA256(pub)
+	}
+	body := func(line string) string { return strings.Fields(line)[1] }
+
+	provider := &fakeProvider{keys: map[string][]string{"octocat": {hubKey, "ssh-ed25519 garbage"}}}
+	km := newTestKeyManager(t, Config{
+		Mappings: map[string]UserMapping{"alice": {
+			GitHub:     Usernames{"octocat"},
+			StaticKeys: []StaticKey{{Key: staticKey}},
+		}},
+	}, WithProvider("github", provider))
+	result, err := km.Resolve(context.Background(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := result.WriteJSON(&out); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []jsonKey
+	if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+		t.Fatalf("output is not a JSON array of keys: %v\n%s", err, out.Bytes())
+	}
+	// static keys come first in the default source order
+	want := []jsonKey{
+		{Source: "static", UpstreamUser: "alice", KeyType: "ssh-ed25519", Key: body(staticKey), Fingerprint: fingerprint(staticKey)},
+		{Source: "github", UpstreamUser: "octocat", KeyType: "ssh-ed25519", Key: body(hubKey), Comment: "octocat@laptop", Fingerprint: fingerprint(hubKey)},
+		{Source: "github", UpstreamUser: "octocat", Key: "ssh-ed25519 garbage", Error: "ssh: no key found"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestStrippedKeys(t *testing.T) {
+	k1, k2 := testKey(t, 1, "alice@laptop"), testKey(t, 2, "alice@desktop")
+	bare := func(line string) string { return strings.Join(strings.Fields(line)[:2], " ") }
+
+	tests := []struct {
+		name   string
+		blocks []KeyBlock
+		want   []string
+	}{
+		{
+			name:   "comments and headers are dropped",
+			blocks: []KeyBlock{{Source: "github", Keys: []string{"# github: alice", k1}}},
+			want:   []string{bare(k1)},
+		},
+		{
+			name:   "options are dropped",
+			blocks: []KeyBlock{{Source: "static", Keys: []string{`no-pty,command="/bin/true" ` + k1}}},
+			want:   []string{bare(k1)},
+		},
+		{
+			name: "duplicates across sources collapse",
+			blocks: []KeyBlock{
+				{Source: "github", Keys: []string{k1, k2}},
+				{Source: "gitlab", Keys: []string{bare(k2) + " other comment"}},
+			},
+			want: []string{bare(k1), bare(k2)},
+		},
+		{
+			name:   "unparseable keys are dropped",
+			blocks: []KeyBlock{{Source: "github", Keys: []string{"ssh-ed25519 garbage", k2}}},
+			want:   []string{bare(k2)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Result{Blocks: tt.blocks}.StrippedKeys()
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHeaderTemplate(t *testing.T) {
+	shared, labKey := testKey(t, 1, "shared"), testKey(t, 2, "lab")
+
+	tests := []struct {
+		name   string
+		config Config
+		want   []string
+	}{
+		{
+			name: "default headers",
+			want: []string{"# github: alice (octocat)", shared, "# gitlab: alice (tanuki)", labKey},
+		},
+		{
+			name:   "custom template",
+			config: Config{HeaderTemplate: "# {login} via {source}/{upstream}"},
+			want:   []string{"# alice via github/octocat", shared, "# alice via gitlab/tanuki", labKey},
+		},
+		{
+			name:   "template gains a comment marker",
+			config: Config{HeaderTemplate: "{source}={upstream}"},
+			want:   []string{"# github=octocat", shared, "# gitlab=tanuki", labKey},
+		},
+		{
+			name:   "newlines can't start a key line",
+			config: Config{HeaderTemplate: "{source}\nssh-ed25519 AAAA"},
+			want:   []string{"# github ssh-ed25519 AAAA", shared, "# gitlab ssh-ed25519 AAAA", labKey},
+		},
+		{
+			name:   "no headers",
+			config: Config{NoHeaders: true, HeaderTemplate: "# {source}"},
+			want:   []string{shared, labKey},
+		},
+		{
+			name:   "dedup looks past templated headers",
+			config: Config{Dedup: true, HeaderTemplate: "{source}"},
+			want:   []string{"# github", shared, "# gitlab", labKey},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			github := &fakeProvider{keys: map[string][]string{"octocat": {shared}}}
+			gitlab := &fakeProvider{keys: map[string][]string{"tanuki": {labKey}}}
+			if tt.config.Dedup {
+				gitlab.keys["tanuki"] = []string{shared, labKey}
+			}
+			config := tt.config
+			config.Mappings = map[string]UserMapping{"alice": {GitHub: Usernames{"octocat"}, GitLab: Usernames{"tanuki"}}}
+			km := newTestKeyManager(t, config, WithProvider("github", github), WithProvider("gitlab", gitlab))
+
+			if got := resolveLines(t, km, "alice"); !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStaticHeader(t *testing.T) {
+	first, second, hubKey := testKey(t, 1, "first"), testKey(t, 2, "second"), testKey(t, 3, "hub")
+
+	tests := []struct {
+		name   string
+		config Config
+		github bool
+		want   []string
+	}{
+		{
+			name: "default header",
+			want: []string{"# static: alice", first, second},
+		},
+		{
+			name:   "header off",
+			config: Config{StaticHeader: "none"},
+			want:   []string{first, second},
+		},
+		{
+			name:   "custom marker",
+			config: Config{StaticHeader: "managed by portunus for {login}"},
+			want:   []string{"# managed by portunus for alice", first, second},
+		},
+		{
+			name:   "header template doesn't apply over static_header",
+			config: Config{StaticHeader: "# {source}", HeaderTemplate: "# {login} via {source}"},
+			github: true,
+			want:   []string{"# static", first, second, "# alice via github", hubKey},
+		},
+		{
+			name:   "header off keeps provider headers",
+			config: Config{StaticHeader: "none"},
+			github: true,
+			want:   []string{first, second, "# github: alice (octocat)", hubKey},
+		},
+		{
+			name:   "unset follows the header template",
+			config: Config{HeaderTemplate: "# {source} for {login}"},
+			want:   []string{"# static for alice", first, second},
+		},
+		{
+			name:   "no headers wins",
+			config: Config{NoHeaders: true, StaticHeader: "# {source}"},
+			want:   []string{first, second},
+		},
+		{
+			name:   "dedup looks past the static header",
+			config: Config{Dedup: true, StaticHeader: "{source}"},
+			want:   []string{"# static", first, second},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			static := []StaticKey{{Key: first}, {Key: second}}
+			if tt.config.Dedup {
+				static = append(static, StaticKey{Key: first})
+			}
+			mapping := UserMapping{StaticKeys: static}
+			github := &fakeProvider{keys: map[string][]string{"octocat": {hubKey}}}
+			if tt.github {
+				mapping.GitHub = Usernames{"octocat"}
+			}
+			config := tt.config
+			config.Mappings = map[string]UserMapping{"alice": mapping}
+			km := newTestKeyManager(t, config, WithProvider("github", github))
+
+			result, err := km.Resolve(context.Background(), "alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := flattenBlocks(result.Blocks); !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			// the header is a comment, so validation doesn't report it
+			if findings := result.Lint(LintPolicy{}); len(findings) > 0 {
+				t.Errorf("got findings %v, want none", findings)
+			}
+		})
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing string
+	}{
+		{name: "new file"},
+		{name: "replaces an existing file", existing: "old keys\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "authorized_keys")
+			var old *os.File
+			if tt.existing != "" {
+				if err := os.WriteFile(path, []byte(tt.existing), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				var err error
+				if old, err = os.Open(path); err != nil {
+					t.Fatal(err)
+				}
+				defer old.Close()
+			}
+
+			if err := WriteFileAtomic(path, []byte("new keys\n"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if data, err := os.ReadFile(path); err != nil || string(data) != "new keys\n" {
+				t.Errorf("file = %q, %v, want the new keys", data, err)
+			}
+			if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+				t.Errorf("stat = %v, %v, want mode 0600", info, err)
+			}
+			// the file was replaced rather than rewritten in place, so a
+			// reader that had it open still sees the old contents
+			if old != nil {
+				if data, err := io.ReadAll(old); err != nil || string(data) != tt.existing {
+					t.Errorf("open reader got %q, %v, want the old keys", data, err)
+				}
+			}
+			if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+				t.Errorf("directory holds %d files, want no temp files left", len(entries))
+			}
+		})
+	}
+}
+
+func TestWriteFileAtomicFailureLeavesNothing(t *testing.T) {
+	dir := t.TempDir()
+	// renaming over a directory fails after the temp file is written
+	path := filepath.Join(dir, "authorized_keys")
+	if err := os.Mkdir(path, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(path, "keep"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFileAtomic(path, []byte("new keys\n"), 0o600); err == nil {
+		t.Fatal("WriteFileAtomic replaced a directory")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("directory holds %d files, want the temp file removed", len(entries))
+	}
+}
+
+func TestFormatGolden(t *testing.T) {
+	k1, k2, k3 := testKey(t, 1, "alice@laptop"), testKey(t, 2, "octocat"), testKey(t, 3, "")
+
+	tests := []struct {
+		name   string
+		blocks []KeyBlock
+	}{
+		{name: "zero keys"},
+		{name: "headers only", blocks: []KeyBlock{{Header: "# static: alice"}, {Header: "# github: alice (octocat)"}}},
+		{name: "one block", blocks: []KeyBlock{{Header: "# static: alice", Keys: []string{k1}}}},
+		{
+			name: "several blocks",
+			blocks: []KeyBlock{
+				{Header: "# static: alice", Keys: []string{k1}},
+				{Header: "# github: alice (octocat)", Keys: []string{k2, k3}},
+			},
+		},
+		{name: "no headers", blocks: []KeyBlock{{Keys: []string{k1}}, {Keys: []string{k2, k3}}}},
+		{
+			name: "stray whitespace and blank lines",
+			blocks: []KeyBlock{
+				{Header: "  # static: alice\r", Keys: []string{"", k1 + "\r", "   "}},
+				{Header: "# github: alice (octocat)", Keys: []string{"\t" + k2 + "  ", "\n"}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Result{Username: "alice", Blocks: tt.blocks}.Text()
+			path := filepath.Join("testdata", "format", strings.ReplaceAll(tt.name, " ", "_")+".golden")
+			if *update {
+				if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, got, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("got:\n%s\nwant:\n%s", got, want)
+			}
+			if len(got) > 0 && (!bytes.HasSuffix(got, []byte("\n")) || bytes.Contains(got, []byte("\n\n"))) {
+				t.Errorf("output %q has blank lines or doesn't end in exactly one newline", got)
+			}
+		})
+	}
+}
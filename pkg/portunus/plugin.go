@@ -0,0 +1,103 @@
+package portunus
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// PluginConfig configures a provider implemented by an external program.
+//
+// The program is run with the upstream identity appended to Command's
+// arguments and Config written to its stdin as JSON. It either prints one
+// authorized_keys line per line, or a JSON object
+// {"keys": ["..."], "error": "..."} where a non-empty error fails the lookup.
+// Every key must parse as an authorized_keys line and the output is capped
+// at 1 MiB. A non-zero exit fails the lookup with its stderr.
+type PluginConfig struct {
+	// Command is split on whitespace into an argv and never passed through
+	// a shell
+	Command string          `json:"command"`
+	Timeout time.Duration   `json:"timeout,omitempty"`
+	Config  json.RawMessage `json:"config,omitempty"`
+}
+
+// PluginProvider fetches keys by running a plugin program, see PluginConfig
+type PluginProvider struct {
+	name    string
+	argv    []string
+	timeout time.Duration
+	config  []byte
+}
+
+func NewPluginProvider(name string, config PluginConfig) (*PluginProvider, error) {
+	argv := strings.Fields(config.Command)
+	if len(argv) == 0 {
+		return nil, fmt.Errorf("plugin %s: command is empty", name)
+	}
+	stdin := []byte(config.Config)
+	if len(stdin) == 0 {
+		stdin = []byte("{}")
+	}
+	if !json.Valid(stdin) {
+		return nil, fmt.Errorf("plugin %s: config is not valid JSON", name)
+	}
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = defaultExecTimeout
+	}
+	return &PluginProvider{name: name, argv: argv, timeout: timeout, config: stdin}, nil
+}
+
+// Check verifies the plugin program can be found, without running it
+func (p *PluginProvider) Check() error {
+	_, err := exec.LookPath(p.argv[0])
+	return err
+}
+
+func (p *PluginProvider) GetKeys(username string) ([]string, error) {
+	what := "plugin " + p.name
+	stdout, err := runCommand(append(p.argv[:len(p.argv):len(p.argv)], username), p.config, p.timeout, what)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	if trimmed := bytes.TrimSpace(stdout); bytes.HasPrefix(trimmed, []byte("{")) {
+		var result struct {
+			Keys  []string `json:"keys"`
+			Error string   `json:"error"`
+		}
+		if err := json.Unmarshal(trimmed, &result); err != nil {
+			return nil, fmt.Errorf("%s returned invalid JSON: %w", what, err)
+		}
+		if result.Error != "" {
+			return nil, fmt.Errorf("%s: %s", what, result.Error)
+		}
+		for _, key := range result.Keys {
+			keys = append(keys, SplitKeyLines(key)...)
+		}
+	} else {
+		keys = SplitKeyLines(string(stdout))
+	}
+
+	var invalid []error
+	for i, key := range keys {
+		if isComment(key) {
+			continue
+		}
+		if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key)); err != nil {
+			invalid = append(invalid, fmt.Errorf("key %d: %w", i+1, err))
+		}
+	}
+	if len(invalid) > 0 {
+		return nil, fmt.Errorf("%s returned invalid keys: %w", what, errors.Join(invalid...))
+	}
+	return keys, nil
+}
@@ -0,0 +1,112 @@
+package portunus
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPluginProvider(t *testing.T) {
+	k1, k2 := testKey(t, 1, "one"), testKey(t, 2, "two")
+	// the plugin checks it got its own argument, then the upstream, and the
+	// config on stdin
+	stub := execStub(t, `config=$(cat)
+[ "$1" = keys ] || { echo "unexpected arguments: $*" >&2; exit 2; }
+[ "$config" = '{"org":"acme"}' ] || { echo "bad config: $config" >&2; exit 2; }
+case "$2" in
+plain) printf '%s\n\n%s\n' "`+k1+`" "`+k2+`" ;;
+json) echo '{"keys": ["`+k1+`", "`+k2+`"]}' ;;
+refused) echo '{"error": "account locked"}' ;;
+garbage) echo "not a key" ;;
+badjson) echo '{"keys": [' ;;
+fail) echo "directory down" >&2; exit 3 ;;
+huge) head -c 2000000 /dev/zero | tr '\0' x ;;
+endless) exec yes x ;;
+slow) exec sleep 5 ;;
+*) echo "unexpected arguments: $*" >&2; exit 4 ;;
+esac
+`)
+
+	tests := []struct {
+		upstream string
+		timeout  time.Duration
+		want     []string
+		wantErr  string
+	}{
+		{upstream: "plain", want: []string{k1, k2}},
+		{upstream: "json", want: []string{k1, k2}},
+		{upstream: "refused", wantErr: "plugin vault: account locked"},
+		{upstream: "garbage", wantErr: "plugin vault returned invalid keys: key 1"},
+		{upstream: "badjson", wantErr: "plugin vault returned invalid JSON"},
+		{upstream: "fail", wantErr: "directory down"},
+		{upstream: "huge", wantErr: "output exceeds"},
+		// killed once past the cap, well before the timeout
+		{upstream: "endless", timeout: 5 * time.Second, wantErr: "output exceeds"},
+		{upstream: "slow", timeout: 100 * time.Millisecond, wantErr: "timed out"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.upstream, func(t *testing.T) {
+			p, err := NewPluginProvider("vault", PluginConfig{
+				Command: stub + " keys",
+				Timeout: tt.timeout,
+				Config:  json.RawMessage(`{"org":"acme"}`),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := p.GetKeys(tt.upstream)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewPluginProvider(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  PluginConfig
+		wantErr string
+	}{
+		{name: "valid", config: PluginConfig{Command: "getkeys --all"}},
+		{name: "empty command", config: PluginConfig{Command: "  "}, wantErr: "plugin vault: command is empty"},
+		{name: "invalid config", config: PluginConfig{Command: "getkeys", Config: json.RawMessage(`{"org": `)}, wantErr: "plugin vault: config is not valid JSON"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewPluginProvider("vault", tt.config)
+			if (err == nil) != (tt.wantErr == "") || err != nil && err.Error() != tt.wantErr {
+				t.Errorf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPluginMapping(t *testing.T) {
+	key := testKey(t, 1, "vault")
+	stub := execStub(t, `cat >/dev/null; echo "`+key+`"`)
+
+	km := newTestKeyManager(t, Config{
+		Plugins:  map[string]PluginConfig{"vault": {Command: stub}},
+		Mappings: map[string]UserMapping{"alice": {Providers: map[string]string{"vault": "alice@corp"}}},
+	})
+	if got, want := resolveLines(t, km, "alice"), []string{"# vault: alice (alice@corp)", key}; !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	_, err := NewKeyManagerFromConfig(Config{Plugins: map[string]PluginConfig{"github": {Command: stub}}})
+	if err == nil || !strings.Contains(err.Error(), "clashes with a built-in") {
+		t.Errorf("error = %v, want a clash with the github provider", err)
+	}
+}
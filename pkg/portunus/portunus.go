@@ -0,0 +1,2040 @@
+// Package portunus resolves the SSH public keys a local login may use from
+// the sources its mapping names, such as GitHub, GitLab, LDAP and static keys.
+// It backs the portunus command, an sshd AuthorizedKeysCommand.
+package portunus
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sync/semaphore"
+	"golang.org/x/sync/singleflight"
+)
+
+// Version is reported in the default User-Agent. The portunus command sets
+// it to its build version.
+var Version = "dev"
+
+// KeyProvider defines the interface for different key sources
+type KeyProvider interface {
+	GetKeys(username string) ([]string, error)
+}
+
+// EmailKeyProvider is implemented by providers that can also look up keys
+// by the user's email address
+type EmailKeyProvider interface {
+	GetKeysByEmail(email string) ([]string, error)
+}
+
+// Config represents the application configuration
+type Config struct {
+	Mappings    map[string]UserMapping `json:"mappings"`
+	Cache       CacheConfig            `json:"cache"`
+	GitHub      GitHubConfig           `json:"github,omitempty"`
+	GitLab      GitLabConfig           `json:"gitlab,omitempty"`
+	LDAP        LDAPConfig             `json:"ldap,omitempty"`
+	Keybase     KeybaseConfig          `json:"keybase,omitempty"`
+	AzureDevOps AzureDevOpsConfig      `json:"azuredevops,omitempty"`
+	OSLogin     OSLoginConfig          `json:"oslogin,omitempty"`
+	Exec        ExecConfig             `json:"exec,omitempty"`
+	DNS         DNSConfig              `json:"dns,omitempty"`
+
+	// BreakGlassKeys are emergency keys served to every login, under their
+	// own header, while enabled with WithBreakGlass
+	BreakGlassKeys []string `json:"break_glass_keys,omitempty"`
+
+	// MappingsSQL adds mappings loaded from a database to those in the file
+	MappingsSQL *SQLMappingsConfig `json:"mappings_sql,omitempty"`
+
+	// Templates are named mappings that mappings and other templates can
+	// build on with "extends". They are not logins themselves.
+	Templates map[string]UserMapping `json:"templates,omitempty"`
+
+	// CircuitBreaker stops calling a provider for a while after it fails
+	// repeatedly, so an outage doesn't cost every login the full timeout.
+	CircuitBreaker CircuitBreakerConfig `json:"circuit_breaker,omitempty"`
+
+	// Audit records which keys were served for which login
+	Audit AuditConfig `json:"audit,omitempty"`
+
+	// Hook is run in the background after each lookup, see HookConfig
+	Hook HookConfig `json:"hook,omitempty"`
+
+	// Providers configures third-party providers added with RegisterProvider,
+	// keyed by their registered name
+	Providers map[string]json.RawMessage `json:"providers,omitempty"`
+
+	// Plugins are providers implemented by external programs, see
+	// PluginConfig. Mappings reference them by name through their
+	// "providers" map, like registered providers.
+	Plugins map[string]PluginConfig `json:"plugins,omitempty"`
+
+	// UserAgent is sent on outbound HTTP requests by every provider that does
+	// not set its own, defaulting to portunus/<version>.
+	UserAgent string `json:"user_agent,omitempty"`
+
+	// MaxKeysPerUser truncates a user's keys after this many across all
+	// sources. Zero means no limit.
+	MaxKeysPerUser int `json:"max_keys_per_user,omitempty"`
+
+	// MaxConcurrentFetches bounds how many provider fetches run at once
+	// across every lookup in the KeyManager, including background cache
+	// refreshes. Fetches over the bound wait for a slot. Zero means no
+	// limit.
+	MaxConcurrentFetches int `json:"max_concurrent_fetches,omitempty"`
+
+	// AdaptiveOrdering emits, and so fetches, the sources that have been
+	// returning keys first, ahead of the default order, so a source that is
+	// consistently authoritative answers first. It only learns over the
+	// KeyManager's lifetime, and is ignored when SourceOrder is set.
+	AdaptiveOrdering bool `json:"adaptive_ordering,omitempty"`
+
+	// SortKeys orders the keys within each source block by key type and body,
+	// making output stable across runs.
+	SortKeys bool `json:"sort_keys,omitempty"`
+
+	// CommentTemplate, when set, replaces the comment of every emitted key.
+	// Supported placeholders are {source}, {upstream} and {login}.
+	CommentTemplate string `json:"comment_template,omitempty"`
+
+	// HeaderTemplate, when set, replaces the comment line emitted above each
+	// source's keys. It takes the same placeholders as CommentTemplate and is
+	// always emitted as a comment, gaining a leading "# " if it lacks one.
+	HeaderTemplate string `json:"header_template,omitempty"`
+
+	// StaticHeader controls the header above static keys on its own: "none"
+	// leaves it out, any other value is a template like HeaderTemplate, and
+	// unset treats static keys like every other source
+	StaticHeader string `json:"static_header,omitempty"`
+
+	// Lint is the policy the lint subcommand checks served keys against
+	Lint LintPolicy `json:"lint,omitempty"`
+
+	// Transforms edit the keys each provider returns, in order, see
+	// TransformRule
+	Transforms []TransformRule `json:"transforms,omitempty"`
+
+	// NoHeaders leaves out the per-source header lines entirely
+	NoHeaders bool `json:"no_headers,omitempty"`
+
+	// ExpiryComments precedes each key with a known expiry, a static key's
+	// not_after or a GitLab API key's expires_at, with a
+	// "# expires: <RFC 3339 time>" line for tooling that prunes
+	// authorized_keys
+	ExpiryComments bool `json:"expiry_comments,omitempty"`
+
+	// Dedup drops keys served by more than one source, keeping the copy from
+	// the highest priority source. Priority is the order blocks are emitted
+	// in unless a mapping sets its own.
+	Dedup bool `json:"dedup,omitempty"`
+
+	// DedupProvenance appends "# also-in: <sources>" to each key Dedup kept
+	// over copies from other sources, so auditors can see everywhere it was
+	// found. The note becomes part of the key's comment.
+	DedupProvenance bool `json:"dedup_provenance,omitempty"`
+
+	// SkipAfterFailures stops calling a provider once it has failed this many
+	// times in a row, for as long as the KeyManager lives. Unlike the circuit
+	// breaker it never retries, which suits resolving many users in one run.
+	// Zero disables skipping.
+	SkipAfterFailures int `json:"skip_after_failures,omitempty"`
+
+	// FailClosed serves no keys at all if any source a user is mapped to
+	// fails, rather than the keys from the sources that worked
+	FailClosed bool `json:"fail_closed,omitempty"`
+
+	// MinKeysExpected guards against an upstream suddenly serving nothing.
+	// Each lookup with at least this many keys is kept as the login's
+	// last-good set, in the cache when there is one. A login that had that
+	// many and now resolves fewer is logged as a warning, and with
+	// FailClosed gets its last-good set instead.
+	MinKeysExpected int `json:"min_keys_expected,omitempty"`
+
+	// Unmapped controls what happens when a login has no mapping: "error"
+	// (the default) fails the lookup, "deny" serves no keys and exits zero.
+	Unmapped string `json:"unmapped,omitempty"`
+
+	// UsernamePattern is the regular expression requested names must match,
+	// replacing defaultUsernamePattern. Names longer than 256 bytes are
+	// always rejected.
+	UsernamePattern string `json:"username_pattern,omitempty"`
+
+	// UsernameRules derive upstream usernames from the login by provider,
+	// e.g. stripping dots for GitHub, for mappings that list the provider in
+	// derive. Providers without a rule use the login unchanged.
+	UsernameRules map[string]UsernameRule `json:"username_rules,omitempty"`
+
+	// SourceOrder lists sources in the order their blocks are emitted, e.g.
+	// ["ldap", "static", "github"]. Unlisted sources follow in the default
+	// order: static keys, then the built-in providers, then registered ones.
+	SourceOrder []string `json:"source_order,omitempty"`
+
+	// DefaultMerge combines the "*" default mapping with a login's own
+	// mapping, rather than only using it for logins that have none
+	DefaultMerge bool `json:"default_merge,omitempty"`
+
+	// CaseInsensitiveUsers matches requested logins to mapping keys
+	// ignoring case, when there is no exact match. Only the mapping lookup
+	// is affected: upstream identities are sent as written in the mapping.
+	CaseInsensitiveUsers bool `json:"case_insensitive_users,omitempty"`
+}
+
+// DefaultMapping is the mappings key applied to logins without a mapping of
+// their own, or to every login when DefaultMerge is set
+const DefaultMapping = "*"
+
+// defaultUsernamePattern accepts POSIX portable names plus @ and + for email
+// lookups, rejecting anything that could break an LDAP filter, URL or log line
+const defaultUsernamePattern = `^[A-Za-z0-9._][A-Za-z0-9._@+-]*$`
+
+// maxUsernameLength bounds requested names whatever the pattern allows
+const maxUsernameLength = 256
+
+// ErrInvalidUsername is returned for requested names that don't match the
+// username pattern
+var ErrInvalidUsername = errors.New("invalid username")
+
+// ErrProviderSkipped is returned instead of calling a provider that has hit
+// SkipAfterFailures
+var ErrProviderSkipped = errors.New("provider skipped after repeated failures")
+
+// ErrNoMapping is returned when a login has no mapping in the config
+var ErrNoMapping = errors.New("no mapping found for user")
+
+// ErrNoKeys is returned when none of a login's sources returned any keys
+var ErrNoKeys = errors.New("no keys found for user")
+
+// ErrMappingDisabled accompanies ErrNoKeys for a login whose mapping has
+// Enabled set to false
+var ErrMappingDisabled = errors.New("mapping is disabled")
+
+type UserMapping struct {
+	GitHub      Usernames   `json:"github,omitempty"`
+	GitLab      Usernames   `json:"gitlab,omitempty"`
+	LDAPUser    string      `json:"ldap,omitempty"`
+	Keybase     string      `json:"keybase,omitempty"`
+	AzureDevOps string      `json:"azuredevops,omitempty"`
+	OSLogin     string      `json:"oslogin,omitempty"`
+	Exec        string      `json:"exec,omitempty"`
+	DNS         string      `json:"dns,omitempty"`
+	StaticKeys  []StaticKey `json:"static_keys,omitempty"`
+
+	// Priority lists sources from most to least preferred when deduplicating
+	// keys, e.g. ["ldap", "github"]. Unlisted sources rank last.
+	Priority []string `json:"priority,omitempty"`
+
+	// Providers maps registered third-party provider names to the upstream
+	// identity to look up with them
+	Providers map[string]string `json:"providers,omitempty"`
+
+	// GitHubTeams serves the keys of every member of these GitHub orgs or
+	// teams, written "org" or "org/team". GitLabGroups does the same for
+	// GitLab group paths, e.g. "infra/oncall". Both need a token.
+	GitHubTeams  []string `json:"github_teams,omitempty"`
+	GitLabGroups []string `json:"gitlab_groups,omitempty"`
+
+	// Extends names a template in Config.Templates this mapping builds on.
+	// The mapping's own single-valued fields override the template's, and
+	// its lists, such as static keys, are added to the template's.
+	Extends string `json:"extends,omitempty"`
+
+	// Derive lists providers whose upstream username is derived from the
+	// login with Config.UsernameRules, where the mapping doesn't set one
+	Derive []string `json:"derive,omitempty"`
+
+	// Enabled set to false serves the login no keys, as if none were found,
+	// so access can be cut off without deleting the mapping. Unset means
+	// enabled.
+	Enabled *bool `json:"enabled,omitempty"`
+}
+
+// disabled reports whether the mapping has been switched off with Enabled
+func (m UserMapping) disabled() bool {
+	return m.Enabled != nil && !*m.Enabled
+}
+
+// Groups returns the groups whose members the mapping serves through a
+// provider, see GitHubTeams
+func (m UserMapping) Groups(provider string) []string {
+	switch provider {
+	case "github":
+		return m.GitHubTeams
+	case "gitlab":
+		return m.GitLabGroups
+	}
+	return nil
+}
+
+// merge returns m combined with def. Upstream lists and static keys are
+// unioned with m's first; single-valued fields and Priority come from m
+// when set.
+func (m UserMapping) merge(def UserMapping) UserMapping {
+	out := m
+	out.GitHub = append(slices.Clip(m.GitHub), def.GitHub...)
+	out.GitLab = append(slices.Clip(m.GitLab), def.GitLab...)
+	out.StaticKeys = append(slices.Clip(m.StaticKeys), def.StaticKeys...)
+	out.GitHubTeams = append(slices.Clip(m.GitHubTeams), def.GitHubTeams...)
+	out.GitLabGroups = append(slices.Clip(m.GitLabGroups), def.GitLabGroups...)
+	out.Derive = append(slices.Clip(m.Derive), def.Derive...)
+	out.Extends = ""
+	out.LDAPUser = cmp.Or(m.LDAPUser, def.LDAPUser)
+	out.Keybase = cmp.Or(m.Keybase, def.Keybase)
+	out.AzureDevOps = cmp.Or(m.AzureDevOps, def.AzureDevOps)
+	out.OSLogin = cmp.Or(m.OSLogin, def.OSLogin)
+	out.Exec = cmp.Or(m.Exec, def.Exec)
+	out.DNS = cmp.Or(m.DNS, def.DNS)
+	if out.Enabled == nil {
+		out.Enabled = def.Enabled
+	}
+	if len(out.Priority) == 0 {
+		out.Priority = def.Priority
+	}
+	if len(def.Providers) > 0 {
+		out.Providers = make(map[string]string, len(m.Providers)+len(def.Providers))
+		maps.Copy(out.Providers, def.Providers)
+		maps.Copy(out.Providers, m.Providers)
+	}
+	return out
+}
+
+// Usernames is one or more upstream usernames. In JSON it may be written as
+// a single string or a list of strings.
+type Usernames []string
+
+func (u *Usernames) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		if single == "" {
+			*u = nil
+		} else {
+			*u = Usernames{single}
+		}
+		return nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("expected a username or list of usernames: %w", err)
+	}
+	*u = list
+	return nil
+}
+
+// MarshalJSON writes a single username as a plain string, matching how it
+// is usually configured
+func (u Usernames) MarshalJSON() ([]byte, error) {
+	if len(u) == 1 {
+		return json.Marshal(u[0])
+	}
+	return json.Marshal([]string(u))
+}
+
+// StaticKey is a static key line with an optional expiry. In JSON it may be
+// written as the plain key line or as {"key": ..., "not_after": ...}, where
+// not_after is an RFC 3339 time or a YYYY-MM-DD date the key stays valid
+// through. A key written as "base64:..." is decoded into the key line.
+type StaticKey struct {
+	Key      string
+	NotAfter time.Time
+
+	// Priority keys are emitted before every other key, whatever the source
+	// order, and are never dropped by MaxKeysPerUser
+	Priority bool
+}
+
+// staticKeyObject is the {key, not_after, priority} form of a StaticKey
+type staticKeyObject struct {
+	Key      string `json:"key"`
+	NotAfter string `json:"not_after"`
+	Priority bool   `json:"priority"`
+}
+
+func (k *StaticKey) UnmarshalJSON(data []byte) error {
+	var line string
+	if err := json.Unmarshal(data, &line); err == nil {
+		line, err = decodeStaticKey(line)
+		*k = StaticKey{Key: line}
+		return err
+	}
+
+	var obj staticKeyObject
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return fmt.Errorf("expected a key line or {key, not_after, priority} object: %w", err)
+	}
+	key, err := decodeStaticKey(obj.Key)
+	if err != nil {
+		return err
+	}
+	*k = StaticKey{Key: key, Priority: obj.Priority}
+	if obj.NotAfter == "" {
+		return nil
+	}
+	if t, err := time.Parse(time.RFC3339, obj.NotAfter); err == nil {
+		k.NotAfter = t
+		return nil
+	}
+	day, err := time.Parse(time.DateOnly, obj.NotAfter)
+	if err != nil {
+		return fmt.Errorf("invalid not_after %q: want RFC 3339 time or YYYY-MM-DD", obj.NotAfter)
+	}
+	k.NotAfter = day.Add(24*time.Hour - time.Nanosecond)
+	return nil
+}
+
+// base64KeyPrefix marks a static key stored base64 encoded, for config
+// systems that mangle key lines
+const base64KeyPrefix = "base64:"
+
+// decodeStaticKey returns line unchanged unless it has the base64: prefix,
+// in which case it decodes the rest, ignoring whitespace, into one key line
+func decodeStaticKey(line string) (string, error) {
+	encoded, ok := strings.CutPrefix(line, base64KeyPrefix)
+	if !ok {
+		return line, nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(encoded), ""))
+	if err != nil {
+		return "", fmt.Errorf("invalid base64 static key: %w", err)
+	}
+	key := strings.TrimSpace(string(decoded))
+	if strings.ContainsAny(key, "\r\n") {
+		return "", errors.New("base64 static key decodes to more than one line")
+	}
+	return key, nil
+}
+
+func (k StaticKey) MarshalJSON() ([]byte, error) {
+	if k.NotAfter.IsZero() && !k.Priority {
+		return json.Marshal(k.Key)
+	}
+	var notAfter *time.Time
+	if !k.NotAfter.IsZero() {
+		notAfter = &k.NotAfter
+	}
+	return json.Marshal(struct {
+		Key      string     `json:"key"`
+		NotAfter *time.Time `json:"not_after,omitempty"`
+		Priority bool       `json:"priority,omitempty"`
+	}{k.Key, notAfter, k.Priority})
+}
+
+// Expired reports whether the key is past its not_after time
+func (k StaticKey) Expired(now time.Time) bool {
+	return !k.NotAfter.IsZero() && now.After(k.NotAfter)
+}
+
+type CacheConfig struct {
+	Enabled bool          `json:"enabled"`
+	TTL     time.Duration `json:"ttl"`
+	MaxSize int           `json:"max_size"`
+
+	// RefreshWindow starts a background refresh when a hit is this close to
+	// expiring, serving the cached keys meanwhile
+	RefreshWindow time.Duration `json:"refresh_window,omitempty"`
+
+	// Jitter adds a random extra lifetime of up to this much to each entry so
+	// entries cached at the same time don't all expire at once
+	Jitter time.Duration `json:"jitter,omitempty"`
+
+	// Providers overrides whether and for how long each provider's keys are
+	// cached, keyed by source name. Providers without an entry follow Enabled
+	// and TTL above.
+	Providers map[string]ProviderCacheConfig `json:"providers,omitempty"`
+
+	// Redis stores cached keys in a Redis server shared between replicas
+	// instead of in memory
+	Redis *RedisConfig `json:"redis,omitempty"`
+
+	// Processed caches each upstream's keys after transforms and
+	// comment_template are applied rather than as fetched, so hits skip
+	// parsing them again. Entries are tied to those settings and are not
+	// reused once they change. explain can't show which transforms changed
+	// keys served this way.
+	Processed bool `json:"processed,omitempty"`
+}
+
+// ProviderCacheConfig is the cache setting for one provider. A zero TTL falls
+// back to the global TTL.
+type ProviderCacheConfig struct {
+	Enabled bool          `json:"enabled"`
+	TTL     time.Duration `json:"ttl,omitempty"`
+}
+
+// providerTTL reports whether source's keys are cached and for how long
+func (c CacheConfig) providerTTL(source string) (time.Duration, bool) {
+	pc, ok := c.Providers[source]
+	if !ok {
+		return c.TTL, c.Enabled
+	}
+	if pc.TTL == 0 {
+		return c.TTL, pc.Enabled
+	}
+	return pc.TTL, pc.Enabled
+}
+
+// anyEnabled reports whether any provider's keys are cached
+func (c CacheConfig) anyEnabled() bool {
+	if c.Enabled {
+		return true
+	}
+	for _, pc := range c.Providers {
+		if pc.Enabled {
+			return true
+		}
+	}
+	return false
+}
+
+// KeyManager orchestrates the key providers and caching
+type KeyManager struct {
+	config Config
+	cache  Cache
+	audit  *auditLogger
+
+	// hook runs after each lookup when Config.Hook is enabled, and hooks
+	// tracks the runs still in flight, see WaitHooks
+	hook  *hook
+	hooks sync.WaitGroup
+
+	// providers holds the key sources by name, see providerOrder
+	providers map[string]KeyProvider
+
+	mu       sync.Mutex
+	breakers map[string]*circuitBreaker
+	// failures counts consecutive failures per provider, see SkipAfterFailures
+	failures map[string]int
+
+	// fetches records the last fetch per provider and upstream, see
+	// recordFetch
+	fetches map[string]fetchRecord
+	// scores rank sources by how often they have returned keys lately, see
+	// Config.AdaptiveOrdering
+	scores map[string]float64
+	// userChecks keeps the answers of CheckUsers by provider and upstream
+	userChecks map[string]UserCheckResult
+
+	// lastGood holds each login's last-good key set, see
+	// Config.MinKeysExpected
+	lastGood Cache
+
+	// lookups shares one upstream fetch between concurrent identical lookups,
+	// and refreshes ensures one background cache refresh per entry at a time
+	lookups   singleflight.Group
+	refreshes singleflight.Group
+
+	// fetchSlots bounds concurrent fetches, see MaxConcurrentFetches. It is
+	// nil when there is no limit.
+	fetchSlots *semaphore.Weighted
+
+	// onlySources restricts resolution to these sources when non-nil
+	onlySources map[string]bool
+
+	// byEmail treats lookups as email addresses, using only providers that
+	// implement EmailKeyProvider
+	byEmail bool
+
+	// profile records per-provider latency when set, see WithProfile
+	profile *profiler
+
+	// strict enables extra config checks when loading, see WithStrictConfig
+	strict bool
+
+	// overrides adjust the config before it is used, see WithConfigOverride
+	overrides []func(*Config)
+
+	// usernamePattern validates requested names, see Config.UsernamePattern
+	usernamePattern *regexp.Regexp
+
+	// transforms are the compiled Config.Transforms
+	transforms []transform
+
+	// processedDigest identifies the settings processed cache entries were
+	// made with, see CacheConfig.Processed
+	processedDigest string
+
+	// providerConfigs holds each source's config section, hashed into the
+	// cache keys of its entries, see mappingDigest
+	providerConfigs map[string]json.RawMessage
+
+	// usernameRules are the compiled Config.UsernameRules patterns
+	usernameRules map[string]*regexp.Regexp
+
+	// foldedLogins maps lowercased mapping keys to the keys themselves,
+	// under CaseInsensitiveUsers
+	foldedLogins map[string]string
+
+	// mappingsMu guards the mappings and foldedLogins, which refreshing
+	// mappings_sql replaces. fileMappings are the config file's own, and
+	// sqlLoaded is when the database was last queried.
+	mappingsMu   sync.RWMutex
+	fileMappings map[string]UserMapping
+	sqlLoaded    time.Time
+
+	// tracer receives lookup and fetch spans, see WithTracer
+	tracer Tracer
+
+	// offline skips every source but localSources, see WithOffline
+	offline bool
+
+	// exitCodes are returned by LookupExitCode, see WithExitCodes
+	exitCodes ExitCodes
+
+	// breakGlass serves the config's BreakGlassKeys, see WithBreakGlass
+	breakGlass bool
+}
+
+// providerOrder is the order provider blocks are emitted in, after static keys
+var providerOrder = []string{"github", "gitlab", "ldap", "keybase", "azuredevops", "oslogin", "exec", "dns"}
+
+// localSources are the sources that don't need the network, the only ones
+// used under WithOffline. Registered providers are assumed to need it.
+var localSources = map[string]bool{"static": true, "exec": true}
+
+// providerNames are the human readable provider names used in log messages
+var providerNames = map[string]string{
+	"github":      "GitHub",
+	"gitlab":      "GitLab",
+	"ldap":        "LDAP",
+	"keybase":     "Keybase",
+	"azuredevops": "Azure DevOps",
+	"oslogin":     "OS Login",
+	"exec":        "Exec",
+	"dns":         "DNS",
+}
+
+// providerName returns the display name for a provider, falling back to the
+// source name for registered providers
+func providerName(source string) string {
+	if name, ok := providerNames[source]; ok {
+		return name
+	}
+	return source
+}
+
+// Option customizes a KeyManager at construction time
+type Option func(*KeyManager)
+
+// WithProvider registers p as the named provider, used instead of the one
+// built from config. This is mainly useful for injecting fakes in tests.
+func WithProvider(name string, p KeyProvider) Option {
+	return func(km *KeyManager) {
+		km.providers[name] = p
+	}
+}
+
+// WithStrictConfig rejects configs that are ambiguous rather than invalid,
+// such as a mapping defined twice for the same login or a misspelled field,
+// and configs under which no mapping could ever resolve a key
+func WithStrictConfig() Option {
+	return func(km *KeyManager) {
+		km.strict = true
+	}
+}
+
+// WithConfigOverride adjusts the config after it is loaded and before it is
+// validated and used, e.g. to apply command line flags
+func WithConfigOverride(override func(*Config)) Option {
+	return func(km *KeyManager) {
+		km.overrides = append(km.overrides, override)
+	}
+}
+
+// WithSortKeys sorts the keys within each source block, as SortKeys does
+func WithSortKeys() Option {
+	return WithConfigOverride(func(c *Config) {
+		c.SortKeys = true
+	})
+}
+
+// WithUnmapped sets the policy for logins with no mapping, "error" or
+// "deny", overriding the config
+func WithUnmapped(mode string) Option {
+	return WithConfigOverride(func(c *Config) {
+		c.Unmapped = mode
+	})
+}
+
+// WithOnlySources restricts resolution to the named sources, skipping any
+// others the mapping configures. Building the KeyManager fails if a name
+// isn't one of its sources.
+func WithOnlySources(sources []string) Option {
+	return func(km *KeyManager) {
+		km.onlySources = make(map[string]bool, len(sources))
+		for _, s := range sources {
+			km.onlySources[s] = true
+		}
+	}
+}
+
+// WithEmailLookup makes lookups treat the requested name, and the mapping's
+// upstream identities, as email addresses. Providers that can't search by
+// email are skipped.
+func WithEmailLookup() Option {
+	return func(km *KeyManager) {
+		km.byEmail = true
+	}
+}
+
+// WithOffline skips every network-backed provider, logging each one skipped,
+// so only static keys and local commands contribute. It is meant for checking
+// that static fallbacks work without reaching any upstream.
+func WithOffline() Option {
+	return func(km *KeyManager) {
+		km.offline = true
+	}
+}
+
+// WithBreakGlass serves the config's BreakGlassKeys to every login, after
+// its own keys. They are served even when the login is unmapped or its
+// lookup failed, and each time is logged as a warning.
+func WithBreakGlass() Option {
+	return func(km *KeyManager) {
+		km.breakGlass = true
+	}
+}
+
+// ParseSources splits a comma separated list of source names. They aren't
+// checked here, as plugins are only known once the config is loaded;
+// WithOnlySources rejects unknown ones when the KeyManager is built, and
+// HasSource checks one against a loaded config.
+func ParseSources(list string) ([]string, error) {
+	var sources []string
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			sources = append(sources, name)
+		}
+	}
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("no sources given")
+	}
+	return sources, nil
+}
+
+// HasSource reports whether name is static, a built-in or registered
+// provider, or one the config or options set up, such as a plugin
+func (km *KeyManager) HasSource(name string) bool {
+	_, builtin := providerNames[name]
+	_, configured := km.providers[name]
+	_, registered := registeredProvider(name)
+	return builtin || configured || registered || name == "static"
+}
+
+// sourceEnabled reports whether a source may contribute keys in this run
+func (km *KeyManager) sourceEnabled(source string) bool {
+	return km.onlySources == nil || km.onlySources[source]
+}
+
+// Upstreams returns the upstream identities the mapping uses for a provider,
+// or nil if the provider isn't used
+func (m UserMapping) Upstreams(provider string) []string {
+	switch provider {
+	case "github":
+		return m.GitHub
+	case "gitlab":
+		return m.GitLab
+	}
+
+	var upstream string
+	switch provider {
+	case "ldap":
+		upstream = m.LDAPUser
+	case "keybase":
+		upstream = m.Keybase
+	case "azuredevops":
+		upstream = m.AzureDevOps
+	case "oslogin":
+		upstream = m.OSLogin
+	case "exec":
+		upstream = m.Exec
+	case "dns":
+		upstream = m.DNS
+	default:
+		upstream = m.Providers[provider]
+	}
+	if upstream == "" {
+		return nil
+	}
+	return []string{upstream}
+}
+
+func NewKeyManager(configPath string, opts ...Option) (*KeyManager, error) {
+	km := newKeyManager(opts)
+	config, err := LoadConfig(configPath, km.strict)
+	if err != nil {
+		return nil, err
+	}
+	if err := km.configure(config); err != nil {
+		return nil, err
+	}
+	return km, nil
+}
+
+// NewKeyManagerFromConfig builds a KeyManager from a config that has already
+// been loaded
+func NewKeyManagerFromConfig(config Config, opts ...Option) (*KeyManager, error) {
+	km := newKeyManager(opts)
+	if err := km.configure(config); err != nil {
+		return nil, err
+	}
+	return km, nil
+}
+
+func newKeyManager(opts []Option) *KeyManager {
+	km := &KeyManager{
+		providers:  make(map[string]KeyProvider),
+		breakers:   make(map[string]*circuitBreaker),
+		failures:   make(map[string]int),
+		fetches:    make(map[string]fetchRecord),
+		scores:     make(map[string]float64),
+		userChecks: make(map[string]UserCheckResult),
+		exitCodes:  DefaultExitCodes,
+	}
+	for _, opt := range opts {
+		opt(km)
+	}
+	return km
+}
+
+// configure validates config and builds the cache, audit log and providers
+// from it
+func (km *KeyManager) configure(config Config) error {
+	for _, override := range km.overrides {
+		override(&config)
+	}
+	if err := checkUnmapped(config.Unmapped); err != nil {
+		return err
+	}
+	if err := resolveExtends(&config); err != nil {
+		return err
+	}
+	if config.MappingsSQL != nil {
+		mappings, err := loadSQLMappings(*config.MappingsSQL, config.Mappings)
+		if err != nil {
+			return err
+		}
+		km.fileMappings = config.Mappings
+		km.sqlLoaded = time.Now()
+		config.Mappings = mappings
+	}
+	for name, httpConfig := range map[string]HTTPConfig{
+		"github":      config.GitHub.HTTPConfig,
+		"gitlab":      config.GitLab.HTTPConfig,
+		"keybase":     config.Keybase.HTTPConfig,
+		"azuredevops": config.AzureDevOps.HTTPConfig,
+		"oslogin":     config.OSLogin.HTTPConfig,
+	} {
+		if _, err := httpConfig.proxyFunc(); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if _, err := httpConfig.tlsConfig(); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if _, err := httpConfig.hostPolicy(); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if httpConfig.InsecureSkipVerify {
+			log.Printf("WARNING: %s TLS certificate verification is disabled by insecure_skip_verify", providerName(name))
+		}
+	}
+
+	pattern := defaultUsernamePattern
+	if config.UsernamePattern != "" {
+		pattern = config.UsernamePattern
+	}
+	usernamePattern, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid username_pattern: %w", err)
+	}
+	km.usernamePattern = usernamePattern
+
+	if config.MaxConcurrentFetches > 0 {
+		km.fetchSlots = semaphore.NewWeighted(int64(config.MaxConcurrentFetches))
+	}
+
+	transforms, err := compileTransforms(config.Transforms)
+	if err != nil {
+		return err
+	}
+	km.transforms = transforms
+	if config.Cache.Processed {
+		km.processedDigest = processedDigest(config)
+	}
+
+	usernameRules, err := compileUsernameRules(config.UsernameRules)
+	if err != nil {
+		return err
+	}
+	km.usernameRules = usernameRules
+	checkAdaptiveOrdering(config)
+	if config.DedupProvenance && !config.Dedup {
+		log.Printf("Warning: dedup_provenance has no effect without dedup")
+	}
+
+	if config.CaseInsensitiveUsers {
+		if km.foldedLogins, err = foldLogins(config.Mappings); err != nil {
+			return err
+		}
+	}
+
+	// Providers without their own user agent inherit the global one
+	if config.GitHub.UserAgent == "" {
+		config.GitHub.UserAgent = config.UserAgent
+	}
+	if config.GitLab.UserAgent == "" {
+		config.GitLab.UserAgent = config.UserAgent
+	}
+	if config.Keybase.UserAgent == "" {
+		config.Keybase.UserAgent = config.UserAgent
+	}
+	if config.AzureDevOps.UserAgent == "" {
+		config.AzureDevOps.UserAgent = config.UserAgent
+	}
+	if config.OSLogin.UserAgent == "" {
+		config.OSLogin.UserAgent = config.UserAgent
+	}
+
+	if config.ExpiryComments {
+		config.GitLab.ExpiryComments = true
+	}
+
+	// set once everything is derived, so EffectiveConfig shows what is used
+	km.config = config
+	km.providerConfigs = providerConfigSections(config)
+
+	if config.Cache.anyEnabled() {
+		if config.Cache.Redis != nil && config.Cache.Redis.Address != "" {
+			km.cache = NewRedisCache(config.Cache)
+		} else {
+			km.cache = NewKeyCache(config.Cache)
+		}
+	}
+	if config.MinKeysExpected > 0 {
+		// without a cache the last-good sets only last as long as the process
+		km.lastGood = cmp.Or[Cache](km.cache, NewKeyCache(CacheConfig{}))
+	}
+
+	if config.Audit.Path != "" || config.Audit.Syslog || config.Audit.SyslogAddress != "" {
+		audit, err := newAuditLogger(config.Audit)
+		if err != nil {
+			return err
+		}
+		km.audit = audit
+	}
+	if config.Hook.Enabled {
+		hook, err := newHook(config.Hook)
+		if err != nil {
+			return err
+		}
+		km.hook = hook
+	}
+
+	// providers set by options take the place of the ones built from config
+	built := make(map[string]KeyProvider)
+
+	// if config.GitHub.Token != "" {
+	githubProvider, err := newGitHubWithMirrors(config.GitHub)
+	if err != nil {
+		return err
+	}
+	built["github"] = githubProvider
+	// }
+
+	// if config.GitLab.URL != "" {
+	gitlabProvider, err := newGitLabWithMirrors(config.GitLab)
+	if err != nil {
+		return err
+	}
+	built["gitlab"] = gitlabProvider
+	// }
+
+	if config.LDAP.URL != "" {
+		ldapProvider, err := newLDAPWithMirrors(config.LDAP)
+		if err != nil {
+			return err
+		}
+		built["ldap"] = ldapProvider
+	}
+
+	built["keybase"] = NewKeybaseProvider(config.Keybase)
+
+	if config.AzureDevOps.Organization != "" {
+		built["azuredevops"] = NewAzureDevOpsProvider(config.AzureDevOps)
+	}
+
+	built["oslogin"] = NewOSLoginProvider(config.OSLogin)
+
+	if config.Exec.Command != "" {
+		execProvider, err := NewExecProvider(config.Exec)
+		if err != nil {
+			return err
+		}
+		built["exec"] = execProvider
+	}
+
+	if config.DNS.Name != "" {
+		dnsProvider, err := NewDNSProvider(config.DNS)
+		if err != nil {
+			return err
+		}
+		built["dns"] = dnsProvider
+	}
+
+	custom, err := newRegisteredProviders(config.Providers)
+	if err != nil {
+		return err
+	}
+	for name, p := range custom {
+		built[name] = p
+	}
+	for name, pluginConfig := range config.Plugins {
+		_, builtin := providerNames[name]
+		_, registered := registeredProvider(name)
+		if builtin || registered || name == "static" {
+			return fmt.Errorf("plugin %s clashes with a built-in or registered provider", name)
+		}
+		plugin, err := NewPluginProvider(name, pluginConfig)
+		if err != nil {
+			return err
+		}
+		built[name] = plugin
+	}
+
+	for name, p := range built {
+		if _, ok := km.providers[name]; !ok {
+			km.providers[name] = p
+		}
+	}
+
+	known := func(name string) bool {
+		return name != "static" && km.HasSource(name)
+	}
+	for name := range km.onlySources {
+		if !km.HasSource(name) {
+			return fmt.Errorf("unknown source: %s", name)
+		}
+	}
+	seen := make(map[string]bool, len(config.SourceOrder))
+	for _, name := range config.SourceOrder {
+		if !km.HasSource(name) {
+			return fmt.Errorf("unknown source in source_order: %s", name)
+		}
+		if seen[name] {
+			return fmt.Errorf("source_order lists %s twice", name)
+		}
+		seen[name] = true
+	}
+	for name := range config.UsernameRules {
+		if !known(name) {
+			return fmt.Errorf("unknown provider in username_rules: %s", name)
+		}
+	}
+	if !km.resolvable() {
+		if km.strict {
+			return ErrNothingResolvable
+		}
+		log.Printf("Warning: %v", ErrNothingResolvable)
+	}
+	for login, mapping := range config.Mappings {
+		for _, name := range mapping.Derive {
+			if !known(name) {
+				return fmt.Errorf("mapping %s: unknown provider in derive: %s", login, name)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (km *KeyManager) GetKeys(username string) ([]string, error) {
+	blocks, err := km.resolve(context.Background(), username)
+	if err != nil {
+		return nil, err
+	}
+	return flattenBlocks(blocks), nil
+}
+
+// WriteCacheStats writes the cache's Stats as JSON. It notes when caching is
+// disabled rather than reporting an empty cache.
+func (km *KeyManager) WriteCacheStats(w io.Writer) {
+	if km.cache == nil {
+		fmt.Fprintln(w, "cache disabled")
+		return
+	}
+	data, err := json.MarshalIndent(km.cache.Stats(), "", "  ")
+	if err != nil {
+		log.Printf("Error encoding cache stats: %v", err)
+		return
+	}
+	fmt.Fprintln(w, string(data))
+}
+
+// Invalidate drops any cached keys for username so the next lookup fetches
+// them fresh, e.g. after the user rotates keys. With case-insensitive logins
+// it drops them whatever case username is given in.
+func (km *KeyManager) Invalidate(username string) {
+	if km.cache != nil {
+		km.cache.DeleteUser(km.canonicalLogin(username))
+	}
+}
+
+// KeyBlock is the set of keys contributed by one source, emitted under its header
+type KeyBlock struct {
+	Source   string
+	Upstream string
+	Header   string
+	Keys     []string
+
+	// Priority is set on the block of priority static keys, which is always
+	// first and exempt from MaxKeysPerUser
+	Priority bool
+
+	// Unchanged is set on provider blocks whose keys are the same as the
+	// last fetch from that provider for that upstream, see LoadFetchState
+	Unchanged bool
+}
+
+// flattenBlocks renders blocks as authorized_keys lines, each header followed by its keys
+func flattenBlocks(blocks []KeyBlock) []string {
+	var lines []string
+	for _, b := range blocks {
+		if b.Header != "" {
+			lines = append(lines, b.Header)
+		}
+		lines = append(lines, b.Keys...)
+	}
+	return lines
+}
+
+// ResolveForSSHD resolves username exactly as portunus does when run as an
+// sshd AuthorizedKeysCommand, returning what it would write to stdout and the
+// exit code it would use. Errors are logged rather than returned.
+func ResolveForSSHD(cfg Config, username string) (string, int) {
+	km, err := NewKeyManagerFromConfig(cfg)
+	if err != nil {
+		log.Printf("Error initializing key manager: %v", err)
+		return "", DefaultExitCodes.ConfigError
+	}
+	return km.ResolveForSSHD(username)
+}
+
+func (km *KeyManager) ResolveForSSHD(username string) (string, int) {
+	result, code := km.LookupForSSHD(context.Background(), username)
+	return string(result.Text()), code
+}
+
+// LookupForSSHD is ResolveForSSHD returning the Result rather than its text,
+// for callers that also report on it. The portunus command's text output
+// goes through here, so it and ResolveForSSHD can't drift apart. A failed
+// lookup is logged and gives an empty Result, with exit code zero for
+// unmapped logins under the deny policy.
+func (km *KeyManager) LookupForSSHD(ctx context.Context, username string) (Result, int) {
+	result, err := km.Resolve(ctx, username)
+	if err != nil {
+		return Result{}, km.LookupExitCode(username, err)
+	}
+	return result, 0
+}
+
+// LookupExitCode logs a failed lookup and returns the exit code it should end
+// the process with, see ExitCodes. Unmapped logins exit zero with no keys
+// under the deny policy.
+func (km *KeyManager) LookupExitCode(username string, err error) int {
+	if errors.Is(err, ErrNoMapping) && km.config.Unmapped == "deny" {
+		log.Printf("Denying %s: %v", username, err)
+		return 0
+	}
+	log.Printf("Error getting keys: %v", err)
+	return km.exitCodes.exitCode(err)
+}
+
+// foldLogins maps the lowercased logins of mappings to the logins themselves,
+// failing if two differ only in case
+func foldLogins(mappings map[string]UserMapping) (map[string]string, error) {
+	folded := make(map[string]string, len(mappings))
+	for _, login := range slices.Sorted(maps.Keys(mappings)) {
+		lower := strings.ToLower(login)
+		if other, dup := folded[lower]; dup {
+			return nil, fmt.Errorf("mappings %s and %s differ only in case, which case_insensitive_users can't tell apart", other, login)
+		}
+		folded[lower] = login
+	}
+	return folded, nil
+}
+
+// Logins returns every login with its own mapping, sorted. The "*" default
+// mapping is not a login and is left out.
+func (km *KeyManager) Logins() []string {
+	mappings := km.currentMappings()
+	logins := make([]string, 0, len(mappings))
+	for login := range mappings {
+		if login != DefaultMapping {
+			logins = append(logins, login)
+		}
+	}
+	sort.Strings(logins)
+	return logins
+}
+
+// Principals returns the upstream identities and group names username's
+// mapping uses across its enabled sources, in emission order without
+// duplicates, for use as SSH certificate principals. No provider is
+// contacted, so groups are named rather than expanded to their members.
+func (km *KeyManager) Principals(username string) ([]string, error) {
+	mapping, err := km.mapping(username)
+	if err != nil {
+		return nil, err
+	}
+
+	var principals []string
+	seen := make(map[string]bool)
+	for _, name := range km.sources(mapping) {
+		if !km.sourceEnabled(name) {
+			continue
+		}
+		for _, principal := range append(slices.Clip(mapping.Upstreams(name)), mapping.Groups(name)...) {
+			if !seen[principal] {
+				seen[principal] = true
+				principals = append(principals, principal)
+			}
+		}
+	}
+	if len(principals) == 0 {
+		return nil, fmt.Errorf("no principals found for user: %s", username)
+	}
+	return principals, nil
+}
+
+// Result is the outcome of resolving a login: one block per source that
+// returned keys, in emission order
+type Result struct {
+	Username string
+	Blocks   []KeyBlock
+}
+
+// Lines renders the result as authorized_keys lines, each source header
+// followed by its keys
+func (r Result) Lines() []string {
+	return flattenBlocks(r.Blocks)
+}
+
+// Text returns the result as authorized_keys content, see FormatLines
+func (r Result) Text() []byte {
+	return FormatLines(r.Lines())
+}
+
+// StrippedKeys renders every key as just "keytype base64", see -strip-comments
+func (r Result) StrippedKeys() []string {
+	return strippedKeys(r.Blocks)
+}
+
+// Summary describes the result in one line for interactive use, e.g.
+// "resolved 4 keys for alice from github(2), ldap(2) in 180ms". The login is
+// passed in since a denied lookup leaves the result empty.
+func (r Result) Summary(login string, elapsed time.Duration) string {
+	var total int
+	var order []string
+	counts := make(map[string]int)
+	for _, b := range r.Blocks {
+		n := 0
+		for _, key := range b.Keys {
+			if !isComment(key) {
+				n++
+			}
+		}
+		if _, ok := counts[b.Source]; !ok {
+			order = append(order, b.Source)
+		}
+		counts[b.Source] += n
+		total += n
+	}
+
+	plural := "s"
+	if total == 1 {
+		plural = ""
+	}
+	summary := fmt.Sprintf("resolved %d key%s for %s", total, plural, login)
+	if len(order) > 0 {
+		sources := make([]string, len(order))
+		for i, source := range order {
+			sources[i] = fmt.Sprintf("%s(%d)", source, counts[source])
+		}
+		summary += " from " + strings.Join(sources, ", ")
+	}
+	return summary + " in " + elapsed.Round(time.Millisecond).String()
+}
+
+// WriteJSON writes the result's keys to w as an indented JSON array
+func (r Result) WriteJSON(w io.Writer) error {
+	return writeJSON(w, r.Blocks)
+}
+
+// canonicalLogin returns the mapping key username resolves through when
+// logins are case-insensitive, or username itself, so that cache entries
+// for a login are found whatever case it is asked for in
+func (km *KeyManager) canonicalLogin(username string) string {
+	km.mappingsMu.RLock()
+	defer km.mappingsMu.RUnlock()
+	if _, ok := km.config.Mappings[username]; ok {
+		return username
+	}
+	if login, ok := km.foldedLogins[strings.ToLower(username)]; ok {
+		return login
+	}
+	return username
+}
+
+// mapping returns the mapping for username, after checking the name is one
+// that is safe to put in provider requests and logs
+func (km *KeyManager) mapping(username string) (UserMapping, error) {
+	if len(username) > maxUsernameLength || !km.usernamePattern.MatchString(username) {
+		return UserMapping{}, fmt.Errorf("%w: %q", ErrInvalidUsername, username)
+	}
+	km.refreshSQLMappings()
+	km.mappingsMu.RLock()
+	mappings := km.config.Mappings
+	mapping, ok := mappings[username]
+	if login, folded := km.foldedLogins[strings.ToLower(username)]; !ok && folded {
+		mapping, ok = mappings[login]
+	}
+	km.mappingsMu.RUnlock()
+	fallback, hasDefault := mappings[DefaultMapping]
+	switch {
+	case !ok && !hasDefault:
+		return UserMapping{}, fmt.Errorf("%w: %s", ErrNoMapping, username)
+	case !ok:
+		mapping = fallback
+	case hasDefault && km.config.DefaultMerge:
+		mapping = mapping.merge(fallback)
+	}
+	if mapping.disabled() {
+		return UserMapping{}, fmt.Errorf("%w: %s: %w", ErrNoKeys, username, ErrMappingDisabled)
+	}
+	return km.deriveUpstreams(username, mapping), nil
+}
+
+// Resolve collects the keys for username from every source in its mapping.
+// If ctx is done first it returns ctx.Err(), though provider requests already
+// in flight run to completion in the background.
+func (km *KeyManager) Resolve(ctx context.Context, username string) (Result, error) {
+	if err := ctx.Err(); err != nil {
+		return Result{}, err
+	}
+
+	type outcome struct {
+		blocks []KeyBlock
+		err    error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		blocks, err := km.resolve(ctx, username)
+		done <- outcome{blocks, err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return Result{}, ctx.Err()
+	case o := <-done:
+		if o.err != nil {
+			return Result{}, o.err
+		}
+		return Result{Username: username, Blocks: o.blocks}, nil
+	}
+}
+
+// resolve collects the keys for username from every source in its mapping,
+// recording the outcome in the audit log
+func (km *KeyManager) resolve(ctx context.Context, username string) ([]KeyBlock, error) {
+	ctx, span := km.startSpan(ctx, "portunus.resolve")
+	span.SetAttribute("portunus.login", username)
+
+	blocks, err := km.lookup(ctx, username)
+	blocks, err = km.guardMinKeys(username, blocks, err)
+	if km.breakGlass && len(km.config.BreakGlassKeys) > 0 && !errors.Is(err, ErrInvalidUsername) {
+		if err != nil {
+			log.Printf("Error looking up keys for %s, serving break-glass keys only: %v", username, err)
+		}
+		blocks, err = append(blocks, km.breakGlassBlock(username)), nil
+	}
+	if km.audit != nil {
+		km.audit.Record(username, blocks, err)
+	}
+	if km.hook != nil {
+		km.runHook(username, blocks, err)
+	}
+
+	var count int
+	for _, b := range blocks {
+		count += len(b.Keys)
+	}
+	span.SetAttribute("portunus.keys", count)
+	span.End(err)
+	return blocks, err
+}
+
+// breakGlassBlock returns the block of break-glass keys served to username,
+// logging loudly since they grant access to every login
+func (km *KeyManager) breakGlassBlock(username string) KeyBlock {
+	log.Printf("WARNING: serving %d break-glass keys for %s", len(km.config.BreakGlassKeys), username)
+	block := KeyBlock{
+		Source:   "break-glass",
+		Upstream: username,
+		Keys:     slices.Clone(km.config.BreakGlassKeys),
+	}
+	if !km.config.NoHeaders {
+		block.Header = "# break-glass: " + username
+	}
+	return block
+}
+
+// lookup resolves username through the cache, fetching on a miss
+func (km *KeyManager) lookup(ctx context.Context, username string) ([]KeyBlock, error) {
+	mapping, err := km.mapping(username)
+	if err != nil {
+		return nil, err
+	}
+
+	// lookups with different source filters or lookup modes can't share a result
+	key := username
+	if km.onlySources != nil {
+		only := make([]string, 0, len(km.onlySources))
+		for s := range km.onlySources {
+			only = append(only, s)
+		}
+		sort.Strings(only)
+		key += "?only=" + strings.Join(only, ",")
+	}
+	if km.byEmail {
+		key += "?by=email"
+	}
+
+	v, err, _ := km.lookups.Do(key, func() (interface{}, error) {
+		return km.collect(ctx, username, mapping)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// every caller sharing the fetch gets its own copy
+	return copyBlocks(v.([]KeyBlock)), nil
+}
+
+// cachedFetch returns the keys for one of username's sources as fetched and
+// as processed, from the cache when the provider is cached there. Entries
+// are per login, source and upstream identity, so each provider's keys
+// expire on their own TTL, and carry digest, from mappingDigest, so editing
+// the mapping or the provider's config misses them. A hit on a processed
+// entry returns the processed keys for both.
+func (km *KeyManager) cachedFetch(ctx context.Context, name string, p KeyProvider, username, upstream, digest string) (fetched, processed []string, err error) {
+	ttl, cached := km.config.Cache.providerTTL(name)
+	if km.cache == nil || !cached {
+		fetched, err = km.fetch(ctx, name, p, upstream)
+		if err != nil {
+			return nil, nil, err
+		}
+		return fetched, km.processKeys(fetched, name, upstream, username), nil
+	}
+
+	key := km.cacheKey(username, name, upstream, digest)
+	if keys, refresh, ok := km.cache.Get(key); ok {
+		explainTraceFrom(ctx).cacheHit(name, upstream)
+		if refresh {
+			go km.refresh(key, name, p, username, upstream, ttl)
+		}
+		if km.config.Cache.Processed {
+			return keys, keys, nil
+		}
+		return keys, km.processKeys(keys, name, upstream, username), nil
+	}
+
+	fetched, err = km.fetch(ctx, name, p, upstream)
+	if err != nil {
+		return nil, nil, err
+	}
+	processed = km.processKeys(fetched, name, upstream, username)
+	if km.config.Cache.Processed {
+		km.cache.Set(key, processed, ttl)
+	} else {
+		km.cache.Set(key, fetched, ttl)
+	}
+	return fetched, processed, nil
+}
+
+// cacheKey returns the cache entry for username's keys from upstream, made
+// under the mapping and provider config digest identifies. Processed entries
+// also carry a digest of the settings that produced them.
+func (km *KeyManager) cacheKey(username, name, upstream, digest string) string {
+	key := fetchKey(km.canonicalLogin(username), name, upstream, km.byEmail) + "?config=" + digest
+	if km.config.Cache.Processed {
+		key += "?processed=" + km.processedDigest
+	}
+	return key
+}
+
+// refresh re-fetches a cache entry in the background. On failure the
+// existing entry is left to be served until it expires.
+func (km *KeyManager) refresh(key, name string, p KeyProvider, username, upstream string, ttl time.Duration) {
+	km.refreshes.Do(key, func() (interface{}, error) {
+		keys, err := km.fetch(context.Background(), name, p, upstream)
+		if err != nil {
+			log.Printf("Error refreshing cached %s keys for %s: %v", providerName(name), upstream, err)
+			return nil, err
+		}
+		if km.config.Cache.Processed {
+			keys = km.processKeys(keys, name, upstream, username)
+		}
+		km.cache.Set(key, keys, ttl)
+		return nil, nil
+	})
+}
+
+// processKeys applies the transforms and comment template to the keys
+// fetched from upstream for username
+func (km *KeyManager) processKeys(keys []string, name, upstream, username string) []string {
+	return km.rewriteComments(km.transformKeys(keys, name, upstream), name, upstream, username)
+}
+
+// collect fetches the keys for a mapping from every source, bypassing the cache
+func (km *KeyManager) collect(ctx context.Context, username string, mapping UserMapping) ([]KeyBlock, error) {
+	var blocks []KeyBlock
+	trace := explainTraceFrom(ctx)
+
+	static, priority, err := km.staticKeys(username, mapping)
+	if err != nil {
+		return nil, err
+	}
+	if len(priority)+len(static) > 0 {
+		trace.fetched("static", username, append(slices.Clip(priority), static...), nil)
+	}
+	if len(priority) > 0 {
+		blocks = append(blocks, KeyBlock{
+			Source:   "static",
+			Upstream: username,
+			Header:   km.header("static", username, username),
+			Keys:     km.rewriteComments(priority, "static", username, username),
+			Priority: true,
+		})
+	}
+
+	// Fetch from each source the mapping uses, in emission order
+	sources := km.sources(mapping)
+	for _, name := range sources {
+		if name == "static" {
+			if len(static) > 0 {
+				blocks = append(blocks, KeyBlock{
+					Source:   "static",
+					Upstream: username,
+					Header:   km.header("static", username, username),
+					Keys:     km.rewriteComments(static, "static", username, username),
+				})
+			}
+			continue
+		}
+
+		upstreams := mapping.Upstreams(name)
+		groups := mapping.Groups(name)
+		provider, ok := km.providers[name]
+		if len(upstreams)+len(groups) == 0 || !ok || !km.sourceEnabled(name) {
+			continue
+		}
+		if km.offline && !localSources[name] {
+			log.Printf("Skipping %s keys for %s: offline mode", providerName(name), username)
+			continue
+		}
+		if _, canEmail := provider.(EmailKeyProvider); km.byEmail && !canEmail {
+			log.Printf("Skipping %s keys for %s: %s does not support email lookup", providerName(name), username, providerName(name))
+			continue
+		}
+
+		if len(groups) > 0 {
+			members, err := km.groupMembers(name, provider, username, groups)
+			if err != nil {
+				return nil, err
+			}
+			for _, member := range members {
+				if !slices.Contains(upstreams, member) {
+					upstreams = append(upstreams, member)
+				}
+			}
+		}
+
+		found := false
+		digest := km.mappingDigest(name, mapping)
+		for _, upstream := range upstreams {
+			fetched, keys, err := km.cachedFetch(ctx, name, provider, username, upstream, digest)
+			trace.fetched(name, upstream, fetched, err)
+			if err != nil {
+				if km.config.FailClosed {
+					return nil, fmt.Errorf("error fetching %s keys for %s (%s), serving none: %w", providerName(name), username, upstream, err)
+				}
+				log.Printf("Error fetching %s keys for %s (%s): %v", providerName(name), username, upstream, err)
+				continue
+			}
+			// an account with no keys is not a failure, but gets no block
+			if !hasKeyLine(keys) {
+				log.Printf("No %s keys for %s (%s)", providerName(name), username, upstream)
+				continue
+			}
+			blocks = append(blocks, KeyBlock{
+				Source:    name,
+				Upstream:  upstream,
+				Header:    km.header(name, username, upstream),
+				Keys:      keys,
+				Unchanged: km.recordFetch(name, upstream, keys),
+			})
+			found = true
+		}
+		km.scoreSource(name, found)
+	}
+
+	blocks = dropEmptyBlocks(blocks)
+	if len(blocks) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrNoKeys, username)
+	}
+
+	if km.config.Dedup {
+		priority := mapping.Priority
+		if len(priority) == 0 {
+			priority = sources
+		}
+		var dropped int
+		blocks, dropped = dedupBlocks(blocks, priority, km.config.DedupProvenance)
+		if dropped > 0 {
+			log.Printf("Dropped %d duplicate keys for %s", dropped, username)
+		}
+	}
+
+	if km.config.SortKeys {
+		for i := range blocks {
+			blocks[i].Keys = sortKeyLines(blocks[i].Keys)
+		}
+	}
+
+	if km.config.MaxKeysPerUser > 0 {
+		var dropped int
+		blocks, dropped = limitKeys(blocks, km.config.MaxKeysPerUser)
+		if dropped > 0 {
+			log.Printf("Warning: dropped %d keys for %s over max_keys_per_user (%d)", dropped, username, km.config.MaxKeysPerUser)
+		}
+	}
+
+	return blocks, nil
+}
+
+// groupMembers returns the members of groups on a provider, in order. Under
+// FailClosed a group that can't be listed fails the lookup, otherwise it is
+// logged and left out.
+func (km *KeyManager) groupMembers(name string, provider KeyProvider, username string, groups []string) ([]string, error) {
+	lister, ok := provider.(MemberLister)
+	if !ok || km.byEmail {
+		log.Printf("Skipping %s groups for %s: members can't be listed for this lookup", providerName(name), username)
+		return nil, nil
+	}
+
+	var members []string
+	for _, group := range groups {
+		listed, err := lister.Members(group)
+		if err != nil {
+			if km.config.FailClosed {
+				return nil, fmt.Errorf("error listing %s group %s for %s, serving none: %w", providerName(name), group, username, err)
+			}
+			log.Printf("Error listing %s group %s for %s: %v", providerName(name), group, username, err)
+			continue
+		}
+		members = append(members, listed...)
+	}
+	return members, nil
+}
+
+// staticKeys returns the mapping's static keys with options expanded,
+// leaving out any that have expired, split into regular and priority keys
+func (km *KeyManager) staticKeys(username string, mapping UserMapping) (static, priority []string, err error) {
+	if !km.sourceEnabled("static") {
+		return nil, nil, nil
+	}
+
+	now := time.Now()
+	for _, key := range mapping.StaticKeys {
+		if key.Expired(now) {
+			log.Printf("Omitting static key for %s: expired at %s", username, key.NotAfter.Format(time.RFC3339))
+			continue
+		}
+		line, err := expandKeyOptions(key.Key, os.LookupEnv)
+		if err != nil {
+			if km.config.FailClosed {
+				return nil, nil, fmt.Errorf("error expanding static key for %s, serving none: %w", username, err)
+			}
+			log.Printf("Omitting static key for %s: %v", username, err)
+			continue
+		}
+		lines := []string{line}
+		if km.config.ExpiryComments && !key.NotAfter.IsZero() {
+			lines = []string{expiryComment(key.NotAfter), line}
+		}
+		if key.Priority {
+			priority = append(priority, lines...)
+		} else {
+			static = append(static, lines...)
+		}
+	}
+	return static, priority, nil
+}
+
+// sources returns the sources a mapping is resolved from, in emission order:
+// any listed in SourceOrder, then the rest in the default order of static
+// keys, the built-in providers and the mapping's registered providers
+func (km *KeyManager) sources(mapping UserMapping) []string {
+	defaults := append(append([]string{"static"}, providerOrder...), mapping.customSources()...)
+	if len(km.config.SourceOrder) == 0 {
+		if km.config.AdaptiveOrdering {
+			return km.adaptiveOrder(defaults)
+		}
+		return defaults
+	}
+	order := slices.Clone(km.config.SourceOrder)
+	for _, name := range defaults {
+		if !slices.Contains(order, name) {
+			order = append(order, name)
+		}
+	}
+	return order
+}
+
+// noStaticHeader is the StaticHeader value that turns the static header off
+const noStaticHeader = "none"
+
+// header returns the comment line emitted above a source's keys, or an
+// empty string when headers are turned off
+func (km *KeyManager) header(source, username, upstream string) string {
+	if km.config.NoHeaders || (source == "static" && km.config.StaticHeader == noStaticHeader) {
+		return ""
+	}
+	template := km.config.HeaderTemplate
+	if source == "static" && km.config.StaticHeader != "" {
+		template = km.config.StaticHeader
+	}
+	if template == "" {
+		return sourceHeader(source, username, upstream)
+	}
+
+	r := strings.NewReplacer("{source}", source, "{upstream}", upstream, "{login}", username, "\n", " ", "\r", " ")
+	header := r.Replace(template)
+	if !isComment(header) {
+		header = "# " + header
+	}
+	return header
+}
+
+// sourceHeader returns the default comment line emitted above a source's keys
+func sourceHeader(source, username, upstream string) string {
+	if source == "static" {
+		return fmt.Sprintf("# static: %s", username)
+	}
+	if source == "ldap" {
+		return fmt.Sprintf("# ldap: %s", username)
+	}
+	return fmt.Sprintf("# %s: %s (%s)", source, username, upstream)
+}
+
+// fetch gets keys for upstream from p, going through the provider's circuit
+// breaker when one is configured
+func (km *KeyManager) fetch(ctx context.Context, name string, p KeyProvider, upstream string) (keys []string, err error) {
+	if km.profile != nil {
+		defer func(start time.Time) { km.profile.record(name, time.Since(start)) }(time.Now())
+	}
+	_, span := km.startSpan(ctx, "portunus.fetch")
+	span.SetAttribute("portunus.provider", name)
+	span.SetAttribute("portunus.upstream", upstream)
+	defer func() {
+		span.SetAttribute("portunus.keys", len(keys))
+		span.End(err)
+	}()
+
+	get := p.GetKeys
+	if ep, ok := p.(EmailKeyProvider); ok && km.byEmail {
+		get = ep.GetKeysByEmail
+	}
+
+	if km.skipping(name) {
+		return nil, ErrProviderSkipped
+	}
+
+	if km.fetchSlots != nil {
+		if err := km.fetchSlots.Acquire(ctx, 1); err != nil {
+			return nil, err
+		}
+		defer km.fetchSlots.Release(1)
+	}
+
+	if km.config.CircuitBreaker.Threshold <= 0 {
+		keys, err = get(upstream)
+	} else {
+		keys, err = km.breaker(name).Call(func() ([]string, error) {
+			return get(upstream)
+		})
+	}
+	km.recordResult(name, err)
+	return keys, err
+}
+
+// skipping reports whether name has failed SkipAfterFailures times in a row
+// and should be left out for the rest of this KeyManager's life
+func (km *KeyManager) skipping(name string) bool {
+	if km.config.SkipAfterFailures <= 0 {
+		return false
+	}
+	km.mu.Lock()
+	defer km.mu.Unlock()
+	return km.failures[name] >= km.config.SkipAfterFailures
+}
+
+// recordResult counts consecutive failures per provider for SkipAfterFailures
+func (km *KeyManager) recordResult(name string, err error) {
+	if km.config.SkipAfterFailures <= 0 {
+		return
+	}
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
+	if err == nil {
+		delete(km.failures, name)
+		return
+	}
+	km.failures[name]++
+	if km.failures[name] == km.config.SkipAfterFailures {
+		log.Printf("Skipping %s for the rest of the run after %d consecutive failures", providerName(name), km.failures[name])
+	}
+}
+
+// breaker returns the circuit breaker for the named provider, creating it on first use
+func (km *KeyManager) breaker(name string) *circuitBreaker {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
+	b, ok := km.breakers[name]
+	if !ok {
+		b = newCircuitBreaker(km.config.CircuitBreaker)
+		km.breakers[name] = b
+	}
+	return b
+}
+
+// rewriteComments applies the configured CommentTemplate to each key. Keys
+// that cannot be parsed are passed through untouched.
+func (km *KeyManager) rewriteComments(keys []string, source, upstream, login string) []string {
+	if km.config.CommentTemplate == "" {
+		return keys
+	}
+
+	r := strings.NewReplacer("{source}", source, "{upstream}", upstream, "{login}", login)
+	comment := r.Replace(km.config.CommentTemplate)
+
+	result := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if isComment(key) {
+			result = append(result, key)
+			continue
+		}
+		rewritten, err := setKeyComment(key, comment)
+		if err != nil {
+			log.Printf("Error parsing %s key for %s, leaving comment as-is: %v", source, login, err)
+			result = append(result, key)
+			continue
+		}
+		result = append(result, rewritten)
+	}
+	return result
+}
+
+// setKeyComment re-serializes an authorized_keys line with the given comment,
+// preserving any options prefix.
+func setKeyComment(line string, comment string) (string, error) {
+	pub, _, options, _, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		return "", err
+	}
+
+	key := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub)))
+	if len(options) > 0 {
+		key = strings.Join(options, ",") + " " + key
+	}
+	if comment != "" {
+		key += " " + comment
+	}
+	return key, nil
+}
+
+// ConfigEnv holds an entire inline JSON config, used when no config path is given
+const ConfigEnv = "PORTUNUS_CONFIG"
+
+// checkUnmapped validates an unmapped login policy, where empty means "error"
+func checkUnmapped(mode string) error {
+	switch mode {
+	case "", "error", "deny":
+		return nil
+	}
+	return fmt.Errorf("unknown unmapped mode: %s", mode)
+}
+
+// LoadConfig reads the config from path, from stdin when path is "-", or from
+// the PORTUNUS_CONFIG environment variable when path is empty. When strict
+// is set, mappings defined more than once are rejected instead of the last
+// one winning, and so are fields the config doesn't define, which are
+// usually typos.
+func LoadConfig(path string, strict bool) (Config, error) {
+	data, err := readConfig(path, strict)
+	if err != nil {
+		return Config{}, err
+	}
+	return decodeConfig(bytes.NewReader(data), strict)
+}
+
+// readConfig returns the raw config at path, as LoadConfig finds it
+func readConfig(path string, strict bool) ([]byte, error) {
+	switch path {
+	case "-":
+		return io.ReadAll(os.Stdin)
+	case "":
+		inline := os.Getenv(ConfigEnv)
+		if inline == "" {
+			return nil, fmt.Errorf("no config path given and %s is not set", ConfigEnv)
+		}
+		return []byte(inline), nil
+	}
+	if isConfigURL(path) {
+		return loadConfigURL(path, strict)
+	}
+	return os.ReadFile(path)
+}
+
+func decodeConfig(r io.Reader, strict bool) (Config, error) {
+	var config Config
+	if !strict {
+		decoder := json.NewDecoder(r)
+		err := decoder.Decode(&config)
+		return config, err
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return config, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return config, err
+	}
+	if err := checkStaticKeyFields(data); err != nil {
+		return config, err
+	}
+	return config, checkDuplicateMappings(data)
+}
+
+// checkStaticKeyFields rejects unknown fields in static key objects, which
+// StaticKey decodes itself, out of reach of DisallowUnknownFields
+func checkStaticKeyFields(data []byte) error {
+	type mapping struct {
+		StaticKeys []json.RawMessage `json:"static_keys"`
+	}
+	var config struct {
+		Mappings  map[string]mapping `json:"mappings"`
+		Templates map[string]mapping `json:"templates"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return err
+	}
+	for _, mappings := range []map[string]mapping{config.Mappings, config.Templates} {
+		for _, m := range mappings {
+			for _, raw := range m.StaticKeys {
+				if !bytes.HasPrefix(bytes.TrimSpace(raw), []byte("{")) {
+					continue
+				}
+				decoder := json.NewDecoder(bytes.NewReader(raw))
+				decoder.DisallowUnknownFields()
+				if err := decoder.Decode(&staticKeyObject{}); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// checkDuplicateMappings walks the config's tokens and returns an error naming
+// the first login that appears more than once under "mappings". The config
+// must already have decoded successfully. A "mappings" that is null or not an
+// object has no logins to check.
+func checkDuplicateMappings(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if _, err := dec.Token(); err != nil { // opening {
+		return err
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if tok != "mappings" {
+			if err := skipValue(dec); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var mappings json.RawMessage
+		if err := dec.Decode(&mappings); err != nil {
+			return err
+		}
+		if err := checkDuplicateLogins(mappings); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkDuplicateLogins returns an error naming the first key that appears
+// more than once in the mappings object data, doing nothing when data is
+// null or some other value
+func checkDuplicateLogins(data json.RawMessage) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return err
+	}
+	seen := make(map[string]bool)
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		login := tok.(string)
+		if seen[login] {
+			return fmt.Errorf("duplicate mapping for user: %s", login)
+		}
+		seen[login] = true
+		if err := skipValue(dec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// skipValue consumes the next JSON value from dec, however deeply nested
+func skipValue(dec *json.Decoder) error {
+	var raw json.RawMessage
+	return dec.Decode(&raw)
+}
@@ -0,0 +1,1325 @@
+package portunus
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestResolveForSSHD(t *testing.T) {
+	key := testKey(t, 1, "alice@laptop")
+	config := Config{
+		Mappings: map[string]UserMapping{
+			"alice": {StaticKeys: []StaticKey{{Key: key}}},
+			"bob":   {},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		unmapped string
+		username string
+		want     string
+		wantCode int
+	}{
+		{name: "mapped login", username: "alice", want: key, wantCode: 0},
+		{name: "login with no keys", username: "bob", wantCode: DefaultExitCodes.NoKeys},
+		{name: "unmapped login", username: "carol", wantCode: DefaultExitCodes.NoMapping},
+		{name: "unmapped login under deny", unmapped: "deny", username: "carol", wantCode: 0},
+		{name: "invalid username", username: "../etc", wantCode: DefaultExitCodes.NoMapping},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			km, err := NewKeyManagerFromConfig(config, WithUnmapped(tt.unmapped))
+			if err != nil {
+				t.Fatal(err)
+			}
+			text, code := km.ResolveForSSHD(tt.username)
+			if code != tt.wantCode {
+				t.Errorf("exit code = %d, want %d", code, tt.wantCode)
+			}
+			if tt.want == "" && text != "" {
+				t.Errorf("text = %q, want none", text)
+			}
+			if !strings.Contains(text, tt.want) {
+				t.Errorf("text = %q, want it to contain %q", text, tt.want)
+			}
+
+			// the text must be what Resolve gives the portunus command
+			result, err := km.Resolve(context.Background(), tt.username)
+			if err == nil && text != string(result.Text()) {
+				t.Errorf("text = %q, Resolve gives %q", text, result.Text())
+			}
+		})
+	}
+}
+
+func TestDeniedLookupWritesEmptyJSON(t *testing.T) {
+	km, err := NewKeyManagerFromConfig(Config{Unmapped: "deny"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, code := km.LookupForSSHD(context.Background(), "carol")
+	if code != 0 {
+		t.Fatalf("exit code = %d, want 0", code)
+	}
+	var out strings.Builder
+	if err := result.WriteJSON(&out); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(out.String()); got != "[]" {
+		t.Errorf("json = %q, want []", got)
+	}
+}
+
+func TestCommentTemplate(t *testing.T) {
+	key := testKey(t, 1, "original comment")
+	bare := strings.Join(strings.Fields(key)[:2], " ")
+
+	tests := []struct {
+		name     string
+		template string
+		keys     []string
+		want     []string
+	}{
+		{
+			name: "no template keeps the comment",
+			keys: []string{key},
+			want: []string{key},
+		},
+		{
+			name:     "placeholders",
+			template: "{login} via {source}:{upstream}",
+			keys:     []string{key},
+			want:     []string{bare + " alice via github:octocat"},
+		},
+		{
+			name:     "options are kept",
+			template: "{login}",
+			keys:     []string{`no-pty,command="/bin/true" ` + key},
+			want:     []string{`no-pty,command="/bin/true" ` + bare + " alice"},
+		},
+		{
+			name:     "unparseable keys pass through",
+			template: "{login}",
+			keys:     []string{"ssh-ed25519 not-base64 comment"},
+			want:     []string{"ssh-ed25519 not-base64 comment"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := &fakeProvider{keys: map[string][]string{"octocat": tt.keys}}
+			km := newTestKeyManager(t, Config{
+				Mappings:        map[string]UserMapping{"alice": {GitHub: Usernames{"octocat"}}},
+				CommentTemplate: tt.template,
+			}, WithProvider("github", provider))
+			got := resolveLines(t, km, "alice")
+			if !slices.Equal(got[1:], tt.want) {
+				t.Errorf("got %q, want %q", got[1:], tt.want)
+			}
+		})
+	}
+}
+
+func TestGetKeysWithInjectedProviders(t *testing.T) {
+	hubKey, labKey := testKey(t, 1, "hub"), testKey(t, 2, "lab")
+
+	tests := []struct {
+		name    string
+		github  *fakeProvider
+		gitlab  *fakeProvider
+		want    []string
+		wantErr error
+	}{
+		{
+			name:   "both sources",
+			github: &fakeProvider{keys: map[string][]string{"octocat": {hubKey}}},
+			gitlab: &fakeProvider{keys: map[string][]string{"octocat": {labKey}}},
+			want:   []string{"# github: alice (octocat)", hubKey, "# gitlab: alice (octocat)", labKey},
+		},
+		{
+			name:   "a failing source is skipped",
+			github: &fakeProvider{err: errors.New("down")},
+			gitlab: &fakeProvider{keys: map[string][]string{"octocat": {labKey}}},
+			want:   []string{"# gitlab: alice (octocat)", labKey},
+		},
+		{
+			name:    "no source has keys",
+			github:  &fakeProvider{},
+			gitlab:  &fakeProvider{err: errors.New("down")},
+			wantErr: ErrNoKeys,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			km := newTestKeyManager(t, Config{
+				Mappings: map[string]UserMapping{"alice": {GitHub: Usernames{"octocat"}, GitLab: Usernames{"octocat"}}},
+			}, WithProvider("github", tt.github), WithProvider("gitlab", tt.gitlab))
+
+			got, err := km.GetKeys("alice")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if tt.github.Calls() != 1 || tt.gitlab.Calls() != 1 {
+				t.Errorf("providers called %d and %d times, want once each", tt.github.Calls(), tt.gitlab.Calls())
+			}
+		})
+	}
+}
+
+func TestOnlySources(t *testing.T) {
+	tests := []struct {
+		name    string
+		list    string
+		want    []string
+		wantErr bool
+	}{
+		{name: "every source without a filter", want: []string{"static", "github", "gitlab"}},
+		{name: "one source", list: "github", want: []string{"github"}},
+		{name: "several sources", list: "gitlab, static", want: []string{"static", "gitlab"}},
+		{name: "empty list", list: " , ", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var opts []Option
+			if tt.list != "" || tt.wantErr {
+				sources, err := ParseSources(tt.list)
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("ParseSources error = %v, want error %v", err, tt.wantErr)
+				}
+				if err != nil {
+					return
+				}
+				opts = append(opts, WithOnlySources(sources))
+			}
+			github := &fakeProvider{keys: map[string][]string{"octocat": {testKey(t, 1, "hub")}}}
+			gitlab := &fakeProvider{keys: map[string][]string{"octocat": {testKey(t, 2, "lab")}}}
+			opts = append(opts, WithProvider("github", github), WithProvider("gitlab", gitlab))
+			km := newTestKeyManager(t, Config{
+				Mappings: map[string]UserMapping{"alice": {
+					GitHub:     Usernames{"octocat"},
+					GitLab:     Usernames{"octocat"},
+					StaticKeys: []StaticKey{{Key: testKey(t, 3, "static")}},
+				}},
+			}, opts...)
+
+			result, err := km.Resolve(context.Background(), "alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, b := range result.Blocks {
+				got = append(got, b.Source)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("sources = %q, want %q", got, tt.want)
+			}
+			if called := github.Calls() > 0; called != slices.Contains(tt.want, "github") {
+				t.Errorf("github called: %v", called)
+			}
+		})
+	}
+}
+
+func TestOnlySourcesFollowTheConfig(t *testing.T) {
+	plugins := map[string]PluginConfig{"vault": {Command: execStub(t, "exit 0")}}
+	tests := []struct {
+		name    string
+		sources string
+		plugins map[string]PluginConfig
+		opts    []Option
+		wantErr string
+	}{
+		{name: "a plugin from the config", sources: "vault,static", plugins: plugins},
+		{name: "a provider set by an option", sources: "vault", opts: []Option{WithProvider("vault", &fakeProvider{})}},
+		{name: "a plugin the config doesn't have", sources: "vault", wantErr: "unknown source: vault"},
+		{name: "an unknown source", sources: "github,bitbucket", plugins: plugins, wantErr: "unknown source: bitbucket"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sources, err := ParseSources(tt.sources)
+			if err != nil {
+				t.Fatal(err)
+			}
+			km, err := NewKeyManagerFromConfig(Config{Plugins: tt.plugins}, append(tt.opts, WithOnlySources(sources))...)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("got error %v, want %q accepted", err, tt.sources)
+				}
+				for _, name := range sources {
+					if !km.HasSource(name) {
+						t.Errorf("HasSource(%q) = false, want true", name)
+					}
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConcurrentLookupsShareOneFetch(t *testing.T) {
+	key := testKey(t, 1, "octocat")
+	tests := []struct {
+		name        string
+		concurrency int
+	}{
+		{name: "two lookups", concurrency: 2},
+		{name: "many lookups", concurrency: 50},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := &gatedProvider{keys: []string{key}, release: make(chan struct{})}
+			km := newTestKeyManager(t, Config{
+				Mappings: map[string]UserMapping{"alice": {GitHub: Usernames{"octocat"}}},
+			}, WithProvider("github", provider))
+
+			var wg sync.WaitGroup
+			for range tt.concurrency {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					result, err := km.Resolve(context.Background(), "alice")
+					if got := flattenBlocks(result.Blocks); err != nil || !slices.Contains(got, key) {
+						t.Errorf("got %q, %v, want the key", got, err)
+					}
+				}()
+			}
+			// let every lookup join the blocked fetch before it finishes
+			time.Sleep(50 * time.Millisecond)
+			close(provider.release)
+			wg.Wait()
+
+			if got := provider.calls.Load(); got != 1 {
+				t.Errorf("provider called %d times, want 1", got)
+			}
+		})
+	}
+}
+
+// busyProvider holds each fetch until release is closed, recording the
+// most fetches it has had in flight at once
+type busyProvider struct {
+	key     string
+	release chan struct{}
+	calls   atomic.Int32
+
+	mu       sync.Mutex
+	inFlight int
+	peak     int
+}
+
+func (p *busyProvider) GetKeys(upstream string) ([]string, error) {
+	p.calls.Add(1)
+	p.mu.Lock()
+	p.inFlight++
+	p.peak = max(p.peak, p.inFlight)
+	p.mu.Unlock()
+
+	<-p.release
+	p.mu.Lock()
+	p.inFlight--
+	p.mu.Unlock()
+	return []string{p.key}, nil
+}
+
+// InFlight returns how many fetches p is holding
+func (p *busyProvider) InFlight() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.inFlight
+}
+
+// Peak returns the most fetches p has held at once
+func (p *busyProvider) Peak() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.peak
+}
+
+func TestMaxConcurrentFetches(t *testing.T) {
+	key := testKey(t, 1, "key")
+	tests := []struct {
+		name     string
+		max      int
+		lookups  int
+		wantPeak int
+	}{
+		{name: "one at a time", max: 1, lookups: 10, wantPeak: 1},
+		{name: "bounded", max: 3, lookups: 20, wantPeak: 3},
+		{name: "bound above demand", max: 50, lookups: 5, wantPeak: 5},
+		{name: "unbounded", lookups: 20, wantPeak: 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// every login is distinct, so no lookups share a fetch
+			mappings := make(map[string]UserMapping, tt.lookups)
+			for i := range tt.lookups {
+				mappings[fmt.Sprintf("user%d", i)] = UserMapping{GitHub: Usernames{fmt.Sprintf("hub%d", i)}}
+			}
+			provider := &busyProvider{key: key, release: make(chan struct{})}
+			km := newTestKeyManager(t, Config{Mappings: mappings, MaxConcurrentFetches: tt.max}, WithProvider("github", provider))
+
+			var wg sync.WaitGroup
+			for login := range mappings {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if _, err := km.Resolve(context.Background(), login); err != nil {
+						t.Errorf("%s: %v", login, err)
+					}
+				}()
+			}
+			// let as many fetches start as the bound admits
+			deadline := time.Now().Add(2 * time.Second)
+			for provider.InFlight() < tt.wantPeak && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			time.Sleep(20 * time.Millisecond)
+			close(provider.release)
+			wg.Wait()
+
+			if got := provider.Peak(); got != tt.wantPeak {
+				t.Errorf("peak of %d concurrent fetches, want %d", got, tt.wantPeak)
+			}
+			if got := provider.calls.Load(); got != int32(tt.lookups) {
+				t.Errorf("provider called %d times, want %d", got, tt.lookups)
+			}
+		})
+	}
+}
+
+func TestFetchWaitingForASlotGivesUp(t *testing.T) {
+	provider := &busyProvider{key: testKey(t, 1, "key"), release: make(chan struct{})}
+	km := newTestKeyManager(t, Config{
+		Mappings: map[string]UserMapping{
+			"alice": {GitHub: Usernames{"octocat"}},
+			"bob":   {GitHub: Usernames{"bobcat"}},
+		},
+		MaxConcurrentFetches: 1,
+	}, WithProvider("github", provider))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		km.Resolve(context.Background(), "alice")
+	}()
+	for provider.InFlight() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// alice's fetch holds the only slot until bob's lookup has given up
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := km.Resolve(ctx, "bob"); err == nil {
+		t.Error("lookup waiting for a fetch slot succeeded, want it to give up")
+	}
+	close(provider.release)
+	<-done
+	if got := provider.calls.Load(); got != 1 {
+		t.Errorf("provider called %d times, want only alice's fetch", got)
+	}
+}
+
+// emailProvider is a fakeProvider that can also look keys up by email,
+// serving them from byEmail
+type emailProvider struct {
+	fakeProvider
+	byEmail map[string][]string
+}
+
+func (p *emailProvider) GetKeysByEmail(email string) ([]string, error) {
+	return p.byEmail[email], nil
+}
+
+func TestEmailLookup(t *testing.T) {
+	userKey, emailKey, hubKey := testKey(t, 1, "by-uid"), testKey(t, 2, "by-mail"), testKey(t, 3, "hub")
+	mappings := map[string]UserMapping{
+		"alice@example.com": {LDAPUser: "alice@example.com", GitHub: Usernames{"alice@example.com"}},
+		"alice":             {LDAPUser: "alice"},
+	}
+
+	tests := []struct {
+		name  string
+		email bool
+		login string
+		want  []string
+	}{
+		{
+			name:  "email lookup uses providers that support it",
+			email: true,
+			login: "alice@example.com",
+			want:  []string{"# ldap: alice@example.com", emailKey},
+		},
+		{
+			name:  "username lookup",
+			login: "alice",
+			want:  []string{"# ldap: alice", userKey},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ldap := &emailProvider{
+				fakeProvider: fakeProvider{keys: map[string][]string{"alice": {userKey}}},
+				byEmail:      map[string][]string{"alice@example.com": {emailKey}},
+			}
+			github := &fakeProvider{keys: map[string][]string{"alice@example.com": {hubKey}}}
+			opts := []Option{WithProvider("ldap", ldap), WithProvider("github", github)}
+			if tt.email {
+				opts = append(opts, WithEmailLookup())
+			}
+			km := newTestKeyManager(t, Config{Mappings: mappings}, opts...)
+
+			if got := resolveLines(t, km, tt.login); !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if tt.email && github.Calls() > 0 {
+				t.Error("github was asked to look up an email")
+			}
+		})
+	}
+}
+
+func TestMultipleUsernames(t *testing.T) {
+	catKey, botKey, labKey := testKey(t, 1, "cat"), testKey(t, 2, "bot"), testKey(t, 3, "lab")
+
+	tests := []struct {
+		name    string
+		mapping UserMapping
+		want    []string
+	}{
+		{
+			name:    "single username",
+			mapping: UserMapping{GitHub: Usernames{"octocat"}},
+			want:    []string{"# github: alice (octocat)", catKey},
+		},
+		{
+			name:    "two github usernames",
+			mapping: UserMapping{GitHub: Usernames{"octocat", "octobot"}},
+			want:    []string{"# github: alice (octocat)", catKey, "# github: alice (octobot)", botKey},
+		},
+		{
+			name:    "github and gitlab usernames",
+			mapping: UserMapping{GitHub: Usernames{"octocat", "octobot"}, GitLab: Usernames{"tanuki"}},
+			want: []string{
+				"# github: alice (octocat)", catKey,
+				"# github: alice (octobot)", botKey,
+				"# gitlab: alice (tanuki)", labKey,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			github := &fakeProvider{keys: map[string][]string{"octocat": {catKey}, "octobot": {botKey}}}
+			gitlab := &fakeProvider{keys: map[string][]string{"tanuki": {labKey}}}
+			km := newTestKeyManager(t, Config{
+				Mappings: map[string]UserMapping{"alice": tt.mapping},
+			}, WithProvider("github", github), WithProvider("gitlab", gitlab))
+
+			if got := resolveLines(t, km, "alice"); !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnmappedPolicy(t *testing.T) {
+	aliceKey, defaultKey := testKey(t, 1, "alice"), testKey(t, 2, "default")
+
+	tests := []struct {
+		name        string
+		unmapped    string
+		withDefault bool
+		wantErr     error
+		wantCode    int
+		want        []string
+	}{
+		{name: "error by default", wantErr: ErrNoMapping, wantCode: DefaultExitCodes.NoMapping},
+		{name: "error", unmapped: "error", wantErr: ErrNoMapping, wantCode: DefaultExitCodes.NoMapping},
+		{name: "deny", unmapped: "deny", wantErr: ErrNoMapping, wantCode: 0},
+		{name: "default mapping wins over error", unmapped: "error", withDefault: true, want: []string{defaultKey}},
+		{name: "default mapping wins over deny", unmapped: "deny", withDefault: true, want: []string{defaultKey}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mappings := map[string]UserMapping{"alice": {StaticKeys: []StaticKey{{Key: aliceKey}}}}
+			if tt.withDefault {
+				mappings[DefaultMapping] = UserMapping{StaticKeys: []StaticKey{{Key: defaultKey}}}
+			}
+			km := newTestKeyManager(t, Config{Mappings: mappings}, WithUnmapped(tt.unmapped))
+
+			result, err := km.Resolve(context.Background(), "carol")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			if got := flattenBlocks(result.Blocks); !slices.Equal(stripHeaders(got), tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if _, code := km.LookupForSSHD(context.Background(), "carol"); code != tt.wantCode {
+				t.Errorf("exit code = %d, want %d", code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestUnknownUnmappedPolicy(t *testing.T) {
+	if _, err := NewKeyManagerFromConfig(Config{}, WithUnmapped("allow")); err == nil {
+		t.Error("unknown unmapped policy was accepted")
+	}
+}
+
+// stripHeaders drops the comment lines from output lines
+func stripHeaders(lines []string) []string {
+	var keys []string
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "#") {
+			keys = append(keys, line)
+		}
+	}
+	return keys
+}
+
+func TestStaticKeyExpiry(t *testing.T) {
+	current, expired, forever := testKey(t, 1, "current"), testKey(t, 2, "expired"), testKey(t, 3, "forever")
+	now := time.Now()
+
+	tests := []struct {
+		name string
+		keys []StaticKey
+		want []string
+	}{
+		{
+			name: "undated key is served",
+			keys: []StaticKey{{Key: forever}},
+			want: []string{forever},
+		},
+		{
+			name: "expired key is omitted",
+			keys: []StaticKey{{Key: expired, NotAfter: now.Add(-time.Hour)}, {Key: forever}},
+			want: []string{forever},
+		},
+		{
+			name: "still valid key is served",
+			keys: []StaticKey{{Key: current, NotAfter: now.Add(time.Hour)}, {Key: expired, NotAfter: now.Add(-time.Hour)}},
+			want: []string{current},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			km := newTestKeyManager(t, Config{
+				Mappings: map[string]UserMapping{"alice": {StaticKeys: tt.keys}},
+			})
+			if got := stripHeaders(resolveLines(t, km, "alice")); !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFailClosed(t *testing.T) {
+	staticKey, hubKey := testKey(t, 1, "static"), testKey(t, 2, "hub")
+	down := errors.New("gitlab down")
+
+	tests := []struct {
+		name       string
+		failClosed bool
+		gitlab     *fakeProvider
+		want       []string
+		wantErr    error
+		wantCode   int
+	}{
+		{
+			name:   "fail open serves the other sources",
+			gitlab: &fakeProvider{err: down},
+			want:   []string{staticKey, hubKey},
+		},
+		{
+			name:       "fail closed serves nothing",
+			failClosed: true,
+			gitlab:     &fakeProvider{err: down},
+			wantErr:    down,
+			wantCode:   DefaultExitCodes.ProviderError,
+		},
+		{
+			name:       "fail closed with every source up",
+			failClosed: true,
+			gitlab:     &fakeProvider{},
+			want:       []string{staticKey, hubKey},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			github := &fakeProvider{keys: map[string][]string{"octocat": {hubKey}}}
+			km := newTestKeyManager(t, Config{
+				Mappings: map[string]UserMapping{"alice": {
+					StaticKeys: []StaticKey{{Key: staticKey}},
+					GitHub:     Usernames{"octocat"},
+					GitLab:     Usernames{"octocat"},
+				}},
+				FailClosed: tt.failClosed,
+			}, WithProvider("github", github), WithProvider("gitlab", tt.gitlab))
+
+			result, err := km.Resolve(context.Background(), "alice")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			if got := stripHeaders(flattenBlocks(result.Blocks)); !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if _, code := km.LookupForSSHD(context.Background(), "alice"); code != tt.wantCode {
+				t.Errorf("exit code = %d, want %d", code, tt.wantCode)
+			}
+		})
+	}
+}
+
+// flakyProvider fails the calls whose number, counting from one, is in fail
+type flakyProvider struct {
+	key   string
+	fail  map[int]bool
+	calls atomic.Int32
+}
+
+func (p *flakyProvider) GetKeys(upstream string) ([]string, error) {
+	if p.fail[int(p.calls.Add(1))] {
+		return nil, errors.New("down")
+	}
+	return []string{p.key}, nil
+}
+
+func TestSkipAfterFailures(t *testing.T) {
+	const users = 10
+	staticKey, hubKey := testKey(t, 1, "static"), testKey(t, 2, "hub")
+	always := make(map[int]bool)
+	for i := 1; i <= users; i++ {
+		always[i] = true
+	}
+
+	tests := []struct {
+		name      string
+		threshold int
+		fail      map[int]bool
+		wantCalls int32
+	}{
+		{name: "disabled", fail: always, wantCalls: users},
+		{name: "down provider is skipped", threshold: 3, fail: always, wantCalls: 3},
+		{name: "a success resets the count", threshold: 3, fail: map[int]bool{1: true, 2: true, 4: true, 5: true}, wantCalls: users},
+		{name: "skipped once the count is reached", threshold: 3, fail: map[int]bool{1: true, 3: true, 4: true, 5: true}, wantCalls: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mappings := make(map[string]UserMapping)
+			for i := range users {
+				mappings[fmt.Sprintf("user%d", i)] = UserMapping{
+					StaticKeys: []StaticKey{{Key: staticKey}},
+					GitHub:     Usernames{"octocat"},
+				}
+			}
+			github := &flakyProvider{key: hubKey, fail: tt.fail}
+			km := newTestKeyManager(t, Config{Mappings: mappings, SkipAfterFailures: tt.threshold}, WithProvider("github", github))
+
+			// resolve in order so the failures land on known calls
+			for i := range users {
+				login := fmt.Sprintf("user%d", i)
+				if got := resolveLines(t, km, login); !slices.Contains(got, staticKey) {
+					t.Errorf("%s got %q, want its static key", login, got)
+				}
+			}
+			if got := github.calls.Load(); got != tt.wantCalls {
+				t.Errorf("provider called %d times, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestPrincipals(t *testing.T) {
+	tests := []struct {
+		name    string
+		mapping UserMapping
+		only    string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:    "single source",
+			mapping: UserMapping{GitHub: Usernames{"octocat"}},
+			want:    []string{"octocat"},
+		},
+		{
+			name: "several sources and groups",
+			mapping: UserMapping{
+				GitHub:       Usernames{"octocat", "octobot"},
+				GitHubTeams:  []string{"acme/ops", "acme/sre"},
+				GitLab:       Usernames{"tanuki"},
+				GitLabGroups: []string{"infra/oncall"},
+				LDAPUser:     "alice",
+			},
+			want: []string{"octocat", "octobot", "acme/ops", "acme/sre", "tanuki", "infra/oncall", "alice"},
+		},
+		{
+			name:    "duplicates across sources",
+			mapping: UserMapping{GitHub: Usernames{"alice"}, GitLab: Usernames{"alice"}},
+			want:    []string{"alice"},
+		},
+		{
+			name:    "disabled sources are left out",
+			mapping: UserMapping{GitHub: Usernames{"octocat"}, GitHubTeams: []string{"acme/ops"}, GitLab: Usernames{"tanuki"}},
+			only:    "gitlab",
+			want:    []string{"tanuki"},
+		},
+		{
+			name:    "static keys only",
+			mapping: UserMapping{StaticKeys: []StaticKey{{Key: testKey(t, 1, "")}}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var opts []Option
+			if tt.only != "" {
+				opts = append(opts, WithOnlySources([]string{tt.only}))
+			}
+			km := newTestKeyManager(t, Config{Mappings: map[string]UserMapping{"alice": tt.mapping}}, opts...)
+
+			got, err := km.Principals("alice")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUsernameValidation(t *testing.T) {
+	tests := []struct {
+		name     string
+		pattern  string
+		username string
+		wantOK   bool
+	}{
+		{name: "plain", username: "alice", wantOK: true},
+		{name: "dotted", username: "first.last", wantOK: true},
+		{name: "email", username: "alice+ops@example.com", wantOK: true},
+		{name: "underscore and dash", username: "_svc-bot_1", wantOK: true},
+		{name: "empty", username: ""},
+		{name: "leading dash", username: "-rf"},
+		{name: "newline", username: "alice\nroot"},
+		{name: "nul byte", username: "alice\x00"},
+		{name: "control character", username: "alice\x1b[2J"},
+		{name: "path traversal", username: "../etc/passwd"},
+		{name: "ldap filter injection", username: "alice)(uid=*"},
+		{name: "space", username: "alice bob"},
+		{name: "too long", username: strings.Repeat("a", 257)},
+		{name: "custom pattern accepts", pattern: `^[a-z]+$`, username: "alice", wantOK: true},
+		{name: "custom pattern rejects", pattern: `^[a-z]+$`, username: "Alice"},
+		{name: "length limit applies to custom patterns", pattern: `.*`, username: strings.Repeat("a", 257)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			github := &fakeProvider{keys: map[string][]string{tt.username: {testKey(t, 1, "")}}}
+			km := newTestKeyManager(t, Config{
+				Mappings:        map[string]UserMapping{tt.username: {GitHub: Usernames{tt.username}}},
+				UsernamePattern: tt.pattern,
+			}, WithProvider("github", github))
+
+			_, err := km.Resolve(context.Background(), tt.username)
+			if tt.wantOK && err != nil {
+				t.Errorf("error = %v, want %q accepted", err, tt.username)
+			}
+			if !tt.wantOK {
+				if !errors.Is(err, ErrInvalidUsername) {
+					t.Errorf("error = %v, want ErrInvalidUsername", err)
+				}
+				if github.Calls() != 0 {
+					t.Errorf("provider called for a rejected name")
+				}
+			}
+		})
+	}
+}
+
+func TestInvalidUsernamePattern(t *testing.T) {
+	if _, err := NewKeyManagerFromConfig(Config{UsernamePattern: "("}); err == nil {
+		t.Error("invalid username_pattern was accepted")
+	}
+}
+
+func TestDefaultMapping(t *testing.T) {
+	shared, personal, hubKey := testKey(t, 1, "shared"), testKey(t, 2, "personal"), testKey(t, 3, "hub")
+	disabled := false
+
+	tests := []struct {
+		name    string
+		merge   bool
+		login   string
+		mapping UserMapping
+		want    []string
+	}{
+		{
+			name:  "fallback serves unmapped logins",
+			login: "carol",
+			want:  []string{shared},
+		},
+		{
+			name:    "fallback only: the exact mapping wins",
+			login:   "alice",
+			mapping: UserMapping{StaticKeys: []StaticKey{{Key: personal}}},
+			want:    []string{personal},
+		},
+		{
+			name:    "merge unions the default with the exact mapping",
+			merge:   true,
+			login:   "alice",
+			mapping: UserMapping{StaticKeys: []StaticKey{{Key: personal}}},
+			want:    []string{personal, shared},
+		},
+		{
+			name:    "merge adds the default's sources",
+			merge:   true,
+			login:   "alice",
+			mapping: UserMapping{GitHub: Usernames{"octocat"}},
+			want:    []string{shared, hubKey},
+		},
+		{
+			name:  "merge still serves unmapped logins",
+			merge: true,
+			login: "carol",
+			want:  []string{shared},
+		},
+		{
+			name:    "a disabled exact mapping isn't rescued by merging",
+			merge:   true,
+			login:   "alice",
+			mapping: UserMapping{StaticKeys: []StaticKey{{Key: personal}}, Enabled: &disabled},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			github := &fakeProvider{keys: map[string][]string{"octocat": {hubKey}}}
+			km := newTestKeyManager(t, Config{
+				Mappings: map[string]UserMapping{
+					"alice":        tt.mapping,
+					DefaultMapping: {StaticKeys: []StaticKey{{Key: shared}}},
+				},
+				DefaultMerge: tt.merge,
+			}, WithProvider("github", github))
+
+			result, err := km.Resolve(context.Background(), tt.login)
+			if tt.want == nil {
+				if !errors.Is(err, ErrMappingDisabled) {
+					t.Errorf("error = %v, want ErrMappingDisabled", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := stripHeaders(flattenBlocks(result.Blocks)); !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOffline(t *testing.T) {
+	staticKey, execKey := testKey(t, 1, "static"), testKey(t, 2, "exec")
+	hubKey, ldapKey := testKey(t, 3, "hub"), testKey(t, 4, "ldap")
+
+	tests := []struct {
+		name    string
+		offline bool
+		want    []string
+		// wantCalls is how many lookups each network provider should get
+		wantCalls int
+	}{
+		{name: "online", want: []string{staticKey, hubKey, ldapKey, execKey}, wantCalls: 1},
+		{name: "offline skips network providers", offline: true, want: []string{staticKey, execKey}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			github := &fakeProvider{keys: map[string][]string{"octocat": {hubKey}}}
+			ldap := &fakeProvider{keys: map[string][]string{"alice": {ldapKey}}}
+			exec := &fakeProvider{keys: map[string][]string{"alice": {execKey}}}
+			opts := []Option{WithProvider("github", github), WithProvider("ldap", ldap), WithProvider("exec", exec)}
+			if tt.offline {
+				opts = append(opts, WithOffline())
+			}
+			km := newTestKeyManager(t, Config{
+				Mappings: map[string]UserMapping{"alice": {
+					StaticKeys: []StaticKey{{Key: staticKey}},
+					GitHub:     Usernames{"octocat"},
+					LDAPUser:   "alice",
+					Exec:       "alice",
+				}},
+			}, opts...)
+
+			if got := stripHeaders(resolveLines(t, km, "alice")); !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if github.Calls() != tt.wantCalls || ldap.Calls() != tt.wantCalls {
+				t.Errorf("network lookups = %d github, %d ldap, want %d each", github.Calls(), ldap.Calls(), tt.wantCalls)
+			}
+			if exec.Calls() != 1 {
+				t.Errorf("exec lookups = %d, want 1", exec.Calls())
+			}
+		})
+	}
+}
+
+func TestSourceOrder(t *testing.T) {
+	tests := []struct {
+		name  string
+		order []string
+		want  []string
+	}{
+		{name: "default order", want: []string{"static", "github", "gitlab", "ldap"}},
+		{name: "fully listed", order: []string{"ldap", "gitlab", "static", "github"}, want: []string{"ldap", "gitlab", "static", "github"}},
+		{name: "unlisted sources follow", order: []string{"ldap"}, want: []string{"ldap", "static", "github", "gitlab"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := &fakeProvider{keys: map[string][]string{"alice": {testKey(t, 2, "")}}}
+			km := newTestKeyManager(t, Config{
+				Mappings: map[string]UserMapping{"alice": {
+					StaticKeys: []StaticKey{{Key: testKey(t, 1, "")}},
+					GitHub:     Usernames{"alice"},
+					GitLab:     Usernames{"alice"},
+					LDAPUser:   "alice",
+				}},
+				SourceOrder: tt.order,
+			}, WithProvider("github", provider), WithProvider("gitlab", provider), WithProvider("ldap", provider))
+
+			result, err := km.Resolve(context.Background(), "alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, b := range result.Blocks {
+				got = append(got, b.Source)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("sources = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInvalidSourceOrder(t *testing.T) {
+	tests := []struct {
+		name  string
+		order []string
+		want  string
+	}{
+		{name: "unknown source", order: []string{"github", "bitbucket"}, want: "unknown source in source_order: bitbucket"},
+		{name: "listed twice", order: []string{"static", "github", "static"}, want: "source_order lists static twice"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewKeyManagerFromConfig(Config{SourceOrder: tt.order})
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestBreakGlass(t *testing.T) {
+	own, glass := testKey(t, 1, "own"), testKey(t, 2, "glass")
+	down := errors.New("github down")
+
+	tests := []struct {
+		name       string
+		login      string
+		enabled    bool
+		noHeaders  bool
+		failClosed bool
+		want       []string
+		wantWarn   bool
+	}{
+		{name: "disabled", login: "alice", want: []string{"# static: alice", own}},
+		{name: "mapped login", login: "alice", enabled: true, want: []string{"# static: alice", own, "# break-glass: alice", glass}, wantWarn: true},
+		{name: "another login", login: "bob", enabled: true, want: []string{"# break-glass: bob", glass}, wantWarn: true},
+		{name: "unmapped login", login: "carol", enabled: true, want: []string{"# break-glass: carol", glass}, wantWarn: true},
+		{name: "failed lookup", login: "bob", enabled: true, failClosed: true, want: []string{"# break-glass: bob", glass}, wantWarn: true},
+		{name: "without headers", login: "alice", enabled: true, noHeaders: true, want: []string{own, glass}, wantWarn: true},
+		{name: "invalid username", login: "../root", enabled: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLog(t)
+			var opts []Option
+			if tt.enabled {
+				opts = append(opts, WithBreakGlass())
+			}
+			km := newTestKeyManager(t, Config{
+				Mappings: map[string]UserMapping{
+					"alice": {StaticKeys: []StaticKey{{Key: own}}},
+					"bob":   {GitHub: Usernames{"bobcat"}},
+				},
+				BreakGlassKeys: []string{glass},
+				FailClosed:     tt.failClosed,
+				NoHeaders:      tt.noHeaders,
+			}, append(opts, WithProvider("github", &fakeProvider{err: down}))...)
+
+			result, _ := km.Resolve(context.Background(), tt.login)
+			if got := result.Lines(); !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			warned := strings.Contains(logs.String(), "WARNING: serving 1 break-glass keys for "+tt.login)
+			if warned != tt.wantWarn {
+				t.Errorf("warning logged = %v, want %v; log:\n%s", warned, tt.wantWarn, logs)
+			}
+		})
+	}
+}
+
+func TestPriorityKeys(t *testing.T) {
+	admin, backup := testKey(t, 1, "admin"), testKey(t, 2, "backup")
+	own, hub1, hub2 := testKey(t, 3, "own"), testKey(t, 4, "hub1"), testKey(t, 5, "hub2")
+
+	tests := []struct {
+		name     string
+		priority []string
+		maxKeys  int
+		want     []string
+	}{
+		{name: "priority keys first", priority: []string{admin}, want: []string{admin, hub1, hub2, own}},
+		{name: "limit keeps priority keys", priority: []string{admin, backup}, maxKeys: 3, want: []string{admin, backup, hub1}},
+		{name: "priority keys count toward the limit", priority: []string{admin}, maxKeys: 2, want: []string{admin, hub1}},
+		{name: "priority keys over the limit are all kept", priority: []string{admin, backup}, maxKeys: 1, want: []string{admin, backup}},
+		{name: "without priority keys", maxKeys: 2, want: []string{hub1, hub2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			static := []StaticKey{{Key: own}}
+			for _, key := range tt.priority {
+				static = append(static, StaticKey{Key: key, Priority: true})
+			}
+			github := &fakeProvider{keys: map[string][]string{"octocat": {hub1, hub2}}}
+			km := newTestKeyManager(t, Config{
+				Mappings:       map[string]UserMapping{"alice": {StaticKeys: static, GitHub: Usernames{"octocat"}}},
+				SourceOrder:    []string{"github", "static"},
+				MaxKeysPerUser: tt.maxKeys,
+			}, WithProvider("github", github))
+
+			if got := stripHeaders(resolveLines(t, km, "alice")); !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPriorityKeyJSON(t *testing.T) {
+	key := testKey(t, 1, "admin")
+	var got StaticKey
+	if err := json.Unmarshal([]byte(`{"key": "`+key+`", "priority": true}`), &got); err != nil {
+		t.Fatal(err)
+	}
+	if !got.Priority || got.Key != key {
+		t.Errorf("got %+v, want a priority key", got)
+	}
+	data, err := json.Marshal(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"key":"` + key + `","priority":true}`; string(data) != want {
+		t.Errorf("marshaled %s, want %s", data, want)
+	}
+}
+
+func TestCaseInsensitiveUsers(t *testing.T) {
+	aliceKey, bobKey := testKey(t, 1, "alice"), testKey(t, 2, "bob")
+
+	tests := []struct {
+		name        string
+		insensitive bool
+		login       string
+		want        []string
+		wantErr     bool
+	}{
+		{name: "exact match", login: "Alice", want: []string{aliceKey}},
+		{name: "other case is a miss by default", login: "alice", wantErr: true},
+		{name: "other case matches", insensitive: true, login: "ALICE", want: []string{aliceKey}},
+		{name: "lowercase mapping from mixed case login", insensitive: true, login: "BoB", want: []string{bobKey}},
+		{name: "exact match still works", insensitive: true, login: "bob", want: []string{bobKey}},
+		{name: "unknown login", insensitive: true, login: "Carol", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// upstreams are case-sensitive here, so they must be sent as written
+			github := &fakeProvider{keys: map[string][]string{"OctoCat": {aliceKey}, "BobCat": {bobKey}}}
+			km := newTestKeyManager(t, Config{
+				Mappings: map[string]UserMapping{
+					"Alice": {GitHub: Usernames{"OctoCat"}},
+					"bob":   {GitHub: Usernames{"BobCat"}},
+				},
+				CaseInsensitiveUsers: tt.insensitive,
+			}, WithProvider("github", github))
+
+			result, err := km.Resolve(context.Background(), tt.login)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if got := stripHeaders(result.Lines()); !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCaseInsensitiveUsersRejectsClashes(t *testing.T) {
+	_, err := NewKeyManagerFromConfig(Config{
+		Mappings:             map[string]UserMapping{"alice": {}, "Alice": {}},
+		CaseInsensitiveUsers: true,
+	})
+	if err == nil || !strings.Contains(err.Error(), "differ only in case") {
+		t.Errorf("error = %v, want logins differing only in case rejected", err)
+	}
+}
+
+func TestDisabledMappings(t *testing.T) {
+	aliceKey, defaultKey, baseKey := testKey(t, 1, "alice"), testKey(t, 2, "default"), testKey(t, 3, "base")
+	on, off := true, false
+
+	tests := []struct {
+		name         string
+		mapping      UserMapping
+		def          *UserMapping
+		defaultMerge bool
+		login        string
+		want         []string
+	}{
+		{name: "enabled by default", mapping: UserMapping{GitHub: Usernames{"octocat"}}, want: []string{aliceKey}},
+		{name: "enabled", mapping: UserMapping{GitHub: Usernames{"octocat"}, Enabled: &on}, want: []string{aliceKey}},
+		{name: "disabled", mapping: UserMapping{GitHub: Usernames{"octocat"}, Enabled: &off}},
+		{
+			name:    "disabled mapping doesn't fall back to the default",
+			mapping: UserMapping{GitHub: Usernames{"octocat"}, Enabled: &off},
+			def:     &UserMapping{StaticKeys: []StaticKey{{Key: defaultKey}}},
+		},
+		{
+			name:         "disabled default disables merged logins",
+			mapping:      UserMapping{GitHub: Usernames{"octocat"}},
+			def:          &UserMapping{StaticKeys: []StaticKey{{Key: defaultKey}}, Enabled: &off},
+			defaultMerge: true,
+		},
+		{
+			name:         "login's own setting beats the default's",
+			mapping:      UserMapping{GitHub: Usernames{"octocat"}, Enabled: &on},
+			def:          &UserMapping{StaticKeys: []StaticKey{{Key: defaultKey}}, Enabled: &off},
+			defaultMerge: true,
+			want:         []string{defaultKey, aliceKey},
+		},
+		{
+			name:  "disabled default disables unmapped logins",
+			def:   &UserMapping{StaticKeys: []StaticKey{{Key: defaultKey}}, Enabled: &off},
+			login: "carol",
+		},
+		{name: "disabled template", mapping: UserMapping{Extends: "base-off"}},
+		{name: "enabled over a disabled template", mapping: UserMapping{Extends: "base-off", Enabled: &on}, want: []string{baseKey}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			github := &fakeProvider{keys: map[string][]string{"octocat": {aliceKey}}}
+			mappings := map[string]UserMapping{"alice": tt.mapping}
+			if tt.def != nil {
+				mappings[DefaultMapping] = *tt.def
+			}
+			km := newTestKeyManager(t, Config{
+				Mappings:     mappings,
+				Templates:    map[string]UserMapping{"base-off": {StaticKeys: []StaticKey{{Key: baseKey}}, Enabled: &off}},
+				DefaultMerge: tt.defaultMerge,
+				SourceOrder:  []string{"static", "github"},
+			}, WithProvider("github", github))
+			login := cmp.Or(tt.login, "alice")
+
+			result, err := km.Resolve(context.Background(), login)
+			if tt.want == nil {
+				if !errors.Is(err, ErrNoKeys) {
+					t.Errorf("error = %v, want ErrNoKeys", err)
+				}
+				if _, code := km.LookupForSSHD(context.Background(), login); code != DefaultExitCodes.NoKeys {
+					t.Errorf("exit code = %d, want the no keys code %d", code, DefaultExitCodes.NoKeys)
+				}
+				if github.Calls() != 0 {
+					t.Errorf("provider called %d times for a disabled mapping", github.Calls())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := stripHeaders(result.Lines()); !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDisabledMappingJSON(t *testing.T) {
+	var m UserMapping
+	if err := json.Unmarshal([]byte(`{"github": "octocat", "enabled": false}`), &m); err != nil {
+		t.Fatal(err)
+	}
+	if !m.disabled() {
+		t.Errorf("got %+v, want a disabled mapping", m)
+	}
+	var unset UserMapping
+	if err := json.Unmarshal([]byte(`{"github": "octocat"}`), &unset); err != nil {
+		t.Fatal(err)
+	}
+	if unset.disabled() {
+		t.Error("mapping without enabled is disabled, want enabled")
+	}
+}
+
+func TestResolveDeadline(t *testing.T) {
+	key := testKey(t, 1, "alice")
+	hung := &busyProvider{key: key, release: make(chan struct{})}
+	t.Cleanup(func() { close(hung.release) })
+	km := newTestKeyManager(t, Config{Mappings: map[string]UserMapping{
+		"alice": {StaticKeys: []StaticKey{{Key: key}}},
+		"bob":   {GitHub: Usernames{"bobcat"}},
+	}}, WithProvider("github", hung))
+
+	tests := []struct {
+		name    string
+		login   string
+		wantErr error
+	}{
+		{name: "hung provider", login: "bob", wantErr: context.DeadlineExceeded},
+		{name: "quick lookup", login: "alice"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+			start := time.Now()
+			result, err := km.Resolve(ctx, tt.login)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Errorf("lookup took %s, want it to return at the deadline", elapsed)
+			}
+			if tt.wantErr == nil && !slices.Equal(stripHeaders(result.Lines()), []string{key}) {
+				t.Errorf("got %q, want alice's key", result.Lines())
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package portunus
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// profiler records how long each provider took during a resolution. It is
+// safe for concurrent use, and a nil profiler records nothing.
+type profiler struct {
+	start time.Time
+
+	mu      sync.Mutex
+	order   []string
+	elapsed map[string]time.Duration
+}
+
+func newProfiler() *profiler {
+	return &profiler{
+		start:   time.Now(),
+		elapsed: make(map[string]time.Duration),
+	}
+}
+
+// WithProfile records per-provider fetch latency, which can be written out
+// with KeyManager.WriteProfile once resolution is done
+func WithProfile() Option {
+	return func(km *KeyManager) {
+		km.profile = newProfiler()
+	}
+}
+
+// record adds d to the time spent in source. Multiple upstreams for the same
+// source are summed.
+func (p *profiler) record(source string, d time.Duration) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.elapsed[source]; !ok {
+		p.order = append(p.order, source)
+	}
+	p.elapsed[source] += d
+}
+
+// WriteProfile writes the timing breakdown recorded so far as a single line,
+// e.g. "github: 120ms, ldap: 45ms, total: 165ms". It writes nothing unless
+// the manager was created with WithProfile.
+func (km *KeyManager) WriteProfile(w io.Writer) {
+	p := km.profile
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	parts := make([]string, 0, len(p.order)+1)
+	for _, source := range p.order {
+		parts = append(parts, fmt.Sprintf("%s: %s", source, p.elapsed[source].Round(time.Millisecond)))
+	}
+	parts = append(parts, fmt.Sprintf("total: %s", time.Since(p.start).Round(time.Millisecond)))
+	fmt.Fprintln(w, strings.Join(parts, ", "))
+}
@@ -0,0 +1,63 @@
+package portunus
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestWriteProfile(t *testing.T) {
+	hubKey, labKey := testKey(t, 1, "hub"), testKey(t, 2, "lab")
+
+	tests := []struct {
+		name    string
+		opts    []Option
+		gitlab  *fakeProvider
+		want    []string
+		wantOut bool
+	}{
+		{
+			name:    "a line for each source",
+			opts:    []Option{WithProfile()},
+			gitlab:  &fakeProvider{keys: map[string][]string{"octocat": {labKey}}},
+			want:    []string{"github: ", "gitlab: ", "total: "},
+			wantOut: true,
+		},
+		{
+			name:    "a failing source is timed too",
+			opts:    []Option{WithProfile()},
+			gitlab:  &fakeProvider{err: errors.New("down")},
+			want:    []string{"github: ", "gitlab: ", "total: "},
+			wantOut: true,
+		},
+		{
+			name:   "nothing without WithProfile",
+			gitlab: &fakeProvider{keys: map[string][]string{"octocat": {labKey}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			github := &fakeProvider{keys: map[string][]string{"octocat": {hubKey}}}
+			opts := append([]Option{WithProvider("github", github), WithProvider("gitlab", tt.gitlab)}, tt.opts...)
+			km := newTestKeyManager(t, Config{
+				Mappings: map[string]UserMapping{"alice": {GitHub: Usernames{"octocat"}, GitLab: Usernames{"octocat"}}},
+			}, opts...)
+			resolveLines(t, km, "alice")
+
+			var out bytes.Buffer
+			km.WriteProfile(&out)
+			if got := out.Len() > 0; got != tt.wantOut {
+				t.Fatalf("profile = %q, want output %v", out.String(), tt.wantOut)
+			}
+			if strings.Count(out.String(), "\n") > 1 {
+				t.Errorf("profile = %q, want a single line", out.String())
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(out.String(), want) {
+					t.Errorf("profile = %q, want it to contain %q", out.String(), want)
+				}
+			}
+		})
+	}
+}
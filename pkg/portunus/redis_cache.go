@@ -0,0 +1,232 @@
+package portunus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// defaults for the RedisConfig fields left unset
+const (
+	defaultRedisPrefix  = "portunus:"
+	defaultRedisTimeout = time.Second
+)
+
+// redisRetryInterval is how long the in-memory cache is used after Redis
+// fails before Redis is tried again
+const redisRetryInterval = 30 * time.Second
+
+// Cache stores the keys fetched from each provider. KeyCache keeps them in
+// memory; RedisCache shares them between replicas.
+type Cache interface {
+	// Get returns the cached keys for key if present and not expired.
+	// refresh reports whether the entry is within the refresh window of
+	// expiring.
+	Get(key string) (keys []string, refresh bool, ok bool)
+
+	// Set stores keys under key for ttl. A zero ttl never expires.
+	Set(key string, keys []string, ttl time.Duration)
+
+	// DeleteUser removes every entry for username and reports how many were
+	// removed
+	DeleteUser(username string) int
+
+	Stats() CacheStats
+}
+
+// RedisConfig points the cache at a Redis server shared between replicas
+type RedisConfig struct {
+	Address  string `json:"address"`
+	Password string `json:"password,omitempty"`
+	DB       int    `json:"db,omitempty"`
+
+	// Prefix is prepended to every key portunus stores, "portunus:" by
+	// default, so one server can be shared with other applications
+	Prefix string `json:"prefix,omitempty"`
+
+	// Timeout bounds dialing and each command, one second by default
+	Timeout time.Duration `json:"timeout,omitempty"`
+}
+
+// RedisCache caches keys in Redis. While Redis can't be reached it falls
+// back to an in-memory KeyCache, trying Redis again every
+// redisRetryInterval.
+type RedisCache struct {
+	client        *redis.Client
+	prefix        string
+	refreshWindow time.Duration
+	jitter        time.Duration
+	fallback      *KeyCache
+
+	mu        sync.Mutex
+	downUntil time.Time
+
+	hits, misses atomic.Int64
+}
+
+// redisEntry is the value stored for each key. Expires is zero for entries
+// that don't expire and lets Get report the refresh window.
+type redisEntry struct {
+	Keys    []string  `json:"keys"`
+	Expires time.Time `json:"expires"`
+}
+
+// NewRedisCache returns a cache backed by config.Redis, which must be set.
+// Nothing is dialed until the first lookup.
+func NewRedisCache(config CacheConfig) *RedisCache {
+	rc := *config.Redis
+	if rc.Prefix == "" {
+		rc.Prefix = defaultRedisPrefix
+	}
+	if rc.Timeout <= 0 {
+		rc.Timeout = defaultRedisTimeout
+	}
+	return &RedisCache{
+		client: redis.NewClient(&redis.Options{
+			Addr:         rc.Address,
+			Password:     rc.Password,
+			DB:           rc.DB,
+			DialTimeout:  rc.Timeout,
+			ReadTimeout:  rc.Timeout,
+			WriteTimeout: rc.Timeout,
+			// the in-memory fallback takes over rather than retrying
+			MaxRetries:      -1,
+			DisableIdentity: true,
+		}),
+		prefix:        rc.Prefix,
+		refreshWindow: config.RefreshWindow,
+		jitter:        config.Jitter,
+		fallback:      NewKeyCache(config),
+	}
+}
+
+// available reports whether Redis should be tried
+func (c *RedisCache) available() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Now().After(c.downUntil)
+}
+
+// failed switches to the in-memory cache until redisRetryInterval passes
+func (c *RedisCache) failed(op string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Now().After(c.downUntil) {
+		log.Printf("Error with Redis cache at %s during %s, using the in-memory cache for %s: %v", c.client.Options().Addr, op, redisRetryInterval, err)
+	}
+	c.downUntil = time.Now().Add(redisRetryInterval)
+}
+
+func (c *RedisCache) Get(key string) (keys []string, refresh bool, ok bool) {
+	if !c.available() {
+		return c.fallback.Get(key)
+	}
+	data, err := c.client.Get(context.Background(), c.prefix+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		c.misses.Add(1)
+		return nil, false, false
+	}
+	if err != nil {
+		c.failed("GET", err)
+		return c.fallback.Get(key)
+	}
+
+	var entry redisEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		log.Printf("Error decoding cached keys for %s, ignoring them: %v", key, err)
+		c.misses.Add(1)
+		return nil, false, false
+	}
+	c.hits.Add(1)
+	if !entry.Expires.IsZero() {
+		refresh = c.refreshWindow > 0 && time.Until(entry.Expires) < c.refreshWindow
+	}
+	return entry.Keys, refresh, true
+}
+
+func (c *RedisCache) Set(key string, keys []string, ttl time.Duration) {
+	if !c.available() {
+		c.fallback.Set(key, keys, ttl)
+		return
+	}
+
+	// the fallback adds its own jitter, so it gets the ttl without ours
+	expiry := ttl
+	entry := redisEntry{Keys: keys}
+	if expiry > 0 {
+		if c.jitter > 0 {
+			expiry += rand.N(c.jitter)
+		}
+		entry.Expires = time.Now().Add(expiry)
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Error encoding keys to cache for %s: %v", key, err)
+		return
+	}
+
+	if err := c.client.Set(context.Background(), c.prefix+key, data, expiry).Err(); err != nil {
+		c.failed("SET", err)
+		c.fallback.Set(key, keys, ttl)
+	}
+}
+
+// DeleteUser removes username's entries from Redis and from the in-memory
+// fallback, which may hold entries stored while Redis was down
+func (c *RedisCache) DeleteUser(username string) int {
+	removed := c.fallback.DeleteUser(username)
+	if !c.available() {
+		return removed
+	}
+
+	ctx := context.Background()
+	pattern := c.prefix + escapeRedisGlob(username) + "/*"
+	var cursor uint64
+	for {
+		found, next, err := c.client.Scan(ctx, cursor, pattern, 100).Result()
+		if err != nil {
+			c.failed("SCAN", err)
+			return removed
+		}
+		if len(found) > 0 {
+			n, err := c.client.Del(ctx, found...).Result()
+			if err != nil {
+				c.failed("DEL", err)
+				return removed
+			}
+			removed += int(n)
+		}
+		if cursor = next; cursor == 0 {
+			return removed
+		}
+	}
+}
+
+// Stats reports the Redis hit and miss counts. Size and Entries describe
+// only the in-memory fallback, since Redis is shared with other replicas.
+func (c *RedisCache) Stats() CacheStats {
+	stats := c.fallback.Stats()
+	stats.Hits += c.hits.Load()
+	stats.Misses += c.misses.Load()
+	return stats
+}
+
+// escapeRedisGlob escapes the characters SCAN MATCH treats specially
+func escapeRedisGlob(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
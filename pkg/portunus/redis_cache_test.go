@@ -0,0 +1,100 @@
+package portunus
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// newTestRedisCache returns a RedisCache backed by a fresh miniredis server
+func newTestRedisCache(t *testing.T, config CacheConfig) (*RedisCache, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	config.Redis = &RedisConfig{Address: mr.Addr()}
+	return NewRedisCache(config), mr
+}
+
+func TestRedisCache(t *testing.T) {
+	keys := []string{testKey(t, 1, "one"), testKey(t, 2, "two")}
+
+	tests := []struct {
+		name        string
+		config      CacheConfig
+		ttl         time.Duration
+		key, get    string
+		wantKeys    []string
+		wantRefresh bool
+		wantOK      bool
+		wantTTL     time.Duration
+	}{
+		{name: "hit", ttl: time.Hour, key: "alice/github/alice", get: "alice/github/alice", wantKeys: keys, wantOK: true, wantTTL: time.Hour},
+		{name: "miss", ttl: time.Hour, key: "alice/github/alice", get: "bob/github/bob", wantTTL: time.Hour},
+		{name: "no expiry", key: "alice/github/alice", get: "alice/github/alice", wantKeys: keys, wantOK: true},
+		{
+			name:        "within the refresh window",
+			config:      CacheConfig{RefreshWindow: 2 * time.Hour},
+			ttl:         time.Hour,
+			key:         "alice/github/alice",
+			get:         "alice/github/alice",
+			wantKeys:    keys,
+			wantRefresh: true,
+			wantOK:      true,
+			wantTTL:     time.Hour,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, mr := newTestRedisCache(t, tt.config)
+			c.Set(tt.key, keys, tt.ttl)
+
+			got, refresh, ok := c.Get(tt.get)
+			if !slices.Equal(got, tt.wantKeys) || refresh != tt.wantRefresh || ok != tt.wantOK {
+				t.Errorf("Get = %q, %v, %v, want %q, %v, %v", got, refresh, ok, tt.wantKeys, tt.wantRefresh, tt.wantOK)
+			}
+			if ttl := mr.TTL(defaultRedisPrefix + tt.key); ttl != tt.wantTTL {
+				t.Errorf("redis ttl = %v, want %v", ttl, tt.wantTTL)
+			}
+		})
+	}
+}
+
+func TestRedisCacheDeleteUser(t *testing.T) {
+	c, mr := newTestRedisCache(t, CacheConfig{})
+	for _, key := range []string{"alice/github/alice", "alice/gitlab/alice", "al*/github/x", "bob/github/bob"} {
+		c.Set(key, []string{testKey(t, 1, "")}, time.Hour)
+	}
+
+	if n := c.DeleteUser("al*"); n != 1 {
+		t.Errorf("DeleteUser(al*) removed %d, want 1", n)
+	}
+	if n := c.DeleteUser("alice"); n != 2 {
+		t.Errorf("DeleteUser(alice) removed %d, want 2", n)
+	}
+	if got := mr.Keys(); !slices.Equal(got, []string{defaultRedisPrefix + "bob/github/bob"}) {
+		t.Errorf("keys left = %q", got)
+	}
+}
+
+func TestRedisCacheFallback(t *testing.T) {
+	const ttl, jitter = time.Hour, time.Hour
+	c, mr := newTestRedisCache(t, CacheConfig{Jitter: jitter})
+	mr.Close()
+
+	// each Set tries Redis first and fails over to memory
+	start := time.Now()
+	for i := range 20 {
+		c.downUntil = time.Time{}
+		c.Set(fmt.Sprintf("alice/github/%d", i), []string{testKey(t, 1, "")}, ttl)
+	}
+	if _, _, ok := c.Get("alice/github/0"); !ok {
+		t.Fatal("keys stored while Redis was down were not cached in memory")
+	}
+	for key, item := range c.fallback.items {
+		if latest := start.Add(ttl + jitter); item.expires.After(latest) {
+			t.Errorf("%s expires at %v, after %v: the jitter was added twice", key, item.expires, latest)
+		}
+	}
+}
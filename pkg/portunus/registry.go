@@ -0,0 +1,77 @@
+package portunus
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// ProviderFactory builds a KeyProvider from its raw JSON config
+type ProviderFactory func(config json.RawMessage) (KeyProvider, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]ProviderFactory)
+)
+
+// RegisterProvider makes a third-party provider available under name. Entries
+// under the config's "providers" map instantiate it, and mappings reference it
+// through their own "providers" map of name to upstream identity. It panics if
+// name is already registered, clashes with a built-in source, or factory is nil.
+func RegisterProvider(name string, factory ProviderFactory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if factory == nil {
+		panic("portunus: RegisterProvider factory is nil")
+	}
+	if _, ok := providerNames[name]; ok || name == "static" {
+		panic("portunus: RegisterProvider called for built-in source " + name)
+	}
+	if _, dup := registry[name]; dup {
+		panic("portunus: RegisterProvider called twice for provider " + name)
+	}
+	registry[name] = factory
+}
+
+// registeredProvider returns the factory registered under name
+func registeredProvider(name string) (ProviderFactory, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	factory, ok := registry[name]
+	return factory, ok
+}
+
+// newRegisteredProviders instantiates every provider configured under the
+// config's "providers" map
+func newRegisteredProviders(configs map[string]json.RawMessage) (map[string]KeyProvider, error) {
+	providers := make(map[string]KeyProvider, len(configs))
+	for name, raw := range configs {
+		factory, ok := registeredProvider(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown provider: %s", name)
+		}
+		p, err := factory(raw)
+		if err != nil {
+			return nil, fmt.Errorf("error configuring provider %s: %w", name, err)
+		}
+		providers[name] = p
+	}
+	return providers, nil
+}
+
+// customSources returns the registered provider names a mapping uses, sorted
+// so they are always emitted in the same order
+func (m UserMapping) customSources() []string {
+	names := make([]string, 0, len(m.Providers))
+	for name := range m.Providers {
+		if _, builtin := providerNames[name]; builtin || name == "static" {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
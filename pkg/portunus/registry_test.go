@@ -0,0 +1,89 @@
+package portunus
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// the registry is global, so the fake provider is registered once
+func init() {
+	RegisterProvider("testvault", func(config json.RawMessage) (KeyProvider, error) {
+		var keys map[string][]string
+		if err := json.Unmarshal(config, &keys); err != nil {
+			return nil, err
+		}
+		return &fakeProvider{keys: keys}, nil
+	})
+}
+
+func TestRegisteredProvider(t *testing.T) {
+	key := testKey(t, 1, "vault")
+
+	tests := []struct {
+		name    string
+		config  string
+		mapping UserMapping
+		want    []string
+		wantErr string
+	}{
+		{
+			name:    "resolves through the registered provider",
+			config:  `{"octocat": ["` + key + `"]}`,
+			mapping: UserMapping{Providers: map[string]string{"testvault": "octocat"}},
+			want:    []string{"# testvault: alice (octocat)", key},
+		},
+		{
+			name:    "factory error",
+			config:  `[]`,
+			mapping: UserMapping{Providers: map[string]string{"testvault": "octocat"}},
+			wantErr: "error configuring provider testvault",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			km, err := NewKeyManagerFromConfig(Config{
+				Mappings:  map[string]UserMapping{"alice": tt.mapping},
+				Providers: map[string]json.RawMessage{"testvault": json.RawMessage(tt.config)},
+			})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := resolveLines(t, km, "alice"); !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegisterProviderPanics(t *testing.T) {
+	factory := func(json.RawMessage) (KeyProvider, error) { return nil, errors.New("unused") }
+	tests := []struct {
+		name     string
+		provider string
+		factory  ProviderFactory
+	}{
+		{name: "nil factory", provider: "other", factory: nil},
+		{name: "built-in name", provider: "github", factory: factory},
+		{name: "static", provider: "static", factory: factory},
+		{name: "registered twice", provider: "testvault", factory: factory},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("RegisterProvider did not panic")
+				}
+			}()
+			RegisterProvider(tt.provider, tt.factory)
+		})
+	}
+}
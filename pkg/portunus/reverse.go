@@ -0,0 +1,66 @@
+package portunus
+
+import (
+	"log"
+	"slices"
+	"strings"
+)
+
+// ReverseResult is what ReverseLookup found for an upstream identity
+type ReverseResult struct {
+	// Logins are the logins with their own mapping that serve the identity's
+	// keys, sorted
+	Logins []string
+
+	// Default is set when the "*" default mapping serves them too, and so
+	// does every login without its own mapping
+	Default bool
+}
+
+// ReverseLookup finds the logins that would serve the keys of upstream on
+// provider. Each login's mapping is resolved as a lookup would resolve it,
+// with the default mapping merged in, derived upstreams filled in and group
+// members listed, so only groups need a provider to be contacted. Disabled
+// logins serve no keys and are left out. Upstream identities are compared
+// case-insensitively, as the hosted providers treat usernames.
+func (km *KeyManager) ReverseLookup(provider, upstream string) ReverseResult {
+	var result ReverseResult
+	for _, login := range km.Logins() {
+		mapping, err := km.mapping(login)
+		if err != nil {
+			continue
+		}
+		if km.servesUpstream(login, mapping, provider, upstream) {
+			result.Logins = append(result.Logins, login)
+		}
+	}
+
+	if def, ok := km.currentMappings()[DefaultMapping]; ok && !def.disabled() {
+		// which logins a derived upstream matches depends on the login, so
+		// deriving the provider at all counts as a match
+		result.Default = slices.Contains(def.Derive, provider) ||
+			km.servesUpstream(DefaultMapping, def, provider, upstream)
+	}
+	return result
+}
+
+// servesUpstream reports whether mapping serves the keys of upstream on
+// provider, directly or as a member of one of its groups
+func (km *KeyManager) servesUpstream(login string, mapping UserMapping, provider, upstream string) bool {
+	matches := func(u string) bool { return strings.EqualFold(u, upstream) }
+	if slices.ContainsFunc(mapping.Upstreams(provider), matches) {
+		return true
+	}
+
+	groups := mapping.Groups(provider)
+	source, ok := km.providers[provider]
+	if len(groups) == 0 || !ok || !km.sourceEnabled(provider) {
+		return false
+	}
+	members, err := km.groupMembers(provider, source, login, groups)
+	if err != nil {
+		log.Printf("Error listing groups for %s: %v", login, err)
+		return false
+	}
+	return slices.ContainsFunc(members, matches)
+}
@@ -0,0 +1,111 @@
+package portunus
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestReverseLookup(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v3/orgs/acme/teams/ops/members", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode([]map[string]string{{"login": "octocat"}})
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	off := false
+
+	tests := []struct {
+		name     string
+		config   Config
+		upstream string
+		want     ReverseResult
+	}{
+		{
+			name: "explicit upstreams, compared case-insensitively",
+			config: Config{Mappings: map[string]UserMapping{
+				"alice": {GitHub: Usernames{"OctoCat"}},
+				"bob":   {GitHub: Usernames{"someone", "octocat"}},
+				"carol": {GitLab: Usernames{"octocat"}},
+			}},
+			upstream: "octocat",
+			want:     ReverseResult{Logins: []string{"alice", "bob"}},
+		},
+		{
+			name: "derived upstreams",
+			config: Config{
+				Mappings: map[string]UserMapping{
+					"o.cat": {Derive: []string{"github"}},
+					"dave":  {Derive: []string{"github"}},
+				},
+				UsernameRules: map[string]UsernameRule{"github": {Pattern: `\.`, Replacement: ""}},
+			},
+			upstream: "ocat",
+			want:     ReverseResult{Logins: []string{"o.cat"}},
+		},
+		{
+			name: "disabled logins are left out",
+			config: Config{Mappings: map[string]UserMapping{
+				"alice": {GitHub: Usernames{"octocat"}, Enabled: &off},
+			}},
+			upstream: "octocat",
+			want:     ReverseResult{},
+		},
+		{
+			name: "default mapping is listed separately",
+			config: Config{Mappings: map[string]UserMapping{
+				"*":     {GitHub: Usernames{"octocat"}},
+				"alice": {GitHub: Usernames{"alice"}},
+			}},
+			upstream: "octocat",
+			want:     ReverseResult{Default: true},
+		},
+		{
+			name: "default mapping merged into every login",
+			config: Config{
+				Mappings: map[string]UserMapping{
+					"*":     {GitHub: Usernames{"octocat"}},
+					"alice": {GitHub: Usernames{"alice"}},
+				},
+				DefaultMerge: true,
+			},
+			upstream: "octocat",
+			want:     ReverseResult{Logins: []string{"alice"}, Default: true},
+		},
+		{
+			name: "default mapping deriving the provider",
+			config: Config{Mappings: map[string]UserMapping{
+				"*": {Derive: []string{"github"}},
+			}},
+			upstream: "octocat",
+			want:     ReverseResult{Default: true},
+		},
+		{
+			name: "team members",
+			config: Config{
+				Mappings: map[string]UserMapping{
+					"ops":   {GitHubTeams: []string{"acme/ops"}},
+					"alice": {GitHub: Usernames{"alice"}},
+				},
+				GitHub: GitHubConfig{URL: srv.URL, Token: "token"},
+			},
+			upstream: "octocat",
+			want:     ReverseResult{Logins: []string{"ops"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.GitHub.AllowPrivateNetworks = true
+			km, err := NewKeyManagerFromConfig(tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := km.ReverseLookup("github", tt.upstream)
+			if !slices.Equal(got.Logins, tt.want.Logins) || got.Default != tt.want.Default {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package portunus
+
+import (
+	"fmt"
+	"maps"
+	"strings"
+)
+
+// resolveExtends replaces every mapping that extends a template with the
+// mapping merged onto the fully resolved template, so the rest of the code
+// never sees Extends. Templates may extend each other, but not in a cycle.
+func resolveExtends(config *Config) error {
+	resolved := make(map[string]UserMapping, len(config.Templates))
+
+	var resolve func(name string, chain []string) (UserMapping, error)
+	resolve = func(name string, chain []string) (UserMapping, error) {
+		if m, ok := resolved[name]; ok {
+			return m, nil
+		}
+		for _, seen := range chain {
+			if seen == name {
+				return UserMapping{}, fmt.Errorf("template cycle: %s", strings.Join(append(chain, name), " -> "))
+			}
+		}
+		template, ok := config.Templates[name]
+		if !ok {
+			return UserMapping{}, fmt.Errorf("unknown template: %s", name)
+		}
+		if template.Extends != "" {
+			parent, err := resolve(template.Extends, append(chain, name))
+			if err != nil {
+				return UserMapping{}, err
+			}
+			template = template.merge(parent)
+		}
+		resolved[name] = template
+		return template, nil
+	}
+
+	var mappings map[string]UserMapping
+	for login, mapping := range config.Mappings {
+		if mapping.Extends == "" {
+			continue
+		}
+		template, err := resolve(mapping.Extends, nil)
+		if err != nil {
+			return fmt.Errorf("mapping %s: %w", login, err)
+		}
+		if mappings == nil {
+			// copy rather than modify a map the caller may still hold
+			mappings = maps.Clone(config.Mappings)
+		}
+		mappings[login] = mapping.merge(template)
+	}
+	if mappings != nil {
+		config.Mappings = mappings
+	}
+
+	// check templates no mapping uses too, so a broken one is caught early
+	for name := range config.Templates {
+		if _, err := resolve(name, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package portunus
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestExtends(t *testing.T) {
+	base, ci, own := testKey(t, 1, "base"), testKey(t, 2, "ci"), testKey(t, 3, "own")
+	templates := map[string]UserMapping{
+		"service-base": {StaticKeys: []StaticKey{{Key: base}}, LDAPUser: "svc"},
+		"ci-base":      {Extends: "service-base", StaticKeys: []StaticKey{{Key: ci}}, GitHub: Usernames{"ci-bot"}},
+		"loop-a":       {Extends: "loop-b"},
+		"loop-b":       {Extends: "loop-a"},
+		"self":         {Extends: "self"},
+		"orphan":       {Extends: "missing"},
+	}
+
+	tests := []struct {
+		name      string
+		mapping   UserMapping
+		templates []string
+		want      UserMapping
+		wantErr   string
+	}{
+		{
+			name:      "single level",
+			mapping:   UserMapping{Extends: "service-base", StaticKeys: []StaticKey{{Key: own}}},
+			templates: []string{"service-base"},
+			want:      UserMapping{StaticKeys: []StaticKey{{Key: own}, {Key: base}}, LDAPUser: "svc"},
+		},
+		{
+			name:      "multi level",
+			mapping:   UserMapping{Extends: "ci-base"},
+			templates: []string{"service-base", "ci-base"},
+			want:      UserMapping{StaticKeys: []StaticKey{{Key: ci}, {Key: base}}, GitHub: Usernames{"ci-bot"}, LDAPUser: "svc"},
+		},
+		{
+			name:      "own fields override",
+			mapping:   UserMapping{Extends: "ci-base", LDAPUser: "deploy", GitHub: Usernames{"deployer"}},
+			templates: []string{"service-base", "ci-base"},
+			want:      UserMapping{StaticKeys: []StaticKey{{Key: ci}, {Key: base}}, GitHub: Usernames{"deployer", "ci-bot"}, LDAPUser: "deploy"},
+		},
+		{
+			name:      "no extends is untouched",
+			mapping:   UserMapping{GitHub: Usernames{"octocat"}},
+			templates: []string{"service-base"},
+			want:      UserMapping{GitHub: Usernames{"octocat"}},
+		},
+		{name: "cycle", mapping: UserMapping{Extends: "loop-a"}, templates: []string{"loop-a", "loop-b"}, wantErr: "template cycle: loop-a -> loop-b -> loop-a"},
+		{name: "extends itself", mapping: UserMapping{}, templates: []string{"self"}, wantErr: "template cycle: self -> self"},
+		{name: "unknown template", mapping: UserMapping{Extends: "nope"}, wantErr: "mapping alice: unknown template: nope"},
+		{name: "unused broken template", mapping: UserMapping{}, templates: []string{"orphan"}, wantErr: "unknown template: missing"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := Config{
+				Mappings:  map[string]UserMapping{"alice": tt.mapping},
+				Templates: make(map[string]UserMapping),
+			}
+			for _, name := range tt.templates {
+				config.Templates[name] = templates[name]
+			}
+			mappings := config.Mappings
+
+			err := resolveExtends(&config)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := config.Mappings["alice"]
+			if got.Extends != "" || got.LDAPUser != tt.want.LDAPUser ||
+				!slices.Equal(got.GitHub, tt.want.GitHub) || !slices.Equal(got.StaticKeys, tt.want.StaticKeys) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+			if mappings["alice"].Extends != tt.mapping.Extends {
+				t.Error("resolving templates modified the caller's mappings")
+			}
+		})
+	}
+}
+
+func TestTemplatesAreNotLogins(t *testing.T) {
+	key := testKey(t, 1, "base")
+	km := newTestKeyManager(t, Config{
+		Templates: map[string]UserMapping{"service-base": {StaticKeys: []StaticKey{{Key: key}}}},
+		Mappings:  map[string]UserMapping{"deploy": {Extends: "service-base"}},
+	})
+	if got := stripHeaders(resolveLines(t, km, "deploy")); !slices.Equal(got, []string{key}) {
+		t.Errorf("got %q, want the template's key", got)
+	}
+	if slices.Contains(km.Logins(), "service-base") {
+		t.Error("template listed as a login")
+	}
+}
@@ -0,0 +1,40 @@
+package portunus
+
+import "context"
+
+// Tracer starts spans around lookups and provider fetches. It mirrors the
+// shape of OpenTelemetry's tracer closely enough that an adapter is a few
+// lines, without this package depending on the OpenTelemetry SDK.
+type Tracer interface {
+	// Start begins a span named name, a child of any span already in ctx,
+	// and returns a context carrying it
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer
+type Span interface {
+	SetAttribute(key string, value any)
+	// End finishes the span, marking it failed when err is non-nil
+	End(err error)
+}
+
+// WithTracer emits a "portunus.resolve" span per lookup and a
+// "portunus.fetch" child span per provider request that misses the cache
+func WithTracer(t Tracer) Option {
+	return func(km *KeyManager) {
+		km.tracer = t
+	}
+}
+
+// startSpan starts a span with t, or a no-op one when no tracer is set
+func (km *KeyManager) startSpan(ctx context.Context, name string) (context.Context, Span) {
+	if km.tracer == nil {
+		return ctx, noopSpan{}
+	}
+	return km.tracer.Start(ctx, name)
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(string, any) {}
+func (noopSpan) End(error)                {}
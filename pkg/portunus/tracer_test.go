@@ -0,0 +1,119 @@
+package portunus
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordedSpan is a span kept by recordingTracer once it ends
+type recordedSpan struct {
+	name   string
+	parent string
+	attrs  map[string]any
+	err    error
+
+	tracer *recordingTracer
+}
+
+func (s *recordedSpan) SetAttribute(key string, value any) {
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	s.attrs[key] = value
+}
+
+func (s *recordedSpan) End(err error) {
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	s.err = err
+	s.tracer.ended = append(s.tracer.ended, s)
+}
+
+type spanKey struct{}
+
+// recordingTracer is an in-memory Tracer that keeps every ended span
+type recordingTracer struct {
+	mu    sync.Mutex
+	ended []*recordedSpan
+}
+
+func (t *recordingTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	span := &recordedSpan{name: name, attrs: make(map[string]any), tracer: t}
+	if parent, ok := ctx.Value(spanKey{}).(*recordedSpan); ok {
+		span.parent = parent.name
+	}
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// Spans returns the ended spans, resolve spans first and fetches by provider
+func (t *recordingTracer) Spans() []*recordedSpan {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	spans := append([]*recordedSpan(nil), t.ended...)
+	sort.SliceStable(spans, func(i, j int) bool {
+		if spans[i].name != spans[j].name {
+			return spans[i].name > spans[j].name
+		}
+		pi, _ := spans[i].attrs["portunus.provider"].(string)
+		pj, _ := spans[j].attrs["portunus.provider"].(string)
+		return pi < pj
+	})
+	return spans
+}
+
+func TestTracerSpans(t *testing.T) {
+	down := errors.New("gitlab down")
+	tracer := &recordingTracer{}
+	github := &fakeProvider{keys: map[string][]string{"octocat": {testKey(t, 1, "hub")}}}
+	gitlab := &fakeProvider{err: down}
+	km := newTestKeyManager(t, Config{
+		Mappings: map[string]UserMapping{"alice": {GitHub: Usernames{"octocat"}, GitLab: Usernames{"tanuki"}}},
+		Cache:    CacheConfig{Enabled: true, TTL: time.Hour},
+	}, WithProvider("github", github), WithProvider("gitlab", gitlab), WithTracer(tracer))
+
+	resolveLines(t, km, "alice")
+	spans := tracer.Spans()
+
+	want := []struct {
+		name, parent string
+		attrs        map[string]any
+		err          error
+	}{
+		{name: "portunus.resolve", attrs: map[string]any{"portunus.login": "alice", "portunus.keys": 1}},
+		{name: "portunus.fetch", parent: "portunus.resolve", attrs: map[string]any{"portunus.provider": "github", "portunus.upstream": "octocat", "portunus.keys": 1}},
+		{name: "portunus.fetch", parent: "portunus.resolve", attrs: map[string]any{"portunus.provider": "gitlab", "portunus.upstream": "tanuki", "portunus.keys": 0}, err: down},
+	}
+	if len(spans) != len(want) {
+		t.Fatalf("got %d spans, want %d", len(spans), len(want))
+	}
+	for i, w := range want {
+		s := spans[i]
+		if s.name != w.name || s.parent != w.parent || !errors.Is(s.err, w.err) {
+			t.Errorf("span %d = %s under %q with error %v, want %s under %q with %v", i, s.name, s.parent, s.err, w.name, w.parent, w.err)
+		}
+		for key, value := range w.attrs {
+			if s.attrs[key] != value {
+				t.Errorf("span %d %s = %v, want %v", i, key, s.attrs[key], value)
+			}
+		}
+	}
+
+	// a cache hit fetches nothing, so only gitlab's failed fetch is retried
+	resolveLines(t, km, "alice")
+	if n := len(tracer.Spans()); n != len(want)+2 {
+		t.Errorf("got %d spans after a cached lookup, want %d", n, len(want)+2)
+	}
+}
+
+func TestNoTracer(t *testing.T) {
+	km := newTestKeyManager(t, Config{
+		Mappings: map[string]UserMapping{"alice": {StaticKeys: []StaticKey{{Key: testKey(t, 1, "")}}}},
+	})
+	// without a tracer spans are no-ops and resolution works as usual
+	if got := resolveLines(t, km, "alice"); len(got) != 2 {
+		t.Errorf("got %q, want a header and a key", got)
+	}
+}
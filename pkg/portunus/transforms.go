@@ -0,0 +1,166 @@
+package portunus
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// TransformRule is one declarative edit to the keys a provider returns. Each
+// rule sets exactly one operation. Rules run in order, before dedup and
+// CommentTemplate, and static keys are never transformed.
+type TransformRule struct {
+	// Sources limits the rule to these providers. Empty applies it to all.
+	Sources []string `json:"sources,omitempty"`
+
+	// ReplaceComment replaces matches of Pattern in each key's comment with
+	// Replacement, which may refer to capture groups as $1
+	ReplaceComment *CommentReplacement `json:"replace_comment,omitempty"`
+
+	// DropIfComment drops keys whose comment matches this regular expression
+	DropIfComment string `json:"drop_if_comment,omitempty"`
+
+	// AddOption adds an authorized_keys option, e.g. no-agent-forwarding or
+	// from="10.0.0.0/8", in front of each key's existing options
+	AddOption string `json:"add_option,omitempty"`
+}
+
+// CommentReplacement is a replace_comment rule's pattern and replacement
+type CommentReplacement struct {
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
+}
+
+// transform is a compiled TransformRule
+type transform struct {
+	sources []string
+	// desc describes the rule in explain output
+	desc  string
+	apply func(options []string, comment string) (newOptions []string, newComment string, keep bool)
+}
+
+// compileTransforms validates rules and compiles their patterns
+func compileTransforms(rules []TransformRule) ([]transform, error) {
+	transforms := make([]transform, 0, len(rules))
+	for i, rule := range rules {
+		var ops int
+		t := transform{sources: rule.Sources}
+		if rule.ReplaceComment != nil {
+			ops++
+			pattern, err := regexp.Compile(rule.ReplaceComment.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("transform %d: invalid replace_comment pattern: %w", i+1, err)
+			}
+			replacement := rule.ReplaceComment.Replacement
+			t.desc = fmt.Sprintf("replace_comment %q -> %q", pattern, replacement)
+			t.apply = func(options []string, comment string) ([]string, string, bool) {
+				return options, pattern.ReplaceAllString(comment, replacement), true
+			}
+		}
+		if rule.DropIfComment != "" {
+			ops++
+			pattern, err := regexp.Compile(rule.DropIfComment)
+			if err != nil {
+				return nil, fmt.Errorf("transform %d: invalid drop_if_comment: %w", i+1, err)
+			}
+			t.desc = fmt.Sprintf("drop_if_comment %q", pattern)
+			t.apply = func(options []string, comment string) ([]string, string, bool) {
+				return options, comment, !pattern.MatchString(comment)
+			}
+		}
+		if rule.AddOption != "" {
+			ops++
+			option := rule.AddOption
+			if strings.ContainsAny(option, "\r\n") {
+				return nil, fmt.Errorf("transform %d: add_option must be on one line", i+1)
+			}
+			t.desc = fmt.Sprintf("add_option %s", option)
+			t.apply = func(options []string, comment string) ([]string, string, bool) {
+				if slices.Contains(options, option) {
+					return options, comment, true
+				}
+				return append([]string{option}, options...), comment, true
+			}
+		}
+		if ops != 1 {
+			return nil, fmt.Errorf("transform %d: set exactly one of replace_comment, drop_if_comment or add_option", i+1)
+		}
+		transforms = append(transforms, t)
+	}
+	return transforms, nil
+}
+
+// transformsFor returns the transforms that apply to source's keys
+func (km *KeyManager) transformsFor(source string) []transform {
+	var rules []transform
+	for _, t := range km.transforms {
+		if len(t.sources) == 0 || slices.Contains(t.sources, source) {
+			rules = append(rules, t)
+		}
+	}
+	return rules
+}
+
+// transformKeys applies the configured transforms for source to keys.
+// Comment lines and keys that can't be parsed are passed through untouched,
+// and a dropped key's metadata comments are dropped with it.
+func (km *KeyManager) transformKeys(keys []string, source, upstream string) []string {
+	rules := km.transformsFor(source)
+	if len(rules) == 0 {
+		return keys
+	}
+
+	result := make([]string, 0, len(keys))
+	for _, unit := range keyUnits(keys) {
+		line, ok := unitKey(unit)
+		if !ok {
+			result = append(result, unit...)
+			continue
+		}
+		out, keep, _, err := transformKey(line, rules)
+		if err != nil {
+			log.Printf("Error parsing %s key for %s, not transforming it: %v", providerName(source), upstream, err)
+		}
+		if keep {
+			result = append(append(result, unit[:len(unit)-1]...), out)
+		}
+	}
+	return result
+}
+
+// transformKey applies rules to one line, returning the new line, whether it
+// is kept and the rules that changed or dropped it. Comment lines and keys
+// that can't be parsed are returned unchanged, the latter with the error.
+func transformKey(line string, rules []transform) (out string, keep bool, applied []string, err error) {
+	if isComment(line) {
+		return line, true, nil, nil
+	}
+	pub, comment, options, _, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		return line, true, nil, err
+	}
+
+	for _, t := range rules {
+		newOptions, newComment, kept := t.apply(options, comment)
+		if !kept {
+			return "", false, append(applied, t.desc), nil
+		}
+		if newComment != comment || !slices.Equal(newOptions, options) {
+			applied = append(applied, t.desc)
+		}
+		options, comment = newOptions, newComment
+	}
+
+	key := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub)))
+	if len(options) > 0 {
+		key = strings.Join(options, ",") + " " + key
+	}
+	if comment != "" {
+		key += " " + comment
+	}
+	return key, true, applied, nil
+}
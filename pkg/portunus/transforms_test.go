@@ -0,0 +1,122 @@
+package portunus
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestTransforms(t *testing.T) {
+	work, personal, own := testKey(t, 1, "alice@corp"), testKey(t, 2, "alice@home"), testKey(t, 3, "own@home")
+
+	tests := []struct {
+		name   string
+		rules  []TransformRule
+		github []string
+		want   []string
+	}{
+		{name: "no rules", github: []string{work, personal}, want: []string{work, personal}},
+		{
+			name:   "replace comment",
+			rules:  []TransformRule{{ReplaceComment: &CommentReplacement{Pattern: `@corp$`, Replacement: "@example.com"}}},
+			github: []string{work, personal},
+			want:   []string{testKey(t, 1, "alice@example.com"), personal},
+		},
+		{
+			name:   "replace comment with capture groups",
+			rules:  []TransformRule{{ReplaceComment: &CommentReplacement{Pattern: `^(\w+)@(\w+)$`, Replacement: "$2-$1"}}},
+			github: []string{work},
+			want:   []string{testKey(t, 1, "corp-alice")},
+		},
+		{
+			name:   "drop if comment matches",
+			rules:  []TransformRule{{DropIfComment: `@home$`}},
+			github: []string{work, personal},
+			want:   []string{work},
+		},
+		{
+			name:   "add option",
+			rules:  []TransformRule{{AddOption: "no-agent-forwarding"}},
+			github: []string{work, `no-pty ` + personal},
+			want:   []string{"no-agent-forwarding " + work, "no-agent-forwarding,no-pty " + personal},
+		},
+		{
+			name:   "option already present",
+			rules:  []TransformRule{{AddOption: "no-pty"}},
+			github: []string{"no-pty " + work},
+			want:   []string{"no-pty " + work},
+		},
+		{
+			name: "rules run in order",
+			rules: []TransformRule{
+				{ReplaceComment: &CommentReplacement{Pattern: `@corp$`, Replacement: "@home"}},
+				{DropIfComment: `@home$`},
+			},
+			github: []string{work, personal},
+			want:   nil,
+		},
+		{
+			name:   "rule for another source",
+			rules:  []TransformRule{{Sources: []string{"gitlab"}, DropIfComment: `.`}},
+			github: []string{work},
+			want:   []string{work},
+		},
+		{
+			name:   "rule for this source",
+			rules:  []TransformRule{{Sources: []string{"gitlab", "github"}, DropIfComment: `@corp`}},
+			github: []string{work, personal},
+			want:   []string{personal},
+		},
+		{
+			name:   "comment lines are left alone",
+			rules:  []TransformRule{{DropIfComment: `home`}},
+			github: []string{"# alice@home", work},
+			want:   []string{"# alice@home", work},
+		},
+		{
+			name:   "unparseable keys are left alone",
+			rules:  []TransformRule{{DropIfComment: `home`}},
+			github: []string{"ssh-ed25519 not-base64 alice@home", work},
+			want:   []string{"ssh-ed25519 not-base64 alice@home", work},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			github := &fakeProvider{keys: map[string][]string{"octocat": tt.github}}
+			km := newTestKeyManager(t, Config{
+				Mappings:    map[string]UserMapping{"alice": {StaticKeys: []StaticKey{{Key: own}}, GitHub: Usernames{"octocat"}}},
+				SourceOrder: []string{"static", "github"},
+				NoHeaders:   true,
+				Transforms:  tt.rules,
+			}, WithProvider("github", github))
+
+			// the static key is never transformed, whatever the rules
+			want := append([]string{own}, tt.want...)
+			if got := resolveLines(t, km, "alice"); !slices.Equal(got, want) {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestInvalidTransforms(t *testing.T) {
+	tests := []struct {
+		name string
+		rule TransformRule
+		want string
+	}{
+		{name: "no operation", rule: TransformRule{Sources: []string{"github"}}, want: "exactly one"},
+		{name: "two operations", rule: TransformRule{DropIfComment: "x", AddOption: "no-pty"}, want: "exactly one"},
+		{name: "invalid replace pattern", rule: TransformRule{ReplaceComment: &CommentReplacement{Pattern: "("}}, want: "invalid replace_comment pattern"},
+		{name: "invalid drop pattern", rule: TransformRule{DropIfComment: "["}, want: "invalid drop_if_comment"},
+		{name: "multi-line option", rule: TransformRule{AddOption: "no-pty\nssh-ed25519 AAAA"}, want: "one line"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewKeyManagerFromConfig(Config{Transforms: []TransformRule{{AddOption: "no-pty"}, tt.rule}})
+			if err == nil || !strings.Contains(err.Error(), "transform 2") || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %v, want a transform 2 error containing %q", err, tt.want)
+			}
+		})
+	}
+}
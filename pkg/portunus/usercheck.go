@@ -0,0 +1,163 @@
+package portunus
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// UserChecker is implemented by providers that can tell whether an upstream
+// account exists, so typos in mappings can be caught before a login finds
+// itself without keys
+type UserChecker interface {
+	UserExists(username string) (bool, error)
+}
+
+// errUserNotFound is returned by provider lookups of an account that doesn't
+// exist
+var errUserNotFound = errors.New("user not found")
+
+// UserCheckResult is the outcome of checking one upstream account, with the
+// logins whose mappings reference it
+type UserCheckResult struct {
+	Provider string
+	Upstream string
+	Logins   []string
+	Exists   bool
+	Err      error
+}
+
+// CheckUsers checks that every upstream username the mappings reference on a
+// provider with a UserChecker exists. Requests are made one at a time with
+// interval between them, and once a provider reports a rate limit its
+// remaining names fail with that error instead of being sent. Results are
+// kept for the KeyManager's lifetime, so a name is only asked about once.
+// Derived names are checked for listed logins, not the default mapping.
+func (km *KeyManager) CheckUsers(interval time.Duration) []UserCheckResult {
+	logins := make(map[string][]string)
+	for login, mapping := range km.currentMappings() {
+		if login != DefaultMapping {
+			mapping = km.deriveUpstreams(login, mapping)
+		}
+		for _, name := range km.sources(mapping) {
+			if _, ok := userChecker(km.providers[name]); !ok {
+				continue
+			}
+			for _, upstream := range mapping.Upstreams(name) {
+				key := name + "/" + upstream
+				if !slices.Contains(logins[key], login) {
+					logins[key] = append(logins[key], login)
+				}
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(logins))
+	for key := range logins {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	results := make([]UserCheckResult, 0, len(keys))
+	limited := make(map[string]error)
+	sent := false
+	for _, key := range keys {
+		name, upstream, _ := strings.Cut(key, "/")
+		sort.Strings(logins[key])
+		r := UserCheckResult{Provider: name, Upstream: upstream, Logins: logins[key]}
+
+		km.mu.Lock()
+		cached, ok := km.userChecks[key]
+		km.mu.Unlock()
+		switch {
+		case ok:
+			r.Exists, r.Err = cached.Exists, cached.Err
+		case limited[name] != nil:
+			r.Err = limited[name]
+		default:
+			if sent {
+				time.Sleep(interval)
+			}
+			sent = true
+			checker, _ := userChecker(km.providers[name])
+			r.Exists, r.Err = checker.UserExists(upstream)
+			var status *StatusError
+			if errors.As(r.Err, &status) && status.RateLimited {
+				limited[name] = fmt.Errorf("skipped after %s rate limit: %w", providerName(name), r.Err)
+				break
+			}
+			if r.Err == nil {
+				km.mu.Lock()
+				km.userChecks[key] = r
+				km.mu.Unlock()
+			}
+		}
+		results = append(results, r)
+	}
+	return results
+}
+
+// userChecker returns p as a UserChecker if it is one, looking through
+// mirrors to the providers they wrap
+func userChecker(p KeyProvider) (UserChecker, bool) {
+	if f, ok := p.(*fallbackProvider); ok {
+		if !slices.ContainsFunc(f.providers, func(p KeyProvider) bool {
+			_, ok := p.(UserChecker)
+			return ok
+		}) {
+			return nil, false
+		}
+	}
+	checker, ok := p.(UserChecker)
+	return checker, ok
+}
+
+// UserExists looks username up through the REST API, treating 404 as an
+// account that doesn't exist
+func (p *GitHubProvider) UserExists(username string) (bool, error) {
+	req, err := http.NewRequest("GET", p.apiURL()+"users/"+url.PathEscape(username), nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	if err := p.authorize(req); err != nil {
+		return false, err
+	}
+	_, err = p.http.Do(req)
+	var status *StatusError
+	if errors.As(err, &status) && status.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// UserExists looks username up with /api/v4/users?username=, which needs no
+// token on gitlab.com
+func (p *GitLabProvider) UserExists(username string) (bool, error) {
+	_, err := p.userID(username)
+	if errors.Is(err, errUserNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// UserExists asks each endpoint in turn until one answers
+func (f *fallbackProvider) UserExists(username string) (bool, error) {
+	err := fmt.Errorf("no %s endpoint can check users", f.name)
+	for _, p := range f.providers {
+		checker, ok := p.(UserChecker)
+		if !ok {
+			continue
+		}
+		var exists bool
+		if exists, err = checker.UserExists(username); err == nil {
+			return exists, nil
+		}
+	}
+	return false, err
+}
@@ -0,0 +1,246 @@
+package portunus
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// githubUsersStub serves GitHub's /users/{name} for the accounts in exists,
+// answering 404 for any other name. It returns the names asked about, in
+// order.
+func githubUsersStub(t *testing.T, exists ...string) (*httptest.Server, func() []string) {
+	t.Helper()
+	var mu sync.Mutex
+	var asked []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/api/v3/users/")
+		mu.Lock()
+		asked = append(asked, name)
+		mu.Unlock()
+		for _, e := range exists {
+			if name == e {
+				w.Write([]byte(`{"login":"` + name + `"}`))
+				return
+			}
+		}
+		http.Error(w, `{"message":"Not Found"}`, http.StatusNotFound)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), asked...)
+	}
+}
+
+func testGitHubProvider(t *testing.T, url string) *GitHubProvider {
+	t.Helper()
+	p, err := NewGitHubProvider(GitHubConfig{URL: url, HTTPConfig: HTTPConfig{AllowPrivateNetworks: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestCheckUsers(t *testing.T) {
+	hub, _ := githubUsersStub(t, "octocat")
+	lab := gitlabStub(t, nil)
+	gitlab, err := NewGitLabProvider(GitLabConfig{URL: lab.URL, HTTPConfig: HTTPConfig{AllowPrivateNetworks: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	mirrored := newFallbackProvider("GitHub", []string{"primary", "mirror"},
+		[]KeyProvider{testGitHubProvider(t, down.URL), testGitHubProvider(t, hub.URL)})
+
+	tests := []struct {
+		name     string
+		mappings map[string]UserMapping
+		github   KeyProvider
+		want     []UserCheckResult
+	}{
+		{
+			name: "existing and missing github users",
+			mappings: map[string]UserMapping{
+				"alice": {GitHub: Usernames{"octocat"}},
+				"bob":   {GitHub: Usernames{"octocta"}},
+			},
+			want: []UserCheckResult{
+				{Provider: "github", Upstream: "octocat", Logins: []string{"alice"}, Exists: true},
+				{Provider: "github", Upstream: "octocta", Logins: []string{"bob"}},
+			},
+		},
+		{
+			name: "existing and missing gitlab users",
+			mappings: map[string]UserMapping{
+				"alice": {GitLab: Usernames{"alice"}},
+				"bob":   {GitLab: Usernames{"alcie"}},
+			},
+			want: []UserCheckResult{
+				{Provider: "gitlab", Upstream: "alcie", Logins: []string{"bob"}},
+				{Provider: "gitlab", Upstream: "alice", Logins: []string{"alice"}, Exists: true},
+			},
+		},
+		{
+			name: "a shared upstream lists every login",
+			mappings: map[string]UserMapping{
+				"carol": {GitHub: Usernames{"octocat"}},
+				"alice": {GitHub: Usernames{"octocat"}},
+			},
+			want: []UserCheckResult{
+				{Provider: "github", Upstream: "octocat", Logins: []string{"alice", "carol"}, Exists: true},
+			},
+		},
+		{
+			name: "derived upstreams",
+			mappings: map[string]UserMapping{
+				"octocat": {Derive: []string{"github"}},
+			},
+			want: []UserCheckResult{
+				{Provider: "github", Upstream: "octocat", Logins: []string{"octocat"}, Exists: true},
+			},
+		},
+		{
+			name: "providers that can't check users are left out",
+			mappings: map[string]UserMapping{
+				"alice": {GitHub: Usernames{"octocat"}, StaticKeys: []StaticKey{{Key: testKey(t, 1, "static")}}},
+			},
+			github: &fakeProvider{},
+		},
+		{
+			name: "mirrors answer for a down primary",
+			mappings: map[string]UserMapping{
+				"alice": {GitHub: Usernames{"octocat"}},
+				"bob":   {GitHub: Usernames{"octocta"}},
+			},
+			github: mirrored,
+			want: []UserCheckResult{
+				{Provider: "github", Upstream: "octocat", Logins: []string{"alice"}, Exists: true},
+				{Provider: "github", Upstream: "octocta", Logins: []string{"bob"}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			github := tt.github
+			if github == nil {
+				github = testGitHubProvider(t, hub.URL)
+			}
+			km := newTestKeyManager(t, Config{Mappings: tt.mappings},
+				WithProvider("github", github), WithProvider("gitlab", gitlab))
+
+			got := km.CheckUsers(0)
+			if len(got) == 0 && len(tt.want) == 0 {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckUsersIsCached(t *testing.T) {
+	hub, asked := githubUsersStub(t, "octocat")
+	km := newTestKeyManager(t, Config{Mappings: map[string]UserMapping{
+		"alice": {GitHub: Usernames{"octocat"}},
+		"bob":   {GitHub: Usernames{"octocta"}},
+	}}, WithProvider("github", testGitHubProvider(t, hub.URL)))
+
+	first := km.CheckUsers(0)
+	if second := km.CheckUsers(0); !reflect.DeepEqual(first, second) {
+		t.Errorf("got %+v, then %+v", first, second)
+	}
+	if got, want := asked(), []string{"octocat", "octocta"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("asked about %q, want %q once each", got, want)
+	}
+}
+
+func TestCheckUsersErrorsAreNotCached(t *testing.T) {
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"login":"octocat"}`))
+	}))
+	defer srv.Close()
+	km := newTestKeyManager(t, Config{Mappings: map[string]UserMapping{
+		"alice": {GitHub: Usernames{"octocat"}},
+	}}, WithProvider("github", testGitHubProvider(t, srv.URL)))
+
+	if got := km.CheckUsers(0); len(got) != 1 || got[0].Err == nil {
+		t.Fatalf("got %+v, want the failed request reported", got)
+	}
+	if got := km.CheckUsers(0); len(got) != 1 || got[0].Err != nil || !got[0].Exists {
+		t.Errorf("got %+v, want the user asked about again and found", got)
+	}
+}
+
+func TestCheckUsersRateLimit(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		header http.Header
+	}{
+		{name: "429", status: http.StatusTooManyRequests},
+		{name: "403 with no requests remaining", status: http.StatusForbidden, header: http.Header{"X-Ratelimit-Remaining": {"0"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				for name, values := range tt.header {
+					w.Header()[name] = values
+				}
+				http.Error(w, "rate limited", tt.status)
+			}))
+			defer srv.Close()
+			km := newTestKeyManager(t, Config{Mappings: map[string]UserMapping{
+				"alice": {GitHub: Usernames{"one"}},
+				"bob":   {GitHub: Usernames{"two"}},
+				"carol": {GitHub: Usernames{"three"}},
+			}}, WithProvider("github", testGitHubProvider(t, srv.URL)))
+
+			results := km.CheckUsers(time.Millisecond)
+			if calls != 1 {
+				t.Errorf("got %d requests, want none after the rate limit", calls)
+			}
+			for _, r := range results {
+				var status *StatusError
+				if !errors.As(r.Err, &status) || !status.RateLimited {
+					t.Errorf("%s: got error %v, want the rate limit", r.Upstream, r.Err)
+				}
+			}
+			if len(results) != 3 {
+				t.Errorf("got %d results, want 3", len(results))
+			}
+		})
+	}
+}
+
+func TestCheckUsersInterval(t *testing.T) {
+	hub, _ := githubUsersStub(t)
+	km := newTestKeyManager(t, Config{Mappings: map[string]UserMapping{
+		"alice": {GitHub: Usernames{"one"}},
+		"bob":   {GitHub: Usernames{"two"}},
+		"carol": {GitHub: Usernames{"three"}},
+	}}, WithProvider("github", testGitHubProvider(t, hub.URL)))
+
+	interval := 20 * time.Millisecond
+	start := time.Now()
+	km.CheckUsers(interval)
+	if elapsed := time.Since(start); elapsed < 2*interval {
+		t.Errorf("three requests took %v, want at least %v between each", elapsed, interval)
+	}
+}
@@ -0,0 +1,51 @@
+package portunus
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"strings"
+	"time"
+)
+
+// Watch re-resolves username every interval until ctx is done, logging each
+// key added or removed since the last resolve, by fingerprint. Lookups go
+// through the usual cache and circuit breakers, so a cached set is only
+// re-fetched once it expires.
+func (km *KeyManager) Watch(ctx context.Context, username string, interval time.Duration) {
+	var last []string
+	resolved := false
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		result, err := km.Resolve(ctx, username)
+		switch {
+		case ctx.Err() != nil:
+			return
+		case err != nil:
+			// keep comparing against the last good set, so a failed lookup
+			// isn't reported as every key being removed
+			log.Printf("Error resolving keys for %s: %v", username, err)
+		case !resolved:
+			log.Printf("Watching %d keys for %s every %s", len(result.StrippedKeys()), username, interval)
+			last, resolved = result.Lines(), true
+		default:
+			current := result.Lines()
+			if d := DiffKeys(last, current); !d.Empty() {
+				var changes bytes.Buffer
+				d.Write(&changes)
+				log.Printf("Keys for %s changed: %d added, %d removed", username, len(d.Added), len(d.Removed))
+				for _, line := range strings.Split(strings.TrimSpace(changes.String()), "\n") {
+					log.Printf("  %s", line)
+				}
+			}
+			last = current
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package portunus
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sequenceProvider serves each lookup the next of its key sets, repeating
+// the last once they run out. A nil set fails the lookup.
+type sequenceProvider struct {
+	sets [][]string
+
+	mu    sync.Mutex
+	calls int
+	done  chan struct{}
+}
+
+func (p *sequenceProvider) GetKeys(upstream string) ([]string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	keys := p.sets[min(p.calls, len(p.sets)-1)]
+	if p.calls++; p.calls == len(p.sets)+1 {
+		close(p.done)
+	}
+	if keys == nil {
+		return nil, errors.New("upstream down")
+	}
+	return keys, nil
+}
+
+func TestWatch(t *testing.T) {
+	k1, k2 := testKey(t, 1, "one"), testKey(t, 2, "two")
+	fingerprint := func(line string) string {
+		pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ssh.FingerprintSHA256(pub)
+	}
+
+	tests := []struct {
+		name string
+		sets [][]string
+		// want are the drift lines logged, in order
+		want []string
+	}{
+		{name: "no change", sets: [][]string{{k1}, {k1}, {k1}}},
+		{
+			name: "key added",
+			sets: [][]string{{k1}, {k1, k2}},
+			want: []string{"Keys for alice changed: 1 added, 0 removed", "  + " + fingerprint(k2)},
+		},
+		{
+			name: "key removed",
+			sets: [][]string{{k1, k2}, {k1}},
+			want: []string{"Keys for alice changed: 0 added, 1 removed", "  - " + fingerprint(k2)},
+		},
+		{name: "failed lookup is not drift", sets: [][]string{{k1}, nil, {k1}}},
+		{
+			name: "key replaced",
+			sets: [][]string{{k1}, nil, {k2}},
+			want: []string{"Keys for alice changed: 1 added, 1 removed", "  - " + fingerprint(k1), "  + " + fingerprint(k2)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLog(t)
+			github := &sequenceProvider{sets: tt.sets, done: make(chan struct{})}
+			km := newTestKeyManager(t, Config{
+				Mappings: map[string]UserMapping{"alice": {GitHub: Usernames{"octocat"}}},
+			}, WithProvider("github", github))
+
+			ctx, cancel := context.WithCancel(context.Background())
+			watching := make(chan struct{})
+			go func() {
+				defer close(watching)
+				km.Watch(ctx, "alice", time.Millisecond)
+			}()
+			select {
+			case <-github.done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("watch didn't re-resolve the keys")
+			}
+			cancel()
+			<-watching
+
+			var drift []string
+			for _, line := range strings.Split(logs.String(), "\n") {
+				// after the date and time come the message, or a change
+				fields := strings.Fields(line)
+				switch {
+				case strings.Contains(line, "Keys for alice changed"):
+					drift = append(drift, strings.Join(fields[2:], " "))
+				case len(fields) > 3 && (fields[2] == "+" || fields[2] == "-"):
+					drift = append(drift, "  "+fields[2]+" "+fields[3])
+				}
+			}
+			if strings.Join(drift, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("logged drift:\n%s\nwant:\n%s", strings.Join(drift, "\n"), strings.Join(tt.want, "\n"))
+			}
+			if !strings.Contains(logs.String(), "Watching ") {
+				t.Error("the first resolve wasn't logged")
+			}
+		})
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/jpetrucciani/portunus/pkg/portunus"
+)
+
+// runProviders implements the providers subcommand, printing a JSON
+// description of every key source in this build, its settings and the
+// mapping fields that use it, for config generators and validators
+func runProviders(args []string) int {
+	fs := flag.NewFlagSet("providers", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s providers\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return 1
+	}
+
+	data, err := json.MarshalIndent(portunus.Providers(), "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error encoding providers: %v\n", err)
+		return 1
+	}
+	fmt.Println(string(data))
+	return 0
+}
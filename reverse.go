@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/jpetrucciani/portunus/pkg/portunus"
+)
+
+// runReverse implements the reverse subcommand, printing every local login
+// that would serve keys for an upstream identity
+func runReverse(args []string) int {
+	fs := flag.NewFlagSet("reverse", flag.ExitOnError)
+	provider := fs.String("provider", "", "provider the identity belongs to, e.g. github")
+	user := fs.String("user", "", "upstream identity to look for")
+	strict := fs.Bool("strict", false, "reject ambiguous configs, such as a login mapped twice or an unknown field")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s reverse -provider <name> -user <upstream> [<config-path>]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *provider == "" || *user == "" || fs.NArg() > 1 {
+		fs.Usage()
+		return 1
+	}
+	if *provider == "static" {
+		fmt.Fprintln(os.Stderr, "static keys have no upstream identity")
+		return 1
+	}
+
+	var opts []portunus.Option
+	if *strict {
+		opts = append(opts, portunus.WithStrictConfig())
+	}
+	km, err := portunus.NewKeyManager(fs.Arg(0), opts...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
+		return 1
+	}
+	defer km.WaitHooks()
+	// checked once the config is loaded, so plugins are known
+	if !km.HasSource(*provider) {
+		fmt.Fprintf(os.Stderr, "Invalid -provider: unknown source: %s\n", *provider)
+		return 1
+	}
+	result := km.ReverseLookup(*provider, *user)
+	for _, login := range result.Logins {
+		fmt.Println(login)
+	}
+	if result.Default {
+		fmt.Fprintf(os.Stderr, "The %q default mapping also serves %s to every login without its own mapping\n", portunus.DefaultMapping, *user)
+	}
+	return 0
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/jpetrucciani/portunus/pkg/portunus"
+)
+
+// minWatchInterval stops watch from hammering upstreams
+const minWatchInterval = 10 * time.Second
+
+// runWatch implements the watch subcommand, logging drift in one login's
+// keys until interrupted, see KeyManager.Watch
+func runWatch(args []string) int {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	interval := fs.Duration("interval", 5*time.Minute, fmt.Sprintf("how often to re-resolve the keys, at least %s", minWatchInterval))
+	strict := fs.Bool("strict", false, "reject ambiguous configs, such as a login mapped twice or an unknown field")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s watch [flags] <config-path> <username>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return 1
+	}
+	if *interval < minWatchInterval {
+		fmt.Fprintf(os.Stderr, "-interval must be at least %s\n", minWatchInterval)
+		return 1
+	}
+	configPath, username := fs.Arg(0), fs.Arg(1)
+
+	var opts []portunus.Option
+	if *strict {
+		opts = append(opts, portunus.WithStrictConfig())
+	}
+	km, err := portunus.NewKeyManager(configPath, opts...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error initializing key manager: %v\n", err)
+		return 1
+	}
+	defer km.WaitHooks()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	km.Watch(ctx, username, *interval)
+	return 0
+}